@@ -0,0 +1,225 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/spf13/cobra"
+	"github.com/weiihann/state-expiry-indexer/internal"
+	"github.com/weiihann/state-expiry-indexer/internal/caller"
+	"github.com/weiihann/state-expiry-indexer/internal/logger"
+	"github.com/weiihann/state-expiry-indexer/pkg/storage"
+)
+
+var (
+	backfillStartBlock uint64
+	backfillEndBlock   uint64
+	backfillWorkers    int
+	backfillDeep       bool
+	backfillReport     string
+)
+
+var backfillCmd = &cobra.Command{
+	Use:   "backfill",
+	Short: "Download the blocks missing from the data directory again and rebuild damaged range files",
+	Long: `Scan the data directory for gaps and fill them.
+
+A block is a gap when no intact range file and no readable per-block file holds it: it is missing,
+its only file is empty, or its only file cannot be decompressed or decoded. Range files are checked
+against their manifest, or decoded completely with --deep; per-block files are always decoded.
+
+Damaged per-block files are deleted and every gap is downloaded again as a per-block file by
+--workers workers, spread across every endpoint in RPC_URLS. Empty or unparsable range files are
+then rebuilt from the per-block files of their blocks. Use verify --gaps to only report gaps.
+
+By default blocks from 1 to the highest block stored are scanned.
+
+Examples:
+  # Fill every gap in the data directory
+  state-expiry-indexer backfill
+
+  # Fill the gaps of a block span and write the gaps found as JSON
+  state-expiry-indexer backfill --start-block 1000000 --end-block 2000000 --report gaps.json`,
+	Run: backfill,
+}
+
+func backfill(cmd *cobra.Command, args []string) {
+	log := logger.GetLogger("backfill")
+
+	config, err := internal.LoadConfig("./configs")
+	if err != nil {
+		log.Error("Configuration validation failed", "error", err)
+		os.Exit(1)
+	}
+	workers := config.DownloadWorkers
+	if backfillWorkers > 0 {
+		workers = backfillWorkers
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	rpcClient, closeRPC, err := newRPCClient(ctx, config)
+	if err != nil {
+		log.Error("Failed to create RPC client", "error", err, "rpc_urls", config.RPCURLS)
+		os.Exit(1)
+	}
+	defer func() {
+		if err := closeRPC(); err != nil {
+			log.Error("Failed to save RPC cassette", "error", err)
+		}
+	}()
+
+	rangeProcessor, err := newRangeProcessor(config, rpcClient)
+	if err != nil {
+		log.Error("Failed to create range processor", "error", err)
+		os.Exit(1)
+	}
+	defer rangeProcessor.Close()
+
+	blockFiles, err := config.NewBlockFileSource(rangeProcessor, rpcClient)
+	if err != nil {
+		log.Error("Failed to load compression dictionaries", "error", err)
+		os.Exit(1)
+	}
+
+	fileStore, err := newFileStore(config)
+	if err != nil {
+		log.Error("Failed to create file store", "error", err, "path", config.DataDir)
+		os.Exit(1)
+	}
+	defer fileStore.Close()
+
+	log.Info("Scanning data directory for gaps",
+		"data_dir", config.DataDir,
+		"start_block", backfillStartBlock,
+		"end_block", backfillEndBlock,
+		"deep", backfillDeep)
+
+	report, err := rangeProcessor.ScanGaps(ctx, blockFiles, backfillStartBlock, backfillEndBlock, backfillDeep)
+	if err != nil {
+		log.Error("Gap scan failed", "error", err)
+		os.Exit(1)
+	}
+	logGapReport(log, report)
+	if backfillReport != "" {
+		if err := writeGapReport(backfillReport, report); err != nil {
+			log.Error("Failed to write gap report", "error", err, "report", backfillReport)
+			os.Exit(1)
+		}
+	}
+	if len(report.Gaps) == 0 && len(report.DamagedRanges) == 0 {
+		log.Info("No gaps found")
+		return
+	}
+
+	// Damaged per-block files would be taken as downloaded
+	backend := rangeProcessor.Backend()
+	for _, gap := range report.Gaps {
+		for _, name := range []string{fmt.Sprintf("%d.json", gap.Block), fmt.Sprintf("%d.json.zst", gap.Block)} {
+			if err := backend.Delete(name); err != nil {
+				log.Error("Failed to delete damaged state diff file", "error", err, "file", backend.Location(name))
+				os.Exit(1)
+			}
+		}
+	}
+
+	callerSvc, err := caller.NewService(rpcClient, fileStore, config)
+	if err != nil {
+		log.Error("Failed to create RPC caller", "error", err)
+		fileStore.Close()
+		rangeProcessor.Close()
+		os.Exit(1)
+	}
+	callerSvc.SetWorkers(workers)
+	downloaded := 0
+	err = callerSvc.DownloadBlocks(ctx, report.Blocks(), func(blockNumber uint64) {
+		downloaded++
+		if downloaded%1000 == 0 {
+			log.Info("Backfill progress", "downloaded", downloaded, "remaining", len(report.Gaps)-downloaded)
+		}
+	})
+	if err == nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		log.Error("Backfill failed", "error", err, "downloaded", downloaded, "remaining", len(report.Gaps)-downloaded)
+		fileStore.Close()
+		rangeProcessor.Close()
+		os.Exit(1)
+	}
+	log.Info("Downloaded missing blocks", "downloaded", downloaded, "workers", workers)
+
+	// Rebuild damaged range files from the per-block files, which now hold all of their blocks
+	rangeProcessor.SetSources(blockFiles)
+	var failed []uint64
+	for _, rangeNumber := range report.DamagedRanges {
+		path := rangeProcessor.GetRangeFilePath(rangeNumber)
+		if err := rangeProcessor.DeleteRange(rangeNumber); err != nil {
+			log.Error("Failed to remove damaged range file", "range_number", rangeNumber, "file", path, "error", err)
+			failed = append(failed, rangeNumber)
+			continue
+		}
+		if err := rangeProcessor.EnsureRangeExists(ctx, rangeNumber); err != nil {
+			log.Error("Failed to rebuild range file", "range_number", rangeNumber, "file", path, "error", err)
+			failed = append(failed, rangeNumber)
+			continue
+		}
+		log.Info("Rebuilt range file", "range_number", rangeNumber, "file", path)
+	}
+
+	log.Info("Backfill completed",
+		"downloaded", downloaded,
+		"rebuilt_ranges", len(report.DamagedRanges)-len(failed),
+		"failed_ranges", failed)
+	if len(failed) > 0 {
+		fileStore.Close()
+		rangeProcessor.Close()
+		os.Exit(1)
+	}
+}
+
+// logGapReport logs every gap of a report and a summary
+func logGapReport(log *slog.Logger, report *storage.GapReport) {
+	kinds := make(map[storage.GapKind]int)
+	for _, gap := range report.Gaps {
+		kinds[gap.Kind]++
+		log.Error("Block not available", "block", gap.Block, "kind", gap.Kind, "file", gap.File, "error", gap.Error)
+	}
+	for _, rangeNumber := range report.DamagedRanges {
+		log.Error("Range file damaged", "range_number", rangeNumber)
+	}
+
+	log.Info("Gap scan completed",
+		"from_block", report.FromBlock,
+		"to_block", report.ToBlock,
+		"gaps", len(report.Gaps),
+		"missing", kinds[storage.GapMissing],
+		"empty", kinds[storage.GapEmpty],
+		"unparsable", kinds[storage.GapUnparsable],
+		"damaged_ranges", report.DamagedRanges)
+}
+
+// writeGapReport writes a gap report as JSON to path
+func writeGapReport(path string, report *storage.GapReport) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}
+
+func init() {
+	backfillCmd.Flags().Uint64Var(&backfillStartBlock, "start-block", 1, "First block to scan")
+	backfillCmd.Flags().Uint64Var(&backfillEndBlock, "end-block", 0, "Last block to scan (defaults to the highest block stored)")
+	backfillCmd.Flags().IntVar(&backfillWorkers, "workers", 0, "Number of blocks downloaded in parallel (defaults to DOWNLOAD_WORKERS)")
+	backfillCmd.Flags().BoolVar(&backfillDeep, "deep", false, "Decompress and decode every range file instead of checking it against its manifest")
+	backfillCmd.Flags().StringVar(&backfillReport, "report", "", "Write the gaps found as JSON to this file")
+	addCassetteFlags(backfillCmd)
+	rootCmd.AddCommand(backfillCmd)
+}
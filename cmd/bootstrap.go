@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/spf13/cobra"
+	"github.com/weiihann/state-expiry-indexer/internal"
+	"github.com/weiihann/state-expiry-indexer/internal/logger"
+	"github.com/weiihann/state-expiry-indexer/pkg/storage"
+)
+
+var bootstrapMirrorURL string
+
+var bootstrapCmd = &cobra.Command{
+	Use:   "bootstrap",
+	Short: "Download the range files of a peer mirror into the data directory",
+	Long: `Download every range file a peer indexer serves with serve-ranges and that the data directory does
+not have yet. Each file is checked against its manifest and must extend the stored chain before it is
+stored. Ranges the mirror does not have are downloaded later by the indexer from its range sources.
+
+Examples:
+  # Bootstrap from the mirror in MIRROR_URL
+  state-expiry-indexer bootstrap
+
+  # Bootstrap from a teammate's mirror
+  state-expiry-indexer bootstrap --mirror http://10.0.0.5:8090`,
+	Run: bootstrap,
+}
+
+func bootstrap(cmd *cobra.Command, args []string) {
+	log := logger.GetLogger("bootstrap")
+
+	config, err := internal.LoadConfig("./configs")
+	if err != nil {
+		log.Error("Configuration validation failed", "error", err)
+		os.Exit(1)
+	}
+
+	mirrorURL := config.MirrorURL
+	if bootstrapMirrorURL != "" {
+		mirrorURL = bootstrapMirrorURL
+	}
+	mirror, err := storage.NewMirrorSource(mirrorURL)
+	if err != nil {
+		log.Error("Invalid mirror, set --mirror or MIRROR_URL", "error", err)
+		os.Exit(1)
+	}
+
+	rangeProcessor, err := newRangeProcessor(config, nil)
+	if err != nil {
+		log.Error("Failed to create range processor", "error", err)
+		os.Exit(1)
+	}
+	defer rangeProcessor.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	log.Info("Starting bootstrap", "mirror", mirrorURL, "data_dir", config.DataDir, "range_size", config.RangeSize)
+
+	var present int
+	var downloadedBytes int64
+	downloaded, err := rangeProcessor.Bootstrap(ctx, mirror, func(progress storage.BootstrapProgress) {
+		if !progress.Downloaded {
+			present++
+			return
+		}
+		downloadedBytes += progress.Bytes
+		log.Debug("Downloaded range", "range_number", progress.RangeNumber, "bytes", progress.Bytes)
+	})
+
+	log.Info("Bootstrap finished",
+		"downloaded", downloaded,
+		"already_present", present,
+		"downloaded_mb", fmt.Sprintf("%.2f", float64(downloadedBytes)/1024/1024))
+	if err != nil {
+		log.Error("Bootstrap failed", "error", err)
+		rangeProcessor.Close()
+		os.Exit(1)
+	}
+}
+
+func init() {
+	bootstrapCmd.Flags().StringVar(&bootstrapMirrorURL, "mirror", "", "URL of the mirror to download from (defaults to MIRROR_URL)")
+	rootCmd.AddCommand(bootstrapCmd)
+}
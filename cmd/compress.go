@@ -1,16 +1,17 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
+	"io/fs"
 	"log/slog"
 	"os"
-	"path/filepath"
-	"strings"
 	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/weiihann/state-expiry-indexer/internal"
 	"github.com/weiihann/state-expiry-indexer/internal/logger"
+	"github.com/weiihann/state-expiry-indexer/pkg/storage"
 	"github.com/weiihann/state-expiry-indexer/pkg/utils"
 )
 
@@ -21,12 +22,22 @@ var (
 	compressDryRun         bool
 	compressOverwrite      bool
 	compressDeleteOriginal bool
+	compressRecompress     bool
+	compressRanges         bool
 )
 
 var compressCmd = &cobra.Command{
 	Use:   "compress",
 	Short: "Compress existing JSON state diff files to zstd format",
 	Long: `Compress existing JSON state diff files to zstd format to save storage space.
+
+Files are compressed at COMPRESSION_LEVEL with the newest dictionary trained by train-dict,
+unless COMPRESSION_DICTIONARY is false.
+
+With --recompress existing .json.zst files are compressed again with the current level and
+dictionary. Files already compressed with the current dictionary are skipped unless --overwrite
+is set. With --ranges range files are compressed again at COMPRESSION_LEVEL too, their content
+and manifest hash do not change.
 	
 Examples:
   # Compress a specific block range
@@ -39,7 +50,13 @@ Examples:
   state-expiry-indexer compress --all --dry-run
   
   # Overwrite existing .json.zst files
-  state-expiry-indexer compress --all --overwrite`,
+  state-expiry-indexer compress --all --overwrite
+
+  # Compress every .json.zst file again with a newly trained dictionary
+  state-expiry-indexer compress --all --recompress
+
+  # Compress range files again after raising COMPRESSION_LEVEL
+  state-expiry-indexer compress --all --recompress --ranges`,
 	Run: compress,
 }
 
@@ -53,26 +70,53 @@ func compress(cmd *cobra.Command, args []string) {
 		os.Exit(1)
 	}
 
+	backend, err := config.NewStorageBackend()
+	if err != nil {
+		log.Error("Failed to open data directory", "error", err, "data_dir", config.DataDir)
+		os.Exit(1)
+	}
+	zstdOptions, err := config.NewZstdOptions(backend)
+	if err != nil {
+		log.Error("Failed to load compression dictionaries", "error", err)
+		os.Exit(1)
+	}
+	dictionaryID := uint32(0)
+	if zstdOptions.Dictionary != nil {
+		dictionaryID, err = utils.ZstdDictionaryID(zstdOptions.Dictionary)
+		if err != nil {
+			log.Error("Invalid compression dictionary", "error", err)
+			os.Exit(1)
+		}
+	}
+
 	log.Info("Starting compression process",
 		"data_dir", config.DataDir,
+		"level", config.CompressionLevel,
+		"dictionary_id", dictionaryID,
+		"recompress", compressRecompress,
 		"dry_run", compressDryRun,
 		"overwrite", compressOverwrite,
 		"delete", compressDeleteOriginal,
 	)
 
+	if compressRecompress {
+		recompress(log, config, backend, zstdOptions, dictionaryID)
+		return
+	}
+
 	// Determine which files to compress
 	var filesToCompress []string
 	var err2 error
 
 	if compressAll {
-		filesToCompress, err2 = getAllJSONFiles(config.DataDir)
+		filesToCompress, err2 = getAllJSONFiles(backend)
 		if err2 != nil {
 			log.Error("Failed to scan for JSON files", "error", err2)
 			os.Exit(1)
 		}
 		log.Info("Found JSON files to compress", "count", len(filesToCompress))
 	} else {
-		filesToCompress, err2 = getJSONFilesInRange(config.DataDir, compressStartBlock, compressEndBlock)
+		filesToCompress, err2 = getJSONFilesInRange(backend, compressStartBlock, compressEndBlock)
 		if err2 != nil {
 			log.Error("Failed to get files in range", "error", err2)
 			os.Exit(1)
@@ -93,7 +137,7 @@ func compress(cmd *cobra.Command, args []string) {
 		log.Info("DRY RUN - Files that would be compressed:")
 		for _, file := range filesToCompress {
 			compressedFile := file + ".zst"
-			if _, err := os.Stat(compressedFile); err == nil && !compressOverwrite {
+			if _, err := backend.Stat(compressedFile); err == nil && !compressOverwrite {
 				log.Info("Would skip (already exists)", "file", file, "compressed", compressedFile)
 			} else {
 				log.Info("Would compress", "file", file, "compressed", compressedFile)
@@ -104,7 +148,7 @@ func compress(cmd *cobra.Command, args []string) {
 	}
 
 	// Perform actual compression
-	compressionStats := performCompression(log, config.DataDir, filesToCompress, compressDeleteOriginal)
+	compressionStats := performCompression(log, backend, filesToCompress, compressDeleteOriginal, zstdOptions)
 
 	// Log final statistics
 	log.Info("Compression completed successfully",
@@ -128,11 +172,11 @@ type compressionStats struct {
 	compressionRatio float64
 }
 
-func performCompression(log *slog.Logger, dataDir string, files []string, deleteOriginal bool) compressionStats {
+func performCompression(log *slog.Logger, backend storage.Backend, files []string, deleteOriginal bool, zstdOptions utils.ZstdOptions) compressionStats {
 	stats := compressionStats{totalFiles: len(files)}
 	lastProgressTime := time.Now()
 	lastProgressCount := 0
-	encoder, err := utils.NewZstdEncoder()
+	encoder, err := utils.NewZstdEncoderWithOptions(zstdOptions)
 	if err != nil {
 		log.Error("Failed to create zstd encoder", "error", err)
 		os.Exit(1)
@@ -156,12 +200,12 @@ func performCompression(log *slog.Logger, dataDir string, files []string, delete
 
 		// Check if compressed file already exists
 		compressedFile := file + ".zst"
-		if _, err := os.Stat(compressedFile); err == nil && !compressOverwrite {
+		if _, err := backend.Stat(compressedFile); err == nil && !compressOverwrite {
 			log.Debug("Skipping file (already compressed)", "file", file)
 			stats.skippedFiles++
 			if deleteOriginal {
-				if _, err := os.Stat(filepath.Join(dataDir, file)); err == nil {
-					if err := os.Remove(filepath.Join(dataDir, file)); err != nil {
+				if _, err := backend.Stat(file); err == nil {
+					if err := backend.Delete(file); err != nil {
 						log.Error("Failed to delete original file", "file", file, "error", err)
 						stats.failedFiles++
 						continue
@@ -172,7 +216,7 @@ func performCompression(log *slog.Logger, dataDir string, files []string, delete
 		}
 
 		// Read original file
-		originalData, err := os.ReadFile(filepath.Join(dataDir, file))
+		originalData, err := storage.ReadFile(backend, file)
 		if err != nil {
 			log.Error("Failed to read file", "file", file, "error", err)
 			stats.failedFiles++
@@ -188,15 +232,14 @@ func performCompression(log *slog.Logger, dataDir string, files []string, delete
 		}
 
 		// Write compressed file
-		compressedFilePath := filepath.Join(dataDir, compressedFile)
-		if err := os.WriteFile(compressedFilePath, compressedData, 0o644); err != nil {
+		if err := backend.Save(compressedFile, compressedData); err != nil {
 			log.Error("Failed to write compressed file", "file", compressedFile, "error", err)
 			stats.failedFiles++
 			continue
 		}
 
 		if deleteOriginal {
-			if err := os.Remove(filepath.Join(dataDir, file)); err != nil {
+			if err := backend.Delete(file); err != nil {
 				log.Error("Failed to delete original file", "file", file, "error", err)
 				stats.failedFiles++
 				continue
@@ -223,33 +266,208 @@ func performCompression(log *slog.Logger, dataDir string, files []string, delete
 	return stats
 }
 
-func getAllJSONFiles(dataDir string) ([]string, error) {
-	var files []string
+// recompress compresses the .json.zst files selected by --all or the block range again with the
+// current level and dictionary, and range files too with --ranges
+func recompress(log *slog.Logger, config internal.Config, backend storage.Backend, zstdOptions utils.ZstdOptions, dictionaryID uint32) {
+	files, err := getCompressedBlockFiles(backend)
+	if err != nil {
+		log.Error("Failed to scan for compressed files", "error", err)
+		os.Exit(1)
+	}
+
+	stats := compressionStats{}
+	if len(files) > 0 {
+		stats = performRecompression(log, backend, files, zstdOptions, dictionaryID)
+		log.Info("Recompression completed",
+			"total_files", stats.totalFiles,
+			"recompressed_files", stats.compressedFiles,
+			"skipped_files", stats.skippedFiles,
+			"failed_files", stats.failedFiles,
+			"size_before_mb", fmt.Sprintf("%.2f", float64(stats.originalSize)/1024/1024),
+			"size_after_mb", fmt.Sprintf("%.2f", float64(stats.compressedSize)/1024/1024))
+	} else {
+		log.Info("No compressed files found to recompress")
+	}
+
+	failed := stats.failedFiles > 0
+	if compressRanges && !recompressRanges(log, config) {
+		failed = true
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func performRecompression(log *slog.Logger, backend storage.Backend, files []string, zstdOptions utils.ZstdOptions, dictionaryID uint32) compressionStats {
+	stats := compressionStats{totalFiles: len(files)}
+
+	encoder, err := utils.NewZstdEncoderWithOptions(zstdOptions)
+	if err != nil {
+		log.Error("Failed to create zstd encoder", "error", err)
+		os.Exit(1)
+	}
+	defer encoder.Close()
+	decoder, err := utils.NewZstdDecoderWithOptions(zstdOptions)
+	if err != nil {
+		log.Error("Failed to create zstd decoder", "error", err)
+		os.Exit(1)
+	}
+	defer decoder.Close()
+
+	for i, file := range files {
+		if i > 0 && i%1000 == 0 {
+			log.Info("Recompression progress",
+				"processed", i,
+				"total", len(files),
+				"percentage", fmt.Sprintf("%.1f%%", float64(i)/float64(len(files))*100))
+		}
+
+		compressedData, err := storage.ReadFile(backend, file)
+		if err != nil {
+			log.Error("Failed to read file", "file", file, "error", err)
+			stats.failedFiles++
+			continue
+		}
+		frameDictionaryID, err := utils.ZstdFrameDictionaryID(compressedData)
+		if err != nil {
+			log.Error("Failed to read compressed file", "file", file, "error", err)
+			stats.failedFiles++
+			continue
+		}
+		if frameDictionaryID == dictionaryID && !compressOverwrite {
+			stats.skippedFiles++
+			continue
+		}
+		if compressDryRun {
+			log.Info("DRY RUN - Would recompress", "file", file, "dictionary_id", frameDictionaryID)
+			stats.compressedFiles++
+			continue
+		}
+
+		data, err := decoder.Decompress(compressedData)
+		if err != nil {
+			log.Error("Failed to decompress file", "file", file, "dictionary_id", frameDictionaryID, "error", err)
+			stats.failedFiles++
+			continue
+		}
+		recompressedData, err := encoder.Compress(data)
+		if err != nil {
+			log.Error("Failed to compress file", "file", file, "error", err)
+			stats.failedFiles++
+			continue
+		}
+		if err := backend.Save(file, recompressedData); err != nil {
+			log.Error("Failed to write compressed file", "file", file, "error", err)
+			stats.failedFiles++
+			continue
+		}
+
+		stats.compressedFiles++
+		stats.originalSize += int64(len(compressedData))
+		stats.compressedSize += int64(len(recompressedData))
+	}
+	return stats
+}
+
+// recompressRanges compresses every range file again at COMPRESSION_LEVEL. It returns false if
+// a range failed.
+func recompressRanges(log *slog.Logger, config internal.Config) bool {
+	rangeProcessor, err := newRangeProcessor(config, nil)
+	if err != nil {
+		log.Error("Failed to create range processor", "error", err)
+		return false
+	}
+	defer rangeProcessor.Close()
 
-	entries, err := os.ReadDir(dataDir)
+	ranges, err := rangeProcessor.ListRanges()
+	if err != nil {
+		log.Error("Failed to list range files", "error", err)
+		return false
+	}
+
+	var recompressed, failed int
+	var sizeBefore, sizeAfter int64
+	for _, rangeNumber := range ranges {
+		path := rangeProcessor.GetRangeFilePath(rangeNumber)
+		if compressDryRun {
+			log.Info("DRY RUN - Would recompress range", "range_number", rangeNumber, "file", path)
+			continue
+		}
+
+		before, err := rangeProcessor.StatRange(rangeNumber)
+		if err == nil {
+			err = rangeProcessor.RecompressRange(rangeNumber)
+		}
+		if err != nil {
+			log.Error("Failed to recompress range", "range_number", rangeNumber, "file", path, "error", err)
+			failed++
+			continue
+		}
+		after, err := rangeProcessor.StatRange(rangeNumber)
+		if err != nil {
+			log.Error("Failed to stat recompressed range file", "range_number", rangeNumber, "file", path, "error", err)
+			failed++
+			continue
+		}
+
+		recompressed++
+		sizeBefore += before.Size
+		sizeAfter += after.Size
+	}
+
+	log.Info("Range recompression completed",
+		"range_files", len(ranges),
+		"recompressed", recompressed,
+		"failed", failed,
+		"size_before_mb", fmt.Sprintf("%.2f", float64(sizeBefore)/1024/1024),
+		"size_after_mb", fmt.Sprintf("%.2f", float64(sizeAfter)/1024/1024))
+	return failed == 0
+}
+
+// getCompressedBlockFiles returns the .json.zst per-block files selected by --all or the block range
+func getCompressedBlockFiles(backend storage.Backend) ([]string, error) {
+	if !compressAll {
+		return getBlockFilesInRange(backend, compressStartBlock, compressEndBlock, ".json.zst")
+	}
+	return getAllBlockFiles(backend, true)
+}
+
+func getAllJSONFiles(backend storage.Backend) ([]string, error) {
+	return getAllBlockFiles(backend, false)
+}
+
+func getJSONFilesInRange(backend storage.Backend, startBlock, endBlock uint64) ([]string, error) {
+	return getBlockFilesInRange(backend, startBlock, endBlock, ".json")
+}
+
+// getAllBlockFiles lists the per-block files of the data directory, either compressed or not
+func getAllBlockFiles(backend storage.Backend, compressed bool) ([]string, error) {
+	entries, err := storage.ListBlockFiles(backend, 0, 0)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read data directory: %w", err)
 	}
 
+	var files []string
 	for _, entry := range entries {
-		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".json") {
-			files = append(files, entry.Name())
+		match := blockFilePattern.FindStringSubmatch(entry.Name)
+		if match != nil && (match[2] != "") == compressed {
+			files = append(files, entry.Name)
 		}
 	}
-
 	return files, nil
 }
 
-func getJSONFilesInRange(dataDir string, startBlock, endBlock uint64) ([]string, error) {
+// getBlockFilesInRange checks which blocks between startBlock and endBlock have a per-block
+// file with the given suffix
+func getBlockFilesInRange(backend storage.Backend, startBlock, endBlock uint64, suffix string) ([]string, error) {
 	var files []string
 
 	for block := startBlock; block <= endBlock; block++ {
-		filename := fmt.Sprintf("%d.json", block)
-		filePath := filepath.Join(dataDir, filename)
+		filename := fmt.Sprintf("%d%s", block, suffix)
 
-		if _, err := os.Stat(filePath); err == nil {
+		if _, err := backend.Stat(filename); err == nil {
 			files = append(files, filename)
-		} else if os.IsNotExist(err) {
+		} else if errors.Is(err, fs.ErrNotExist) {
 			// File doesn't exist, skip it
 			continue
 		} else {
@@ -268,6 +486,8 @@ func init() {
 	compressCmd.Flags().BoolVar(&compressDryRun, "dry-run", false, "Preview what would be compressed without actually doing it")
 	compressCmd.Flags().BoolVar(&compressOverwrite, "overwrite", false, "Overwrite existing .json.zst files")
 	compressCmd.Flags().BoolVar(&compressDeleteOriginal, "delete", false, "Delete original JSON files after compression")
+	compressCmd.Flags().BoolVar(&compressRecompress, "recompress", false, "Compress existing .json.zst files again with the current level and dictionary")
+	compressCmd.Flags().BoolVar(&compressRanges, "ranges", false, "With --recompress, compress range files again at the current level too")
 
 	// Mark flags as mutually exclusive
 	compressCmd.MarkFlagsMutuallyExclusive("all", "start-block")
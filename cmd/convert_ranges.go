@@ -0,0 +1,132 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/weiihann/state-expiry-indexer/internal"
+	"github.com/weiihann/state-expiry-indexer/internal/logger"
+	"github.com/weiihann/state-expiry-indexer/pkg/storage"
+)
+
+var convertRangesDryRun bool
+
+var convertRangesCmd = &cobra.Command{
+	Use:   "convert-ranges",
+	Short: "Rewrite JSON range files in the compact binary range format",
+	Long: `Rewrite every JSON range file in the data directory in the binary range format.
+
+Binary range files only keep what the indexer reads: block hashes, accessed accounts with their
+contract flag, accessed storage slots and protocol accesses. Balances, nonces, storage values and
+transaction hashes are dropped. Ranges that are already binary are skipped, so the command can be
+interrupted and run again. Each file is replaced only after the binary version is fully written.
+
+Examples:
+  # Convert all range files
+  state-expiry-indexer convert-ranges
+
+  # List the ranges that would be converted
+  state-expiry-indexer convert-ranges --dry-run`,
+	Run: convertRanges,
+}
+
+func convertRanges(cmd *cobra.Command, args []string) {
+	log := logger.GetLogger("convert-ranges")
+
+	config, err := internal.LoadConfig("./configs")
+	if err != nil {
+		log.Error("Configuration validation failed", "error", err)
+		os.Exit(1)
+	}
+
+	rangeProcessor, err := newRangeProcessor(config, nil)
+	if err != nil {
+		log.Error("Failed to create range processor", "error", err)
+		os.Exit(1)
+	}
+	defer rangeProcessor.Close()
+
+	ranges, err := rangeProcessor.ListRanges()
+	if err != nil {
+		log.Error("Failed to list range files", "error", err)
+		os.Exit(1)
+	}
+
+	log.Info("Starting range conversion",
+		"data_dir", config.DataDir,
+		"range_size", config.RangeSize,
+		"range_files", len(ranges),
+		"dry_run", convertRangesDryRun)
+
+	var converted, skipped, failed int
+	var sizeBefore, sizeAfter int64
+	for _, rangeNumber := range ranges {
+		path := rangeProcessor.GetRangeFilePath(rangeNumber)
+
+		if convertRangesDryRun {
+			format, err := rangeProcessor.RangeFormat(rangeNumber)
+			if err != nil {
+				log.Error("Failed to read range file", "range_number", rangeNumber, "file", path, "error", err)
+				failed++
+				continue
+			}
+			if format == storage.RangeFormatBinary {
+				skipped++
+				continue
+			}
+			log.Info("DRY RUN - Would convert range", "range_number", rangeNumber, "file", path)
+			converted++
+			continue
+		}
+
+		before, err := rangeProcessor.StatRange(rangeNumber)
+		if err != nil {
+			log.Error("Failed to stat range file", "range_number", rangeNumber, "file", path, "error", err)
+			failed++
+			continue
+		}
+
+		ok, err := rangeProcessor.ConvertRange(rangeNumber)
+		if err != nil {
+			log.Error("Failed to convert range", "range_number", rangeNumber, "file", path, "error", err)
+			failed++
+			continue
+		}
+		if !ok {
+			skipped++
+			continue
+		}
+
+		after, err := rangeProcessor.StatRange(rangeNumber)
+		if err != nil {
+			log.Error("Failed to stat converted range file", "range_number", rangeNumber, "file", path, "error", err)
+			failed++
+			continue
+		}
+
+		converted++
+		sizeBefore += before.Size
+		sizeAfter += after.Size
+		log.Debug("Converted range",
+			"range_number", rangeNumber,
+			"json_size", before.Size,
+			"binary_size", after.Size)
+	}
+
+	log.Info("Range conversion completed",
+		"converted", converted,
+		"already_binary", skipped,
+		"failed", failed,
+		"json_size_mb", fmt.Sprintf("%.2f", float64(sizeBefore)/1024/1024),
+		"binary_size_mb", fmt.Sprintf("%.2f", float64(sizeAfter)/1024/1024))
+
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+func init() {
+	convertRangesCmd.Flags().BoolVar(&convertRangesDryRun, "dry-run", false, "List the ranges that would be converted without converting them")
+	rootCmd.AddCommand(convertRangesCmd)
+}
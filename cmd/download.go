@@ -0,0 +1,103 @@
+package cmd
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/spf13/cobra"
+	"github.com/weiihann/state-expiry-indexer/internal"
+	"github.com/weiihann/state-expiry-indexer/internal/caller"
+	"github.com/weiihann/state-expiry-indexer/internal/logger"
+)
+
+var downloadWorkers int
+
+var downloadCmd = &cobra.Command{
+	Use:   "download",
+	Short: "Download the state diff of every finalized block into per-block files",
+	Long: `Run the RPC caller on its own: download the state diff of every block up to the head selected
+by FINALITY into a {block}.json(.zst) file in the data directory, then follow the chain as new
+blocks arrive.
+
+Blocks are downloaded by --workers workers in parallel, spread across every endpoint in RPC_URLS.
+RPC_MAX_IN_FLIGHT caps the calls on a single endpoint. Workers may finish blocks out of order: the
+download tracker records every completed block, so after a crash or restart exactly the missing
+blocks are downloaded again. Per-block files are used by the blocks range source and merge.
+
+Examples:
+  # Download with DOWNLOAD_WORKERS workers
+  state-expiry-indexer download
+
+  # Download with 32 workers spread across every RPC endpoint
+  state-expiry-indexer download --workers 32`,
+	Run: download,
+}
+
+func download(cmd *cobra.Command, args []string) {
+	log := logger.GetLogger("download")
+
+	config, err := internal.LoadConfig("./configs")
+	if err != nil {
+		log.Error("Configuration validation failed", "error", err)
+		os.Exit(1)
+	}
+	workers := config.DownloadWorkers
+	if downloadWorkers > 0 {
+		workers = downloadWorkers
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	rpcClient, closeRPC, err := newRPCClient(ctx, config)
+	if err != nil {
+		log.Error("Failed to create RPC client", "error", err, "rpc_urls", config.RPCURLS)
+		os.Exit(1)
+	}
+	defer func() {
+		if err := closeRPC(); err != nil {
+			log.Error("Failed to save RPC cassette", "error", err)
+		}
+	}()
+
+	fileStore, err := newFileStore(config)
+	if err != nil {
+		log.Error("Failed to create file store", "error", err, "path", config.DataDir)
+		os.Exit(1)
+	}
+	defer fileStore.Close()
+
+	log.Info("Starting download",
+		"data_dir", config.DataDir,
+		"rpc_endpoints", len(config.RPCURLS),
+		"workers", workers,
+		"compression_enabled", config.CompressionEnabled)
+
+	callerSvc, err := caller.NewService(rpcClient, fileStore, config)
+	if err != nil {
+		log.Error("Failed to create RPC caller", "error", err)
+		fileStore.Close()
+		os.Exit(1)
+	}
+	callerSvc.SetWorkers(workers)
+	if err := callerSvc.Run(ctx); err != nil {
+		log.Error("Download failed", "error", err)
+		fileStore.Close()
+		os.Exit(1)
+	}
+
+	lastDownloadedBlock, err := callerSvc.GetLastDownloadedBlock()
+	if err != nil {
+		log.Error("Failed to read download tracker", "error", err)
+		os.Exit(1)
+	}
+	log.Info("Download stopped", "last_downloaded_block", lastDownloadedBlock)
+}
+
+func init() {
+	downloadCmd.Flags().IntVar(&downloadWorkers, "workers", 0, "Number of blocks downloaded in parallel (defaults to DOWNLOAD_WORKERS)")
+	addCassetteFlags(downloadCmd)
+	rootCmd.AddCommand(downloadCmd)
+}
@@ -9,8 +9,6 @@ import (
 	"github.com/weiihann/state-expiry-indexer/internal/indexer"
 	"github.com/weiihann/state-expiry-indexer/internal/logger"
 	"github.com/weiihann/state-expiry-indexer/internal/repository"
-	"github.com/weiihann/state-expiry-indexer/pkg/rpc"
-	"github.com/weiihann/state-expiry-indexer/pkg/storage"
 )
 
 var expCmd = &cobra.Command{
@@ -45,21 +43,22 @@ func exp(cmd *cobra.Command, args []string) {
 
 	log.Info("Repository initialized successfully")
 
-	// Initialize RPC clients
-	var clients []*rpc.Client
-	for _, rpcURL := range config.RPCURLS {
-		log.Info("Initializing RPC client...", "rpc_url", rpcURL)
-		client, err := rpc.NewClient(ctx, rpcURL)
-		if err != nil {
-			log.Error("Failed to create RPC client", "error", err, "rpc_url", rpcURL)
-			os.Exit(1)
-		}
-		clients = append(clients, client)
+	// Initialize RPC client, optionally recording to or replaying from a cassette
+	log.Info("Initializing RPC client...", "rpc_urls", config.RPCURLS, "record", rpcRecordPath, "replay", rpcReplayPath)
+	rpcClient, closeRPC, err := newRPCClient(ctx, config)
+	if err != nil {
+		log.Error("Failed to create RPC client", "error", err, "rpc_urls", config.RPCURLS)
+		os.Exit(1)
 	}
+	defer func() {
+		if err := closeRPC(); err != nil {
+			log.Error("Failed to save RPC cassette", "error", err)
+		}
+	}()
 
 	// Initialize file storage using config paths
 	log.Info("Initializing file storage...", "path", config.DataDir, "compression_enabled", config.CompressionEnabled)
-	fileStore, err := storage.NewFileStoreWithCompression(config.DataDir, config.CompressionEnabled)
+	fileStore, err := newFileStore(config)
 	if err != nil {
 		log.Error("Failed to create file store", "error", err, "path", config.DataDir)
 		os.Exit(1)
@@ -69,12 +68,6 @@ func exp(cmd *cobra.Command, args []string) {
 	// Initialize services only if not in download-only mode
 	var indexerSvc *indexer.Service
 
-	// Use the first RPC client for the indexer (could be enhanced to use multiple clients)
-	var rpcClient *rpc.Client
-	if len(clients) > 0 {
-		rpcClient = clients[0]
-	}
-
 	indexerSvc = indexer.NewService(repo, rpcClient, config)
 	if indexerSvc == nil {
 		log.Error("Failed to create indexer service")
@@ -88,10 +81,15 @@ func exp(cmd *cobra.Command, args []string) {
 
 	if err := indexerSvc.ProcessRangeDebug(ctx, 4901); err != nil {
 		log.Error("Failed to process range", "error", err)
+		// Keep the cassette of the failing range, os.Exit skips deferred calls
+		if err := closeRPC(); err != nil {
+			log.Error("Failed to save RPC cassette", "error", err)
+		}
 		os.Exit(1)
 	}
 }
 
 func init() {
+	addCassetteFlags(expCmd)
 	rootCmd.AddCommand(expCmd)
 }
@@ -2,19 +2,19 @@ package cmd
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"io/fs"
 	"log/slog"
-	"math/big"
 	"os"
-	"path/filepath"
-	"time"
+	"os/signal"
+	"syscall"
 
 	"github.com/spf13/cobra"
 	"github.com/weiihann/state-expiry-indexer/internal"
 	"github.com/weiihann/state-expiry-indexer/internal/logger"
 	"github.com/weiihann/state-expiry-indexer/pkg/rpc"
-	"github.com/weiihann/state-expiry-indexer/pkg/utils"
+	"github.com/weiihann/state-expiry-indexer/pkg/storage"
 )
 
 var (
@@ -26,37 +26,33 @@ var (
 	mergeRPC        bool
 )
 
-// RangeDiffs represents a block range with its state diffs
-type RangeDiffs struct {
-	BlockNum uint64                  `json:"blockNum"`
-	Diffs    []rpc.TransactionResult `json:"diffs"`
-}
-
 var mergeCmd = &cobra.Command{
 	Use:   "merge",
 	Short: "Merge JSON state diff files by block range with compression",
 	Long: `Merge individual JSON state diff files into compressed block ranges to optimize filesystem performance.
-	
-For each block in the range, the command will:
-1. Check if {block}.json exists
-2. If not, check if {block}.json.zst exists and decompress it
-3. If neither exists, download the block via RPC
-4. Aggregate all blocks into RangeDiffs structure
-5. Compress and save as {start}_{end}.json.zst
-6. Delete individual files after successful merge
+
+Range files are written the same way the indexer writes them, so the indexer uses them as they
+are. Ranges are aligned to the range size: every range holding a block from --start-block to
+--end-block is merged. For each range that is not stored yet, the command will:
+1. Assemble the range from the {block}.json and {block}.json.zst files of its blocks, with
+   block headers fetched through RPC
+2. If a block file is missing or damaged, download the whole range via RPC
+3. Check that the range builds on the previous range file and save it as a range file
+4. Delete the individual files of the range after a successful merge
 
 Examples:
   # Merge a specific block range
-  state-expiry-indexer merge --start-block 1000000 --end-block 2000000
-  
-  # Merge with custom range size (default 1000)
-  state-expiry-indexer merge --start-block 1000000 --end-block 2000000 --range-size 500
-  
+  state-expiry-indexer merge --start-block 1000001 --end-block 2000000
+
+  # Merge with a custom range size (defaults to RANGE_SIZE), which the indexer only reads
+  # when RANGE_SIZE is set to the same size
+  state-expiry-indexer merge --start-block 1000001 --end-block 2000000 --range-size 500
+
   # Preview merge without actually doing it
-  state-expiry-indexer merge --start-block 1000000 --end-block 2000000 --dry-run
-  
+  state-expiry-indexer merge --start-block 1000001 --end-block 2000000 --dry-run
+
   # Merge but keep individual files
-  state-expiry-indexer merge --start-block 1000000 --end-block 2000000 --no-cleanup`,
+  state-expiry-indexer merge --start-block 1000001 --end-block 2000000 --no-cleanup`,
 	Run: mergeBlocks,
 }
 
@@ -69,10 +65,13 @@ func mergeBlocks(cmd *cobra.Command, args []string) {
 		log.Error("Configuration validation failed", "error", err)
 		os.Exit(1)
 	}
+	if mergeRangeSize > 0 {
+		config.RangeSize = int(mergeRangeSize)
+	}
 
 	// Validate input parameters
-	if mergeStartBlock > mergeEndBlock {
-		log.Error("Invalid block range", "start_block", mergeStartBlock, "end_block", mergeEndBlock)
+	if mergeStartBlock == 0 || mergeStartBlock > mergeEndBlock {
+		log.Error("Invalid block range, blocks start at 1", "start_block", mergeStartBlock, "end_block", mergeEndBlock)
 		os.Exit(1)
 	}
 
@@ -81,335 +80,182 @@ func mergeBlocks(cmd *cobra.Command, args []string) {
 		log.Warn("Large block range detected", "total_blocks", totalBlocks)
 	}
 
-	log.Info("Starting merge process",
-		"start_block", mergeStartBlock,
-		"end_block", mergeEndBlock,
-		"range_size", mergeRangeSize,
-		"total_blocks", totalBlocks,
-		"data_dir", config.DataDir,
-		"dry_run", mergeDryRun,
-		"no_cleanup", mergeNoCleanup,
-	)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
-	// Initialize RPC client for downloading missing blocks
-	ctx := context.Background()
-	var rpcClient *rpc.Client
-	if len(config.RPCURLS) > 0 {
-		client, err := rpc.NewClient(ctx, config.RPCURLS[0])
+	// Initialize RPC client for block headers and missing blocks, optionally recording to or replaying from a cassette
+	var rpcClient rpc.ClientInterface
+	if len(config.RPCURLS) > 0 || rpcReplayPath != "" {
+		client, closeRPC, err := newRPCClient(ctx, config)
 		if err != nil {
-			log.Error("Failed to create RPC client", "error", err, "rpc_url", config.RPCURLS[0])
+			log.Error("Failed to create RPC client", "error", err, "rpc_urls", config.RPCURLS)
 			os.Exit(1)
 		}
+		defer func() {
+			if err := closeRPC(); err != nil {
+				log.Error("Failed to save RPC cassette", "error", err)
+			}
+		}()
 		rpcClient = client
 	} else {
-		log.Warn("No RPC URLs configured, will not be able to download missing blocks")
+		log.Warn("No RPC URLs configured, ranges are merged without block hashes and missing blocks cannot be downloaded")
 	}
 
-	// Initialize compression utilities
-	encoder, err := utils.NewZstdEncoder()
+	rangeProcessor, err := newRangeProcessor(config, rpcClient)
 	if err != nil {
-		log.Error("Failed to create compression encoder", "error", err)
+		log.Error("Failed to create range processor", "error", err)
 		os.Exit(1)
 	}
-	defer encoder.Close()
+	defer rangeProcessor.Close()
 
-	decoder, err := utils.NewZstdDecoder()
-	if err != nil {
-		log.Error("Failed to create compression decoder", "error", err)
-		os.Exit(1)
+	// Ranges are taken from the per-block files first, RPC only fills in ranges missing blocks
+	var sources []storage.RangeSource
+	if !mergeRPC {
+		blockFiles, err := config.NewBlockFileSource(rangeProcessor, rpcClient)
+		if err != nil {
+			log.Error("Failed to load compression dictionaries", "error", err)
+			os.Exit(1)
+		}
+		sources = append(sources, blockFiles)
 	}
-	defer decoder.Close()
+	if rpcClient != nil {
+		sources = append(sources, rangeProcessor.RPCSource())
+	}
+	rangeProcessor.SetSources(sources...)
+
+	firstRange := rangeProcessor.GetRangeNumber(mergeStartBlock) + 1
+	lastRange := rangeProcessor.GetRangeNumber(mergeEndBlock) + 1
+	log.Info("Starting merge process",
+		"start_block", mergeStartBlock,
+		"end_block", mergeEndBlock,
+		"range_size", config.RangeSize,
+		"first_range", firstRange,
+		"last_range", lastRange,
+		"total_blocks", totalBlocks,
+		"data_dir", config.DataDir,
+		"dry_run", mergeDryRun,
+		"no_cleanup", mergeNoCleanup,
+	)
 
 	// Process block ranges
-	stats := processMergeRanges(log, config, rpcClient, encoder, decoder, ctx)
+	stats := processMergeRanges(ctx, log, rangeProcessor, firstRange, lastRange)
 
 	// Log final statistics
 	log.Info("Merge process completed",
 		"total_ranges", stats.totalRanges,
 		"successful_ranges", stats.successfulRanges,
 		"failed_ranges", stats.failedRanges,
-		"blocks_processed", stats.blocksProcessed,
-		"blocks_downloaded", stats.blocksDownloaded,
+		"existing_ranges", stats.existingRanges,
+		"ranges_from_block_files", stats.sourceRanges[storage.SourceBlockFiles],
+		"ranges_from_rpc", stats.sourceRanges[storage.SourceRPC],
 		"files_cleaned", stats.filesCleaned,
-		"original_size_mb", fmt.Sprintf("%.2f", float64(stats.originalSize)/1024/1024),
-		"compressed_size_mb", fmt.Sprintf("%.2f", float64(stats.compressedSize)/1024/1024),
-		"compression_ratio", fmt.Sprintf("%.2f%%", stats.compressionRatio))
+		"compressed_size_mb", fmt.Sprintf("%.2f", float64(stats.compressedSize)/1024/1024))
 }
 
 type mergeStats struct {
 	totalRanges      int
 	successfulRanges int
 	failedRanges     int
-	blocksProcessed  int
-	blocksDownloaded int
+	existingRanges   int
+	sourceRanges     map[string]int
 	filesCleaned     int
-	originalSize     int64
 	compressedSize   int64
-	compressionRatio float64
 }
 
-func processMergeRanges(log *slog.Logger, config internal.Config, rpcClient *rpc.Client, encoder *utils.ZstdEncoder, decoder *utils.ZstdDecoder, ctx context.Context) mergeStats {
-	stats := mergeStats{}
-
-	// Calculate ranges to process
-	currentStart := mergeStartBlock
-	for currentStart <= mergeEndBlock {
-		currentEnd := currentStart + mergeRangeSize - 1
-		if currentEnd > mergeEndBlock {
-			currentEnd = mergeEndBlock
+func processMergeRanges(ctx context.Context, log *slog.Logger, rangeProcessor *storage.RangeProcessor, firstRange, lastRange uint64) mergeStats {
+	stats := mergeStats{sourceRanges: make(map[string]int)}
+	rangeProcessor.SetSourceFunc(func(rangeNumber uint64, source string, err error) {
+		if err == nil {
+			stats.sourceRanges[source]++
+			return
 		}
+		log.Debug("Range source does not have the range", "range_number", rangeNumber, "source", source, "error", err)
+	})
 
+	for rangeNumber := firstRange; rangeNumber <= lastRange && ctx.Err() == nil; rangeNumber++ {
+		start, end := rangeProcessor.GetRangeBlockNumbers(rangeNumber)
 		stats.totalRanges++
 
 		log.Info("Processing range",
-			"range_start", currentStart,
-			"range_end", currentEnd,
-			"range_size", currentEnd-currentStart+1)
+			"range_number", rangeNumber,
+			"range_start", start,
+			"range_end", end)
 
 		if mergeDryRun {
 			log.Info("DRY RUN - Would process range",
-				"start", currentStart,
-				"end", currentEnd,
-				"output_file", fmt.Sprintf("%d_%d.json.zst", currentStart, currentEnd))
+				"start", start,
+				"end", end,
+				"output_file", rangeProcessor.GetRangeFilePath(rangeNumber))
 			stats.successfulRanges++
-			currentStart = currentEnd + 1
 			continue
 		}
 
 		// Process the range
-		if err := processBlockRange(log, config, rpcClient, encoder, decoder, ctx, currentStart, currentEnd, &stats); err != nil {
-			log.Error("Failed to process range", "start", currentStart, "end", currentEnd, "error", err)
+		if err := processBlockRange(ctx, log, rangeProcessor, rangeNumber, &stats); err != nil {
+			log.Error("Failed to process range", "start", start, "end", end, "error", err)
 			stats.failedRanges++
 		} else {
 			stats.successfulRanges++
 		}
-
-		currentStart = currentEnd + 1
-	}
-
-	// Calculate overall compression ratio
-	if stats.originalSize > 0 {
-		stats.compressionRatio = utils.GetCompressionRatio(int(stats.originalSize), int(stats.compressedSize))
 	}
 
 	return stats
 }
 
-func processBlockRange(log *slog.Logger, config internal.Config, rpcClient *rpc.Client, encoder *utils.ZstdEncoder, decoder *utils.ZstdDecoder, ctx context.Context, startBlock, endBlock uint64, stats *mergeStats) error {
-	var rangeDiffs []RangeDiffs
-	var filesToClean []uint64
-
-	lastProgressTime := time.Now()
-	lastProgressBlock := startBlock
-
-	rangeFilename := fmt.Sprintf("%d_%d.json.zst", startBlock, endBlock)
-	rangeFilePath := filepath.Join(config.DataDir, rangeFilename)
-	if fileInfo, err := os.Stat(rangeFilePath); err == nil && fileInfo.Size() > 0 {
-		log.Info("Range file already exists", "filename", rangeFilename)
-		return nil
+// processBlockRange stores a range file through the range sources, then deletes the per-block
+// files of its blocks
+func processBlockRange(ctx context.Context, log *slog.Logger, rangeProcessor *storage.RangeProcessor, rangeNumber uint64, stats *mergeStats) error {
+	rangeFile := rangeProcessor.GetRangeFilePath(rangeNumber)
+	if rangeProcessor.RangeExists(rangeNumber) {
+		log.Info("Range file already exists", "file", rangeFile)
+		stats.existingRanges++
+	} else if err := rangeProcessor.EnsureRangeExists(ctx, rangeNumber); err != nil {
+		return err
 	}
 
-	// Process each block in the range
-	for blockNum := startBlock; blockNum <= endBlock; blockNum++ {
-		// Progress reporting every 100 blocks or 30 seconds
-		now := time.Now()
-		blocksSinceProgress := blockNum - lastProgressBlock
-		timeSinceProgress := now.Sub(lastProgressTime).Seconds()
-
-		if blocksSinceProgress >= 100 || timeSinceProgress >= 30 {
-			log.Info("Range processing progress",
-				"current_block", blockNum,
-				"range_end", endBlock,
-				"remaining", endBlock-blockNum)
-			lastProgressTime = now
-			lastProgressBlock = blockNum
-		}
-
-		// Get block data
-		var blockData []rpc.TransactionResult
-		var cleanupBlocks []uint64
-		var err error
-		if mergeRPC {
-			blockData, err = getBlockDataFromRPC(log, rpcClient, ctx, blockNum)
-			if err != nil {
-				return fmt.Errorf("failed to get block data for block %d: %w", blockNum, err)
-			}
-		} else {
-			blockData, cleanupBlocks, err = getBlockData(log, config, rpcClient, decoder, ctx, blockNum)
-			if err != nil {
-				return fmt.Errorf("failed to get block data for block %d: %w", blockNum, err)
-			}
-		}
-
-		// Add block data to range
-		rangeDiffs = append(rangeDiffs, RangeDiffs{
-			BlockNum: blockNum,
-			Diffs:    blockData,
-		})
-
-		// Track files to clean up and increment download counter if no files to clean (means RPC download)
-		filesToClean = append(filesToClean, cleanupBlocks...)
-		if len(cleanupBlocks) == 0 {
-			stats.blocksDownloaded++
-		}
-		stats.blocksProcessed++
-	}
-
-	// Marshal range data to JSON
-	rangeData, err := json.MarshalIndent(rangeDiffs, "", "  ")
+	info, err := rangeProcessor.StatRange(rangeNumber)
 	if err != nil {
-		return fmt.Errorf("failed to marshal range data: %w", err)
+		return fmt.Errorf("failed to check range file %s: %w", rangeFile, err)
 	}
-
-	// Compress the range data
-	compressedData, err := encoder.Compress(rangeData)
-	if err != nil {
-		return fmt.Errorf("failed to compress range data: %w", err)
-	}
-
-	// Save compressed range file
-	if err := os.WriteFile(rangeFilePath, compressedData, 0o644); err != nil {
-		return fmt.Errorf("failed to write range file %s: %w", rangeFilename, err)
-	}
-
-	// Update statistics
-	stats.originalSize += int64(len(rangeData))
-	stats.compressedSize += int64(len(compressedData))
-
-	log.Info("Successfully created range file",
-		"filename", rangeFilename,
-		"blocks", endBlock-startBlock+1,
-		"original_size", len(rangeData),
-		"compressed_size", len(compressedData),
-		"compression_ratio", fmt.Sprintf("%.2f%%", utils.GetCompressionRatio(len(rangeData), len(compressedData))))
+	stats.compressedSize += info.Size
+	log.Info("Range file stored",
+		"file", rangeFile,
+		"compressed_size", info.Size)
 
 	// Clean up individual files if requested
-	if !mergeNoCleanup {
-		for _, block := range filesToClean {
-			jsonFilename := fmt.Sprintf("%d.json", block)
-			jsonFilePath := filepath.Join(config.DataDir, jsonFilename)
-			if _, err := os.Stat(jsonFilePath); err == nil {
-				if err := os.Remove(jsonFilePath); err != nil {
-					log.Warn("Failed to remove file", "file", jsonFilePath, "error", err)
-				} else {
-					log.Debug("Cleaned up file", "file", jsonFilePath)
-					stats.filesCleaned++
-				}
-			}
-
-			compressedFilename := fmt.Sprintf("%d.json.zst", block)
-			compressedFilePath := filepath.Join(config.DataDir, compressedFilename)
-			if _, err := os.Stat(compressedFilePath); err == nil {
-				if err := os.Remove(compressedFilePath); err != nil {
-					log.Warn("Failed to remove file", "file", compressedFilePath, "error", err)
-				} else {
-					log.Debug("Cleaned up file", "file", compressedFilePath)
-					stats.filesCleaned++
-				}
-			}
-		}
+	if mergeNoCleanup {
+		return nil
 	}
-
-	return nil
-}
-
-func getBlockData(log *slog.Logger, config internal.Config, rpcClient *rpc.Client, decoder *utils.ZstdDecoder, ctx context.Context, blockNum uint64) ([]rpc.TransactionResult, []uint64, error) {
-	var filesToClean []uint64
-
-	// Check for uncompressed JSON file first
-	jsonFilename := fmt.Sprintf("%d.json", blockNum)
-	jsonFilePath := filepath.Join(config.DataDir, jsonFilename)
-
-	if fileInfo, err := os.Stat(jsonFilePath); err == nil {
-		// Sanity check: if file is empty, treat as corrupted and proceed to RPC
-		if fileInfo.Size() == 0 {
-			log.Warn("Found empty uncompressed file, treating as corrupted", "block", blockNum, "file", jsonFilename)
-			// Don't add to cleanup list since we'll proceed to RPC download
-		} else {
-			// Read uncompressed JSON file
-			data, err := os.ReadFile(jsonFilePath)
-			if err != nil {
-				log.Warn("Failed to read JSON file, proceeding to RPC", "block", blockNum, "file", jsonFilename, "error", err)
-			} else {
-				// Additional sanity check: ensure the data is valid JSON
-				var transactionResults []rpc.TransactionResult
-				if err := json.Unmarshal(data, &transactionResults); err != nil {
-					log.Warn("Failed to unmarshal JSON data, treating as corrupted and proceeding to RPC", "block", blockNum, "file", jsonFilename, "error", err)
-				} else {
-					filesToClean = append(filesToClean, blockNum)
-					log.Debug("Found valid uncompressed file", "block", blockNum, "file", jsonFilename, "transactions", len(transactionResults))
-					return transactionResults, filesToClean, nil
+	backend := rangeProcessor.Backend()
+	start, end := rangeProcessor.GetRangeBlockNumbers(rangeNumber)
+	for block := start; block <= end; block++ {
+		for _, filename := range []string{fmt.Sprintf("%d.json", block), fmt.Sprintf("%d.json.zst", block)} {
+			if _, err := backend.Stat(filename); err != nil {
+				if !errors.Is(err, fs.ErrNotExist) {
+					log.Warn("Failed to check file", "file", backend.Location(filename), "error", err)
 				}
+				continue
 			}
-		}
-	}
-
-	// Check for compressed JSON file
-	compressedFilename := fmt.Sprintf("%d.json.zst", blockNum)
-	compressedFilePath := filepath.Join(config.DataDir, compressedFilename)
-
-	if fileInfo, err := os.Stat(compressedFilePath); err == nil {
-		// Sanity check: if file is empty, treat as corrupted and proceed to RPC
-		if fileInfo.Size() == 0 {
-			log.Warn("Found empty compressed file, treating as corrupted", "block", blockNum, "file", compressedFilename)
-			// Don't add to cleanup list since we'll proceed to RPC download
-		} else {
-			// Read and decompress file
-			compressedData, err := os.ReadFile(compressedFilePath)
-			if err != nil {
-				log.Warn("Failed to read compressed file, proceeding to RPC", "block", blockNum, "file", compressedFilename, "error", err)
+			if err := backend.Delete(filename); err != nil {
+				log.Warn("Failed to remove file", "file", backend.Location(filename), "error", err)
 			} else {
-				decompressedData, err := decoder.Decompress(compressedData)
-				if err != nil {
-					log.Warn("Failed to decompress file, treating as corrupted and proceeding to RPC", "block", blockNum, "file", compressedFilename, "error", err)
-				} else {
-					// Additional sanity check: ensure the decompressed data is valid JSON
-					var transactionResults []rpc.TransactionResult
-					if err := json.Unmarshal(decompressedData, &transactionResults); err != nil {
-						log.Warn("Failed to unmarshal decompressed data, treating as corrupted and proceeding to RPC", "block", blockNum, "file", compressedFilename, "error", err)
-					} else {
-						filesToClean = append(filesToClean, blockNum)
-						log.Debug("Found valid compressed file", "block", blockNum, "file", compressedFilename, "transactions", len(transactionResults))
-						return transactionResults, filesToClean, nil
-					}
-				}
+				log.Debug("Cleaned up file", "file", backend.Location(filename))
+				stats.filesCleaned++
 			}
 		}
 	}
 
-	// Neither file exists or both files are corrupted, download via RPC
-	if rpcClient == nil {
-		return nil, nil, fmt.Errorf("block %d not found (or corrupted) and no RPC client available for download", blockNum)
-	}
-
-	log.Debug("Downloading block via RPC", "block", blockNum, "reason", "missing_or_corrupted_files")
-
-	stateDiff, err := getBlockDataFromRPC(log, rpcClient, ctx, blockNum)
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to download block %d via RPC: %w", blockNum, err)
-	}
-
-	return stateDiff, filesToClean, nil
-}
-
-func getBlockDataFromRPC(log *slog.Logger, rpcClient *rpc.Client, ctx context.Context, blockNum uint64) ([]rpc.TransactionResult, error) {
-	blockBigInt := big.NewInt(int64(blockNum))
-	stateDiff, err := rpcClient.GetStateDiff(ctx, blockBigInt)
-	if err != nil {
-		return nil, fmt.Errorf("failed to download block %d via RPC: %w", blockNum, err)
-	}
-
-	log.Debug("Successfully downloaded block via RPC", "block", blockNum, "transactions", len(stateDiff))
-	return stateDiff, nil
+	return nil
 }
 
 func init() {
 	mergeCmd.Flags().Uint64Var(&mergeStartBlock, "start-block", 1, "Start block number for merge range")
 	mergeCmd.Flags().Uint64Var(&mergeEndBlock, "end-block", 1, "End block number for merge range")
-	mergeCmd.Flags().Uint64Var(&mergeRangeSize, "range-size", 1000, "Number of blocks per merged range file")
+	mergeCmd.Flags().Uint64Var(&mergeRangeSize, "range-size", 0, "Number of blocks per merged range file (defaults to RANGE_SIZE)")
 	mergeCmd.Flags().BoolVar(&mergeDryRun, "dry-run", false, "Preview merge without actually doing it")
 	mergeCmd.Flags().BoolVar(&mergeNoCleanup, "no-cleanup", false, "Keep individual files after merge")
-	mergeCmd.Flags().BoolVar(&mergeRPC, "rpc", false, "Download blocks via RPC and skip file check")
+	mergeCmd.Flags().BoolVar(&mergeRPC, "rpc", false, "Download ranges via RPC and skip the block files")
+	addCassetteFlags(mergeCmd)
 
 	rootCmd.AddCommand(mergeCmd)
 }
@@ -0,0 +1,170 @@
+package cmd
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/spf13/cobra"
+	"github.com/weiihann/state-expiry-indexer/internal"
+	"github.com/weiihann/state-expiry-indexer/internal/logger"
+	"github.com/weiihann/state-expiry-indexer/internal/repository"
+)
+
+var (
+	rechunkFromSize       int
+	rechunkToSize         int
+	rechunkDeleteSource   bool
+	rechunkUpdateMetadata bool
+)
+
+var rechunkCmd = &cobra.Command{
+	Use:   "rechunk",
+	Short: "Rewrite the range files of the data directory in another range size",
+	Long: `Stream the range files of --from-size blocks in the data directory into range files of --to-size
+blocks, so RANGE_SIZE can be changed without downloading every range again.
+
+Range files are written in the binary format with the same compression and manifest as the
+indexer. The blocks of every range file must be contiguous and every new range must extend the
+stored chain. Ranges of the new size that are already stored are skipped, so the command can be
+interrupted and run again. Ranges whose blocks are not all stored in the old range files are left
+to be downloaded by the indexer.
+
+With --delete-source old range files are deleted once all of their blocks are stored in new range
+files. With --update-metadata the last indexed range in the database is translated to the new
+range size. If the last indexed block does not end a range of the new size, the blocks after the
+last complete range are removed from the database and indexed again. Stop the indexer first and
+set RANGE_SIZE to --to-size afterwards.
+
+Examples:
+  # Rewrite ranges of 1000 blocks in ranges of 10000 blocks
+  state-expiry-indexer rechunk --from-size 1000 --to-size 10000
+
+  # Also remove the old range files and translate the last indexed range
+  state-expiry-indexer rechunk --from-size 1000 --to-size 10000 --delete-source --update-metadata`,
+	Run: rechunk,
+}
+
+func rechunk(cmd *cobra.Command, args []string) {
+	log := logger.GetLogger("rechunk")
+
+	config, err := internal.LoadConfig("./configs")
+	if err != nil {
+		log.Error("Configuration validation failed", "error", err)
+		os.Exit(1)
+	}
+
+	if rechunkFromSize <= 0 || rechunkToSize <= 0 || rechunkFromSize == rechunkToSize {
+		log.Error("Invalid range sizes, --from-size and --to-size must be positive and differ",
+			"from_size", rechunkFromSize, "to_size", rechunkToSize)
+		os.Exit(1)
+	}
+
+	fromConfig, toConfig := config, config
+	fromConfig.RangeSize = rechunkFromSize
+	toConfig.RangeSize = rechunkToSize
+
+	from, err := newRangeProcessor(fromConfig, nil)
+	if err != nil {
+		log.Error("Failed to create range processor", "error", err)
+		os.Exit(1)
+	}
+	defer from.Close()
+
+	to, err := newRangeProcessor(toConfig, nil)
+	if err != nil {
+		log.Error("Failed to create range processor", "error", err)
+		os.Exit(1)
+	}
+	defer to.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	log.Info("Starting rechunk",
+		"data_dir", config.DataDir,
+		"from_size", rechunkFromSize,
+		"to_size", rechunkToSize,
+		"delete_source", rechunkDeleteSource,
+		"update_metadata", rechunkUpdateMetadata)
+
+	result, err := to.Rechunk(ctx, from, func(rangeNumber uint64) {
+		log.Debug("Wrote range", "range_number", rangeNumber, "file", to.GetRangeFilePath(rangeNumber))
+	})
+	log.Info("Rechunk finished",
+		"written", result.Written,
+		"already_stored", result.Existing,
+		"incomplete", len(result.Incomplete))
+	if len(result.Incomplete) > 0 {
+		log.Warn("Ranges missing blocks in the old range files were not written, the indexer downloads them",
+			"ranges", result.Incomplete)
+	}
+	if err != nil {
+		log.Error("Rechunk failed", "error", err)
+		from.Close()
+		to.Close()
+		os.Exit(1)
+	}
+
+	if rechunkDeleteSource {
+		deleted, err := to.DeleteRechunked(from)
+		if err != nil {
+			log.Error("Failed to delete old range files", "deleted", deleted, "error", err)
+			from.Close()
+			to.Close()
+			os.Exit(1)
+		}
+		log.Info("Deleted old range files", "deleted", deleted)
+	}
+
+	if rechunkUpdateMetadata {
+		if err := translateLastIndexedRange(ctx, config); err != nil {
+			log.Error("Failed to update last indexed range", "error", err)
+			from.Close()
+			to.Close()
+			os.Exit(1)
+		}
+	}
+}
+
+// translateLastIndexedRange moves the last indexed range to the last range of --to-size blocks
+// that is fully indexed. Blocks indexed after it are rolled back, so they are not indexed twice.
+func translateLastIndexedRange(ctx context.Context, config internal.Config) error {
+	log := logger.GetLogger("rechunk")
+
+	repo, err := repository.NewRepository(ctx, config)
+	if err != nil {
+		return err
+	}
+	lastIndexedRange, err := repo.GetLastIndexedRange(ctx)
+	if err != nil {
+		return err
+	}
+
+	lastBlock := lastIndexedRange * uint64(rechunkFromSize)
+	translated := lastBlock / uint64(rechunkToSize)
+	translatedBlock := translated * uint64(rechunkToSize)
+	if translatedBlock < lastBlock {
+		log.Warn("Last indexed block does not end a range of the new size, later blocks are indexed again",
+			"last_indexed_block", lastBlock,
+			"rollback_to_block", translatedBlock)
+	}
+
+	if err := repo.Rollback(ctx, translatedBlock, translated); err != nil {
+		return err
+	}
+	log.Info("Updated last indexed range",
+		"last_indexed_range", lastIndexedRange,
+		"translated_range", translated,
+		"range_size", rechunkToSize)
+	return nil
+}
+
+func init() {
+	rechunkCmd.Flags().IntVar(&rechunkFromSize, "from-size", 0, "Range size of the existing range files")
+	rechunkCmd.Flags().IntVar(&rechunkToSize, "to-size", 0, "Range size to rewrite the range files in")
+	rechunkCmd.Flags().BoolVar(&rechunkDeleteSource, "delete-source", false, "Delete old range files once all of their blocks are stored in new range files")
+	rechunkCmd.Flags().BoolVar(&rechunkUpdateMetadata, "update-metadata", false, "Translate the last indexed range in the database to the new range size")
+	rootCmd.AddCommand(rechunkCmd)
+}
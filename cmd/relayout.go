@@ -0,0 +1,98 @@
+package cmd
+
+import (
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/weiihann/state-expiry-indexer/internal"
+	"github.com/weiihann/state-expiry-indexer/internal/logger"
+	"github.com/weiihann/state-expiry-indexer/pkg/storage"
+)
+
+var (
+	relayoutLayout string
+	relayoutDryRun bool
+)
+
+var relayoutCmd = &cobra.Command{
+	Use:   "relayout",
+	Short: "Move the per-block and range files of the data directory to another layout",
+	Long: `Move the per-block and range files of the data directory to where DATA_LAYOUT places them.
+
+The flat layout stores every file in the root of DATA_DIR. The sharded layout stores per-block
+and range files in directories by the million and thousand of their first block, such as
+20/123/20123456.json.zst, which keeps directories small enough for fast lookups and scans.
+Range files go under ranges/, such as ranges/20/123/20123001_20124000.json.zst, so they are
+listed without walking the per-block files; run relayout again on data directories sharded
+before range files moved there. Dictionaries and other files stay in the root.
+
+Files are moved in place and found in any layout, so an interrupted relayout can be run again.
+A file is left where it is when a file with the same name is already at its destination. Stop
+the indexer first and set DATA_LAYOUT to the new layout before starting it again.
+
+Examples:
+  # Move every file to the sharded layout
+  state-expiry-indexer relayout --layout sharded
+
+  # List the files that would be moved to the layout in DATA_LAYOUT
+  state-expiry-indexer relayout --dry-run`,
+	Run: relayout,
+}
+
+func relayout(cmd *cobra.Command, args []string) {
+	log := logger.GetLogger("relayout")
+
+	config, err := internal.LoadConfig("./configs")
+	if err != nil {
+		log.Error("Configuration validation failed", "error", err)
+		os.Exit(1)
+	}
+
+	layoutName := config.DataLayout
+	if relayoutLayout != "" {
+		layoutName = relayoutLayout
+	}
+	layout, err := storage.ParseLayout(layoutName)
+	if err != nil {
+		log.Error("Invalid layout, set --layout or DATA_LAYOUT", "error", err)
+		os.Exit(1)
+	}
+	backend, err := config.NewRawStorageBackend()
+	if err != nil {
+		log.Error("Failed to open data directory", "error", err, "data_dir", config.DataDir)
+		os.Exit(1)
+	}
+
+	log.Info("Starting relayout", "data_dir", config.DataDir, "layout", layout, "dry_run", relayoutDryRun)
+
+	result, err := storage.Relayout(backend, layout, relayoutDryRun, func(from, to string) {
+		if relayoutDryRun {
+			log.Info("DRY RUN - Would move", "from", from, "to", to)
+		} else {
+			log.Debug("Moved file", "from", from, "to", to)
+		}
+	})
+	log.Info("Relayout finished",
+		"layout", layout,
+		"moved", result.Moved,
+		"already_in_place", result.InPlace,
+		"conflicts", len(result.Conflicts))
+	if err != nil {
+		log.Error("Relayout failed", "error", err)
+		os.Exit(1)
+	}
+	if len(result.Conflicts) > 0 {
+		log.Error("Files were left in place because their destination exists, remove the stale copies and run again",
+			"files", result.Conflicts)
+		os.Exit(1)
+	}
+	if layout != storage.Layout(config.DataLayout) && !relayoutDryRun {
+		log.Warn("Set DATA_LAYOUT to the new layout before starting the indexer", "data_layout", layout)
+	}
+}
+
+func init() {
+	relayoutCmd.Flags().StringVar(&relayoutLayout, "layout", "", "Layout to move files to: flat or sharded (defaults to DATA_LAYOUT)")
+	relayoutCmd.Flags().BoolVar(&relayoutDryRun, "dry-run", false, "List the files that would be moved without moving them")
+	rootCmd.AddCommand(relayoutCmd)
+}
@@ -0,0 +1,72 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/weiihann/state-expiry-indexer/internal"
+	"github.com/weiihann/state-expiry-indexer/pkg/rpc"
+)
+
+var (
+	rpcRecordPath string
+	rpcReplayPath string
+)
+
+// addCassetteFlags registers the --record and --replay flags on a command that talks to RPC
+func addCassetteFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&rpcRecordPath, "record", "", "Record every RPC request and response to this cassette file")
+	cmd.Flags().StringVar(&rpcReplayPath, "replay", "", "Serve RPC responses from this cassette file instead of the network")
+}
+
+// rpcPoolConfig builds the RPC pool configuration from the loaded config
+func rpcPoolConfig(config internal.Config) rpc.PoolConfig {
+	poolConfig := rpc.DefaultPoolConfig()
+	poolConfig.Batch.BatchSize = config.BlockBatchSize
+	poolConfig.Batch.Concurrency = config.RPCBatchConcurrency
+	poolConfig.MaxInFlight = config.RPCMaxInFlight
+	return poolConfig
+}
+
+// rpcRetryConfig builds the RPC retry configuration from the loaded config
+func rpcRetryConfig(config internal.Config) rpc.RetryConfig {
+	retryConfig := rpc.DefaultRetryConfig()
+	retryConfig.MaxAttempts = config.RPCMaxRetries + 1
+	retryConfig.Budget = time.Duration(config.RPCRetryBudgetSeconds) * time.Second
+	return retryConfig
+}
+
+// newRPCClient builds the RPC client used by the indexing commands: a retrying client
+// over the endpoint pool. With --record the pool is wrapped in a recorder, with --replay
+// responses come from a cassette and no endpoint is dialed. The returned function must
+// be called on shutdown to write the cassette.
+func newRPCClient(ctx context.Context, config internal.Config) (rpc.ClientInterface, func() error, error) {
+	noop := func() error { return nil }
+
+	if rpcRecordPath != "" && rpcReplayPath != "" {
+		return nil, noop, fmt.Errorf("--record and --replay cannot be used together")
+	}
+
+	if rpcReplayPath != "" {
+		replay, err := rpc.NewReplayClient(rpcReplayPath)
+		if err != nil {
+			return nil, noop, err
+		}
+		return rpc.NewRetryClient(replay, rpcRetryConfig(config)), noop, nil
+	}
+
+	pool, err := rpc.NewPool(ctx, config.RPCURLS, rpcPoolConfig(config))
+	if err != nil {
+		return nil, noop, err
+	}
+
+	if rpcRecordPath != "" {
+		recorder := rpc.NewRecordingClient(pool, rpcRecordPath)
+		return rpc.NewRetryClient(recorder, rpcRetryConfig(config)), recorder.Close, nil
+	}
+
+	// Retries wrap the pool so every attempt can fail over between endpoints
+	return rpc.NewRetryClient(pool, rpcRetryConfig(config)), noop, nil
+}
@@ -17,21 +17,20 @@ import (
 	"github.com/weiihann/state-expiry-indexer/internal/indexer"
 	"github.com/weiihann/state-expiry-indexer/internal/logger"
 	"github.com/weiihann/state-expiry-indexer/internal/repository"
-	"github.com/weiihann/state-expiry-indexer/pkg/rpc"
-	"github.com/weiihann/state-expiry-indexer/pkg/storage"
 )
 
 var archiveMode bool
 
 var runCmd = &cobra.Command{
 	Use:   "run",
-	Short: "Run the state expiry indexer with separated RPC caller and processor workflows",
-	Long:  `This command starts the separated RPC caller, indexer processor, and API server concurrently. The RPC caller downloads state diffs, the processor indexes them into the database, and the API server serves queries. Use --archive to enable ClickHouse archive mode with complete state history.`,
+	Short: "Run the state expiry indexer processor and API server",
+	Long:  `This command starts the indexer processor and API server concurrently. The processor takes each range from the configured range sources, indexes it into the database, and the API server serves queries. Per-block state diffs are downloaded separately by the download command. Use --archive to enable ClickHouse archive mode with complete state history.`,
 	Run:   run,
 }
 
 func init() {
 	runCmd.Flags().BoolVar(&archiveMode, "archive", false, "Enable archive mode with ClickHouse for complete state access history")
+	addCassetteFlags(runCmd)
 	rootCmd.AddCommand(runCmd)
 }
 
@@ -73,21 +72,22 @@ func run(cmd *cobra.Command, args []string) {
 
 	log.Info("Repository initialized successfully")
 
-	// Initialize RPC clients
-	var clients []*rpc.Client
-	for _, rpcURL := range config.RPCURLS {
-		log.Info("Initializing RPC client...", "rpc_url", rpcURL)
-		client, err := rpc.NewClient(ctx, rpcURL)
-		if err != nil {
-			log.Error("Failed to create RPC client", "error", err, "rpc_url", rpcURL)
-			os.Exit(1)
-		}
-		clients = append(clients, client)
+	// Initialize RPC client, optionally recording to or replaying from a cassette
+	log.Info("Initializing RPC client...", "rpc_urls", config.RPCURLS, "record", rpcRecordPath, "replay", rpcReplayPath)
+	rpcClient, closeRPC, err := newRPCClient(ctx, config)
+	if err != nil {
+		log.Error("Failed to create RPC client", "error", err, "rpc_urls", config.RPCURLS)
+		os.Exit(1)
 	}
+	defer func() {
+		if err := closeRPC(); err != nil {
+			log.Error("Failed to save RPC cassette", "error", err)
+		}
+	}()
 
 	// Initialize file storage using config paths
 	log.Info("Initializing file storage...", "path", config.DataDir, "compression_enabled", config.CompressionEnabled)
-	fileStore, err := storage.NewFileStoreWithCompression(config.DataDir, config.CompressionEnabled)
+	fileStore, err := newFileStore(config)
 	if err != nil {
 		log.Error("Failed to create file store", "error", err, "path", config.DataDir)
 		os.Exit(1)
@@ -98,12 +98,6 @@ func run(cmd *cobra.Command, args []string) {
 	var indexerSvc *indexer.Service
 	var apiServer *api.Server
 
-	// Use the first RPC client for the indexer (could be enhanced to use multiple clients)
-	var rpcClient *rpc.Client
-	if len(clients) > 0 {
-		rpcClient = clients[0]
-	}
-
 	indexerSvc = indexer.NewService(repo, rpcClient, config)
 	if indexerSvc == nil {
 		log.Error("Failed to create indexer service")
@@ -171,7 +165,6 @@ func run(cmd *cobra.Command, args []string) {
 		"data_dir", config.DataDir)
 	log.Info("Services running",
 		"api_available", true,
-		"rpc_caller_running", true,
 		"indexer_processor_running", true)
 	log.Info("Press Ctrl+C to stop all services")
 
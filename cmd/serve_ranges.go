@@ -0,0 +1,86 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/weiihann/state-expiry-indexer/internal"
+	"github.com/weiihann/state-expiry-indexer/internal/logger"
+)
+
+var serveRangesAddr string
+
+var serveRangesCmd = &cobra.Command{
+	Use:   "serve-ranges",
+	Short: "Serve the range files of the data directory as a mirror for other indexers",
+	Long: `Serve the range files of the data directory over HTTP, so other indexers can download them with
+the bootstrap command or the mirror range source instead of tracing every block again.
+
+  GET /ranges                 lists every intact range file with its manifest as JSON
+  GET /ranges/{start}_{end}   streams a range file, with its manifest hash in X-Range-Sha256
+
+Range requests are supported, so interrupted downloads are resumed. Corrupt range files are not served.
+
+Examples:
+  # Serve the data directory from the configuration
+  state-expiry-indexer serve-ranges --addr 0.0.0.0:8090`,
+	Run: serveRanges,
+}
+
+func serveRanges(cmd *cobra.Command, args []string) {
+	log := logger.GetLogger("serve-ranges")
+
+	config, err := internal.LoadConfig("./configs")
+	if err != nil {
+		log.Error("Configuration validation failed", "error", err)
+		os.Exit(1)
+	}
+
+	rangeProcessor, err := newRangeProcessor(config, nil)
+	if err != nil {
+		log.Error("Failed to create range processor", "error", err)
+		os.Exit(1)
+	}
+	defer rangeProcessor.Close()
+
+	server := &http.Server{
+		Addr:    serveRangesAddr,
+		Handler: rangeProcessor.MirrorHandler(),
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Error("Range server shutdown error", "error", err)
+		}
+	}()
+
+	log.Info("Serving range files",
+		"url", "http://"+serveRangesAddr+"/ranges",
+		"data_dir", config.DataDir,
+		"range_size", config.RangeSize)
+	log.Info("Press Ctrl+C to stop")
+
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Error("Range server error", "error", err)
+		rangeProcessor.Close()
+		os.Exit(1)
+	}
+	log.Info("Range server stopped")
+}
+
+func init() {
+	serveRangesCmd.Flags().StringVar(&serveRangesAddr, "addr", "localhost:8090", "Address to listen on")
+	rootCmd.AddCommand(serveRangesCmd)
+}
@@ -0,0 +1,140 @@
+package cmd
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/weiihann/state-expiry-indexer/internal"
+	"github.com/weiihann/state-expiry-indexer/internal/logger"
+	"github.com/weiihann/state-expiry-indexer/pkg/rpc/rpctest"
+	"github.com/weiihann/state-expiry-indexer/pkg/storage"
+)
+
+var (
+	serveRPCAddr          string
+	serveRPCDataDir       string
+	serveRPCFile          string
+	serveRPCLatency       time.Duration
+	serveRPCErrorRate     float64
+	serveRPCRateLimitRate float64
+	serveRPCRetryAfter    time.Duration
+	serveRPCFailBlocks    []uint
+)
+
+var serveRPCCmd = &cobra.Command{
+	Use:   "serve-rpc",
+	Short: "Serve a local JSON-RPC endpoint from downloaded state diffs",
+	Long: `Serve eth_blockNumber, eth_getCode, eth_getBlockByNumber and trace_replayBlockTransactions from existing
+range files, per-block files or a JSON file, so the indexer can run end-to-end without a node.
+
+Examples:
+  # Serve the data directory from the configuration
+  state-expiry-indexer serve-rpc
+
+  # Serve the example data on a custom address
+  state-expiry-indexer serve-rpc --file testdata/example.json --addr localhost:9545
+
+  # Exercise failure handling with latency, errors and rate limiting
+  state-expiry-indexer serve-rpc --latency 50ms --error-rate 0.05 --rate-limit-rate 0.05 --retry-after 2s`,
+	Run: serveRPC,
+}
+
+func serveRPC(cmd *cobra.Command, args []string) {
+	log := logger.GetLogger("serve-rpc")
+
+	var source rpctest.Source
+	if serveRPCFile != "" {
+		fileSource, err := rpctest.NewFileSource(serveRPCFile)
+		if err != nil {
+			log.Error("Failed to load data file", "file", serveRPCFile, "error", err)
+			os.Exit(1)
+		}
+		source = fileSource
+	} else {
+		config, err := internal.LoadConfig("./configs")
+		if err != nil {
+			log.Error("Configuration validation failed", "error", err)
+			os.Exit(1)
+		}
+
+		dataDir := config.DataDir
+		if serveRPCDataDir != "" {
+			dataDir = serveRPCDataDir
+		}
+
+		layout, err := storage.ParseLayout(config.DataLayout)
+		if err != nil {
+			log.Error("Invalid data directory layout", "error", err)
+			os.Exit(1)
+		}
+		dataDirSource, err := rpctest.NewDataDirSource(dataDir, config.RangeSize)
+		if err != nil {
+			log.Error("Failed to open data directory", "data_dir", dataDir, "error", err)
+			os.Exit(1)
+		}
+		defer dataDirSource.Close()
+		dataDirSource.SetLayout(layout)
+		source = dataDirSource
+	}
+
+	failBlocks := make(map[uint64]bool, len(serveRPCFailBlocks))
+	for _, block := range serveRPCFailBlocks {
+		failBlocks[uint64(block)] = true
+	}
+
+	server, err := rpctest.NewServer(source, rpctest.Options{
+		Latency:       serveRPCLatency,
+		ErrorRate:     serveRPCErrorRate,
+		RateLimitRate: serveRPCRateLimitRate,
+		RetryAfter:    serveRPCRetryAfter,
+		FailBlocks:    failBlocks,
+	})
+	if err != nil {
+		log.Error("Failed to create RPC server", "error", err)
+		os.Exit(1)
+	}
+	defer server.Stop()
+
+	latest, err := source.LatestBlock()
+	if err != nil {
+		log.Error("Failed to determine latest block", "error", err)
+		os.Exit(1)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	log.Info("Serving JSON-RPC",
+		"url", "http://"+serveRPCAddr,
+		"latest_block", latest,
+		"latency", serveRPCLatency,
+		"error_rate", serveRPCErrorRate,
+		"rate_limit_rate", serveRPCRateLimitRate,
+		"fail_blocks", len(failBlocks))
+	log.Info("Press Ctrl+C to stop")
+
+	if err := server.ListenAndServe(ctx, serveRPCAddr); err != nil {
+		log.Error("RPC server error", "error", err)
+		os.Exit(1)
+	}
+	log.Info("RPC server stopped")
+}
+
+func init() {
+	serveRPCCmd.Flags().StringVar(&serveRPCAddr, "addr", "localhost:8545", "Address to listen on")
+	serveRPCCmd.Flags().StringVar(&serveRPCDataDir, "data-dir", "", "Data directory to serve (defaults to DATA_DIR)")
+	serveRPCCmd.Flags().StringVar(&serveRPCFile, "file", "", "Serve a JSON file in the range file layout, e.g. testdata/example.json")
+	serveRPCCmd.Flags().DurationVar(&serveRPCLatency, "latency", 0, "Latency added to every call")
+	serveRPCCmd.Flags().Float64Var(&serveRPCErrorRate, "error-rate", 0, "Fraction of calls answered with a server error (0-1)")
+	serveRPCCmd.Flags().Float64Var(&serveRPCRateLimitRate, "rate-limit-rate", 0, "Fraction of requests answered with 429 Too Many Requests (0-1)")
+	serveRPCCmd.Flags().DurationVar(&serveRPCRetryAfter, "retry-after", time.Second, "Retry-After sent with rate limited responses")
+	serveRPCCmd.Flags().UintSliceVar(&serveRPCFailBlocks, "fail-blocks", nil, "Blocks whose traces always fail as if history was pruned")
+
+	serveRPCCmd.MarkFlagsMutuallyExclusive("file", "data-dir")
+
+	rootCmd.AddCommand(serveRPCCmd)
+}
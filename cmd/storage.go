@@ -0,0 +1,51 @@
+package cmd
+
+import (
+	"os"
+
+	"github.com/weiihann/state-expiry-indexer/internal"
+	"github.com/weiihann/state-expiry-indexer/pkg/rpc"
+	"github.com/weiihann/state-expiry-indexer/pkg/storage"
+)
+
+// newRangeProcessor builds a range processor over the storage backend selected by DATA_DIR.
+// rpcClient may be nil for commands that only read range files.
+func newRangeProcessor(config internal.Config, rpcClient rpc.ClientInterface) (*storage.RangeProcessor, error) {
+	accessMode, err := rpc.ParseAccessMode(config.AccessMode)
+	if err != nil {
+		return nil, err
+	}
+	backend, err := config.NewStorageBackend()
+	if err != nil {
+		return nil, err
+	}
+	rangeProcessor, err := storage.NewRangeProcessorWithBackend(backend, rpcClient, config.RangeSize, accessMode)
+	if err != nil {
+		return nil, err
+	}
+	if err := rangeProcessor.SetCompressionLevel(config.CompressionLevel); err != nil {
+		rangeProcessor.Close()
+		return nil, err
+	}
+	return rangeProcessor, nil
+}
+
+// newFileStore builds the file store of per-block state diffs over the storage backend
+// selected by DATA_DIR, compressing with the configured level and dictionary. Local data
+// directories are created if missing.
+func newFileStore(config internal.Config) (*storage.FileStore, error) {
+	backend, err := config.NewStorageBackend()
+	if err != nil {
+		return nil, err
+	}
+	if root, ok := storage.LocalRoot(backend); ok {
+		if err := os.MkdirAll(root, os.ModePerm); err != nil {
+			return nil, err
+		}
+	}
+	options, err := config.NewZstdOptions(backend)
+	if err != nil {
+		return nil, err
+	}
+	return storage.NewFileStoreWithOptions(backend, config.CompressionEnabled, options)
+}
@@ -0,0 +1,219 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/weiihann/state-expiry-indexer/internal"
+	"github.com/weiihann/state-expiry-indexer/internal/logger"
+	"github.com/weiihann/state-expiry-indexer/pkg/storage"
+	"github.com/weiihann/state-expiry-indexer/pkg/utils"
+)
+
+var (
+	trainDictSamples int
+	trainDictSize    int
+	trainDictDryRun  bool
+)
+
+// blockFilePattern matches per-block state diff files, compressed or not
+var blockFilePattern = regexp.MustCompile(`^(\d+)\.json(\.zst)?$`)
+
+var trainDictCmd = &cobra.Command{
+	Use:   "train-dict",
+	Short: "Train a zstd dictionary on the per-block state diff files of the data directory",
+	Long: `Train a zstd dictionary on a sample of the per-block state diff files in the data directory.
+
+Per-block files are small and repeat the same JSON keys and hot contract addresses, which zstd
+cannot exploit within a single file. A dictionary holds the content they share, so per-block
+files compress several times better. Samples are spread evenly over the stored blocks, every
+fifth sample is held out to measure the gain.
+
+The dictionary is stored in the data directory as zstd-{id}.dict. New per-block files are
+compressed with the newest dictionary unless COMPRESSION_DICTIONARY is false, and every stored
+dictionary stays loaded to read older files. Existing files are migrated with
+compress --all --recompress. Range files are not compressed with a dictionary.
+
+Examples:
+  # Train a dictionary on 1000 per-block files
+  state-expiry-indexer train-dict
+
+  # Measure the gain of a larger dictionary without storing it
+  state-expiry-indexer train-dict --samples 5000 --size 262144 --dry-run`,
+	Run: trainDict,
+}
+
+func trainDict(cmd *cobra.Command, args []string) {
+	log := logger.GetLogger("train-dict")
+
+	config, err := internal.LoadConfig("./configs")
+	if err != nil {
+		log.Error("Configuration validation failed", "error", err)
+		os.Exit(1)
+	}
+
+	backend, err := config.NewStorageBackend()
+	if err != nil {
+		log.Error("Failed to open data directory", "error", err)
+		os.Exit(1)
+	}
+	files, err := sampleBlockFiles(backend, trainDictSamples)
+	if err != nil {
+		log.Error("Failed to list per-block files", "error", err)
+		os.Exit(1)
+	}
+	if len(files) < 10 {
+		log.Error("Not enough per-block files to train a dictionary", "files", len(files), "data_dir", config.DataDir)
+		os.Exit(1)
+	}
+
+	// Compressed files may already use an older dictionary
+	dictionaries, err := storage.LoadDictionaries(backend)
+	if err != nil {
+		log.Error("Failed to load dictionaries", "error", err)
+		os.Exit(1)
+	}
+	decoder, err := utils.NewZstdDecoderWithOptions(utils.ZstdOptions{Dictionaries: dictionaries})
+	if err != nil {
+		log.Error("Failed to create zstd decoder", "error", err)
+		os.Exit(1)
+	}
+	defer decoder.Close()
+
+	log.Info("Reading samples", "data_dir", config.DataDir, "samples", len(files))
+	var training, heldOut [][]byte
+	for i, name := range files {
+		data, err := storage.ReadFile(backend, name)
+		if err == nil && strings.HasSuffix(name, ".zst") {
+			data, err = decoder.Decompress(data)
+		}
+		if err != nil {
+			log.Error("Failed to read sample", "file", backend.Location(name), "error", err)
+			os.Exit(1)
+		}
+		if i%5 == 4 {
+			heldOut = append(heldOut, data)
+		} else {
+			training = append(training, data)
+		}
+	}
+
+	id, err := storage.NextDictionaryID(backend)
+	if err != nil {
+		log.Error("Failed to choose dictionary ID", "error", err)
+		os.Exit(1)
+	}
+	log.Info("Training dictionary", "id", id, "size", trainDictSize, "level", config.CompressionLevel, "training_samples", len(training))
+	dictionary, err := utils.TrainZstdDictionary(training, id, trainDictSize, config.CompressionLevel)
+	if err != nil {
+		log.Error("Failed to train dictionary", "error", err)
+		os.Exit(1)
+	}
+
+	plainSize, dictionarySize, err := measureDictionary(heldOut, dictionary, config.CompressionLevel)
+	if err != nil {
+		log.Error("Failed to measure dictionary", "error", err)
+		os.Exit(1)
+	}
+	log.Info("Measured dictionary on held out samples",
+		"samples", len(heldOut),
+		"without_dictionary_bytes", plainSize,
+		"with_dictionary_bytes", dictionarySize,
+		"improvement", fmt.Sprintf("%.2fx", float64(plainSize)/float64(dictionarySize)))
+
+	if trainDictDryRun {
+		log.Info("DRY RUN - Dictionary not stored", "id", id)
+		return
+	}
+	location, err := storage.SaveDictionary(backend, dictionary)
+	if err != nil {
+		log.Error("Failed to store dictionary", "error", err)
+		os.Exit(1)
+	}
+	log.Info("Stored dictionary, run compress --all --recompress to migrate existing files", "id", id, "file", location)
+}
+
+// sampleBlockFiles returns up to count per-block files spread evenly over the stored blocks
+func sampleBlockFiles(backend storage.Backend, count int) ([]string, error) {
+	files, err := storage.ListBlockFiles(backend, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	type blockFile struct {
+		block uint64
+		name  string
+	}
+	var blockFiles []blockFile
+	for _, file := range files {
+		match := blockFilePattern.FindStringSubmatch(file.Name)
+		if match == nil || file.Size == 0 {
+			continue
+		}
+		block, err := strconv.ParseUint(match[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		blockFiles = append(blockFiles, blockFile{block: block, name: file.Name})
+	}
+	slices.SortFunc(blockFiles, func(a, b blockFile) int {
+		switch {
+		case a.block < b.block:
+			return -1
+		case a.block > b.block:
+			return 1
+		}
+		return strings.Compare(a.name, b.name)
+	})
+
+	count = min(count, len(blockFiles))
+	samples := make([]string, 0, count)
+	for i := range count {
+		samples = append(samples, blockFiles[i*len(blockFiles)/count].name)
+	}
+	return samples, nil
+}
+
+// measureDictionary returns the compressed size of samples without and with dictionary
+func measureDictionary(samples [][]byte, dictionary []byte, level int) (int, int, error) {
+	plain, err := utils.NewZstdEncoderWithOptions(utils.ZstdOptions{Level: level})
+	if err != nil {
+		return 0, 0, err
+	}
+	defer plain.Close()
+	withDictionary, err := utils.NewZstdEncoderWithOptions(utils.ZstdOptions{Level: level, Dictionary: dictionary})
+	if err != nil {
+		return 0, 0, err
+	}
+	defer withDictionary.Close()
+
+	var plainSize, dictionarySize int
+	for _, sample := range samples {
+		if len(sample) == 0 {
+			continue
+		}
+		compressed, err := plain.Compress(sample)
+		if err != nil {
+			return 0, 0, err
+		}
+		plainSize += len(compressed)
+		compressed, err = withDictionary.Compress(sample)
+		if err != nil {
+			return 0, 0, err
+		}
+		dictionarySize += len(compressed)
+	}
+	return plainSize, dictionarySize, nil
+}
+
+func init() {
+	trainDictCmd.Flags().IntVar(&trainDictSamples, "samples", 1000, "Number of per-block files to sample")
+	trainDictCmd.Flags().IntVar(&trainDictSize, "size", utils.DefaultZstdDictionarySize, "Maximum dictionary content size in bytes")
+	trainDictCmd.Flags().BoolVar(&trainDictDryRun, "dry-run", false, "Train and measure the dictionary without storing it")
+	rootCmd.AddCommand(trainDictCmd)
+}
@@ -1,24 +1,56 @@
 package cmd
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"log/slog"
 	"os"
-	"path/filepath"
 
 	"github.com/spf13/cobra"
 	"github.com/weiihann/state-expiry-indexer/internal"
 	"github.com/weiihann/state-expiry-indexer/internal/logger"
+	"github.com/weiihann/state-expiry-indexer/pkg/rpc"
+	"github.com/weiihann/state-expiry-indexer/pkg/storage"
 )
 
 var (
-	startBlock uint64
-	endBlock   uint64
+	startBlock   uint64
+	endBlock     uint64
+	verifyDeep   bool
+	verifyRepair bool
+	verifyGaps   bool
+	verifyReport string
 )
 
 var verifyCmd = &cobra.Command{
 	Use:   "verify",
 	Short: "Iterate through all the files in the data directory and verify that the sequence is correct",
-	Run:   verify,
+	Long: `Verify the range files in the data directory.
+
+By default every range file is checked against the manifest at its end, which catches truncated
+files without decompressing them. With --deep every range is decompressed and decoded, its blocks
+must be contiguous and build on each other, and the content hash must match the manifest.
+Range files written before manifests existed are only checked by --deep.
+
+With --repair corrupt ranges are deleted and downloaded again through RPC.
+
+With --gaps the data directory is scanned for blocks that no intact range file or readable per-block
+file holds instead: missing blocks, and blocks whose only file is empty or cannot be decoded. Blocks
+from --start-block to --end-block are scanned, by default up to the highest block stored, and the
+gaps found are written as JSON to --report. The command fails if gaps are found; backfill fills
+them.
+
+Examples:
+  # Check every range file against its manifest
+  state-expiry-indexer verify
+
+  # Decode every range file and download corrupt ones again
+  state-expiry-indexer verify --deep --repair
+
+  # List the gaps of a block span as JSON
+  state-expiry-indexer verify --gaps --start-block 1 --end-block 1000 --report gaps.json`,
+	Run: verify,
 }
 
 func verify(cmd *cobra.Command, args []string) {
@@ -33,29 +65,150 @@ func verify(cmd *cobra.Command, args []string) {
 
 	log.Info("Configuration loaded successfully", "data_dir", config.DataDir)
 
-	missingBlocks := []uint64{}
-	for i := startBlock; i <= endBlock; i++ {
-		filePath := filepath.Join(config.DataDir, fmt.Sprintf("%d.json", i))
-		compressedFilePath := filepath.Join(config.DataDir, fmt.Sprintf("%d.json.zst", i))
-		if _, err := os.Stat(filePath); os.IsNotExist(err) {
-			if _, err := os.Stat(compressedFilePath); os.IsNotExist(err) {
-				missingBlocks = append(missingBlocks, i)
-				log.Error("State diff not found", "block", i)
-			} else if err != nil {
-				log.Error("Failed to check state diff file", "error", err, "block", i)
-				os.Exit(1)
-			}
-		} else if err != nil {
-			log.Error("Failed to check state diff file", "error", err, "block", i)
+	ctx := context.Background()
+	if verifyGaps || cmd.Flags().Changed("start-block") || cmd.Flags().Changed("end-block") {
+		if !verifyBlocks(ctx, log, config, startBlock, endBlock) {
 			os.Exit(1)
 		}
+		return
+	}
+
+	var rpcClient rpc.ClientInterface
+	if verifyRepair {
+		client, closeRPC, err := newRPCClient(ctx, config)
+		if err != nil {
+			log.Error("Failed to create RPC client", "error", err, "rpc_urls", config.RPCURLS)
+			os.Exit(1)
+		}
+		defer func() {
+			if err := closeRPC(); err != nil {
+				log.Error("Failed to save RPC cassette", "error", err)
+			}
+		}()
+		rpcClient = client
+	}
+
+	rangeProcessor, err := newRangeProcessor(config, rpcClient)
+	if err != nil {
+		log.Error("Failed to create range processor", "error", err)
+		os.Exit(1)
 	}
+	defer rangeProcessor.Close()
+
+	if !verifyRanges(ctx, log, rangeProcessor) {
+		rangeProcessor.Close()
+		os.Exit(1)
+	}
+}
 
-	log.Info("Verification completed successfully", "missing_count", len(missingBlocks), "missing_blocks", missingBlocks)
+// verifyRanges checks every range file in the data directory and repairs corrupt ones when
+// --repair is set. It returns false if corrupt ranges remain.
+func verifyRanges(ctx context.Context, log *slog.Logger, rangeProcessor *storage.RangeProcessor) bool {
+	ranges, err := rangeProcessor.ListRanges()
+	if err != nil {
+		log.Error("Failed to list range files", "error", err)
+		return false
+	}
+
+	log.Info("Starting range verification",
+		"range_files", len(ranges),
+		"deep", verifyDeep,
+		"repair", verifyRepair)
+
+	var valid, legacy, repaired int
+	var corrupt []uint64
+	for _, rangeNumber := range ranges {
+		path := rangeProcessor.GetRangeFilePath(rangeNumber)
+
+		var err error
+		if verifyDeep {
+			_, err = rangeProcessor.VerifyRange(rangeNumber)
+		} else {
+			err = rangeProcessor.CheckRange(rangeNumber)
+		}
+		if err == nil {
+			if _, manifestErr := rangeProcessor.ReadManifest(rangeNumber); errors.Is(manifestErr, storage.ErrNoManifest) {
+				legacy++
+			}
+			valid++
+			continue
+		}
+
+		log.Error("Range file failed verification", "range_number", rangeNumber, "file", path, "error", err)
+		if !verifyRepair {
+			corrupt = append(corrupt, rangeNumber)
+			continue
+		}
+
+		if err := repairRange(ctx, rangeProcessor, rangeNumber); err != nil {
+			log.Error("Failed to repair range", "range_number", rangeNumber, "file", path, "error", err)
+			corrupt = append(corrupt, rangeNumber)
+			continue
+		}
+		log.Info("Repaired range", "range_number", rangeNumber, "file", path)
+		repaired++
+	}
+
+	log.Info("Range verification completed",
+		"valid", valid,
+		"without_manifest", legacy,
+		"repaired", repaired,
+		"corrupt_count", len(corrupt),
+		"corrupt_ranges", corrupt)
+
+	return len(corrupt) == 0
+}
+
+// repairRange deletes a corrupt range file and downloads the range again
+func repairRange(ctx context.Context, rangeProcessor *storage.RangeProcessor, rangeNumber uint64) error {
+	if err := rangeProcessor.DeleteRange(rangeNumber); err != nil {
+		return fmt.Errorf("failed to remove corrupt range file: %w", err)
+	}
+	if err := rangeProcessor.DownloadRange(ctx, rangeNumber); err != nil {
+		return err
+	}
+	_, err := rangeProcessor.VerifyRange(rangeNumber)
+	return err
+}
+
+// verifyBlocks scans the blocks from from to to, up to the highest block stored if to is 0, for
+// gaps. It returns false if gaps or damaged range files are found.
+func verifyBlocks(ctx context.Context, log *slog.Logger, config internal.Config, from, to uint64) bool {
+	rangeProcessor, err := newRangeProcessor(config, nil)
+	if err != nil {
+		log.Error("Failed to create range processor", "error", err)
+		return false
+	}
+	defer rangeProcessor.Close()
+
+	blockFiles, err := config.NewBlockFileSource(rangeProcessor, nil)
+	if err != nil {
+		log.Error("Failed to load compression dictionaries", "error", err)
+		return false
+	}
+
+	report, err := rangeProcessor.ScanGaps(ctx, blockFiles, from, to, verifyDeep)
+	if err != nil {
+		log.Error("Gap scan failed", "error", err)
+		return false
+	}
+	logGapReport(log, report)
+	if verifyReport != "" {
+		if err := writeGapReport(verifyReport, report); err != nil {
+			log.Error("Failed to write gap report", "error", err, "report", verifyReport)
+			return false
+		}
+	}
+	return len(report.Gaps) == 0 && len(report.DamagedRanges) == 0
 }
 
 func init() {
-	verifyCmd.Flags().Uint64Var(&startBlock, "start-block", 1, "Start block")
-	verifyCmd.Flags().Uint64Var(&endBlock, "end-block", 1, "End block")
+	verifyCmd.Flags().Uint64Var(&startBlock, "start-block", 1, "First block scanned for gaps")
+	verifyCmd.Flags().Uint64Var(&endBlock, "end-block", 0, "Last block scanned for gaps (defaults to the highest block stored)")
+	verifyCmd.Flags().BoolVar(&verifyDeep, "deep", false, "Decompress and decode every range file and check that its blocks are contiguous")
+	verifyCmd.Flags().BoolVar(&verifyRepair, "repair", false, "Delete corrupt range files and download them again through RPC")
+	verifyCmd.Flags().BoolVar(&verifyGaps, "gaps", false, "Scan per-block and range files for missing, empty and unparsable blocks")
+	verifyCmd.Flags().StringVar(&verifyReport, "report", "", "Write the gaps found by --gaps as JSON to this file")
+	addCassetteFlags(verifyCmd)
 	rootCmd.AddCommand(verifyCmd)
 }
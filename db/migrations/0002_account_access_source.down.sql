@@ -0,0 +1,2 @@
+-- Drop the access source of account accesses
+ALTER TABLE accounts_archive DROP COLUMN IF EXISTS access_source;
@@ -0,0 +1,4 @@
+-- Record what touched an account, so protocol touches outside of transactions can be told apart.
+-- Bit flags: 1 = transaction, 2 = beacon withdrawal, 4 = coinbase (fee recipient), 8 = system contract call.
+-- Rows indexed before this migration were all made by transactions.
+ALTER TABLE accounts_archive ADD COLUMN access_source UInt8 DEFAULT 1;
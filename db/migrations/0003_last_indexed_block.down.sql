@@ -0,0 +1,2 @@
+-- Drop the last block indexed on its own and its hash
+ALTER TABLE metadata_archive DELETE WHERE key IN ('last_indexed_block', 'last_indexed_block_hash');
@@ -0,0 +1,3 @@
+-- Track the last block indexed on its own and its hash. Once caught up, the blocks of the range that is not
+-- complete yet are indexed one at a time instead of waiting for the whole range.
+INSERT INTO metadata_archive (key, value) VALUES ('last_indexed_block', '0'), ('last_indexed_block_hash', '');
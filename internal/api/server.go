@@ -18,13 +18,13 @@ import (
 
 type Server struct {
 	repo      repository.StateRepositoryInterface
-	rpcClient *rpc.Client
+	rpcClient rpc.ClientInterface
 	rangeSize uint64
 	log       *slog.Logger
 	server    *http.Server
 }
 
-func NewServer(repo repository.StateRepositoryInterface, rpcClient *rpc.Client, rangeSize uint64) *Server {
+func NewServer(repo repository.StateRepositoryInterface, rpcClient rpc.ClientInterface, rangeSize uint64) *Server {
 	return &Server{
 		repo:      repo,
 		rpcClient: rpcClient,
@@ -42,6 +42,7 @@ func (s *Server) Run(ctx context.Context, host string, port int) error {
 
 	r.Route("/api/v1", func(r chi.Router) {
 		r.Get("/sync", s.handleGetSyncStatus)
+		r.Get("/rpc", s.handleGetRPCStats)
 
 		// Optimized analytics endpoints grouped by question categories
 		r.Route("/accounts", func(r chi.Router) {
@@ -167,12 +168,24 @@ func (s *Server) handleGetSyncStatus(w http.ResponseWriter, r *http.Request) {
 		"latest_block", latestBlock,
 		"latest_range", latestRange,
 		"last_indexed_range", syncStatus.LastIndexedRange,
+		"last_indexed_block", syncStatus.LastIndexedBlock,
 		"is_synced", syncStatus.IsSynced,
 		"end_block", syncStatus.EndBlock,
 		"remote_addr", r.RemoteAddr)
 	respondWithJSON(w, http.StatusOK, syncStatus)
 }
 
+// handleGetRPCStats returns per-endpoint health when the server is backed by an RPC pool
+func (s *Server) handleGetRPCStats(w http.ResponseWriter, r *http.Request) {
+	pool, ok := rpc.FindPool(s.rpcClient)
+	if !ok {
+		respondWithError(w, http.StatusNotFound, "RPC endpoint statistics are not available")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, pool.Stats())
+}
+
 // Advanced analytics handlers
 
 func (s *Server) handleGetExtendedAnalytics(w http.ResponseWriter, r *http.Request) {
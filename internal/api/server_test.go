@@ -10,6 +10,7 @@ import (
 	"net/http/httptest"
 	"testing"
 
+	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/go-chi/chi/v5"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -471,14 +472,46 @@ func (m *MockRPCWrapper) GetLatestBlockNumber(ctx context.Context) (*big.Int, er
 	return big.NewInt(1000), nil
 }
 
+func (m *MockRPCWrapper) GetBlockNumberByTag(ctx context.Context, tag rpc.BlockTag) (*big.Int, error) {
+	return big.NewInt(1000), nil
+}
+
 func (m *MockRPCWrapper) GetCode(ctx context.Context, address string, blockNumber *big.Int) (string, error) {
 	return "0x", nil
 }
 
+func (m *MockRPCWrapper) GetCodes(ctx context.Context, accounts map[string]uint64) (map[string]string, error) {
+	return rpc.FetchCodes(ctx, accounts, m.GetCode)
+}
+
 func (m *MockRPCWrapper) GetStateDiff(ctx context.Context, blockNumber *big.Int) ([]rpc.TransactionResult, error) {
 	return []rpc.TransactionResult{}, nil
 }
 
+func (m *MockRPCWrapper) GetPrestate(ctx context.Context, blockNumber *big.Int) ([]rpc.TransactionResult, error) {
+	return []rpc.TransactionResult{}, nil
+}
+
+func (m *MockRPCWrapper) GetStateDiffs(ctx context.Context, blocks []uint64) (map[uint64][]rpc.TransactionResult, error) {
+	return rpc.FetchEach(ctx, blocks, m.GetStateDiff)
+}
+
+func (m *MockRPCWrapper) GetPrestates(ctx context.Context, blocks []uint64) (map[uint64][]rpc.TransactionResult, error) {
+	return rpc.FetchEach(ctx, blocks, m.GetPrestate)
+}
+
+func (m *MockRPCWrapper) GetBlockHeaders(ctx context.Context, blocks []uint64) (map[uint64]*rpc.Head, error) {
+	headers := make(map[uint64]*rpc.Head, len(blocks))
+	for _, block := range blocks {
+		headers[block] = &rpc.Head{
+			Number:     hexutil.Uint64(block),
+			Hash:       fmt.Sprintf("0x%064x", block),
+			ParentHash: fmt.Sprintf("0x%064x", block-1),
+		}
+	}
+	return headers, nil
+}
+
 // FailingRPCWrapper provides an RPC client that always fails
 type FailingRPCWrapper struct{}
 
@@ -486,14 +519,38 @@ func (f *FailingRPCWrapper) GetLatestBlockNumber(ctx context.Context) (*big.Int,
 	return nil, fmt.Errorf("RPC client failure")
 }
 
+func (f *FailingRPCWrapper) GetBlockNumberByTag(ctx context.Context, tag rpc.BlockTag) (*big.Int, error) {
+	return nil, fmt.Errorf("RPC client failure")
+}
+
 func (f *FailingRPCWrapper) GetCode(ctx context.Context, address string, blockNumber *big.Int) (string, error) {
 	return "", fmt.Errorf("RPC client failure")
 }
 
+func (f *FailingRPCWrapper) GetCodes(ctx context.Context, accounts map[string]uint64) (map[string]string, error) {
+	return nil, fmt.Errorf("RPC client failure")
+}
+
 func (f *FailingRPCWrapper) GetStateDiff(ctx context.Context, blockNumber *big.Int) ([]rpc.TransactionResult, error) {
 	return nil, fmt.Errorf("RPC client failure")
 }
 
+func (f *FailingRPCWrapper) GetPrestate(ctx context.Context, blockNumber *big.Int) ([]rpc.TransactionResult, error) {
+	return nil, fmt.Errorf("RPC client failure")
+}
+
+func (f *FailingRPCWrapper) GetStateDiffs(ctx context.Context, blocks []uint64) (map[uint64][]rpc.TransactionResult, error) {
+	return rpc.FetchEach(ctx, blocks, f.GetStateDiff)
+}
+
+func (f *FailingRPCWrapper) GetPrestates(ctx context.Context, blocks []uint64) (map[uint64][]rpc.TransactionResult, error) {
+	return rpc.FetchEach(ctx, blocks, f.GetPrestate)
+}
+
+func (f *FailingRPCWrapper) GetBlockHeaders(ctx context.Context, blocks []uint64) (map[uint64]*rpc.Head, error) {
+	return nil, fmt.Errorf("RPC client failure")
+}
+
 // createTestRouter creates a test router for the server
 func createTestRouter(server *TestServer) http.Handler {
 	r := chi.NewRouter()
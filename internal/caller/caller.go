@@ -3,11 +3,13 @@ package caller
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"iter"
 	"log/slog"
 	"math/big"
-	"os"
-	"path/filepath"
+	"slices"
+	"sync"
 	"time"
 
 	"github.com/weiihann/state-expiry-indexer/internal"
@@ -15,40 +17,66 @@ import (
 	"github.com/weiihann/state-expiry-indexer/pkg/rpc"
 	"github.com/weiihann/state-expiry-indexer/pkg/storage"
 	"github.com/weiihann/state-expiry-indexer/pkg/tracker"
+	"github.com/weiihann/state-expiry-indexer/pkg/utils"
 )
 
 const (
-	FinalizedBlockOffset = 64
-	rpcTimeout           = 1 * time.Minute
+	rpcTimeout = 1 * time.Minute
 )
 
 // Service handles RPC calls and file storage for state diffs
 type Service struct {
-	client          []*rpc.Client
+	client          rpc.ClientInterface
 	fileStore       *storage.FileStore
 	downloadTracker *tracker.DownloadTracker
+	finality        *rpc.Finality
 	config          internal.Config
+	workers         int
 	log             *slog.Logger
 }
 
-func NewService(client []*rpc.Client, fileStore *storage.FileStore, config internal.Config) *Service {
-	log := logger.GetLogger("rpc-caller")
+// NewService returns the RPC caller saving state diffs to fileStore. An error is returned if the
+// configured finality is invalid.
+func NewService(client rpc.ClientInterface, fileStore *storage.FileStore, config internal.Config) (*Service, error) {
+	finality, err := config.NewFinality()
+	if err != nil {
+		return nil, fmt.Errorf("invalid finality: %w", err)
+	}
+
 	return &Service{
 		client:          client,
 		fileStore:       fileStore,
-		downloadTracker: tracker.NewDownloadTracker(config.DataDir),
+		downloadTracker: tracker.NewDownloadTracker(fileStore.Backend()),
+		finality:        finality,
 		config:          config,
-		log:             log,
-	}
+		workers:         max(config.DownloadWorkers, 1),
+		log:             logger.GetLogger("rpc-caller"),
+	}, nil
+}
+
+// SetWorkers sets how many blocks are downloaded in parallel. Calls are spread across the
+// endpoints of the RPC pool, which also caps how many reach a single endpoint.
+func (s *Service) SetWorkers(workers int) {
+	s.workers = max(workers, 1)
 }
 
 // Run starts the RPC caller workflow that downloads and saves state diffs
 func (s *Service) Run(ctx context.Context) error {
 	s.log.Info("Starting RPC caller workflow",
 		"poll_interval", s.config.PollInterval,
-		"finalized_block_offset", FinalizedBlockOffset)
+		"workers", s.workers,
+		"finality", s.finality)
+
+	if err := s.recover(); err != nil {
+		return err
+	}
 
 	pollInterval := time.Duration(s.config.PollInterval) * time.Second
+
+	// New heads pushed over WebSocket or IPC wake the loop up before the poll interval elapses
+	heads := rpc.NewHeadWatcher(s.client)
+	heads.Start(ctx)
+
 	for {
 		select {
 		case <-ctx.Done():
@@ -58,35 +86,98 @@ func (s *Service) Run(ctx context.Context) error {
 		}
 
 		// Run download logic
+		wait := pollInterval
 		if err := s.downloadNewBlocks(ctx); err != nil {
+			// Retrying cannot fix a permanent RPC error such as pruned history or a missing trace API
+			var permanentErr *rpc.PermanentError
+			if errors.As(err, &permanentErr) {
+				s.log.Error("Download cycle failed with a permanent RPC error, stopping", "error", err)
+				return err
+			}
+
+			// Rate limited endpoints tell us how long to back off
+			wait = rpc.RetryDelay(err, pollInterval)
 			s.log.Warn("Download cycle failed, will retry...",
 				"error", err,
-				"retry_interval", pollInterval)
+				"error_class", rpc.ClassOf(err),
+				"retry_interval", wait)
 		}
 
-		// Wait for next poll or cancellation
-		select {
-		case <-ctx.Done():
+		// Wait for the next head or poll, unless an endpoint asked us to back off for longer
+		if wait > pollInterval {
+			select {
+			case <-ctx.Done():
+			case <-time.After(wait):
+			}
+		} else {
+			heads.Wait(ctx, wait)
+		}
+		if ctx.Err() != nil {
 			s.log.Info("RPC caller workflow stopped")
 			return nil
-		case <-time.After(pollInterval):
 		}
 	}
 }
 
-// downloadNewBlocks downloads state diffs for new blocks
-func (s *Service) downloadNewBlocks(ctx context.Context) error {
+// recover cleans up after a crash: it removes the temp files of interrupted writes and moves
+// the download tracker back if it points past the blocks that were actually saved
+func (s *Service) recover() error {
+	// Object stores replace objects atomically and leave no temp files behind
+	if root, ok := storage.LocalRoot(s.fileStore.Backend()); ok {
+		removed, err := utils.RemoveTempFiles(root, utils.StaleTempFileAge)
+		if err != nil {
+			return fmt.Errorf("could not remove temp files: %w", err)
+		}
+		if len(removed) > 0 {
+			s.log.Warn("Removed temp files of interrupted writes", "files", removed)
+		}
+	}
+
 	lastDownloadedBlock, err := s.downloadTracker.GetLastDownloadedBlock()
 	if err != nil {
 		return fmt.Errorf("could not get last downloaded block: %w", err)
 	}
+	lastSavedBlock, err := s.downloadTracker.Reconcile(s.saved)
+	if err != nil {
+		return fmt.Errorf("could not check download tracker: %w", err)
+	}
+	if lastSavedBlock != lastDownloadedBlock {
+		s.log.Warn("Download tracker pointed past the saved blocks, moved it back",
+			"last_downloaded_block", lastDownloadedBlock,
+			"last_saved_block", lastSavedBlock)
+	}
+	return nil
+}
+
+// saved reports whether a block was saved, in its own file or in the range file holding it
+func (s *Service) saved(blockNumber uint64) bool {
+	if s.fileStore.Exists(fmt.Sprintf("%d.json", blockNumber)) {
+		return true
+	}
+	if blockNumber == 0 || s.config.RangeSize <= 0 {
+		return false
+	}
+	rangeSize := uint64(s.config.RangeSize)
+	start := (blockNumber-1)/rangeSize*rangeSize + 1
+	return s.fileStore.Exists(fmt.Sprintf("%d_%d.json", start, start+rangeSize-1))
+}
 
-	latestBlock, err := s.client[0].GetLatestBlockNumber(ctx)
+// downloadNewBlocks downloads state diffs for new blocks. Blocks completed out of order before
+// a restart are not downloaded again.
+func (s *Service) downloadNewBlocks(ctx context.Context) error {
+	lastDownloadedBlock, err := s.downloadTracker.GetLastDownloadedBlock()
+	if err != nil {
+		return fmt.Errorf("could not get last downloaded block: %w", err)
+	}
+	completed, err := s.downloadTracker.GetCompletedBlocks()
 	if err != nil {
-		return fmt.Errorf("could not get latest block number: %w", err)
+		return fmt.Errorf("could not get completed blocks: %w", err)
 	}
 
-	finalizedBlock := latestBlock.Uint64() - FinalizedBlockOffset
+	finalizedBlock, err := s.finality.Head(ctx, s.client)
+	if err != nil {
+		return fmt.Errorf("could not get finalized block number: %w", err)
+	}
 
 	if lastDownloadedBlock >= finalizedBlock {
 		s.log.Debug("Caught up to finalized block, waiting for new blocks...",
@@ -98,45 +189,38 @@ func (s *Service) downloadNewBlocks(ctx context.Context) error {
 	s.log.Info("Downloading block range",
 		"from_block", lastDownloadedBlock+1,
 		"to_block", finalizedBlock,
-		"total_blocks", finalizedBlock-lastDownloadedBlock)
-
-	lastProgressTime := time.Now()
-	lastProgressBlock := lastDownloadedBlock
-
-	for i := lastDownloadedBlock + 1; i <= finalizedBlock; i++ {
-		select {
-		case <-ctx.Done():
-			return nil
-		default:
-		}
-
-		if err := s.downloadBlock(ctx, i); err != nil {
-			return fmt.Errorf("failed to download block %d: %w", i, err)
-		}
+		"total_blocks", finalizedBlock-lastDownloadedBlock,
+		"already_completed", len(completed),
+		"workers", s.workers)
 
-		// Update progress tracker
-		if err := s.downloadTracker.SetLastDownloadedBlock(i); err != nil {
-			s.log.Error("Could not update last downloaded block",
-				"block_number", i,
-				"error", err)
+	skip := make(map[uint64]bool, len(completed))
+	for _, block := range completed {
+		skip[block] = true
+	}
+	blocks := func(yield func(uint64) bool) {
+		for i := lastDownloadedBlock + 1; i <= finalizedBlock; i++ {
+			if !skip[i] && !yield(i) {
+				return
+			}
 		}
+	}
 
-		// Show simple progress every 1000 blocks or 8 seconds
+	// Show simple progress every 1000 blocks or 8 seconds
+	lastProgressTime := time.Now()
+	lastProgressBlock := lastDownloadedBlock
+	err = s.downloadBlocks(ctx, blocks, func(_, lowWaterMark uint64) {
 		now := time.Now()
-		blocksSinceProgress := i - lastProgressBlock
-		timeSinceProgress := now.Sub(lastProgressTime).Seconds()
-
-		if blocksSinceProgress >= 1000 || timeSinceProgress >= 8 {
+		if lowWaterMark > lastProgressBlock && (lowWaterMark-lastProgressBlock >= 1000 || now.Sub(lastProgressTime).Seconds() >= 8) {
 			s.log.Info("Download progress",
-				"current_block", i,
+				"current_block", lowWaterMark,
 				"target_block", finalizedBlock,
-				"remaining", finalizedBlock-i)
+				"remaining", finalizedBlock-lowWaterMark)
 			lastProgressTime = now
-			lastProgressBlock = i
+			lastProgressBlock = lowWaterMark
 		}
-
-		s.log.Debug("Successfully downloaded block",
-			"block_number", i)
+	})
+	if err != nil || ctx.Err() != nil {
+		return err
 	}
 
 	s.log.Info("Completed block range download",
@@ -147,41 +231,106 @@ func (s *Service) downloadNewBlocks(ctx context.Context) error {
 	return nil
 }
 
-// downloadBlock downloads and saves state diff for a single block
-func (s *Service) downloadBlock(ctx context.Context, blockNumber uint64) error {
-	blockNum := big.NewInt(int64(blockNumber))
+// DownloadBlocks downloads the state diffs of the given blocks with the configured number of
+// workers, such as blocks found missing by a gap scan. Blocks whose file exists are skipped, so
+// damaged files must be deleted first. downloaded, if not nil, is called after every block.
+func (s *Service) DownloadBlocks(ctx context.Context, blocks []uint64, downloaded func(blockNumber uint64)) error {
+	return s.downloadBlocks(ctx, slices.Values(blocks), func(blockNumber, _ uint64) {
+		if downloaded != nil {
+			downloaded(blockNumber)
+		}
+	})
+}
 
-	// Check if block is already downloaded
-	filename := fmt.Sprintf("%d.json", blockNumber)
-	filePath := filepath.Join(s.config.DataDir, filename)
-	compressedFilePath := filepath.Join(s.config.DataDir, filename+".zst")
+// downloadBlocks hands blocks out in order to a bounded pool of workers and records them with
+// the tracker as they complete, in any order. done is called one block at a time with the
+// downloaded block and the low-water mark of the tracker. The first failure, including a
+// failure to record a block, cancels the downloads still in flight and the failure of the
+// lowest block is returned. The tracker is flushed before returning. Only a failure to flush it
+// is returned if ctx is cancelled.
+func (s *Service) downloadBlocks(ctx context.Context, blocks iter.Seq[uint64], done func(blockNumber, lowWaterMark uint64)) error {
+	downloadCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var failedBlock uint64
+	var failure error
+	fail := func(blockNumber uint64, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		// Report the failure of the lowest block, not the cancellations it caused
+		if !errors.Is(err, context.Canceled) && (failure == nil || blockNumber < failedBlock) {
+			failedBlock = blockNumber
+			failure = err
+		}
+		cancel()
+	}
 
-	// Check for existing files - either uncompressed or compressed
-	if _, err := os.Stat(filePath); err == nil {
-		s.log.Debug("Block already downloaded (uncompressed), skipping...",
-			"block_number", blockNumber)
-		return nil
+	sem := make(chan struct{}, s.workers)
+	for blockNumber := range blocks {
+		select {
+		case <-downloadCtx.Done():
+		case sem <- struct{}{}:
+		}
+		if downloadCtx.Err() != nil {
+			break
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			if err := s.downloadBlock(downloadCtx, blockNumber); err != nil {
+				fail(blockNumber, err)
+				return
+			}
+
+			// Update progress tracker
+			lowWaterMark, err := s.downloadTracker.MarkDownloaded(blockNumber)
+			if err != nil {
+				fail(blockNumber, fmt.Errorf("could not update download tracker: %w", err))
+				return
+			}
+			s.log.Debug("Successfully downloaded block",
+				"block_number", blockNumber)
+
+			mu.Lock()
+			defer mu.Unlock()
+			done(blockNumber, lowWaterMark)
+		}()
 	}
-	if _, err := os.Stat(compressedFilePath); err == nil {
-		s.log.Debug("Block already downloaded (compressed), skipping...",
-			"block_number", blockNumber)
+	wg.Wait()
+
+	if err := s.downloadTracker.Flush(); err != nil {
+		return fmt.Errorf("could not update download tracker: %w", err)
+	}
+	if ctx.Err() != nil {
 		return nil
 	}
+	if failure != nil {
+		return fmt.Errorf("failed to download block %d: %w", failedBlock, failure)
+	}
+	return nil
+}
 
-	// Download state diff from RPC with per-call timeout
-	var err error
-	var stateDiff []rpc.TransactionResult
-	for _, client := range s.client {
-		// Create a fresh timeout context for each RPC call
-		timeoutCtx, cancel := context.WithTimeout(ctx, rpcTimeout)
-		stateDiff, err = client.GetStateDiff(timeoutCtx, blockNum)
-		cancel() // Always cancel to release resources
+// downloadBlock downloads and saves state diff for a single block
+func (s *Service) downloadBlock(ctx context.Context, blockNumber uint64) error {
+	blockNum := big.NewInt(int64(blockNumber))
 
-		if err == nil {
-			break
-		}
+	// Check for existing files - either uncompressed or compressed, wherever DATA_LAYOUT places them
+	filename := fmt.Sprintf("%d.json", blockNumber)
+	if s.fileStore.Exists(filename) {
+		s.log.Debug("Block already downloaded, skipping...",
+			"block_number", blockNumber)
+		return nil
 	}
 
+	// Download state diff from RPC with per-call timeout, the client fails over between endpoints
+	timeoutCtx, cancel := context.WithTimeout(ctx, rpcTimeout)
+	stateDiff, err := rpc.GetBlockAccesses(timeoutCtx, s.client, rpc.AccessMode(s.config.AccessMode), blockNum)
+	cancel()
 	if err != nil {
 		return fmt.Errorf("could not get state diff: %w", err)
 	}
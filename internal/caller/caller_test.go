@@ -0,0 +1,226 @@
+package caller
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/weiihann/state-expiry-indexer/internal"
+	"github.com/weiihann/state-expiry-indexer/pkg/rpc"
+	"github.com/weiihann/state-expiry-indexer/pkg/rpc/rpctest"
+	"github.com/weiihann/state-expiry-indexer/pkg/storage"
+	"github.com/weiihann/state-expiry-indexer/pkg/tracker"
+	"github.com/weiihann/state-expiry-indexer/pkg/utils"
+)
+
+// countingClient tracks the state diff calls in flight and can hold blocks back until released
+type countingClient struct {
+	rpc.ClientInterface
+
+	calls       atomic.Int64
+	inFlight    atomic.Int64
+	maxInFlight atomic.Int64
+	hold        map[uint64]chan struct{}
+}
+
+func (c *countingClient) GetStateDiff(ctx context.Context, blockNumber *big.Int) ([]rpc.TransactionResult, error) {
+	c.calls.Add(1)
+	inFlight := c.inFlight.Add(1)
+	defer c.inFlight.Add(-1)
+	for {
+		current := c.maxInFlight.Load()
+		if inFlight <= current || c.maxInFlight.CompareAndSwap(current, inFlight) {
+			break
+		}
+	}
+
+	if release, ok := c.hold[blockNumber.Uint64()]; ok {
+		select {
+		case <-release:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return c.ClientInterface.GetStateDiff(ctx, blockNumber)
+}
+
+// newTestService returns a caller downloading blocks 1 to latest from an rpctest server into a
+// temp dir
+func newTestService(t *testing.T, latest uint64, options rpctest.Options) (*Service, *countingClient, string) {
+	t.Helper()
+
+	blocks := make(map[uint64][]rpc.TransactionResult, latest)
+	for block := uint64(1); block <= latest; block++ {
+		blocks[block] = []rpc.TransactionResult{}
+	}
+	server, err := rpctest.NewServer(rpctest.NewMemorySource(blocks), options)
+	require.NoError(t, err)
+	httpServer := httptest.NewServer(server)
+	t.Cleanup(func() {
+		httpServer.Close()
+		server.Stop()
+	})
+	inner, err := rpc.NewClient(t.Context(), httpServer.URL)
+	require.NoError(t, err)
+	client := &countingClient{ClientInterface: inner, hold: make(map[uint64]chan struct{})}
+
+	dir := t.TempDir()
+	fileStore, err := storage.NewFileStoreWithBackend(storage.NewLocalBackend(dir), false)
+	require.NoError(t, err)
+	t.Cleanup(func() { fileStore.Close() })
+
+	service, err := NewService(client, fileStore, internal.Config{
+		Finality:        "latest",
+		AccessMode:      string(rpc.AccessModeStateDiff),
+		RangeSize:       100,
+		DownloadWorkers: 4,
+	})
+	require.NoError(t, err)
+	return service, client, dir
+}
+
+// storedTracker reads the download tracker written to dir
+func storedTracker(t *testing.T, dir string) (uint64, []uint64) {
+	t.Helper()
+	downloadTracker := tracker.NewDownloadTracker(storage.NewLocalBackend(dir))
+	last, err := downloadTracker.GetLastDownloadedBlock()
+	require.NoError(t, err)
+	completed, err := downloadTracker.GetCompletedBlocks()
+	require.NoError(t, err)
+	return last, completed
+}
+
+func TestDownloadBlocks(t *testing.T) {
+	t.Run("workers cap the downloads in flight", func(t *testing.T) {
+		service, client, dir := newTestService(t, 40, rpctest.Options{Latency: 5 * time.Millisecond})
+
+		err := service.downloadBlocks(t.Context(), slices.Values(blockNumbers(1, 40)), func(_, _ uint64) {})
+		require.NoError(t, err)
+		assert.EqualValues(t, 40, client.calls.Load())
+		assert.LessOrEqual(t, client.maxInFlight.Load(), int64(4))
+		assert.Greater(t, client.maxInFlight.Load(), int64(1), "blocks are downloaded in parallel")
+		for block := uint64(1); block <= 40; block++ {
+			assert.FileExists(t, filepath.Join(dir, fmt.Sprintf("%d.json", block)))
+		}
+
+		last, completed := storedTracker(t, dir)
+		assert.Equal(t, uint64(40), last, "the tracker is flushed before returning")
+		assert.Empty(t, completed)
+	})
+
+	t.Run("the first failure cancels the downloads in flight", func(t *testing.T) {
+		service, client, dir := newTestService(t, 200, rpctest.Options{
+			Latency:    5 * time.Millisecond,
+			FailBlocks: map[uint64]bool{5: true},
+		})
+
+		err := service.downloadBlocks(t.Context(), slices.Values(blockNumbers(1, 200)), func(_, _ uint64) {})
+		require.Error(t, err)
+		assert.ErrorContains(t, err, "failed to download block 5")
+		assert.Equal(t, rpc.ErrorClassPermanent, rpc.ClassOf(err))
+		assert.Less(t, client.calls.Load(), int64(200), "no blocks are handed out after the failure")
+		assert.NoFileExists(t, filepath.Join(dir, "5.json"))
+
+		last, _ := storedTracker(t, dir)
+		assert.Less(t, last, uint64(5), "the tracker never passes the failed block")
+	})
+
+	t.Run("blocks completed out of order are recorded", func(t *testing.T) {
+		service, client, dir := newTestService(t, 4, rpctest.Options{})
+		release := make(chan struct{})
+		client.hold[1] = release
+
+		// Block 1 is held back until every other block is done
+		var marks [][2]uint64
+		err := service.downloadBlocks(t.Context(), slices.Values(blockNumbers(1, 4)), func(block, lowWaterMark uint64) {
+			marks = append(marks, [2]uint64{block, lowWaterMark})
+			if len(marks) == 3 {
+				completed, err := service.downloadTracker.GetCompletedBlocks()
+				assert.NoError(t, err)
+				assert.Equal(t, []uint64{2, 3, 4}, completed)
+				close(release)
+			}
+		})
+		require.NoError(t, err)
+
+		require.Len(t, marks, 4)
+		for _, mark := range marks[:3] {
+			assert.Zero(t, mark[1], "block %d does not move the low-water mark past block 1", mark[0])
+		}
+		assert.Equal(t, [2]uint64{1, 4}, marks[3])
+		last, completed := storedTracker(t, dir)
+		assert.Equal(t, uint64(4), last)
+		assert.Empty(t, completed)
+	})
+
+	t.Run("cancelling stops without an error", func(t *testing.T) {
+		service, client, _ := newTestService(t, 4, rpctest.Options{})
+		client.hold[2] = make(chan struct{})
+
+		ctx, cancel := context.WithCancel(t.Context())
+		var once sync.Once
+		err := service.downloadBlocks(ctx, slices.Values(blockNumbers(1, 4)), func(_, _ uint64) {
+			once.Do(cancel)
+		})
+		assert.NoError(t, err)
+	})
+}
+
+func TestService_DownloadBlocks(t *testing.T) {
+	service, client, dir := newTestService(t, 10, rpctest.Options{})
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "7.json"), []byte("[]"), 0o644))
+
+	var downloaded []uint64
+	err := service.DownloadBlocks(t.Context(), []uint64{2, 7, 9}, func(block uint64) {
+		downloaded = append(downloaded, block)
+	})
+	require.NoError(t, err)
+	slices.Sort(downloaded)
+	assert.Equal(t, []uint64{2, 7, 9}, downloaded)
+	assert.EqualValues(t, 2, client.calls.Load(), "blocks whose file exists are not downloaded again")
+	assert.FileExists(t, filepath.Join(dir, "2.json"))
+	assert.FileExists(t, filepath.Join(dir, "9.json"))
+}
+
+func TestService_Recover(t *testing.T) {
+	service, _, dir := newTestService(t, 10, rpctest.Options{})
+	for block := 1; block <= 3; block++ {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, fmt.Sprintf("%d.json", block)), []byte("[]"), 0o644))
+	}
+
+	// The tracker was written before a crash lost blocks 4 and 5
+	require.NoError(t, service.downloadTracker.SetLastDownloadedBlock(5))
+	stale := filepath.Join(dir, "4.json.123"+utils.TempFileSuffix)
+	inProgress := filepath.Join(dir, "6.json.456"+utils.TempFileSuffix)
+	require.NoError(t, os.WriteFile(stale, []byte("partial"), 0o644))
+	require.NoError(t, os.WriteFile(inProgress, []byte("partial"), 0o644))
+	old := time.Now().Add(-2 * utils.StaleTempFileAge)
+	require.NoError(t, os.Chtimes(stale, old, old))
+
+	require.NoError(t, service.recover())
+	assert.NoFileExists(t, stale)
+	assert.FileExists(t, inProgress, "temp files of writes in progress are kept")
+	last, err := service.GetLastDownloadedBlock()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), last)
+	stored, _ := storedTracker(t, dir)
+	assert.Equal(t, uint64(3), stored)
+}
+
+func blockNumbers(from, to uint64) []uint64 {
+	blocks := make([]uint64, 0, to-from+1)
+	for block := from; block <= to; block++ {
+		blocks = append(blocks, block)
+	}
+	return blocks
+}
@@ -8,6 +8,8 @@ import (
 	"strings"
 
 	"github.com/spf13/viper"
+	"github.com/weiihann/state-expiry-indexer/pkg/rpc"
+	"github.com/weiihann/state-expiry-indexer/pkg/utils"
 )
 
 // TODO:
@@ -25,6 +27,11 @@ type Config struct {
 	RPCURLS    []string `mapstructure:"RPC_URLS"`
 	RPCTimeout int      `mapstructure:"RPC_TIMEOUT_SECONDS"`
 
+	// RPC retry configuration: failed calls are retried with jittered exponential
+	// backoff until RPC_MAX_RETRIES or RPC_RETRY_BUDGET_SECONDS is exhausted
+	RPCMaxRetries         int `mapstructure:"RPC_MAX_RETRIES"`
+	RPCRetryBudgetSeconds int `mapstructure:"RPC_RETRY_BUDGET_SECONDS"`
+
 	// API Server configuration
 	APIPort int    `mapstructure:"API_PORT"`
 	APIHost string `mapstructure:"API_HOST"`
@@ -33,13 +40,48 @@ type Config struct {
 	PrometheusHost string `mapstructure:"PROMETHEUS_HOST"`
 	PrometheusPort int    `mapstructure:"PROMETHEUS_PORT"`
 
-	// File storage configuration
+	// File storage configuration. DATA_DIR is a local path, or s3://bucket/prefix to store
+	// files in an S3 compatible object store reached through S3_ENDPOINT.
 	DataDir string `mapstructure:"DATA_DIR"`
+	// DataLayout places per-block and range files in DATA_DIR: "flat" stores every file in
+	// the root, "sharded" in directories by the million and thousand of their first block,
+	// with range files under ranges/
+	DataLayout string `mapstructure:"DATA_LAYOUT"`
+
+	// S3 configuration, used when DATA_DIR is an s3:// URL. Requests are anonymous when no
+	// access key is set.
+	S3Endpoint        string `mapstructure:"S3_ENDPOINT"`
+	S3Region          string `mapstructure:"S3_REGION"`
+	S3AccessKeyID     string `mapstructure:"S3_ACCESS_KEY_ID"`
+	S3SecretAccessKey string `mapstructure:"S3_SECRET_ACCESS_KEY"`
 
 	// Indexer configuration
-	BlockBatchSize int `mapstructure:"BLOCK_BATCH_SIZE"`
-	PollInterval   int `mapstructure:"POLL_INTERVAL_SECONDS"`
-	RangeSize      int `mapstructure:"RANGE_SIZE"`
+	BlockBatchSize      int `mapstructure:"BLOCK_BATCH_SIZE"`
+	RPCBatchConcurrency int `mapstructure:"RPC_BATCH_CONCURRENCY"`
+	PollInterval        int `mapstructure:"POLL_INTERVAL_SECONDS"`
+	RangeSize           int `mapstructure:"RANGE_SIZE"`
+
+	// Finality selects the highest block downloaded and indexed: "finalized" or "safe" follow
+	// the block tags of the node, "latest-N" stays N blocks below the latest block. Nodes without
+	// the tags fall back to FINALITY_FALLBACK_OFFSET blocks below the latest block.
+	Finality               string `mapstructure:"FINALITY"`
+	FinalityFallbackOffset int    `mapstructure:"FINALITY_FALLBACK_OFFSET"`
+
+	// Range downloads are split in chunks fetched by DOWNLOAD_WORKERS workers, the download
+	// command fetches that many blocks at once, and no RPC endpoint gets more than
+	// RPC_MAX_IN_FLIGHT calls at once (0: no limit)
+	DownloadWorkers int `mapstructure:"DOWNLOAD_WORKERS"`
+	RPCMaxInFlight  int `mapstructure:"RPC_MAX_IN_FLIGHT"`
+
+	// RangeSources lists where ranges that are not stored yet are taken from, in order:
+	// "blocks" (per-block state diff files in DATA_DIR), "mirror" (another indexer serving
+	// range files at MIRROR_URL) and "rpc"
+	RangeSources []string `mapstructure:"RANGE_SOURCES"`
+	MirrorURL    string   `mapstructure:"MIRROR_URL"`
+
+	// AccessMode selects how state accesses are collected: "statediff" records only
+	// modified state, "prestate" also records read-only accesses
+	AccessMode string `mapstructure:"ACCESS_MODE"`
 
 	// Logging configuration
 	LogLevel  string `mapstructure:"LOG_LEVEL"`
@@ -51,6 +93,10 @@ type Config struct {
 
 	// Compression configuration
 	CompressionEnabled bool `mapstructure:"COMPRESSION_ENABLED"`
+	// CompressionLevel is the zstd level files are compressed with, 0 for the default level
+	CompressionLevel int `mapstructure:"COMPRESSION_LEVEL"`
+	// CompressionDictionary compresses per-block files with the newest dictionary trained by train-dict
+	CompressionDictionary bool `mapstructure:"COMPRESSION_DICTIONARY"`
 }
 
 // ValidationError represents configuration validation errors
@@ -100,11 +146,19 @@ func LoadConfig(path string) (config Config, err error) {
 		return config, fmt.Errorf("error unmarshaling config: %w", err)
 	}
 
+	// Range sources may be listed with spaces, as in "blocks, rpc"
+	for i, source := range config.RangeSources {
+		config.RangeSources[i] = strings.ToLower(strings.TrimSpace(source))
+	}
+	config.DataLayout = strings.ToLower(strings.TrimSpace(config.DataLayout))
+
 	// Validate configuration
 	if err := validateConfig(config); err != nil {
 		return config, err
 	}
 
+	config.AccessMode = strings.ToLower(config.AccessMode)
+
 	// Expand data directory paths
 	config.DataDir = expandPath(config.DataDir)
 	if config.LogFile != "" {
@@ -137,6 +191,8 @@ func setDefaults() {
 	// RPC defaults
 	viper.SetDefault("RPC_URL", "")
 	viper.SetDefault("RPC_TIMEOUT_SECONDS", 30)
+	viper.SetDefault("RPC_MAX_RETRIES", 4)
+	viper.SetDefault("RPC_RETRY_BUDGET_SECONDS", 120)
 
 	// API Server defaults
 	viper.SetDefault("API_PORT", 8080)
@@ -148,12 +204,25 @@ func setDefaults() {
 
 	// File storage defaults
 	viper.SetDefault("DATA_DIR", "data")
+	viper.SetDefault("DATA_LAYOUT", "flat")
 	viper.SetDefault("STATE_DIFF_DIR", "data/statediffs")
+	viper.SetDefault("S3_ENDPOINT", "")
+	viper.SetDefault("S3_REGION", "us-east-1")
+	viper.SetDefault("S3_ACCESS_KEY_ID", "")
+	viper.SetDefault("S3_SECRET_ACCESS_KEY", "")
 
 	// Indexer defaults
 	viper.SetDefault("BLOCK_BATCH_SIZE", 100)
+	viper.SetDefault("RPC_BATCH_CONCURRENCY", 4)
+	viper.SetDefault("DOWNLOAD_WORKERS", 4)
+	viper.SetDefault("RPC_MAX_IN_FLIGHT", 8)
 	viper.SetDefault("POLL_INTERVAL_SECONDS", 60)
 	viper.SetDefault("RANGE_SIZE", 1000)
+	viper.SetDefault("FINALITY", "finalized")
+	viper.SetDefault("FINALITY_FALLBACK_OFFSET", 64)
+	viper.SetDefault("ACCESS_MODE", "statediff")
+	viper.SetDefault("RANGE_SOURCES", []string{"blocks", "rpc"})
+	viper.SetDefault("MIRROR_URL", "")
 
 	// Logging defaults
 	viper.SetDefault("LOG_LEVEL", "info")
@@ -165,6 +234,8 @@ func setDefaults() {
 
 	// Compression defaults
 	viper.SetDefault("COMPRESSION_ENABLED", true)
+	viper.SetDefault("COMPRESSION_LEVEL", 0)
+	viper.SetDefault("COMPRESSION_DICTIONARY", true)
 }
 
 func validateConfig(config Config) error {
@@ -265,6 +336,18 @@ func validateConfig(config Config) error {
 			Message: "RPC timeout must be greater than 0 seconds",
 		})
 	}
+	if config.RPCMaxRetries < 0 {
+		errors = append(errors, ValidationError{
+			Field:   "RPC_MAX_RETRIES",
+			Message: "RPC max retries cannot be negative",
+		})
+	}
+	if config.RPCRetryBudgetSeconds <= 0 {
+		errors = append(errors, ValidationError{
+			Field:   "RPC_RETRY_BUDGET_SECONDS",
+			Message: "RPC retry budget must be greater than 0 seconds",
+		})
+	}
 
 	// Batch size validation
 	if config.BlockBatchSize <= 0 {
@@ -273,6 +356,69 @@ func validateConfig(config Config) error {
 			Message: "block batch size must be greater than 0",
 		})
 	}
+	if config.RPCBatchConcurrency <= 0 {
+		errors = append(errors, ValidationError{
+			Field:   "RPC_BATCH_CONCURRENCY",
+			Message: "RPC batch concurrency must be greater than 0",
+		})
+	}
+	if config.DownloadWorkers <= 0 {
+		errors = append(errors, ValidationError{
+			Field:   "DOWNLOAD_WORKERS",
+			Message: "download workers must be greater than 0",
+		})
+	}
+	if config.RPCMaxInFlight < 0 {
+		errors = append(errors, ValidationError{
+			Field:   "RPC_MAX_IN_FLIGHT",
+			Message: "RPC max in flight cannot be negative",
+		})
+	}
+
+	// S3 credentials validation
+	if (config.S3AccessKeyID == "") != (config.S3SecretAccessKey == "") {
+		errors = append(errors, ValidationError{
+			Field:   "S3_ACCESS_KEY_ID",
+			Message: "S3 access key ID and secret access key must be set together",
+		})
+	}
+
+	// Data layout validation
+	validLayouts := []string{"flat", "sharded"}
+	if !contains(validLayouts, config.DataLayout) {
+		errors = append(errors, ValidationError{
+			Field:   "DATA_LAYOUT",
+			Message: fmt.Sprintf("data layout must be one of: %s", strings.Join(validLayouts, ", ")),
+		})
+	}
+
+	// Range sources validation
+	if len(config.RangeSources) == 0 {
+		errors = append(errors, ValidationError{
+			Field:   "RANGE_SOURCES",
+			Message: "at least one range source is required",
+		})
+	}
+	validSources := []string{"blocks", "mirror", "rpc"}
+	for i, source := range config.RangeSources {
+		if !contains(validSources, source) {
+			errors = append(errors, ValidationError{
+				Field:   "RANGE_SOURCES",
+				Message: fmt.Sprintf("unknown range source %q, must be one of: %s", source, strings.Join(validSources, ", ")),
+			})
+		} else if contains(config.RangeSources[:i], source) {
+			errors = append(errors, ValidationError{
+				Field:   "RANGE_SOURCES",
+				Message: fmt.Sprintf("range source %q is listed more than once", source),
+			})
+		}
+	}
+	if contains(config.RangeSources, "mirror") && config.MirrorURL == "" {
+		errors = append(errors, ValidationError{
+			Field:   "MIRROR_URL",
+			Message: "mirror URL is required when RANGE_SOURCES includes mirror",
+		})
+	}
 
 	// Poll interval validation
 	if config.PollInterval <= 0 {
@@ -282,6 +428,20 @@ func validateConfig(config Config) error {
 		})
 	}
 
+	// Finality validation
+	if _, err := rpc.ParseFinality(config.Finality, 0); err != nil {
+		errors = append(errors, ValidationError{
+			Field:   "FINALITY",
+			Message: err.Error(),
+		})
+	}
+	if config.FinalityFallbackOffset < 0 {
+		errors = append(errors, ValidationError{
+			Field:   "FINALITY_FALLBACK_OFFSET",
+			Message: "finality fallback offset cannot be negative",
+		})
+	}
+
 	// Range size validation
 	if config.RangeSize <= 0 {
 		errors = append(errors, ValidationError{
@@ -290,6 +450,23 @@ func validateConfig(config Config) error {
 		})
 	}
 
+	// Compression level validation
+	if err := utils.ValidateZstdLevel(config.CompressionLevel); err != nil {
+		errors = append(errors, ValidationError{
+			Field:   "COMPRESSION_LEVEL",
+			Message: err.Error(),
+		})
+	}
+
+	// Access mode validation
+	validAccessModes := []string{"statediff", "prestate"}
+	if !contains(validAccessModes, strings.ToLower(config.AccessMode)) {
+		errors = append(errors, ValidationError{
+			Field:   "ACCESS_MODE",
+			Message: fmt.Sprintf("access mode must be one of: %s", strings.Join(validAccessModes, ", ")),
+		})
+	}
+
 	// Log level validation
 	validLogLevels := []string{"debug", "info", "warn", "error"}
 	if !contains(validLogLevels, strings.ToLower(config.LogLevel)) {
@@ -397,3 +574,8 @@ func (c *Config) IsProduction() bool {
 func (c *Config) IsDevelopment() bool {
 	return strings.ToLower(c.Environment) == "development"
 }
+
+// NewFinality returns the finality policy selected by FINALITY
+func (c *Config) NewFinality() (*rpc.Finality, error) {
+	return rpc.ParseFinality(c.Finality, uint64(max(c.FinalityFallbackOffset, 0)))
+}
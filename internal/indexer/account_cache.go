@@ -33,3 +33,8 @@ func (c *AccountCache) Set(addr string, isContract bool) {
 	}
 	c.cache.Set([]byte(addr), bytes)
 }
+
+// Reset removes every cached account type
+func (c *AccountCache) Reset() {
+	c.cache.Reset()
+}
@@ -17,3 +17,12 @@ func TestAccountCache(t *testing.T) {
 	assert.False(t, isContract)
 	assert.False(t, ok)
 }
+
+func TestAccountCacheReset(t *testing.T) {
+	cache := NewAccountCache()
+	cache.Set("0x123", true)
+	cache.Reset()
+
+	_, ok := cache.Get("0x123")
+	assert.False(t, ok)
+}
@@ -2,6 +2,7 @@ package indexer
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"math/big"
@@ -32,8 +33,12 @@ type Service struct {
 	indexer   *Indexer
 	repo      repository.StateRepositoryInterface
 	rpcClient rpc.ClientInterface
+	finality  *rpc.Finality
 	config    internal.Config
 	log       *slog.Logger
+
+	// tail is the last block indexed one at a time, read back from the repository after a restart
+	tail tailBlock
 }
 
 func NewIndexer(repo repository.StateRepositoryInterface, rangeProcessor *storage.RangeProcessor, rpcClient rpc.ClientInterface, config internal.Config) *Indexer {
@@ -54,16 +59,69 @@ func NewService(
 ) *Service {
 	log := logger.GetLogger("indexer-service")
 
+	accessMode, err := rpc.ParseAccessMode(config.AccessMode)
+	if err != nil {
+		log.Error("Invalid access mode", "error", err)
+		return nil
+	}
+
+	finality, err := config.NewFinality()
+	if err != nil {
+		log.Error("Invalid finality", "error", err)
+		return nil
+	}
+
+	backend, err := config.NewStorageBackend()
+	if err != nil {
+		log.Error("Failed to create storage backend", "error", err, "data_dir", config.DataDir)
+		return nil
+	}
+
 	// Initialize range processor
-	rangeProcessor, err := storage.NewRangeProcessor(config.DataDir, rpcClient, config.RangeSize)
+	rangeProcessor, err := storage.NewRangeProcessorWithBackend(backend, rpcClient, config.RangeSize, accessMode)
 	if err != nil {
 		log.Error("Failed to create range processor", "error", err)
 		return nil
 	}
+	if err := rangeProcessor.SetCompressionLevel(config.CompressionLevel); err != nil {
+		log.Error("Failed to set compression level", "error", err)
+		rangeProcessor.Close()
+		return nil
+	}
+	rangeProcessor.SetDownloadWorkers(config.DownloadWorkers)
+	rangeProcessor.SetProgressFunc(func(progress storage.DownloadProgress) {
+		log.Debug("Downloading range",
+			"range_number", progress.RangeNumber,
+			"blocks", progress.Blocks,
+			"total_blocks", progress.TotalBlocks,
+			"blocks_per_second", fmt.Sprintf("%.1f", float64(progress.Blocks)/progress.Elapsed.Seconds()))
+	})
+
+	// Without configured sources ranges are downloaded through RPC
+	if len(config.RangeSources) > 0 {
+		sources, err := config.NewRangeSources(rangeProcessor, rpcClient)
+		if err != nil {
+			log.Error("Failed to create range sources", "error", err)
+			rangeProcessor.Close()
+			return nil
+		}
+		rangeProcessor.SetSources(sources...)
+	}
+	rangeProcessor.SetSourceFunc(func(rangeNumber uint64, source string, err error) {
+		switch {
+		case err == nil:
+			log.Debug("Range taken from source", "range_number", rangeNumber, "source", source)
+		case errors.Is(err, storage.ErrRangeUnavailable):
+			log.Debug("Range not available from source", "range_number", rangeNumber, "source", source)
+		default:
+			log.Warn("Range source failed", "range_number", rangeNumber, "source", source, "error", err)
+		}
+	})
 
 	return &Service{
 		indexer:   NewIndexer(repo, rangeProcessor, rpcClient, config),
 		rpcClient: rpcClient,
+		finality:  finality,
 		repo:      repo,
 		config:    config,
 		log:       log,
@@ -99,40 +157,59 @@ func (i *Indexer) ProcessGenesis(ctx context.Context) error {
 
 // ProcessRange processes an entire range of blocks
 func (i *Indexer) ProcessRange(ctx context.Context, rangeNumber uint64, sa StateAccess, force bool) error {
+	return i.processRange(ctx, rangeNumber, 0, sa, force)
+}
+
+// processRange processes the blocks of a range from firstBlock on. Blocks before firstBlock were
+// indexed one at a time while the range was not complete yet and are skipped.
+func (i *Indexer) processRange(ctx context.Context, rangeNumber uint64, firstBlock uint64, sa StateAccess, force bool) error {
 	if rangeNumber == 0 {
 		// Genesis is handled separately
 		return i.ProcessGenesis(ctx)
 	}
 
 	start, end := i.rangeProcessor.GetRangeBlockNumbers(rangeNumber)
+	accessMode := i.rangeProcessor.AccessMode()
 
 	i.log.Info("Processing range",
 		"range_number", rangeNumber,
 		"range_start", start,
 		"range_end", end,
-		"range_size", end-start+1)
+		"range_size", end-start+1,
+		"access_mode", accessMode)
 
 	// Ensure the range file exists (download if necessary)
 	if err := i.rangeProcessor.EnsureRangeExists(ctx, rangeNumber); err != nil {
 		return fmt.Errorf("could not ensure range %d exists: %w", rangeNumber, err)
 	}
 
-	// Read the range file
-	rangeDiffs, err := i.rangeProcessor.ReadRange(rangeNumber)
-	if err != nil {
-		return fmt.Errorf("could not read range %d: %w", rangeNumber, err)
+	// The range file is streamed twice, one block in memory at a time: first to resolve the
+	// type of every unknown account in one batch, then to process the blocks
+	if err := i.prefillAccountCacheFromRange(ctx, rangeNumber); err != nil {
+		return err
 	}
 
-	i.log.Debug("Read range file",
-		"range_number", rangeNumber,
-		"blocks_in_range", len(rangeDiffs))
-
 	// Process all blocks in the range and prepare batch data
-	for _, rangeDiff := range rangeDiffs {
-		err := i.processBlockDiff(ctx, rangeDiff, sa)
-		if err != nil {
+	blocks := 0
+	err := i.rangeProcessor.StreamRange(rangeNumber, func(rangeDiff storage.ReadRangeDiffs) error {
+		// Mixing access models would make expiry numbers meaningless, so refuse ranges built differently
+		if rangeDiff.AccessMode != accessMode {
+			return fmt.Errorf("block %d in range %d was built with %s access mode, indexer is configured for %s",
+				rangeDiff.BlockNum, rangeNumber, rangeDiff.AccessMode, accessMode)
+		}
+
+		if rangeDiff.BlockNum < firstBlock {
+			return nil
+		}
+
+		if err := i.processBlockDiff(ctx, rangeDiff, sa); err != nil {
 			return fmt.Errorf("could not process block %d in range %d: %w", rangeDiff.BlockNum, rangeNumber, err)
 		}
+		blocks++
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("could not read range %d: %w", rangeNumber, err)
 	}
 
 	if sa.Count() > defaultCommitSize || force {
@@ -151,7 +228,7 @@ func (i *Indexer) ProcessRange(ctx context.Context, rangeNumber uint64, sa State
 		"range", rangeNumber,
 		"range_start", start,
 		"range_end", end,
-		"blocks", len(rangeDiffs))
+		"blocks", blocks)
 
 	return nil
 }
@@ -166,15 +243,18 @@ func (i *Indexer) ProcessRangeDebug(ctx context.Context, rangeNumber uint64) err
 		"range_end", end,
 		"range_size", end-start+1)
 
-	rangeDiffs, err := i.rangeProcessor.ReadRange(rangeNumber)
-	if err != nil {
-		return fmt.Errorf("could not read range %d: %w", rangeNumber, err)
+	if err := i.prefillAccountCacheFromRange(ctx, rangeNumber); err != nil {
+		return err
 	}
 
-	for _, rangeDiff := range rangeDiffs {
+	err := i.rangeProcessor.StreamRange(rangeNumber, func(rangeDiff storage.ReadRangeDiffs) error {
 		if err := i.processBlockDiff(ctx, rangeDiff, sa); err != nil {
 			return fmt.Errorf("could not process block %d in range %d: %w", rangeDiff.BlockNum, rangeNumber, err)
 		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("could not read range %d: %w", rangeNumber, err)
 	}
 
 	return nil
@@ -196,7 +276,7 @@ func (i *Indexer) processBlockDiff(ctx context.Context, rangeDiff storage.ReadRa
 				return fmt.Errorf("could not determine account type for %s in block %d: %w", addr, blockNumber, err)
 			}
 
-			err = sa.AddAccount(addr, blockNumber, isContract)
+			err = sa.AddAccount(addr, blockNumber, isContract, rpc.AccessSourceTransaction)
 			if err != nil {
 				return fmt.Errorf("could not process account %s in block %d: %w", addr, blockNumber, err)
 			}
@@ -209,6 +289,22 @@ func (i *Indexer) processBlockDiff(ctx context.Context, rangeDiff storage.ReadRa
 		}
 	}
 
+	// Accounts touched by the protocol itself: fee recipient, withdrawals and system contracts
+	for _, access := range rangeDiff.Protocol {
+		isContract, err := i.determineAccountType(ctx, access.Address, blockNumber, storage.Diff{IsContract: access.Source == rpc.AccessSourceSystem})
+		if err != nil {
+			return fmt.Errorf("could not determine account type for %s in block %d: %w", access.Address, blockNumber, err)
+		}
+
+		if err := sa.AddAccount(access.Address, blockNumber, isContract, access.Source); err != nil {
+			return fmt.Errorf("could not process %s access of %s in block %d: %w", access.Source, access.Address, blockNumber, err)
+		}
+
+		for _, slot := range access.Storage {
+			sa.AddStorage(access.Address, slot, blockNumber)
+		}
+	}
+
 	i.log.Debug("Processed block",
 		"block_number", blockNumber,
 		"account_events", sa.Count())
@@ -216,6 +312,101 @@ func (i *Indexer) processBlockDiff(ctx context.Context, rangeDiff storage.ReadRa
 	return nil
 }
 
+// prefillAccountCache resolves the type of every account in the range that is neither cached
+// nor known to be a contract from its diff with batched eth_getCode calls, so processBlockDiff
+// does not make one round-trip per account. Each account's code is read at the first block it
+// is accessed in, the same block determineAccountType would have used.
+func (i *Indexer) prefillAccountCache(ctx context.Context, rangeDiffs []storage.ReadRangeDiffs) error {
+	collector := i.newUnknownAccounts()
+	for _, rangeDiff := range rangeDiffs {
+		collector.visitBlock(rangeDiff)
+	}
+	return i.resolveAccountTypes(ctx, collector.unknown)
+}
+
+// prefillAccountCacheFromRange is prefillAccountCache for a range file, streamed block by block
+func (i *Indexer) prefillAccountCacheFromRange(ctx context.Context, rangeNumber uint64) error {
+	collector := i.newUnknownAccounts()
+	err := i.rangeProcessor.StreamRange(rangeNumber, func(rangeDiff storage.ReadRangeDiffs) error {
+		collector.visitBlock(rangeDiff)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("could not read range %d: %w", rangeNumber, err)
+	}
+
+	if err := i.resolveAccountTypes(ctx, collector.unknown); err != nil {
+		return fmt.Errorf("could not determine account types in range %d: %w", rangeNumber, err)
+	}
+	return nil
+}
+
+// unknownAccounts collects the accounts whose type is neither cached nor evident from their
+// diff, with the first block each is accessed in
+type unknownAccounts struct {
+	cache   *AccountCache
+	unknown map[string]uint64
+	seen    map[string]struct{}
+}
+
+func (i *Indexer) newUnknownAccounts() *unknownAccounts {
+	return &unknownAccounts{
+		cache:   i.accountCache,
+		unknown: make(map[string]uint64),
+		seen:    make(map[string]struct{}),
+	}
+}
+
+func (u *unknownAccounts) visitBlock(rangeDiff storage.ReadRangeDiffs) {
+	for _, txResult := range rangeDiff.Diffs {
+		for addr, diff := range txResult.StateDiff {
+			u.visit(addr, rangeDiff.BlockNum, diff.IsContract)
+		}
+	}
+	for _, access := range rangeDiff.Protocol {
+		u.visit(access.Address, rangeDiff.BlockNum, access.Source == rpc.AccessSourceSystem)
+	}
+}
+
+func (u *unknownAccounts) visit(addr string, blockNumber uint64, isContract bool) {
+	if _, ok := u.seen[addr]; ok {
+		return
+	}
+	u.seen[addr] = struct{}{}
+
+	// Contracts deployed in the range and system contracts are known without a lookup
+	if isContract {
+		return
+	}
+	if _, ok := u.cache.Get(addr); ok {
+		return
+	}
+	u.unknown[addr] = blockNumber
+}
+
+// resolveAccountTypes fetches the code of the given accounts and caches their type
+func (i *Indexer) resolveAccountTypes(ctx context.Context, unknown map[string]uint64) error {
+	if len(unknown) == 0 {
+		return nil
+	}
+
+	start := time.Now()
+	codes, err := i.rpcClient.GetCodes(ctx, unknown)
+	// Accounts resolved before a failure are kept, they do not need to be fetched again
+	for addr, code := range codes {
+		i.accountCache.Set(addr, len(code) > 2) // Omit the 0x prefix
+	}
+	if err != nil {
+		return err
+	}
+
+	i.log.Debug("Resolved account types",
+		"accounts", len(unknown),
+		"duration", time.Since(start))
+
+	return nil
+}
+
 // determineAccountType analyzes the account diff to determine if it's a contract
 func (i *Indexer) determineAccountType(ctx context.Context, addr string, blockNumber uint64, diff storage.Diff) (bool, error) {
 	if diff.IsContract {
@@ -246,10 +437,24 @@ func (s *Service) RunProcessor(ctx context.Context) error {
 	s.log.Info("Starting range-based indexer processor workflow",
 		"poll_interval", s.config.PollInterval,
 		"data_path", s.config.DataDir,
-		"range_size", s.config.RangeSize)
+		"range_size", s.config.RangeSize,
+		"finality", s.finality)
+
+	// Writes interrupted by a crash leave temp files behind
+	removed, err := s.indexer.rangeProcessor.Recover()
+	if err != nil {
+		return fmt.Errorf("could not recover data directory: %w", err)
+	}
+	if len(removed) > 0 {
+		s.log.Warn("Removed temp files of interrupted writes", "files", removed)
+	}
 
 	pollInterval := time.Duration(s.config.PollInterval) * time.Second
 
+	// New heads pushed over WebSocket or IPC wake the loop up before the poll interval elapses
+	heads := rpc.NewHeadWatcher(s.rpcClient)
+	heads.Start(ctx)
+
 	for {
 		select {
 		case <-ctx.Done():
@@ -259,35 +464,64 @@ func (s *Service) RunProcessor(ctx context.Context) error {
 			// Continue with processing logic
 		}
 
+		wait := pollInterval
 		if err := s.processAvailableRanges(ctx); err != nil {
+			// Retrying cannot fix a permanent RPC error such as pruned history or a missing trace API
+			var permanentErr *rpc.PermanentError
+			if errors.As(err, &permanentErr) {
+				s.log.Error("Processing cycle failed with a permanent RPC error, stopping", "error", err)
+				return err
+			}
+
+			// Rate limited endpoints tell us how long to back off
+			wait = rpc.RetryDelay(err, pollInterval)
 			s.log.Warn("Processing cycle failed, retrying...",
 				"error", err,
-				"retry_interval", pollInterval)
+				"error_class", rpc.ClassOf(err),
+				"retry_interval", wait)
 		}
 
-		select {
-		case <-ctx.Done():
+		// Wait for the next head or poll, unless an endpoint asked us to back off for longer
+		if wait > pollInterval {
+			select {
+			case <-ctx.Done():
+			case <-time.After(wait):
+			}
+		} else {
+			heads.Wait(ctx, wait)
+		}
+		if ctx.Err() != nil {
 			s.log.Info("Indexer processor workflow stopped")
 			return nil
-		case <-time.After(pollInterval):
-			// Wait before next processing cycle
 		}
 	}
 }
 
 // processAvailableRanges processes all available ranges that haven't been indexed yet
 func (s *Service) processAvailableRanges(ctx context.Context) error {
+	// A rollback left unfinished must complete before anything is indexed on top of it
+	if err := s.resumeRollback(ctx); err != nil {
+		return fmt.Errorf("could not resume rollback: %w", err)
+	}
+
 	lastIndexedRange, err := s.repo.GetLastIndexedRange(ctx)
 	if err != nil {
 		return fmt.Errorf("could not get last processed range: %w", err)
 	}
 
-	s.log.Debug("Checking for ranges to process", "last_indexed_range", lastIndexedRange)
+	lastIndexedBlock, err := s.repo.GetLastIndexedBlock(ctx)
+	if err != nil {
+		return fmt.Errorf("could not get last indexed block: %w", err)
+	}
+
+	s.log.Debug("Checking for ranges to process",
+		"last_indexed_range", lastIndexedRange,
+		"last_indexed_block", lastIndexedBlock)
 
 	sa := newStateAccessArchive()
 
-	// Special case: process genesis if starting from range 0
-	if lastIndexedRange == 0 {
+	// Special case: process genesis if starting from range 0, unless later blocks were indexed one at a time
+	if lastIndexedRange == 0 && lastIndexedBlock == 0 {
 		if err := s.indexer.ProcessRange(ctx, 0, sa, true); err != nil {
 			return fmt.Errorf("could not process genesis range: %w", err)
 		}
@@ -300,16 +534,18 @@ func (s *Service) processAvailableRanges(ctx context.Context) error {
 	lastProgressTime := time.Now()
 	lastProgressRange := lastIndexedRange
 
-	// Get latest block to determine how many ranges we can process
-	latestBlock, err := s.rpcClient.GetLatestBlockNumber(ctx)
+	// Only ranges below the final block are processed, blocks above it may still be reorganized
+	finalBlock, err := s.finality.Head(ctx, s.rpcClient)
 	if err != nil {
-		return fmt.Errorf("could not get latest available block: %w", err)
+		return fmt.Errorf("could not get final block: %w", err)
 	}
 
-	latestRange := s.indexer.rangeProcessor.GetRangeNumber(latestBlock.Uint64())
+	// Ranges before the one holding the final block are complete, that one is indexed one block at a time
+	latestRange := s.indexer.rangeProcessor.GetRangeNumber(finalBlock) + 1
 
 	s.log.Debug("Range processing scope",
-		"latest_block", latestBlock,
+		"final_block", finalBlock,
+		"finality", s.finality,
 		"latest_range", latestRange,
 		"current_range", currentRange)
 
@@ -321,8 +557,14 @@ func (s *Service) processAvailableRanges(ctx context.Context) error {
 		default:
 		}
 
-		// Process the range
-		if err := s.indexer.ProcessRange(ctx, currentRange, sa, false); err != nil {
+		// Process the range, the blocks of the first one may have been indexed one at a time already
+		if err := s.indexer.processRange(ctx, currentRange, lastIndexedBlock+1, sa, false); err != nil {
+			// Uncommitted accesses may come from the abandoned fork, the next cycle indexes them again
+			var reorgErr *storage.ReorgError
+			if errors.As(err, &reorgErr) {
+				sa.Reset()
+				return s.handleReorg(ctx, reorgErr, currentRange)
+			}
 			return fmt.Errorf("could not process range %d: %w", currentRange, err)
 		}
 
@@ -351,24 +593,23 @@ func (s *Service) processAvailableRanges(ctx context.Context) error {
 		currentRange++
 	}
 
-	// TODO: When caught up to the latest range, switch to block-by-block processing.
-	// The current implementation waits for a full new range to become available, which
-	// can lead to delays in indexing the most recent blocks. The new logic should:
-	// 1. Check if we are at the chain head (e.g., lastIndexedRange == latestRange).
-	// 2. If so, switch to polling for new blocks individually.
-	// 3. Process new blocks one by one until a new full range is available behind us.
-	// 4. Once a full range is available, we can potentially switch back to range processing.
-	// This will require careful state management and new logic to fetch and process
-	// single blocks.
-
-	// Force commit any remaining data
-	if sa.Count() > 0 {
-		if err := sa.Commit(ctx, s.repo, currentRange); err != nil {
-			return fmt.Errorf("could not commit range %d: %w", currentRange, err)
+	// Force commit any remaining data, currentRange is the first range that was not processed
+	if sa.Count() > 0 || processedCount > 0 {
+		if err := sa.Commit(ctx, s.repo, currentRange-1); err != nil {
+			return fmt.Errorf("could not commit range %d: %w", currentRange-1, err)
 		}
 		sa.Reset()
 	}
 
+	// Caught up with the complete ranges, the final blocks of the next one are indexed one at a time
+	if err := s.processTail(ctx, currentRange, lastIndexedBlock, finalBlock); err != nil {
+		var reorgErr *storage.ReorgError
+		if errors.As(err, &reorgErr) {
+			return s.handleReorg(ctx, reorgErr, currentRange)
+		}
+		return fmt.Errorf("could not process blocks of range %d: %w", currentRange, err)
+	}
+
 	if processedCount > 0 {
 		s.log.Info("Completed range processing cycle",
 			"processed_ranges", processedCount,
@@ -9,6 +9,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/weiihann/state-expiry-indexer/internal"
@@ -24,6 +25,9 @@ type MockRPCClient struct {
 	codeResponses     map[string]string
 	stateDiffResponse []rpc.TransactionResult
 	getCodeCallCount  int
+	getCodesCallCount int
+	forkBlock         uint64
+	fork              int
 }
 
 func NewMockRPCClient() *MockRPCClient {
@@ -49,6 +53,10 @@ func (m *MockRPCClient) GetLatestBlockNumber(ctx context.Context) (*big.Int, err
 	return m.latestBlock, nil
 }
 
+func (m *MockRPCClient) GetBlockNumberByTag(ctx context.Context, tag rpc.BlockTag) (*big.Int, error) {
+	return m.latestBlock, nil
+}
+
 func (m *MockRPCClient) GetCode(ctx context.Context, address string, blockNumber *big.Int) (string, error) {
 	m.getCodeCallCount++
 	if code, exists := m.codeResponses[address]; exists {
@@ -57,10 +65,54 @@ func (m *MockRPCClient) GetCode(ctx context.Context, address string, blockNumber
 	return "0x", nil // Default to EOA
 }
 
+func (m *MockRPCClient) GetCodes(ctx context.Context, accounts map[string]uint64) (map[string]string, error) {
+	m.getCodesCallCount++
+	return rpc.FetchCodes(ctx, accounts, m.GetCode)
+}
+
 func (m *MockRPCClient) GetStateDiff(ctx context.Context, blockNumber *big.Int) ([]rpc.TransactionResult, error) {
 	return m.stateDiffResponse, nil
 }
 
+func (m *MockRPCClient) GetPrestate(ctx context.Context, blockNumber *big.Int) ([]rpc.TransactionResult, error) {
+	return m.stateDiffResponse, nil
+}
+
+func (m *MockRPCClient) GetStateDiffs(ctx context.Context, blocks []uint64) (map[uint64][]rpc.TransactionResult, error) {
+	return rpc.FetchEach(ctx, blocks, m.GetStateDiff)
+}
+
+func (m *MockRPCClient) GetPrestates(ctx context.Context, blocks []uint64) (map[uint64][]rpc.TransactionResult, error) {
+	return rpc.FetchEach(ctx, blocks, m.GetPrestate)
+}
+
+func (m *MockRPCClient) GetBlockHeaders(ctx context.Context, blocks []uint64) (map[uint64]*rpc.Head, error) {
+	headers := make(map[uint64]*rpc.Head, len(blocks))
+	for _, block := range blocks {
+		headers[block] = &rpc.Head{
+			Number:     hexutil.Uint64(block),
+			Hash:       m.blockHash(block),
+			ParentHash: m.blockHash(block - 1),
+		}
+	}
+	return headers, nil
+}
+
+// blockHash returns the hash of a block, blocks from the fork block set by SetFork on are on a new fork
+func (m *MockRPCClient) blockHash(block uint64) string {
+	fork := 0
+	if m.forkBlock > 0 && block >= m.forkBlock {
+		fork = m.fork
+	}
+	return fmt.Sprintf("0x%062x%02x", block, fork)
+}
+
+// SetFork switches the chain to a new fork starting at block
+func (m *MockRPCClient) SetFork(block uint64) {
+	m.forkBlock = block
+	m.fork++
+}
+
 // createTestConfig creates a test configuration
 func createTestConfig(dataDir string) internal.Config {
 	testConfig := testdb.GetTestConfig()
@@ -381,6 +433,184 @@ func TestIndexerServiceProcessAvailableRanges(t *testing.T) {
 	})
 }
 
+// TestIndexerServiceReorg tests rolling back ranges that were reorganized away
+func TestIndexerServiceReorg(t *testing.T) {
+	setup := func(t *testing.T) (*Service, *MockRPCClient, repository.StateRepositoryInterface, string) {
+		dataDir, cleanupDir := createTestDataDir(t)
+		t.Cleanup(cleanupDir)
+
+		config := createTestConfig(dataDir)
+		repo, cleanupDB := createTestRepository(t, config)
+		t.Cleanup(cleanupDB)
+
+		mockRPC := NewMockRPCClient()
+		service := NewService(repo, mockRPC, config)
+		require.NotNil(t, service)
+		t.Cleanup(service.Close)
+
+		// Index genesis and ranges 1-2 (blocks 1-200)
+		ctx := context.Background()
+		for rangeNumber := uint64(0); rangeNumber <= 2; rangeNumber++ {
+			require.NoError(t, service.indexer.ProcessRange(ctx, rangeNumber, newStateAccessArchive(), true))
+		}
+
+		return service, mockRPC, repo, dataDir
+	}
+
+	t.Run("Rolls back to the fork and indexes the new chain", func(t *testing.T) {
+		service, mockRPC, repo, dataDir := setup(t)
+		ctx := context.Background()
+
+		// Blocks 180 and later are replaced, range 3 no longer builds on the stored range 2
+		mockRPC.SetFork(180)
+		mockRPC.SetLatestBlock(450)
+
+		require.NoError(t, service.processAvailableRanges(ctx))
+
+		lastRange, err := repo.GetLastIndexedRange(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, uint64(1), lastRange, "Range 2 contains the fork and must be indexed again")
+		assert.False(t, service.indexer.rangeProcessor.RangeExists(2), "Range file containing the fork must be deleted")
+		assert.NoFileExists(t, filepath.Join(dataDir, rollbackMarkerFile))
+
+		// The next cycle downloads range 2 from the new fork and continues
+		require.NoError(t, service.processAvailableRanges(ctx))
+
+		rangeDiffs, err := service.indexer.rangeProcessor.ReadRange(2)
+		require.NoError(t, err)
+		assert.Equal(t, mockRPC.blockHash(200), rangeDiffs[len(rangeDiffs)-1].Hash)
+	})
+
+	t.Run("Resumes an interrupted rollback", func(t *testing.T) {
+		service, mockRPC, repo, dataDir := setup(t)
+		ctx := context.Background()
+
+		mockRPC.SetLatestBlock(200)
+		marker := filepath.Join(dataDir, rollbackMarkerFile)
+		require.NoError(t, os.WriteFile(marker, []byte(`{"forkBlock":150}`), 0o644))
+
+		require.NoError(t, service.processAvailableRanges(ctx))
+
+		lastRange, err := repo.GetLastIndexedRange(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, uint64(1), lastRange)
+		assert.False(t, service.indexer.rangeProcessor.RangeExists(2))
+		assert.NoFileExists(t, marker)
+	})
+}
+
+// TestIndexerServiceTail tests indexing the final blocks of an incomplete range one at a time
+func TestIndexerServiceTail(t *testing.T) {
+	account := "0x1111111111111111111111111111111111111111"
+
+	setup := func(t *testing.T) (*Service, *MockRPCClient, repository.StateRepositoryInterface) {
+		dataDir, cleanupDir := createTestDataDir(t)
+		t.Cleanup(cleanupDir)
+
+		config := createTestConfig(dataDir)
+		repo, cleanupDB := createTestRepository(t, config)
+		t.Cleanup(cleanupDB)
+
+		// Every block touches the same account once
+		mockRPC := NewMockRPCClient()
+		mockRPC.SetStateDiffResponse([]rpc.TransactionResult{
+			*createTransactionResult("0x01", map[string]rpc.AccountDiff{account: createAccountDiff(true, false, false, false, nil)}),
+		})
+		service := NewService(repo, mockRPC, config)
+		require.NotNil(t, service)
+		t.Cleanup(service.Close)
+
+		return service, mockRPC, repo
+	}
+
+	// indexed returns the last indexed range and block and how many blocks touched the account
+	indexed := func(t *testing.T, repo repository.StateRepositoryInterface) (uint64, uint64, int) {
+		lastRange, err := repo.GetLastIndexedRange(t.Context())
+		require.NoError(t, err)
+		lastBlock, err := repo.GetLastIndexedBlock(t.Context())
+		require.NoError(t, err)
+		accounts, err := repo.GetMostFrequentAccounts(t.Context(), 1)
+		require.NoError(t, err)
+		require.Len(t, accounts, 1)
+		return lastRange, lastBlock, accounts[0].AccessCount
+	}
+
+	t.Run("Blocks are indexed as they become final and not again with their range", func(t *testing.T) {
+		service, mockRPC, repo := setup(t)
+		ctx := t.Context()
+
+		mockRPC.SetLatestBlock(150)
+		require.NoError(t, service.processAvailableRanges(ctx))
+		lastRange, lastBlock, accesses := indexed(t, repo)
+		assert.Equal(t, uint64(1), lastRange)
+		assert.Equal(t, uint64(150), lastBlock)
+		assert.Equal(t, 150, accesses)
+		assert.False(t, service.indexer.rangeProcessor.RangeExists(2), "the incomplete range has no range file")
+
+		mockRPC.SetLatestBlock(160)
+		require.NoError(t, service.processAvailableRanges(ctx))
+		_, lastBlock, accesses = indexed(t, repo)
+		assert.Equal(t, uint64(160), lastBlock)
+		assert.Equal(t, 160, accesses)
+
+		// Range 2 is complete, its blocks indexed one at a time are skipped
+		mockRPC.SetLatestBlock(250)
+		require.NoError(t, service.processAvailableRanges(ctx))
+		lastRange, lastBlock, accesses = indexed(t, repo)
+		assert.Equal(t, uint64(2), lastRange)
+		assert.Equal(t, uint64(250), lastBlock)
+		assert.Equal(t, 250, accesses)
+		assert.True(t, service.indexer.rangeProcessor.RangeExists(2))
+
+		status, err := repo.GetSyncStatus(ctx, 3, 100)
+		require.NoError(t, err)
+		assert.True(t, status.IsSynced)
+		assert.Equal(t, uint64(250), status.EndBlock)
+	})
+
+	t.Run("Blocks indexed on an abandoned fork are indexed again", func(t *testing.T) {
+		service, mockRPC, repo := setup(t)
+		ctx := t.Context()
+
+		mockRPC.SetLatestBlock(150)
+		require.NoError(t, service.processAvailableRanges(ctx))
+
+		// Blocks 140 and later are replaced
+		mockRPC.SetFork(140)
+		mockRPC.SetLatestBlock(160)
+		require.NoError(t, service.processAvailableRanges(ctx))
+		lastRange, lastBlock, accesses := indexed(t, repo)
+		assert.Equal(t, uint64(1), lastRange)
+		assert.Equal(t, uint64(100), lastBlock)
+		assert.Equal(t, 100, accesses)
+
+		require.NoError(t, service.processAvailableRanges(ctx))
+		_, lastBlock, accesses = indexed(t, repo)
+		assert.Equal(t, uint64(160), lastBlock)
+		assert.Equal(t, 160, accesses)
+	})
+
+	t.Run("Blocks indexed before a restart are checked against the new chain", func(t *testing.T) {
+		service, mockRPC, repo := setup(t)
+		ctx := t.Context()
+
+		mockRPC.SetLatestBlock(150)
+		require.NoError(t, service.processAvailableRanges(ctx))
+
+		// A new service does not have the hash of the last indexed block in memory
+		restarted := NewService(repo, mockRPC, service.config)
+		require.NotNil(t, restarted)
+		t.Cleanup(restarted.Close)
+
+		mockRPC.SetFork(140)
+		mockRPC.SetLatestBlock(160)
+		require.NoError(t, restarted.processAvailableRanges(ctx))
+		_, lastBlock, accesses := indexed(t, repo)
+		assert.Equal(t, uint64(100), lastBlock)
+		assert.Equal(t, 100, accesses)
+	})
+}
+
 // TestIndexerServiceErrorHandling tests error handling scenarios
 func TestIndexerServiceErrorHandling(t *testing.T) {
 	t.Run("Database connection error handling", func(t *testing.T) {
@@ -434,6 +664,76 @@ func TestIndexerServiceErrorHandling(t *testing.T) {
 	})
 }
 
+// TestIndexerPrefillAccountCache tests resolving unknown account types of a range in one batched call
+func TestIndexerPrefillAccountCache(t *testing.T) {
+	mockRPC := NewMockRPCClient()
+	mockRPC.SetCodeResponse("0xc0", "0x6080")
+
+	indexer := NewIndexer(nil, nil, mockRPC, createTestConfig(t.TempDir()))
+	indexer.accountCache.Set("0xca", false)
+
+	rangeDiffs := []storage.ReadRangeDiffs{
+		{BlockNum: 1, Diffs: []storage.ReadDiffs{{StateDiff: map[string]storage.Diff{
+			"0xc0": {},
+			"0xe0": {},
+			"0xca": {},
+			"0xd0": {IsContract: true},
+		}}}},
+		{BlockNum: 2, Diffs: []storage.ReadDiffs{{StateDiff: map[string]storage.Diff{
+			"0xe0": {},
+			"0xd0": {},
+		}}}},
+	}
+
+	require.NoError(t, indexer.prefillAccountCache(context.Background(), rangeDiffs))
+	assert.Equal(t, 1, mockRPC.getCodesCallCount, "Unknown accounts should be resolved in a single call")
+	assert.Equal(t, 2, mockRPC.getCodeCallCount, "Cached accounts and contracts deployed in the range should not be fetched")
+
+	isContract, ok := indexer.accountCache.Get("0xc0")
+	assert.True(t, ok)
+	assert.True(t, isContract)
+	isContract, ok = indexer.accountCache.Get("0xe0")
+	assert.True(t, ok)
+	assert.False(t, isContract)
+
+	// Every account is known now, processing the block makes no further calls
+	sa := newStateAccessArchive()
+	for _, rangeDiff := range rangeDiffs {
+		require.NoError(t, indexer.processBlockDiff(context.Background(), rangeDiff, sa))
+	}
+	assert.Equal(t, 2, mockRPC.getCodeCallCount)
+}
+
+func TestIndexerProtocolAccesses(t *testing.T) {
+	mockRPC := NewMockRPCClient()
+	indexer := NewIndexer(nil, nil, mockRPC, createTestConfig(t.TempDir()))
+
+	rangeDiff := storage.ReadRangeDiffs{
+		BlockNum: 1,
+		Diffs: []storage.ReadDiffs{{StateDiff: map[string]storage.Diff{
+			"0xc0": {},
+		}}},
+		Protocol: []rpc.ProtocolAccess{
+			{Address: "0xc0", Source: rpc.AccessSourceCoinbase},
+			{Address: "0xd0", Source: rpc.AccessSourceWithdrawal},
+			{Address: rpc.BeaconRootsAddress, Source: rpc.AccessSourceSystem, Storage: []string{"0x01"}},
+		},
+	}
+
+	require.NoError(t, indexer.prefillAccountCache(context.Background(), []storage.ReadRangeDiffs{rangeDiff}))
+	assert.Equal(t, 2, mockRPC.getCodeCallCount, "System contracts are known to be contracts")
+
+	sa := newStateAccessArchive()
+	require.NoError(t, indexer.processBlockDiff(context.Background(), rangeDiff, sa))
+
+	// A fee recipient that also sent a transaction keeps both sources
+	assert.Equal(t, rpc.AccessSourceTransaction|rpc.AccessSourceCoinbase, sa.accountsByBlock[1]["0xc0"])
+	assert.Equal(t, rpc.AccessSourceWithdrawal, sa.accountsByBlock[1]["0xd0"])
+	assert.Equal(t, rpc.AccessSourceSystem, sa.accountsByBlock[1][rpc.BeaconRootsAddress])
+	assert.True(t, sa.accountType[rpc.BeaconRootsAddress])
+	assert.Contains(t, sa.storageByBlock[1][rpc.BeaconRootsAddress], "0x01")
+}
+
 // TestIndexerServiceContextCancellation tests graceful handling of context cancellation
 func TestIndexerServiceContextCancellation(t *testing.T) {
 	t.Run("Context cancellation during processing", func(t *testing.T) {
@@ -241,7 +241,7 @@ func TestRangeMetadataTracking(t *testing.T) {
 				sa = newStateAccessArchive()
 
 				// Simulate processing range 1
-				err := sa.AddAccount("0x1111111111111111111111111111111111111111", 100, false)
+				err := sa.AddAccount("0x1111111111111111111111111111111111111111", 100, false, rpc.AccessSourceTransaction)
 				require.NoError(t, err, "Should be able to add account")
 
 				err = sa.Commit(ctx, repo, 1)
@@ -254,7 +254,7 @@ func TestRangeMetadataTracking(t *testing.T) {
 
 				// Process range 2
 				sa.Reset()
-				err = sa.AddAccount("0x2222222222222222222222222222222222222222", 200, true)
+				err = sa.AddAccount("0x2222222222222222222222222222222222222222", 200, true, rpc.AccessSourceTransaction)
 				require.NoError(t, err, "Should be able to add account")
 
 				err = sa.Commit(ctx, repo, 2)
@@ -312,7 +312,7 @@ func TestRangeErrorRecovery(t *testing.T) {
 
 		// Create state access
 		sa := newStateAccessArchive()
-		err := sa.AddAccount("0x1111111111111111111111111111111111111111", 100, false)
+		err := sa.AddAccount("0x1111111111111111111111111111111111111111", 100, false, rpc.AccessSourceTransaction)
 		require.NoError(t, err, "Should be able to add account")
 
 		ctx := context.Background()
@@ -440,6 +440,14 @@ func (f *FailingMockRPCClient) GetLatestBlockNumber(ctx context.Context) (*big.I
 	return f.mockRPC.GetLatestBlockNumber(ctx)
 }
 
+func (f *FailingMockRPCClient) GetBlockNumberByTag(ctx context.Context, tag rpc.BlockTag) (*big.Int, error) {
+	if f.failCount > 0 {
+		f.failCount--
+		return nil, fmt.Errorf("simulated RPC failure")
+	}
+	return f.mockRPC.GetBlockNumberByTag(ctx, tag)
+}
+
 func (f *FailingMockRPCClient) GetCode(ctx context.Context, address string, blockNumber *big.Int) (string, error) {
 	if f.failCount > 0 {
 		f.failCount--
@@ -448,6 +456,10 @@ func (f *FailingMockRPCClient) GetCode(ctx context.Context, address string, bloc
 	return f.mockRPC.GetCode(ctx, address, blockNumber)
 }
 
+func (f *FailingMockRPCClient) GetCodes(ctx context.Context, accounts map[string]uint64) (map[string]string, error) {
+	return rpc.FetchCodes(ctx, accounts, f.GetCode)
+}
+
 func (f *FailingMockRPCClient) GetStateDiff(ctx context.Context, blockNumber *big.Int) ([]rpc.TransactionResult, error) {
 	if f.failCount > 0 {
 		f.failCount--
@@ -455,3 +467,23 @@ func (f *FailingMockRPCClient) GetStateDiff(ctx context.Context, blockNumber *bi
 	}
 	return f.mockRPC.GetStateDiff(ctx, blockNumber)
 }
+
+func (f *FailingMockRPCClient) GetPrestate(ctx context.Context, blockNumber *big.Int) ([]rpc.TransactionResult, error) {
+	if f.failCount > 0 {
+		f.failCount--
+		return nil, fmt.Errorf("simulated RPC failure")
+	}
+	return f.mockRPC.GetPrestate(ctx, blockNumber)
+}
+
+func (f *FailingMockRPCClient) GetStateDiffs(ctx context.Context, blocks []uint64) (map[uint64][]rpc.TransactionResult, error) {
+	return rpc.FetchEach(ctx, blocks, f.GetStateDiff)
+}
+
+func (f *FailingMockRPCClient) GetPrestates(ctx context.Context, blocks []uint64) (map[uint64][]rpc.TransactionResult, error) {
+	return rpc.FetchEach(ctx, blocks, f.GetPrestate)
+}
+
+func (f *FailingMockRPCClient) GetBlockHeaders(ctx context.Context, blocks []uint64) (map[uint64]*rpc.Head, error) {
+	return f.mockRPC.GetBlockHeaders(ctx, blocks)
+}
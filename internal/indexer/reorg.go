@@ -0,0 +1,109 @@
+package indexer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+
+	"github.com/weiihann/state-expiry-indexer/pkg/storage"
+)
+
+// rollbackMarkerFile records an unfinished rollback in the storage backend, so a rollback
+// interrupted between deleting range files and cleaning the database is finished on restart
+const rollbackMarkerFile = "rollback.json"
+
+type rollbackMarker struct {
+	ForkBlock uint64 `json:"forkBlock"`
+}
+
+// resumeRollback finishes a rollback that was interrupted before it completed
+func (s *Service) resumeRollback(ctx context.Context) error {
+	backend := s.indexer.rangeProcessor.Backend()
+	data, err := storage.ReadFile(backend, rollbackMarkerFile)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("could not read rollback marker: %w", err)
+	}
+
+	var marker rollbackMarker
+	if err := json.Unmarshal(data, &marker); err != nil {
+		return fmt.Errorf("could not parse rollback marker %s: %w", backend.Location(rollbackMarkerFile), err)
+	}
+
+	s.log.Warn("Resuming interrupted rollback", "fork_block", marker.ForkBlock)
+	return s.rollback(ctx, marker.ForkBlock)
+}
+
+// handleReorg locates where the stored chain left the canonical chain and rolls back to it.
+// currentRange is the range that did not build on the stored ranges.
+func (s *Service) handleReorg(ctx context.Context, reorgErr *storage.ReorgError, currentRange uint64) error {
+	rangeProcessor := s.indexer.rangeProcessor
+
+	forkBlock, err := rangeProcessor.FindForkPoint(ctx, currentRange-1)
+	if err != nil {
+		return fmt.Errorf("could not find fork point of reorg at block %d: %w", reorgErr.Block, err)
+	}
+
+	// The stored ranges are canonical again, the chain reorganized back while we were looking
+	if _, end := rangeProcessor.GetRangeBlockNumbers(currentRange - 1); forkBlock > end {
+		return fmt.Errorf("chain reorganized during download of range %d: %w", currentRange, reorgErr)
+	}
+
+	s.log.Warn("Chain reorganization detected",
+		"detected_at_block", reorgErr.Block,
+		"fork_block", forkBlock,
+		"stored_hash", reorgErr.StoredHash,
+		"parent_hash", reorgErr.ParentHash)
+
+	return s.rollback(ctx, forkBlock)
+}
+
+// rollback removes everything stored and indexed from forkBlock onwards. Whole ranges are
+// removed, the ranges containing forkBlock and later are downloaded and indexed again.
+func (s *Service) rollback(ctx context.Context, forkBlock uint64) error {
+	rangeProcessor := s.indexer.rangeProcessor
+
+	data, err := json.Marshal(rollbackMarker{ForkBlock: forkBlock})
+	if err != nil {
+		return fmt.Errorf("could not marshal rollback marker: %w", err)
+	}
+	if err := rangeProcessor.Backend().Save(rollbackMarkerFile, data); err != nil {
+		return fmt.Errorf("could not write rollback marker: %w", err)
+	}
+
+	deleted, err := rangeProcessor.DeleteRangesFrom(forkBlock)
+	if err != nil {
+		return fmt.Errorf("could not delete ranges from block %d: %w", forkBlock, err)
+	}
+
+	lastIndexedRange, err := s.repo.GetLastIndexedRange(ctx)
+	if err != nil {
+		return fmt.Errorf("could not get last indexed range: %w", err)
+	}
+
+	lastValidRange := rangeProcessor.GetRangeNumber(forkBlock)
+	_, lastBlock := rangeProcessor.GetRangeBlockNumbers(lastValidRange)
+	if err := s.repo.Rollback(ctx, lastBlock, min(lastIndexedRange, lastValidRange)); err != nil {
+		return fmt.Errorf("could not roll back indexed data to block %d: %w", lastBlock, err)
+	}
+
+	// Accounts created on the abandoned fork may not be contracts on the canonical chain
+	s.indexer.accountCache.Reset()
+	s.tail = tailBlock{}
+
+	if err := rangeProcessor.Backend().Delete(rollbackMarkerFile); err != nil {
+		return fmt.Errorf("could not remove rollback marker: %w", err)
+	}
+
+	s.log.Info("Rolled back to before fork",
+		"fork_block", forkBlock,
+		"last_block", lastBlock,
+		"last_indexed_range", min(lastIndexedRange, lastValidRange),
+		"deleted_range_files", deleted)
+
+	return nil
+}
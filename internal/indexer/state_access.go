@@ -4,20 +4,24 @@ import (
 	"context"
 
 	"github.com/weiihann/state-expiry-indexer/internal/repository"
+	"github.com/weiihann/state-expiry-indexer/pkg/rpc"
 )
 
 var _ StateAccess = &stateAccessArchive{}
 
 type StateAccess interface {
-	AddAccount(addr string, blockNumber uint64, isContract bool) error
+	AddAccount(addr string, blockNumber uint64, isContract bool, source rpc.AccessSource) error
 	AddStorage(addr string, slot string, blockNumber uint64)
 	Commit(ctx context.Context, repo repository.StateRepositoryInterface, rangeNumber uint64) error
+	// CommitBlocks records blocks indexed one at a time, lastBlock being the last of them
+	CommitBlocks(ctx context.Context, repo repository.StateRepositoryInterface, lastBlock uint64, lastBlockHash string) error
 	Reset()
 	Count() int
 }
 
 type stateAccessArchive struct {
-	accountsByBlock map[uint64]map[string]struct{}
+	// accountsByBlock holds every way each account was touched in a block
+	accountsByBlock map[uint64]map[string]rpc.AccessSource
 	accountType     map[string]bool
 	storageByBlock  map[uint64]map[string]map[string]struct{}
 
@@ -26,15 +30,15 @@ type stateAccessArchive struct {
 
 func newStateAccessArchive() *stateAccessArchive {
 	return &stateAccessArchive{
-		accountsByBlock: make(map[uint64]map[string]struct{}),
+		accountsByBlock: make(map[uint64]map[string]rpc.AccessSource),
 		accountType:     make(map[string]bool),
 		storageByBlock:  make(map[uint64]map[string]map[string]struct{}),
 	}
 }
 
-func (s *stateAccessArchive) AddAccount(addr string, blockNumber uint64, isContract bool) error {
+func (s *stateAccessArchive) AddAccount(addr string, blockNumber uint64, isContract bool, source rpc.AccessSource) error {
 	if _, exists := s.accountsByBlock[blockNumber]; !exists {
-		s.accountsByBlock[blockNumber] = make(map[string]struct{})
+		s.accountsByBlock[blockNumber] = make(map[string]rpc.AccessSource)
 	}
 
 	// If the account is not in the map, add it
@@ -48,7 +52,7 @@ func (s *stateAccessArchive) AddAccount(addr string, blockNumber uint64, isContr
 		s.count++
 	}
 
-	s.accountsByBlock[blockNumber][addr] = struct{}{}
+	s.accountsByBlock[blockNumber][addr] |= source
 
 	return nil
 }
@@ -69,11 +73,15 @@ func (s *stateAccessArchive) AddStorage(addr string, slot string, blockNumber ui
 }
 
 func (s *stateAccessArchive) Commit(ctx context.Context, repo repository.StateRepositoryInterface, rangeNumber uint64) error {
-	return repo.InsertRange(ctx, s.accountsByBlock, s.accountType, s.storageByBlock, rangeNumber)
+	return repo.InsertRangeWithSources(ctx, s.accountsByBlock, s.accountType, s.storageByBlock, rangeNumber)
+}
+
+func (s *stateAccessArchive) CommitBlocks(ctx context.Context, repo repository.StateRepositoryInterface, lastBlock uint64, lastBlockHash string) error {
+	return repo.InsertBlocksWithSources(ctx, s.accountsByBlock, s.accountType, s.storageByBlock, lastBlock, lastBlockHash)
 }
 
 func (s *stateAccessArchive) Reset() {
-	s.accountsByBlock = make(map[uint64]map[string]struct{})
+	s.accountsByBlock = make(map[uint64]map[string]rpc.AccessSource)
 	s.accountType = make(map[string]bool)
 	s.storageByBlock = make(map[uint64]map[string]map[string]struct{})
 	s.count = 0
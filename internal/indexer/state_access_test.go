@@ -107,11 +107,11 @@ func TestStateAccessArchive(t *testing.T) {
 		sa := newStateAccessArchive()
 
 		// Add accounts to different blocks
-		err := sa.AddAccount(fixtures.EOAAddress1, fixtures.Block100, false)
+		err := sa.AddAccount(fixtures.EOAAddress1, fixtures.Block100, false, rpc.AccessSourceTransaction)
 		assert.NoError(t, err)
 		assert.Equal(t, 1, sa.Count())
 
-		err = sa.AddAccount(fixtures.ContractAddress1, fixtures.Block200, true)
+		err = sa.AddAccount(fixtures.ContractAddress1, fixtures.Block200, true, rpc.AccessSourceTransaction)
 		assert.NoError(t, err)
 		assert.Equal(t, 2, sa.Count())
 
@@ -128,15 +128,15 @@ func TestStateAccessArchive(t *testing.T) {
 		sa := newStateAccessArchive()
 
 		// Add same account to multiple blocks
-		err := sa.AddAccount(fixtures.EOAAddress1, fixtures.Block100, false)
+		err := sa.AddAccount(fixtures.EOAAddress1, fixtures.Block100, false, rpc.AccessSourceTransaction)
 		assert.NoError(t, err)
 		assert.Equal(t, 1, sa.Count())
 
-		err = sa.AddAccount(fixtures.EOAAddress1, fixtures.Block200, false)
+		err = sa.AddAccount(fixtures.EOAAddress1, fixtures.Block200, false, rpc.AccessSourceTransaction)
 		assert.NoError(t, err)
 		assert.Equal(t, 2, sa.Count()) // Count should increase
 
-		err = sa.AddAccount(fixtures.EOAAddress1, fixtures.Block300, false)
+		err = sa.AddAccount(fixtures.EOAAddress1, fixtures.Block300, false, rpc.AccessSourceTransaction)
 		assert.NoError(t, err)
 		assert.Equal(t, 3, sa.Count()) // Count should increase again
 
@@ -150,11 +150,11 @@ func TestStateAccessArchive(t *testing.T) {
 		sa := newStateAccessArchive()
 
 		// Add same account multiple times to same block
-		err := sa.AddAccount(fixtures.EOAAddress1, fixtures.Block100, false)
+		err := sa.AddAccount(fixtures.EOAAddress1, fixtures.Block100, false, rpc.AccessSourceTransaction)
 		assert.NoError(t, err)
 		assert.Equal(t, 1, sa.Count())
 
-		err = sa.AddAccount(fixtures.EOAAddress1, fixtures.Block100, false)
+		err = sa.AddAccount(fixtures.EOAAddress1, fixtures.Block100, false, rpc.AccessSourceTransaction)
 		assert.NoError(t, err)
 		assert.Equal(t, 1, sa.Count()) // Count should not increase for same block
 
@@ -186,7 +186,7 @@ func TestStateAccessArchive(t *testing.T) {
 		sa := newStateAccessArchive()
 
 		// Add some data
-		err := sa.AddAccount(fixtures.EOAAddress1, fixtures.Block100, false)
+		err := sa.AddAccount(fixtures.EOAAddress1, fixtures.Block100, false, rpc.AccessSourceTransaction)
 		assert.NoError(t, err)
 		sa.AddStorage(fixtures.ContractAddress1, fixtures.StorageSlot1, fixtures.Block100)
 		assert.Equal(t, 2, sa.Count())
@@ -213,11 +213,11 @@ func TestStateAccessCommit(t *testing.T) {
 		ctx := context.Background()
 
 		// Add test data with multiple blocks
-		err := sa.AddAccount(fixtures.EOAAddress1, fixtures.Block100, false)
+		err := sa.AddAccount(fixtures.EOAAddress1, fixtures.Block100, false, rpc.AccessSourceTransaction)
 		require.NoError(t, err)
-		err = sa.AddAccount(fixtures.EOAAddress1, fixtures.Block200, false)
+		err = sa.AddAccount(fixtures.EOAAddress1, fixtures.Block200, false, rpc.AccessSourceTransaction)
 		require.NoError(t, err)
-		err = sa.AddAccount(fixtures.ContractAddress1, fixtures.Block200, true)
+		err = sa.AddAccount(fixtures.ContractAddress1, fixtures.Block200, true, rpc.AccessSourceTransaction)
 		require.NoError(t, err)
 		sa.AddStorage(fixtures.ContractAddress1, fixtures.StorageSlot1, fixtures.Block200)
 
@@ -236,11 +236,11 @@ func TestStateAccessBehaviorDifferences(t *testing.T) {
 		saArchive := newStateAccessArchive()
 
 		// Add same account multiple times to different blocks
-		err := saArchive.AddAccount(fixtures.EOAAddress1, fixtures.Block100, false)
+		err := saArchive.AddAccount(fixtures.EOAAddress1, fixtures.Block100, false, rpc.AccessSourceTransaction)
 		require.NoError(t, err)
-		err = saArchive.AddAccount(fixtures.EOAAddress1, fixtures.Block200, false)
+		err = saArchive.AddAccount(fixtures.EOAAddress1, fixtures.Block200, false, rpc.AccessSourceTransaction)
 		require.NoError(t, err)
-		err = saArchive.AddAccount(fixtures.EOAAddress1, fixtures.Block300, false)
+		err = saArchive.AddAccount(fixtures.EOAAddress1, fixtures.Block300, false, rpc.AccessSourceTransaction)
 		require.NoError(t, err)
 
 		// Archive mode should count all access events
@@ -264,9 +264,9 @@ func TestStateAccessBehaviorDifferences(t *testing.T) {
 
 		// Archive mode stores: block -> set of addresses
 		saArchive := newStateAccessArchive()
-		err := saArchive.AddAccount(fixtures.EOAAddress1, fixtures.Block100, false)
+		err := saArchive.AddAccount(fixtures.EOAAddress1, fixtures.Block100, false, rpc.AccessSourceTransaction)
 		require.NoError(t, err)
-		err = saArchive.AddAccount(fixtures.EOAAddress1, fixtures.Block200, false)
+		err = saArchive.AddAccount(fixtures.EOAAddress1, fixtures.Block200, false, rpc.AccessSourceTransaction)
 		require.NoError(t, err)
 
 		// Should store all block access events
@@ -286,7 +286,7 @@ func TestStateAccessMemoryManagement(t *testing.T) {
 			addr := generateTestAddress(i)
 			block := uint64(1000 + i)
 
-			err := saArchive.AddAccount(addr, block, i%2 == 0)
+			err := saArchive.AddAccount(addr, block, i%2 == 0, rpc.AccessSourceTransaction)
 			require.NoError(t, err)
 		}
 
@@ -337,7 +337,7 @@ func TestStateAccessEdgeCases(t *testing.T) {
 		saArchive := newStateAccessArchive()
 
 		// Add accounts at block 0 (genesis)
-		err := saArchive.AddAccount(fixtures.EOAAddress1, 0, false)
+		err := saArchive.AddAccount(fixtures.EOAAddress1, 0, false, rpc.AccessSourceTransaction)
 		assert.NoError(t, err)
 
 		// Add storage at block 0
@@ -350,7 +350,7 @@ func TestStateAccessEdgeCases(t *testing.T) {
 		saArchive := newStateAccessArchive()
 
 		// Add empty address (should work but not be realistic)
-		err := saArchive.AddAccount("", fixtures.Block100, false)
+		err := saArchive.AddAccount("", fixtures.Block100, false, rpc.AccessSourceTransaction)
 		assert.NoError(t, err)
 
 		// Add storage with empty address
@@ -364,7 +364,7 @@ func TestStateAccessEdgeCases(t *testing.T) {
 
 		largeBlock := uint64(18446744073709551615) // Max uint64
 
-		err := saArchive.AddAccount(fixtures.EOAAddress1, largeBlock, false)
+		err := saArchive.AddAccount(fixtures.EOAAddress1, largeBlock, false, rpc.AccessSourceTransaction)
 		assert.NoError(t, err)
 
 		assert.Equal(t, 1, saArchive.Count())
@@ -0,0 +1,93 @@
+package indexer
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/weiihann/state-expiry-indexer/pkg/storage"
+)
+
+// tailBlock is the last block indexed one at a time, with its hash
+type tailBlock struct {
+	number uint64
+	hash   string
+}
+
+// processTail indexes the final blocks of a range that is not complete yet, so the newest blocks
+// are indexed without waiting for the whole range. Blocks up to lastIndexedBlock are indexed
+// already. Once the range is complete it is processed as a whole, skipping the blocks indexed here.
+func (s *Service) processTail(ctx context.Context, rangeNumber, lastIndexedBlock, finalBlock uint64) error {
+	rangeProcessor := s.indexer.rangeProcessor
+	start, end := rangeProcessor.GetRangeBlockNumbers(rangeNumber)
+	from := max(start, lastIndexedBlock+1)
+	to := min(end, finalBlock)
+	if rangeNumber == 0 || from > to {
+		return nil
+	}
+
+	// After a restart the hash of the last block indexed one at a time is read back
+	if s.tail.number != lastIndexedBlock {
+		hash, err := s.repo.GetLastIndexedBlockHash(ctx)
+		if err != nil {
+			return fmt.Errorf("could not get last indexed block hash: %w", err)
+		}
+		s.tail = tailBlock{number: lastIndexedBlock, hash: hash}
+	}
+
+	blocks, err := rangeProcessor.FetchBlocks(ctx, rangeNumber, from, to)
+	if err != nil {
+		return err
+	}
+
+	// The blocks indexed by the previous cycle are no longer on the canonical chain
+	if s.tail.hash != "" && s.tail.number == from-1 && blocks[0].ParentHash != "" && blocks[0].ParentHash != s.tail.hash {
+		return s.rollbackTail(ctx, rangeNumber, blocks[0])
+	}
+
+	if err := s.indexer.prefillAccountCache(ctx, blocks); err != nil {
+		return fmt.Errorf("could not determine account types in blocks %d-%d: %w", from, to, err)
+	}
+
+	sa := newStateAccessArchive()
+	for _, block := range blocks {
+		if err := s.indexer.processBlockDiff(ctx, block, sa); err != nil {
+			return fmt.Errorf("could not process block %d: %w", block.BlockNum, err)
+		}
+	}
+	hash := blocks[len(blocks)-1].Hash
+	if err := sa.CommitBlocks(ctx, s.repo, to, hash); err != nil {
+		return fmt.Errorf("could not commit blocks %d-%d: %w", from, to, err)
+	}
+	s.tail = tailBlock{number: to, hash: hash}
+
+	s.log.Info("Indexed blocks of incomplete range",
+		"range_number", rangeNumber,
+		"from_block", from,
+		"to_block", to,
+		"count", sa.Count())
+
+	return nil
+}
+
+// rollbackTail removes the blocks of a range indexed one at a time after the chain reorganized
+// under them. The next cycle indexes the range again from its first block, which must build on
+// the previous range file.
+func (s *Service) rollbackTail(ctx context.Context, rangeNumber uint64, first storage.ReadRangeDiffs) error {
+	start, _ := s.indexer.rangeProcessor.GetRangeBlockNumbers(rangeNumber)
+
+	s.log.Warn("Chain reorganization detected in blocks indexed one at a time",
+		"detected_at_block", first.BlockNum,
+		"stored_hash", s.tail.hash,
+		"parent_hash", first.ParentHash,
+		"range_number", rangeNumber)
+
+	if err := s.repo.Rollback(ctx, start-1, rangeNumber-1); err != nil {
+		return fmt.Errorf("could not roll back blocks of range %d: %w", rangeNumber, err)
+	}
+
+	// Accounts created on the abandoned fork may not be contracts on the canonical chain
+	s.indexer.accountCache.Reset()
+	s.tail = tailBlock{}
+
+	return nil
+}
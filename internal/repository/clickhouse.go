@@ -8,7 +8,9 @@ import (
 	"strings"
 	"time"
 
+	"github.com/ClickHouse/clickhouse-go/v2"
 	"github.com/weiihann/state-expiry-indexer/internal/logger"
+	"github.com/weiihann/state-expiry-indexer/pkg/rpc"
 )
 
 // ClickHouseRepository implements StateRepositoryInterface for ClickHouse archive mode
@@ -23,50 +25,88 @@ func NewClickHouseRepository(db *sql.DB) *ClickHouseRepository {
 	return &ClickHouseRepository{db: db}
 }
 
+// Metadata keys tracking indexing progress
+const (
+	metadataLastIndexedRange = "last_indexed_range"
+	metadataLastIndexedBlock = "last_indexed_block"
+	// metadataLastIndexedBlockHash is the hash of the last indexed block, to detect reorgs under it
+	metadataLastIndexedBlockHash = "last_indexed_block_hash"
+)
+
 // Range-based processing methods (used by indexer)
 func (r *ClickHouseRepository) GetLastIndexedRange(ctx context.Context) (uint64, error) {
+	return r.getMetadataNumber(ctx, metadataLastIndexedRange)
+}
+
+// GetLastIndexedBlock returns the last block indexed on its own, before its range was complete
+func (r *ClickHouseRepository) GetLastIndexedBlock(ctx context.Context) (uint64, error) {
+	return r.getMetadataNumber(ctx, metadataLastIndexedBlock)
+}
+
+// GetLastIndexedBlockHash returns the hash of the last block indexed on its own, empty if it is not known
+func (r *ClickHouseRepository) GetLastIndexedBlockHash(ctx context.Context) (string, error) {
+	return r.getMetadataValue(ctx, metadataLastIndexedBlockHash)
+}
+
+// getMetadataValue returns the latest value stored under a metadata key, empty if there is none
+func (r *ClickHouseRepository) getMetadataValue(ctx context.Context, key string) (string, error) {
 	log := logger.GetLogger("clickhouse-repo")
 
 	tx, err := r.db.BeginTx(ctx, nil)
 	if err != nil {
 		log.Error("Could not begin transaction", "error", err)
-		return 0, fmt.Errorf("could not begin transaction: %w", err)
+		return "", fmt.Errorf("could not begin transaction: %w", err)
 	}
 	defer tx.Rollback()
 
 	var value string
 	// Use argMax to get the most recent value based on updated_at timestamp
 	// This ensures we get the latest value even before background merges occur
-	query := "SELECT argMax(value, updated_at) FROM metadata_archive WHERE key = 'last_indexed_range'"
-	err = tx.QueryRowContext(ctx, query).Scan(&value)
+	query := "SELECT argMax(value, updated_at) FROM metadata_archive WHERE key = ?"
+	err = tx.QueryRowContext(ctx, query, key).Scan(&value)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			// This can happen if the metadata table is empty. Assume we start from 0.
-			log.Info("No last indexed range found, starting from 0")
-			return 0, nil
+			// This can happen if the metadata table is empty
+			log.Info("No metadata value found", "key", key)
+			return "", nil
 		}
-		log.Error("Could not get last indexed range", "error", err)
-		return 0, fmt.Errorf("could not get last indexed range: %w", err)
+		log.Error("Could not get metadata value", "key", key, "error", err)
+		return "", fmt.Errorf("could not get %s: %w", key, err)
+	}
+	return value, nil
+}
+
+// getMetadataNumber returns the latest number stored under a metadata key, 0 if there is none
+func (r *ClickHouseRepository) getMetadataNumber(ctx context.Context, key string) (uint64, error) {
+	log := logger.GetLogger("clickhouse-repo")
+
+	value, err := r.getMetadataValue(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	// argMax over no rows returns an empty value, start from 0
+	if value == "" {
+		return 0, nil
 	}
 
-	var rangeNumber uint64
-	if _, err := fmt.Sscanf(value, "%d", &rangeNumber); err != nil {
-		log.Error("Could not parse last indexed range value", "value", value, "error", err)
-		return 0, fmt.Errorf("could not parse last indexed range value '%s': %w", value, err)
+	var number uint64
+	if _, err := fmt.Sscanf(value, "%d", &number); err != nil {
+		log.Error("Could not parse metadata value", "key", key, "value", value, "error", err)
+		return 0, fmt.Errorf("could not parse %s value '%s': %w", key, value, err)
 	}
 
-	log.Debug("Retrieved last indexed range", "range_number", rangeNumber)
-	return rangeNumber, nil
+	log.Debug("Retrieved metadata value", "key", key, "value", number)
+	return number, nil
 }
 
-// updateLastIndexedRangeInTx updates the last indexed range in metadata
-func (r *ClickHouseRepository) updateLastIndexedRangeInTx(ctx context.Context, tx *sql.Tx, rangeNumber uint64) error {
+// setMetadataInTx stores a value under a metadata key
+func (r *ClickHouseRepository) setMetadataInTx(ctx context.Context, tx *sql.Tx, key string, value string) error {
 	// ClickHouse uses ReplacingMergeTree, so we can simply INSERT the new value
 	query := `INSERT INTO metadata_archive (key, value) VALUES (?, ?)`
 
-	_, err := tx.ExecContext(ctx, query, "last_indexed_range", fmt.Sprintf("%d", rangeNumber))
+	_, err := tx.ExecContext(ctx, query, key, value)
 	if err != nil {
-		return fmt.Errorf("could not update last indexed range: %w", err)
+		return fmt.Errorf("could not update %s: %w", key, err)
 	}
 
 	return nil
@@ -81,6 +121,12 @@ func (r *ClickHouseRepository) GetSyncStatus(ctx context.Context, latestRange ui
 		return nil, fmt.Errorf("could not get last indexed range: %w", err)
 	}
 
+	lastIndexedBlock, err := r.GetLastIndexedBlock(ctx)
+	if err != nil {
+		log.Error("Could not get last indexed block for sync status", "error", err)
+		return nil, fmt.Errorf("could not get last indexed block: %w", err)
+	}
+
 	// Calculate the end block of the last indexed range
 	var endBlock uint64
 	if lastIndexedRange == 0 {
@@ -88,34 +134,104 @@ func (r *ClickHouseRepository) GetSyncStatus(ctx context.Context, latestRange ui
 	} else {
 		endBlock = lastIndexedRange * rangeSize
 	}
+	// Blocks of the range that is not complete yet are indexed one at a time
+	endBlock = max(endBlock, lastIndexedBlock)
 
-	isSynced := lastIndexedRange >= latestRange
+	// Synced once every block before the range of the latest block is indexed
+	isSynced := lastIndexedRange >= latestRange || (latestRange > 0 && endBlock > (latestRange-1)*rangeSize)
 
 	log.Debug("Retrieved sync status",
 		"is_synced", isSynced,
 		"last_indexed_range", lastIndexedRange,
+		"last_indexed_block", lastIndexedBlock,
 		"latest_range", latestRange,
 		"end_block", endBlock)
 
 	return &SyncStatus{
 		IsSynced:         isSynced,
 		LastIndexedRange: lastIndexedRange,
+		LastIndexedBlock: lastIndexedBlock,
 		EndBlock:         endBlock,
 	}, nil
 }
 
-// InsertRange processes all events for archive mode (stores ALL events, not just latest)
+// InsertRange processes all events for archive mode (stores ALL events, not just latest).
+// Every account access is recorded as made by a transaction.
 func (r *ClickHouseRepository) InsertRange(
 	ctx context.Context,
 	accountAccesses map[uint64]map[string]struct{},
 	accountType map[string]bool,
 	storageAccesses map[uint64]map[string]map[string]struct{},
 	rangeNumber uint64,
+) error {
+	accountSources := make(map[uint64]map[string]rpc.AccessSource, len(accountAccesses))
+	for blockNumber, accounts := range accountAccesses {
+		accountSources[blockNumber] = make(map[string]rpc.AccessSource, len(accounts))
+		for addr := range accounts {
+			accountSources[blockNumber][addr] = rpc.AccessSourceTransaction
+		}
+	}
+	return r.InsertRangeWithSources(ctx, accountSources, accountType, storageAccesses, rangeNumber)
+}
+
+// InsertRangeWithSources processes all events for archive mode, recording what touched each account
+func (r *ClickHouseRepository) InsertRangeWithSources(
+	ctx context.Context,
+	accountAccesses map[uint64]map[string]rpc.AccessSource,
+	accountType map[string]bool,
+	storageAccesses map[uint64]map[string]map[string]struct{},
+	rangeNumber uint64,
 ) error {
 	log := logger.GetLogger("clickhouse-repo")
 
 	log.Info("Inserting range", "range_number", rangeNumber)
 
+	progress := map[string]string{metadataLastIndexedRange: fmt.Sprintf("%d", rangeNumber)}
+	if err := r.insertAccesses(ctx, accountAccesses, accountType, storageAccesses, progress); err != nil {
+		return err
+	}
+
+	log.Info("Successfully inserted range", "range", rangeNumber)
+
+	return nil
+}
+
+// InsertBlocksWithSources records the accesses of blocks indexed one at a time, before their range
+// is complete, and sets the last indexed block to lastBlock with hash lastBlockHash
+func (r *ClickHouseRepository) InsertBlocksWithSources(
+	ctx context.Context,
+	accountAccesses map[uint64]map[string]rpc.AccessSource,
+	accountType map[string]bool,
+	storageAccesses map[uint64]map[string]map[string]struct{},
+	lastBlock uint64,
+	lastBlockHash string,
+) error {
+	log := logger.GetLogger("clickhouse-repo")
+
+	progress := map[string]string{
+		metadataLastIndexedBlock:     fmt.Sprintf("%d", lastBlock),
+		metadataLastIndexedBlockHash: lastBlockHash,
+	}
+	if err := r.insertAccesses(ctx, accountAccesses, accountType, storageAccesses, progress); err != nil {
+		return err
+	}
+
+	log.Debug("Successfully inserted blocks", "last_block", lastBlock)
+
+	return nil
+}
+
+// insertAccesses inserts account and storage access events and stores progress under metadata
+// keys in a single transaction
+func (r *ClickHouseRepository) insertAccesses(
+	ctx context.Context,
+	accountAccesses map[uint64]map[string]rpc.AccessSource,
+	accountType map[string]bool,
+	storageAccesses map[uint64]map[string]map[string]struct{},
+	progress map[string]string,
+) error {
+	log := logger.GetLogger("clickhouse-repo")
+
 	// Start transaction
 	tx, err := r.db.BeginTx(ctx, nil)
 	if err != nil {
@@ -136,10 +252,12 @@ func (r *ClickHouseRepository) InsertRange(
 		return fmt.Errorf("could not insert all storage access events: %w", err)
 	}
 
-	// Update the last indexed range
-	if err := r.updateLastIndexedRangeInTx(ctx, tx, rangeNumber); err != nil {
-		log.Error("Could not update last indexed range", "error", err)
-		return fmt.Errorf("could not update last indexed range: %w", err)
+	// Update the indexing progress
+	for key, value := range progress {
+		if err := r.setMetadataInTx(ctx, tx, key, value); err != nil {
+			log.Error("Could not update indexing progress", "key", key, "error", err)
+			return err
+		}
 	}
 
 	// Commit transaction
@@ -148,8 +266,6 @@ func (r *ClickHouseRepository) InsertRange(
 		return fmt.Errorf("could not commit transaction: %w", err)
 	}
 
-	log.Info("Successfully inserted range", "range", rangeNumber)
-
 	return nil
 }
 
@@ -157,7 +273,7 @@ func (r *ClickHouseRepository) InsertRange(
 func (r *ClickHouseRepository) insertAllAccountAccessEventsInTx(
 	ctx context.Context,
 	tx *sql.Tx,
-	accountAccesses map[uint64]map[string]struct{},
+	accountAccesses map[uint64]map[string]rpc.AccessSource,
 	accountType map[string]bool,
 ) error {
 	if len(accountAccesses) == 0 {
@@ -167,7 +283,7 @@ func (r *ClickHouseRepository) insertAllAccountAccessEventsInTx(
 	log := logger.GetLogger("clickhouse-repo")
 
 	// ClickHouse INSERT statement for accounts_archive table
-	query := `INSERT INTO accounts_archive (address, block_number, is_contract) VALUES `
+	query := `INSERT INTO accounts_archive (address, block_number, is_contract, access_source) VALUES `
 
 	var values []interface{}
 	var placeholders []string
@@ -182,7 +298,7 @@ func (r *ClickHouseRepository) insertAllAccountAccessEventsInTx(
 	})
 
 	for _, blockNumber := range blockNumbers {
-		for addr := range accountAccesses[blockNumber] {
+		for addr, source := range accountAccesses[blockNumber] {
 			// Clean the address hex string (remove 0x prefix and ensure proper length)
 			addressHex := strings.TrimPrefix(addr, "0x")
 
@@ -191,14 +307,14 @@ func (r *ClickHouseRepository) insertAllAccountAccessEventsInTx(
 				return fmt.Errorf("invalid address length: %s", addr)
 			}
 
-			placeholders = append(placeholders, "(unhex(?), ?, ?)")
+			placeholders = append(placeholders, "(unhex(?), ?, ?, ?)")
 			values = append(values, addressHex, blockNumber, func() uint8 {
 				isContract := accountType[addr]
 				if isContract {
 					return 1
 				}
 				return 0
-			}())
+			}(), uint8(source))
 		}
 	}
 
@@ -293,6 +409,97 @@ func (r *ClickHouseRepository) insertAllStorageAccessEventsInTx(ctx context.Cont
 	return nil
 }
 
+// rollbackStatements undo every access after a block. The derived tables are fed by
+// materialized views that cannot subtract, so the rows of every address accessed after
+// the block are deleted and rebuilt from the archive tables, which are trimmed last.
+// Every statement can be repeated, so an interrupted rollback is finished by running it again.
+var rollbackStatements = []string{
+	`ALTER TABLE accounts_state DELETE WHERE last_access_block > ?`,
+	`INSERT INTO accounts_state (address, is_contract, last_access_block)
+	SELECT address, argMax(is_contract, block_number), max(block_number)
+	FROM accounts_archive
+	WHERE block_number <= ? AND address IN (SELECT address FROM accounts_archive WHERE block_number > ?)
+	GROUP BY address`,
+	`ALTER TABLE storage_state DELETE WHERE last_access_block > ?`,
+	`INSERT INTO storage_state (address, slot_key, last_access_block)
+	SELECT address, slot_key, max(block_number)
+	FROM storage_archive
+	WHERE block_number <= ? AND (address, slot_key) IN (SELECT address, slot_key FROM storage_archive WHERE block_number > ?)
+	GROUP BY address, slot_key`,
+	`ALTER TABLE account_access_count_agg DELETE WHERE address IN (SELECT address FROM accounts_archive WHERE block_number > ?)`,
+	`INSERT INTO account_access_count_agg (address, is_contract_state, access_count)
+	SELECT address, argMaxState(is_contract, block_number), countState()
+	FROM accounts_archive
+	WHERE block_number <= ? AND address IN (SELECT address FROM accounts_archive WHERE block_number > ?)
+	GROUP BY address`,
+	`ALTER TABLE storage_access_count_agg DELETE WHERE (address, slot_key) IN (SELECT address, slot_key FROM storage_archive WHERE block_number > ?)`,
+	`INSERT INTO storage_access_count_agg (address, slot_key, access_count)
+	SELECT address, slot_key, countState()
+	FROM storage_archive
+	WHERE block_number <= ? AND (address, slot_key) IN (SELECT address, slot_key FROM storage_archive WHERE block_number > ?)
+	GROUP BY address, slot_key`,
+	`ALTER TABLE contract_storage_count_agg DELETE WHERE address IN (SELECT address FROM storage_archive WHERE block_number > ?)`,
+	`INSERT INTO contract_storage_count_agg (address, total_slots)
+	SELECT address, uniqState(slot_key)
+	FROM storage_archive
+	WHERE block_number <= ? AND address IN (SELECT address FROM storage_archive WHERE block_number > ?)
+	GROUP BY address`,
+	`ALTER TABLE accounts_block_summary DELETE WHERE block_number > ?`,
+	`ALTER TABLE storage_block_summary DELETE WHERE block_number > ?`,
+	`ALTER TABLE accounts_archive DELETE WHERE block_number > ?`,
+	`ALTER TABLE storage_archive DELETE WHERE block_number > ?`,
+}
+
+// Rollback removes every access after lastBlock and sets the last indexed range to lastIndexedRange.
+// A last indexed block past lastBlock is moved back to lastBlock.
+func (r *ClickHouseRepository) Rollback(ctx context.Context, lastBlock uint64, lastIndexedRange uint64) error {
+	log := logger.GetLogger("clickhouse-repo")
+
+	log.Warn("Rolling back indexed data", "last_block", lastBlock, "last_indexed_range", lastIndexedRange)
+
+	// Later statements read what earlier deletes left behind, so wait for every mutation to finish
+	ctx = clickhouse.Context(ctx, clickhouse.WithSettings(clickhouse.Settings{"mutations_sync": 2}))
+
+	for _, statement := range rollbackStatements {
+		args := make([]any, strings.Count(statement, "?"))
+		for i := range args {
+			args[i] = lastBlock
+		}
+		if _, err := r.db.ExecContext(ctx, statement, args...); err != nil {
+			log.Error("Could not roll back indexed data", "statement", statement, "error", err)
+			return fmt.Errorf("could not roll back indexed data after block %d: %w", lastBlock, err)
+		}
+	}
+
+	// Blocks indexed one at a time past lastBlock are gone too. The hash of lastBlock is not known,
+	// so it is cleared.
+	lastIndexedBlock, err := r.GetLastIndexedBlock(ctx)
+	if err != nil {
+		return err
+	}
+	query := `INSERT INTO metadata_archive (key, value) VALUES (?, ?)`
+	if lastIndexedBlock > lastBlock {
+		if _, err := r.db.ExecContext(ctx, query, metadataLastIndexedBlock, fmt.Sprintf("%d", lastBlock)); err != nil {
+			log.Error("Could not update last indexed block", "error", err)
+			return fmt.Errorf("could not update last indexed block: %w", err)
+		}
+		if _, err := r.db.ExecContext(ctx, query, metadataLastIndexedBlockHash, ""); err != nil {
+			log.Error("Could not clear last indexed block hash", "error", err)
+			return fmt.Errorf("could not clear last indexed block hash: %w", err)
+		}
+	}
+
+	// The range is only moved back once the data is gone, so a failed rollback is retried
+	if _, err := r.db.ExecContext(ctx, query, metadataLastIndexedRange, fmt.Sprintf("%d", lastIndexedRange)); err != nil {
+		log.Error("Could not update last indexed range", "error", err)
+		return fmt.Errorf("could not update last indexed range: %w", err)
+	}
+
+	log.Info("Successfully rolled back indexed data", "last_block", lastBlock, "last_indexed_range", lastIndexedRange)
+
+	return nil
+}
+
 // ==============================================================================
 // OPTIMIZED ANALYTICS METHODS (Questions 1-15)
 // ==============================================================================
@@ -11,6 +11,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/weiihann/state-expiry-indexer/internal/testdb"
+	"github.com/weiihann/state-expiry-indexer/pkg/rpc"
 
 	// ClickHouse database drivers
 	_ "github.com/ClickHouse/clickhouse-go/v2"
@@ -467,6 +468,138 @@ func TestClickHouseGetSyncStatus(t *testing.T) {
 		assert.Equal(t, uint64(100), status.LastIndexedRange)
 		assert.Equal(t, uint64(100*10), status.EndBlock)
 	})
+
+	t.Run("BlocksOfIncompleteRange", func(t *testing.T) {
+		repo, cleanup := setupClickHouseTestRepository(t)
+		defer cleanup()
+
+		ctx := context.Background()
+
+		// Ranges up to 99 are complete, blocks of range 100 are indexed one at a time
+		accounts := map[uint64]map[string]rpc.AccessSource{995: {"0x1234567890123456789012345678901234567890": rpc.AccessSourceTransaction}}
+		accountType := map[string]bool{"0x1234567890123456789012345678901234567890": false}
+		storage := map[uint64]map[string]map[string]struct{}{}
+
+		require.NoError(t, repo.InsertRange(ctx, map[uint64]map[string]struct{}{}, accountType, storage, 99))
+		require.NoError(t, repo.InsertBlocksWithSources(ctx, accounts, accountType, storage, 995, "0x995"))
+
+		status, err := repo.GetSyncStatus(ctx, 100, 10)
+		require.NoError(t, err)
+
+		assert.True(t, status.IsSynced, "Should be synced when indexing the latest range")
+		assert.Equal(t, uint64(99), status.LastIndexedRange)
+		assert.Equal(t, uint64(995), status.LastIndexedBlock)
+		assert.Equal(t, uint64(995), status.EndBlock)
+	})
+}
+
+// TestClickHouseInsertBlocks tests tracking blocks indexed one at a time
+func TestClickHouseInsertBlocks(t *testing.T) {
+	repo, cleanup := setupClickHouseTestRepository(t)
+	t.Cleanup(cleanup)
+
+	ctx := t.Context()
+
+	lastBlock, err := repo.GetLastIndexedBlock(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0), lastBlock)
+
+	eoa := generateClickHouseTestAddress(1)
+	accountType := map[string]bool{eoa: false}
+	storage := map[uint64]map[string]map[string]struct{}{}
+
+	require.NoError(t, repo.InsertRange(ctx, map[uint64]map[string]struct{}{5: {eoa: {}}}, accountType, storage, 1))
+	for block := uint64(11); block <= 13; block++ {
+		accounts := map[uint64]map[string]rpc.AccessSource{block: {eoa: rpc.AccessSourceTransaction}}
+		require.NoError(t, repo.InsertBlocksWithSources(ctx, accounts, accountType, storage, block, fmt.Sprintf("0x%x", block)))
+	}
+
+	lastBlock, err = repo.GetLastIndexedBlock(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(13), lastBlock)
+	lastHash, err := repo.GetLastIndexedBlockHash(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "0xd", lastHash)
+	lastRange, err := repo.GetLastIndexedRange(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), lastRange, "blocks indexed one at a time do not complete a range")
+
+	accounts, err := repo.GetMostFrequentAccounts(ctx, 1)
+	require.NoError(t, err)
+	require.Len(t, accounts, 1)
+	assert.Equal(t, 4, accounts[0].AccessCount)
+
+	// Rolling back below the blocks moves the last indexed block back with them
+	require.NoError(t, repo.Rollback(ctx, 12, 1))
+	lastBlock, err = repo.GetLastIndexedBlock(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(12), lastBlock)
+	lastHash, err = repo.GetLastIndexedBlockHash(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, lastHash, "the hash of the block rolled back to is not known")
+
+	require.NoError(t, repo.Rollback(ctx, 20, 1))
+	lastBlock, err = repo.GetLastIndexedBlock(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(12), lastBlock, "a rollback past the last indexed block leaves it")
+}
+
+// TestClickHouseRollback tests removing accesses past a reorganized block
+func TestClickHouseRollback(t *testing.T) {
+	repo, cleanup := setupClickHouseTestRepository(t)
+	t.Cleanup(cleanup)
+
+	ctx := t.Context()
+
+	eoa := generateClickHouseTestAddress(1)
+	contract := generateClickHouseTestAddress(2)
+	accountType := map[string]bool{eoa: false, contract: true}
+
+	// Range 1 accesses the EOA at block 5 and the contract at block 8
+	accounts := map[uint64]map[string]struct{}{
+		5: {eoa: {}},
+		8: {contract: {}},
+	}
+	storage := map[uint64]map[string]map[string]struct{}{
+		8: {contract: {generateClickHouseTestStorageSlot(1): {}}},
+	}
+	require.NoError(t, repo.InsertRange(ctx, accounts, accountType, storage, 1))
+
+	// Range 2 accesses both again and a new contract slot, all of it is reorganized away
+	accounts = map[uint64]map[string]struct{}{
+		12: {eoa: {}, contract: {}},
+	}
+	storage = map[uint64]map[string]map[string]struct{}{
+		12: {contract: {generateClickHouseTestStorageSlot(1): {}, generateClickHouseTestStorageSlot(2): {}}},
+	}
+	require.NoError(t, repo.InsertRange(ctx, accounts, accountType, storage, 2))
+
+	require.NoError(t, repo.Rollback(ctx, 10, 1))
+
+	lastRange, err := repo.GetLastIndexedRange(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), lastRange)
+
+	// Only the EOA, last accessed at block 5, has expired by block 7
+	params := QueryParams{ExpiryBlock: 7, CurrentBlock: 10}
+	accountAnalytics, err := repo.GetAccountAnalytics(ctx, params)
+	require.NoError(t, err)
+	assert.Equal(t, 1, accountAnalytics.Total.EOAs)
+	assert.Equal(t, 1, accountAnalytics.Total.Contracts)
+	assert.Equal(t, 1, accountAnalytics.Expiry.ExpiredEOAs)
+	assert.Equal(t, 0, accountAnalytics.Expiry.ExpiredContracts)
+	assert.Equal(t, 2, accountAnalytics.SingleAccess.TotalSingleAccess, "accesses after the rollback block must not be counted")
+
+	storageAnalytics, err := repo.GetStorageAnalytics(ctx, params)
+	require.NoError(t, err)
+	assert.Equal(t, 1, storageAnalytics.Total.TotalSlots)
+	assert.Equal(t, 1, storageAnalytics.SingleAccess.SingleAccessSlots)
+
+	// Rolling back again is harmless
+	require.NoError(t, repo.Rollback(ctx, 10, 1))
+	storageAnalytics, err = repo.GetStorageAnalytics(ctx, params)
+	require.NoError(t, err)
+	assert.Equal(t, 1, storageAnalytics.Total.TotalSlots)
 }
 
 // TestGetAccountAnalytics provides comprehensive testing for the GetAccountAnalytics method
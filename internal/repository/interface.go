@@ -6,6 +6,7 @@ import (
 
 	"github.com/weiihann/state-expiry-indexer/db"
 	"github.com/weiihann/state-expiry-indexer/internal"
+	"github.com/weiihann/state-expiry-indexer/pkg/rpc"
 )
 
 // StateRepositoryInterface defines efficient methods for ClickHouse queries
@@ -20,7 +21,27 @@ type StateRepositoryInterface interface {
 		storageAccesses map[uint64]map[string]map[string]struct{},
 		rangeNumber uint64,
 	) error
+	InsertRangeWithSources(
+		ctx context.Context,
+		accountAccesses map[uint64]map[string]rpc.AccessSource,
+		accountType map[string]bool,
+		storageAccesses map[uint64]map[string]map[string]struct{},
+		rangeNumber uint64,
+	) error
+	// Blocks of the range that is not complete yet are indexed one at a time, tracked by the last indexed block
+	GetLastIndexedBlock(ctx context.Context) (uint64, error)
+	GetLastIndexedBlockHash(ctx context.Context) (string, error)
+	InsertBlocksWithSources(
+		ctx context.Context,
+		accountAccesses map[uint64]map[string]rpc.AccessSource,
+		accountType map[string]bool,
+		storageAccesses map[uint64]map[string]map[string]struct{},
+		lastBlock uint64,
+		lastBlockHash string,
+	) error
 	GetSyncStatus(ctx context.Context, latestRange uint64, rangeSize uint64) (*SyncStatus, error)
+	// Rollback removes every access after lastBlock, used when the chain reorganizes below indexed blocks
+	Rollback(ctx context.Context, lastBlock uint64, lastIndexedRange uint64) error
 
 	// ==============================================================================
 	// OPTIMIZED ANALYTICS METHODS (Questions 1-15)
@@ -271,6 +271,7 @@ func DefaultQueryParams() QueryParams {
 type SyncStatus struct {
 	IsSynced         bool   `json:"is_synced"`
 	LastIndexedRange uint64 `json:"last_indexed_range"`
+	LastIndexedBlock uint64 `json:"last_indexed_block"`
 	EndBlock         uint64 `json:"end_block"`
 }
 
@@ -0,0 +1,80 @@
+package internal
+
+import (
+	"fmt"
+
+	"github.com/weiihann/state-expiry-indexer/pkg/rpc"
+	"github.com/weiihann/state-expiry-indexer/pkg/storage"
+	"github.com/weiihann/state-expiry-indexer/pkg/utils"
+)
+
+// NewStorageBackend returns the storage backend selected by DATA_DIR, storing per-block and
+// range files in DATA_LAYOUT
+func (c *Config) NewStorageBackend() (storage.Backend, error) {
+	backend, err := c.NewRawStorageBackend()
+	if err != nil {
+		return nil, err
+	}
+	layout, err := storage.ParseLayout(c.DataLayout)
+	if err != nil {
+		return nil, err
+	}
+	return storage.WithLayout(backend, layout), nil
+}
+
+// NewRawStorageBackend returns the storage backend selected by DATA_DIR without a layout, for
+// commands that see files where they are actually stored
+func (c *Config) NewRawStorageBackend() (storage.Backend, error) {
+	return storage.NewBackend(c.DataDir, storage.S3Config{
+		Endpoint:        c.S3Endpoint,
+		Region:          c.S3Region,
+		AccessKeyID:     c.S3AccessKeyID,
+		SecretAccessKey: c.S3SecretAccessKey,
+	})
+}
+
+// NewZstdOptions returns the compression options of per-block files in backend: the level set
+// by COMPRESSION_LEVEL, the newest trained dictionary unless COMPRESSION_DICTIONARY is false,
+// and every stored dictionary for decompression
+func (c *Config) NewZstdOptions(backend storage.Backend) (utils.ZstdOptions, error) {
+	return storage.LoadZstdOptions(backend, c.CompressionLevel, c.CompressionDictionary)
+}
+
+// NewRangeSources returns the range sources listed in RANGE_SOURCES, in order. Per-block
+// files are read from the backend of rangeProcessor, with headers fetched through rpcClient.
+func (c *Config) NewRangeSources(rangeProcessor *storage.RangeProcessor, rpcClient rpc.ClientInterface) ([]storage.RangeSource, error) {
+	sources := make([]storage.RangeSource, 0, len(c.RangeSources))
+	for _, name := range c.RangeSources {
+		switch name {
+		case storage.SourceBlockFiles:
+			source, err := c.NewBlockFileSource(rangeProcessor, rpcClient)
+			if err != nil {
+				return nil, err
+			}
+			sources = append(sources, source)
+		case storage.SourceMirror:
+			mirror, err := storage.NewMirrorSource(c.MirrorURL)
+			if err != nil {
+				return nil, err
+			}
+			sources = append(sources, mirror)
+		case storage.SourceRPC:
+			sources = append(sources, rangeProcessor.RPCSource())
+		default:
+			return nil, fmt.Errorf("unknown range source %q", name)
+		}
+	}
+	return sources, nil
+}
+
+// NewBlockFileSource returns the source of per-block files in the backend of rangeProcessor,
+// decompressed with every stored dictionary and with headers fetched through rpcClient
+func (c *Config) NewBlockFileSource(rangeProcessor *storage.RangeProcessor, rpcClient rpc.ClientInterface) (*storage.BlockFileSource, error) {
+	dictionaries, err := storage.LoadDictionaries(rangeProcessor.Backend())
+	if err != nil {
+		return nil, err
+	}
+	source := storage.NewBlockFileSource(rangeProcessor.Backend(), rpcClient, rangeProcessor.AccessMode())
+	source.SetDictionaries(dictionaries)
+	return source, nil
+}
@@ -0,0 +1,325 @@
+package rpc
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"math/big"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// BatchConfig controls how batched JSON-RPC calls are issued
+type BatchConfig struct {
+	// BatchSize is the number of calls sent in a single JSON-RPC batch request
+	BatchSize int
+	// Concurrency is the number of batch requests in flight at once
+	Concurrency int
+	// MaxRetries is how many times blocks that failed inside a batch are retried
+	MaxRetries int
+}
+
+// DefaultBatchConfig returns the default batch configuration
+func DefaultBatchConfig() BatchConfig {
+	return BatchConfig{
+		BatchSize:   100,
+		Concurrency: 4,
+		MaxRetries:  3,
+	}
+}
+
+// BatchError reports the blocks of a batched call that could not be fetched.
+// Results for every other block are still returned alongside it.
+type BatchError struct {
+	Failed map[uint64]error
+}
+
+func (e *BatchError) Error() string {
+	first := e.FirstFailed()
+	return fmt.Sprintf("%d blocks failed, first failed block %d: %v", len(e.Failed), first, e.Failed[first])
+}
+
+// Unwrap returns the error of the lowest failed block
+func (e *BatchError) Unwrap() error {
+	return e.Failed[e.FirstFailed()]
+}
+
+// FirstFailed returns the lowest block number that failed
+func (e *BatchError) FirstFailed() uint64 {
+	blocks := e.Blocks()
+	if len(blocks) == 0 {
+		return 0
+	}
+	return blocks[0]
+}
+
+// Blocks returns the failed block numbers in ascending order
+func (e *BatchError) Blocks() []uint64 {
+	blocks := make([]uint64, 0, len(e.Failed))
+	for block := range e.Failed {
+		blocks = append(blocks, block)
+	}
+	slices.Sort(blocks)
+	return blocks
+}
+
+// GetBlockAccessesBatch fetches the state accesses of many blocks using the tracer selected by mode
+func GetBlockAccessesBatch(ctx context.Context, client ClientInterface, mode AccessMode, blocks []uint64) (map[uint64][]TransactionResult, error) {
+	if mode == AccessModePrestate {
+		return client.GetPrestates(ctx, blocks)
+	}
+	return client.GetStateDiffs(ctx, blocks)
+}
+
+// FetchEach fetches blocks one at a time with a single-block method such as GetStateDiff.
+// It has the same partial-result semantics as the batched methods and is meant for
+// ClientInterface implementations that have no native batching.
+func FetchEach[R any](ctx context.Context, blocks []uint64, fetch func(context.Context, *big.Int) (R, error)) (map[uint64]R, error) {
+	results := make(map[uint64]R, len(blocks))
+	failed := make(map[uint64]error)
+	for _, block := range blocks {
+		if err := ctx.Err(); err != nil {
+			return results, err
+		}
+		result, err := fetch(ctx, new(big.Int).SetUint64(block))
+		if err != nil {
+			failed[block] = err
+			continue
+		}
+		results[block] = result
+	}
+
+	if len(failed) > 0 {
+		return results, &BatchError{Failed: failed}
+	}
+	return results, nil
+}
+
+// FetchCodes fetches the code of many accounts one at a time with a single-account method such
+// as GetCode. It is meant for ClientInterface implementations that have no native batching.
+func FetchCodes(ctx context.Context, accounts map[string]uint64, getCode func(context.Context, string, *big.Int) (string, error)) (map[string]string, error) {
+	results := make(map[string]string, len(accounts))
+	failed := make(map[string]error)
+	for address, block := range accounts {
+		if err := ctx.Err(); err != nil {
+			return results, err
+		}
+		code, err := getCode(ctx, address, new(big.Int).SetUint64(block))
+		if err != nil {
+			failed[address] = err
+			continue
+		}
+		results[address] = code
+	}
+	return results, accountsError(failed)
+}
+
+// accountsError reports the lowest failed account of a multi-account call, keeping its error class
+func accountsError(failed map[string]error) error {
+	if len(failed) == 0 {
+		return nil
+	}
+	first := slices.Min(slices.Collect(maps.Keys(failed)))
+	return fmt.Errorf("%d accounts failed, first failed account %s: %w", len(failed), first, failed[first])
+}
+
+// GetStateDiffs fetches the state diffs of many blocks with batched trace_replayBlockTransactions calls
+func (c *Client) GetStateDiffs(ctx context.Context, blocks []uint64) (map[uint64][]TransactionResult, error) {
+	return batchFetch(ctx, c, blocks,
+		func(block uint64) []any {
+			return []any{hexutil.EncodeUint64(block), []string{"stateDiff"}}
+		},
+		"trace_replayBlockTransactions",
+		func(block uint64, result *[]TransactionResult) ([]TransactionResult, error) {
+			return *result, nil
+		})
+}
+
+// GetPrestates fetches the prestate of many blocks with batched debug_traceBlockByNumber calls
+func (c *Client) GetPrestates(ctx context.Context, blocks []uint64) (map[uint64][]TransactionResult, error) {
+	return batchFetch(ctx, c, blocks,
+		func(block uint64) []any {
+			return []any{hexutil.EncodeUint64(block), prestateTracerConfig}
+		},
+		"debug_traceBlockByNumber",
+		func(block uint64, result *[]PrestateResult) ([]TransactionResult, error) {
+			return prestateToTransactionResults(fmt.Sprint(block), *result)
+		})
+}
+
+// GetBlockHeaders fetches the hash and parent hash of many blocks with batched eth_getBlockByNumber calls
+func (c *Client) GetBlockHeaders(ctx context.Context, blocks []uint64) (map[uint64]*Head, error) {
+	return batchFetch(ctx, c, blocks,
+		func(block uint64) []any {
+			return []any{hexutil.EncodeUint64(block), false}
+		},
+		"eth_getBlockByNumber",
+		func(block uint64, result **Head) (*Head, error) {
+			// Nodes answer null for blocks they have not seen yet
+			if *result == nil {
+				return nil, &TransientError{Err: fmt.Errorf("block %d not found", block)}
+			}
+			return *result, nil
+		})
+}
+
+// GetCodes fetches the code of many accounts with batched eth_getCode calls. Each account is
+// mapped to the block its code is read at.
+func (c *Client) GetCodes(ctx context.Context, accounts map[string]uint64) (map[string]string, error) {
+	results, failed, err := batchCall(ctx, c, slices.Collect(maps.Keys(accounts)),
+		func(address string) []any {
+			return []any{address, hexutil.EncodeUint64(accounts[address])}
+		},
+		"eth_getCode",
+		func(address string, result *string) (string, error) {
+			return *result, nil
+		})
+	if err != nil {
+		return results, err
+	}
+	return results, accountsError(failed)
+}
+
+// batchRetryDelay returns the delay before retrying failed calls of a batch, honouring Retry-After
+func batchRetryDelay[K comparable](attempt int, failed map[K]error) time.Duration {
+	delay := time.Duration(attempt) * 200 * time.Millisecond
+	for _, err := range failed {
+		if after := RetryAfter(err); after > delay {
+			delay = after
+		}
+	}
+	return delay
+}
+
+// batchFetch issues one call per block in bounded, concurrent JSON-RPC batches and
+// reports the blocks that could not be fetched in a BatchError
+func batchFetch[T, R any](
+	ctx context.Context,
+	c *Client,
+	blocks []uint64,
+	args func(block uint64) []any,
+	method string,
+	convert func(block uint64, result *T) (R, error),
+) (map[uint64]R, error) {
+	results, failed, err := batchCall(ctx, c, blocks, args, method, convert)
+	if err != nil {
+		return results, err
+	}
+	if len(failed) > 0 {
+		return results, &BatchError{Failed: failed}
+	}
+	return results, nil
+}
+
+// batchCall issues one call per key in bounded, concurrent JSON-RPC batches.
+// Keys that fail, either individually or because their whole batch failed, are retried
+// on their own until MaxRetries is exhausted, and are returned with their last error.
+func batchCall[K cmp.Ordered, T, R any](
+	ctx context.Context,
+	c *Client,
+	keys []K,
+	args func(key K) []any,
+	method string,
+	convert func(key K, result *T) (R, error),
+) (map[K]R, map[K]error, error) {
+	config := c.batch
+	results := make(map[K]R, len(keys))
+
+	pending := slices.Clone(keys)
+	slices.Sort(pending)
+	pending = slices.Compact(pending)
+
+	failed := make(map[K]error)
+	permanent := make(map[K]error)
+	for attempt := 0; attempt <= config.MaxRetries && len(pending) > 0; attempt++ {
+		if attempt > 0 {
+			c.logger.Debug("Retrying failed batch calls", "method", method, "calls", len(pending), "attempt", attempt)
+			select {
+			case <-ctx.Done():
+				return results, nil, ctx.Err()
+			case <-time.After(batchRetryDelay(attempt, failed)):
+			}
+		}
+
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		sem := make(chan struct{}, config.Concurrency)
+		failed = make(map[K]error)
+
+		for start := 0; start < len(pending); start += config.BatchSize {
+			chunk := pending[start:min(start+config.BatchSize, len(pending))]
+
+			select {
+			case <-ctx.Done():
+				wg.Wait()
+				return results, nil, ctx.Err()
+			case sem <- struct{}{}:
+			}
+
+			wg.Add(1)
+			go func(chunk []K) {
+				defer wg.Done()
+				defer func() { <-sem }()
+
+				elems := make([]rpc.BatchElem, len(chunk))
+				outputs := make([]*T, len(chunk))
+				for i, key := range chunk {
+					outputs[i] = new(T)
+					elems[i] = rpc.BatchElem{Method: method, Args: args(key), Result: outputs[i]}
+				}
+
+				err := c.eth.BatchCallContext(ctx, elems)
+
+				mu.Lock()
+				defer mu.Unlock()
+				for i, key := range chunk {
+					if err != nil {
+						failed[key] = Classify(err)
+						continue
+					}
+					if elems[i].Error != nil {
+						failed[key] = Classify(elems[i].Error)
+						continue
+					}
+					result, convErr := convert(key, outputs[i])
+					if convErr != nil {
+						// Malformed results will not improve on retry unless the converter says so
+						var transient *TransientError
+						if !errors.As(convErr, &transient) {
+							convErr = &PermanentError{Err: convErr}
+						}
+						failed[key] = convErr
+						continue
+					}
+					results[key] = result
+				}
+			}(chunk)
+		}
+		wg.Wait()
+
+		if ctx.Err() != nil {
+			return results, nil, ctx.Err()
+		}
+
+		// Only retry calls that may succeed, permanent failures are reported as they are
+		pending = pending[:0]
+		for key, err := range failed {
+			if IsRetryable(err) {
+				pending = append(pending, key)
+			} else {
+				permanent[key] = err
+				delete(failed, key)
+			}
+		}
+		slices.Sort(pending)
+	}
+
+	maps.Copy(failed, permanent)
+	return results, failed, nil
+}
@@ -0,0 +1,400 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/weiihann/state-expiry-indexer/internal/logger"
+	"github.com/weiihann/state-expiry-indexer/pkg/utils"
+)
+
+// ErrNotRecorded is returned by a ReplayClient for requests that are missing from the cassette
+var ErrNotRecorded = errors.New("request not recorded in cassette")
+
+// Interaction is a single recorded RPC request and its outcome
+type Interaction struct {
+	Method     string          `json:"method"`
+	Params     []string        `json:"params"`
+	Result     json.RawMessage `json:"result,omitempty"`
+	Error      string          `json:"error,omitempty"`
+	ErrorClass ErrorClass      `json:"errorClass,omitempty"`
+}
+
+func (i Interaction) key() string {
+	return i.Method + "(" + strings.Join(i.Params, ",") + ")"
+}
+
+// Cassette is an ordered log of RPC interactions, stored as zstd compressed JSON
+type Cassette struct {
+	mu           sync.Mutex
+	Interactions []Interaction `json:"interactions"`
+}
+
+// LoadCassette reads a cassette written by Save
+func LoadCassette(path string) (*Cassette, error) {
+	compressed, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cassette %s: %w", path, err)
+	}
+
+	decoder, err := utils.NewZstdDecoder()
+	if err != nil {
+		return nil, err
+	}
+	defer decoder.Close()
+
+	data, err := decoder.Decompress(compressed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress cassette %s: %w", path, err)
+	}
+
+	var cassette Cassette
+	if err := json.Unmarshal(data, &cassette); err != nil {
+		return nil, fmt.Errorf("failed to parse cassette %s: %w", path, err)
+	}
+	return &cassette, nil
+}
+
+// Save writes the cassette to path
+func (c *Cassette) Save(path string) error {
+	c.mu.Lock()
+	data, err := json.Marshal(c)
+	c.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to marshal cassette: %w", err)
+	}
+
+	encoder, err := utils.NewZstdEncoder()
+	if err != nil {
+		return err
+	}
+	defer encoder.Close()
+
+	compressed, err := encoder.Compress(data)
+	if err != nil {
+		return fmt.Errorf("failed to compress cassette: %w", err)
+	}
+
+	if err := utils.WriteFileAtomic(path, compressed, 0o644); err != nil {
+		return fmt.Errorf("failed to write cassette %s: %w", path, err)
+	}
+	return nil
+}
+
+// Len returns the number of recorded interactions
+func (c *Cassette) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.Interactions)
+}
+
+func (c *Cassette) add(interaction Interaction) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Interactions = append(c.Interactions, interaction)
+}
+
+// record appends the outcome of a call. Calls cancelled by the caller are not recorded.
+func (c *Cassette) record(method string, params []string, result any, err error) {
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+
+	interaction := Interaction{Method: method, Params: params}
+	if err != nil {
+		interaction.Error = err.Error()
+		interaction.ErrorClass = ClassOf(err)
+	} else {
+		data, marshalErr := json.Marshal(result)
+		if marshalErr != nil {
+			return
+		}
+		interaction.Result = data
+	}
+	c.add(interaction)
+}
+
+// blockParam encodes a block number the same way the client sends it
+func blockParam(blockNumber *big.Int) string {
+	if blockNumber == nil {
+		return "latest"
+	}
+	return hexutil.EncodeBig(blockNumber)
+}
+
+// RecordingClient is a ClientInterface decorator that records every request and
+// response of the wrapped client to a cassette. Batched calls are recorded per block
+// so they can be replayed by either the single or the batched methods.
+type RecordingClient struct {
+	inner    ClientInterface
+	cassette *Cassette
+	path     string
+	log      *slog.Logger
+}
+
+// Ensure RecordingClient implements ClientInterface
+var _ ClientInterface = (*RecordingClient)(nil)
+
+// NewRecordingClient records the calls made through inner. The cassette is written to path by Close.
+func NewRecordingClient(inner ClientInterface, path string) *RecordingClient {
+	return &RecordingClient{
+		inner:    inner,
+		cassette: &Cassette{},
+		path:     path,
+		log:      logger.GetLogger("rpc-recorder"),
+	}
+}
+
+// Unwrap returns the wrapped client
+func (r *RecordingClient) Unwrap() ClientInterface {
+	return r.inner
+}
+
+// Close writes the cassette to disk
+func (r *RecordingClient) Close() error {
+	if err := r.cassette.Save(r.path); err != nil {
+		return err
+	}
+	r.log.Info("Saved RPC cassette", "path", r.path, "interactions", r.cassette.Len())
+	return nil
+}
+
+func (r *RecordingClient) GetLatestBlockNumber(ctx context.Context) (*big.Int, error) {
+	result, err := r.inner.GetLatestBlockNumber(ctx)
+	var recorded any
+	if result != nil {
+		recorded = (*hexutil.Big)(result)
+	}
+	r.cassette.record("eth_blockNumber", nil, recorded, err)
+	return result, err
+}
+
+func (r *RecordingClient) GetBlockNumberByTag(ctx context.Context, tag BlockTag) (*big.Int, error) {
+	result, err := r.inner.GetBlockNumberByTag(ctx, tag)
+	var recorded any
+	if result != nil {
+		recorded = &Head{Number: hexutil.Uint64(result.Uint64())}
+	}
+	r.cassette.record("eth_getBlockByNumber", append([]string{string(tag)}, headerParams...), recorded, err)
+	return result, err
+}
+
+func (r *RecordingClient) GetCode(ctx context.Context, address string, blockNumber *big.Int) (string, error) {
+	result, err := r.inner.GetCode(ctx, address, blockNumber)
+	r.cassette.record("eth_getCode", []string{address, blockParam(blockNumber)}, result, err)
+	return result, err
+}
+
+// GetCodes records every account as its own eth_getCode call
+func (r *RecordingClient) GetCodes(ctx context.Context, accounts map[string]uint64) (map[string]string, error) {
+	results, err := r.inner.GetCodes(ctx, accounts)
+	for address, block := range accounts {
+		params := []string{address, hexutil.EncodeUint64(block)}
+		if code, ok := results[address]; ok {
+			r.cassette.record("eth_getCode", params, code, nil)
+		} else if err != nil {
+			r.cassette.record("eth_getCode", params, nil, err)
+		}
+	}
+	return results, err
+}
+
+func (r *RecordingClient) GetStateDiff(ctx context.Context, blockNumber *big.Int) ([]TransactionResult, error) {
+	result, err := r.inner.GetStateDiff(ctx, blockNumber)
+	r.cassette.record("trace_replayBlockTransactions", []string{blockParam(blockNumber)}, result, err)
+	return result, err
+}
+
+func (r *RecordingClient) GetPrestate(ctx context.Context, blockNumber *big.Int) ([]TransactionResult, error) {
+	result, err := r.inner.GetPrestate(ctx, blockNumber)
+	r.cassette.record("debug_traceBlockByNumber", []string{blockParam(blockNumber)}, result, err)
+	return result, err
+}
+
+func (r *RecordingClient) GetStateDiffs(ctx context.Context, blocks []uint64) (map[uint64][]TransactionResult, error) {
+	results, err := r.inner.GetStateDiffs(ctx, blocks)
+	recordBatch(r.cassette, "trace_replayBlockTransactions", nil, blocks, results, err)
+	return results, err
+}
+
+func (r *RecordingClient) GetPrestates(ctx context.Context, blocks []uint64) (map[uint64][]TransactionResult, error) {
+	results, err := r.inner.GetPrestates(ctx, blocks)
+	recordBatch(r.cassette, "debug_traceBlockByNumber", nil, blocks, results, err)
+	return results, err
+}
+
+func (r *RecordingClient) GetBlockHeaders(ctx context.Context, blocks []uint64) (map[uint64]*Head, error) {
+	results, err := r.inner.GetBlockHeaders(ctx, blocks)
+	recordBatch(r.cassette, "eth_getBlockByNumber", headerParams, blocks, results, err)
+	return results, err
+}
+
+// headerParams are the parameters sent after the block number by eth_getBlockByNumber
+var headerParams = []string{"false"}
+
+// recordBatch records the outcome of a batched call per block, followed by extra parameters
+func recordBatch[R any](cassette *Cassette, method string, extra []string, blocks []uint64, results map[uint64]R, err error) {
+	var batchErr *BatchError
+	errors.As(err, &batchErr)
+
+	for _, block := range blocks {
+		params := append([]string{hexutil.EncodeUint64(block)}, extra...)
+		if result, ok := results[block]; ok {
+			cassette.record(method, params, result, nil)
+			continue
+		}
+		if batchErr != nil {
+			if blockErr, ok := batchErr.Failed[block]; ok {
+				cassette.record(method, params, nil, blockErr)
+				continue
+			}
+		}
+		if err != nil {
+			cassette.record(method, params, nil, err)
+		}
+	}
+}
+
+// ReplayClient serves responses from a cassette without touching the network.
+// Repeated requests are served in recorded order, and the last response is
+// repeated once they run out.
+type ReplayClient struct {
+	mu        sync.Mutex
+	responses map[string][]Interaction
+	served    map[string]int
+}
+
+// Ensure ReplayClient implements ClientInterface
+var _ ClientInterface = (*ReplayClient)(nil)
+
+// NewReplayClient loads the cassette at path
+func NewReplayClient(path string) (*ReplayClient, error) {
+	cassette, err := LoadCassette(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewReplayClientFromCassette(cassette), nil
+}
+
+// NewReplayClientFromCassette serves responses from an in-memory cassette
+func NewReplayClientFromCassette(cassette *Cassette) *ReplayClient {
+	responses := make(map[string][]Interaction)
+	for _, interaction := range cassette.Interactions {
+		key := interaction.key()
+		responses[key] = append(responses[key], interaction)
+	}
+	return &ReplayClient{
+		responses: responses,
+		served:    make(map[string]int),
+	}
+}
+
+// replay decodes the next recorded response for a request into result
+func (r *ReplayClient) replay(method string, params []string, result any) error {
+	key := Interaction{Method: method, Params: params}.key()
+
+	r.mu.Lock()
+	recorded, ok := r.responses[key]
+	index := r.served[key]
+	if ok && index < len(recorded)-1 {
+		r.served[key]++
+	}
+	r.mu.Unlock()
+
+	if !ok {
+		return &PermanentError{Err: fmt.Errorf("%w: %s", ErrNotRecorded, key)}
+	}
+
+	interaction := recorded[min(index, len(recorded)-1)]
+	if interaction.Error != "" {
+		err := errors.New(interaction.Error)
+		switch interaction.ErrorClass {
+		case ErrorClassPermanent:
+			return &PermanentError{Err: err}
+		case ErrorClassRateLimit:
+			return &RateLimitError{Err: err}
+		default:
+			return &TransientError{Err: err}
+		}
+	}
+
+	if err := json.Unmarshal(interaction.Result, result); err != nil {
+		return fmt.Errorf("failed to decode recorded response for %s: %w", key, err)
+	}
+	return nil
+}
+
+func (r *ReplayClient) GetLatestBlockNumber(ctx context.Context) (*big.Int, error) {
+	var result hexutil.Big
+	if err := r.replay("eth_blockNumber", nil, &result); err != nil {
+		return nil, err
+	}
+	return (*big.Int)(&result), nil
+}
+
+func (r *ReplayClient) GetBlockNumberByTag(ctx context.Context, tag BlockTag) (*big.Int, error) {
+	var result Head
+	if err := r.replay("eth_getBlockByNumber", append([]string{string(tag)}, headerParams...), &result); err != nil {
+		// Recorded errors are only kept as text, a rejected tag must still read as unsupported
+		if detail, ok := strings.CutPrefix(err.Error(), ErrBlockTagUnsupported.Error()+": "); ok {
+			return nil, &PermanentError{Err: fmt.Errorf("%w: %s", ErrBlockTagUnsupported, detail)}
+		}
+		return nil, err
+	}
+	return new(big.Int).SetUint64(uint64(result.Number)), nil
+}
+
+func (r *ReplayClient) GetCode(ctx context.Context, address string, blockNumber *big.Int) (string, error) {
+	var result string
+	if err := r.replay("eth_getCode", []string{address, blockParam(blockNumber)}, &result); err != nil {
+		return "", err
+	}
+	return result, nil
+}
+
+func (r *ReplayClient) GetCodes(ctx context.Context, accounts map[string]uint64) (map[string]string, error) {
+	return FetchCodes(ctx, accounts, r.GetCode)
+}
+
+func (r *ReplayClient) GetStateDiff(ctx context.Context, blockNumber *big.Int) ([]TransactionResult, error) {
+	var result []TransactionResult
+	if err := r.replay("trace_replayBlockTransactions", []string{blockParam(blockNumber)}, &result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (r *ReplayClient) GetPrestate(ctx context.Context, blockNumber *big.Int) ([]TransactionResult, error) {
+	var result []TransactionResult
+	if err := r.replay("debug_traceBlockByNumber", []string{blockParam(blockNumber)}, &result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (r *ReplayClient) GetStateDiffs(ctx context.Context, blocks []uint64) (map[uint64][]TransactionResult, error) {
+	return FetchEach(ctx, blocks, r.GetStateDiff)
+}
+
+func (r *ReplayClient) GetPrestates(ctx context.Context, blocks []uint64) (map[uint64][]TransactionResult, error) {
+	return FetchEach(ctx, blocks, r.GetPrestate)
+}
+
+func (r *ReplayClient) GetBlockHeaders(ctx context.Context, blocks []uint64) (map[uint64]*Head, error) {
+	return FetchEach(ctx, blocks, func(ctx context.Context, blockNumber *big.Int) (*Head, error) {
+		var result *Head
+		params := append([]string{blockParam(blockNumber)}, headerParams...)
+		if err := r.replay("eth_getBlockByNumber", params, &result); err != nil {
+			return nil, err
+		}
+		return result, nil
+	})
+}
@@ -0,0 +1,116 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "session.cassette.zst")
+
+	inner := newScriptedClient(map[uint64][]error{
+		13: {&PermanentError{Err: errors.New("missing trie node")}},
+	})
+	inner.block = 100
+	recorder := NewRecordingClient(inner, path)
+
+	// Record a session mixing single and batched calls
+	head, err := recorder.GetLatestBlockNumber(ctx)
+	require.NoError(t, err)
+	inner.block = 101
+	_, err = recorder.GetLatestBlockNumber(ctx)
+	require.NoError(t, err)
+
+	code, err := recorder.GetCode(ctx, "0xabc", big.NewInt(10))
+	require.NoError(t, err)
+
+	diff, err := recorder.GetStateDiff(ctx, big.NewInt(11))
+	require.NoError(t, err)
+
+	diffs, err := recorder.GetStateDiffs(ctx, []uint64{12, 13})
+	require.Error(t, err)
+	require.Len(t, diffs, 1)
+
+	headers, err := recorder.GetBlockHeaders(ctx, []uint64{12})
+	require.NoError(t, err)
+
+	codes, err := recorder.GetCodes(ctx, map[string]uint64{"0xdef": 12})
+	require.NoError(t, err)
+
+	require.NoError(t, recorder.Close())
+	assert.FileExists(t, path)
+
+	replay, err := NewReplayClient(path)
+	require.NoError(t, err)
+
+	t.Run("serves repeated requests in recorded order", func(t *testing.T) {
+		first, err := replay.GetLatestBlockNumber(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, head.Uint64(), first.Uint64())
+
+		second, err := replay.GetLatestBlockNumber(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, uint64(101), second.Uint64())
+
+		// The last response is repeated once recorded responses run out
+		third, err := replay.GetLatestBlockNumber(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, uint64(101), third.Uint64())
+	})
+
+	t.Run("replays responses", func(t *testing.T) {
+		replayedCode, err := replay.GetCode(ctx, "0xabc", big.NewInt(10))
+		require.NoError(t, err)
+		assert.Equal(t, code, replayedCode)
+
+		replayedDiff, err := replay.GetStateDiff(ctx, big.NewInt(11))
+		require.NoError(t, err)
+		assert.Equal(t, diff, replayedDiff)
+	})
+
+	t.Run("replays batched calls block by block", func(t *testing.T) {
+		replayed, err := replay.GetStateDiff(ctx, big.NewInt(12))
+		require.NoError(t, err)
+		assert.Equal(t, diffs[12], replayed)
+
+		replayedHeaders, err := replay.GetBlockHeaders(ctx, []uint64{12})
+		require.NoError(t, err)
+		assert.Equal(t, headers, replayedHeaders)
+
+		replayedCode, err := replay.GetCode(ctx, "0xdef", big.NewInt(12))
+		require.NoError(t, err)
+		assert.Equal(t, codes["0xdef"], replayedCode)
+	})
+
+	t.Run("replays recorded errors with their class", func(t *testing.T) {
+		_, err := replay.GetStateDiffs(ctx, []uint64{13})
+		var permanent *PermanentError
+		assert.ErrorAs(t, err, &permanent)
+		assert.ErrorContains(t, err, "missing trie node")
+	})
+
+	t.Run("fails on requests missing from the cassette", func(t *testing.T) {
+		_, err := replay.GetStateDiff(ctx, big.NewInt(999))
+		assert.ErrorIs(t, err, ErrNotRecorded)
+		assert.False(t, IsRetryable(err))
+	})
+}
+
+func TestFindPool(t *testing.T) {
+	pool := NewPoolWithClients(nil, []ClientInterface{&fakeClient{}}, DefaultPoolConfig())
+	client := NewRetryClient(NewRecordingClient(pool, filepath.Join(t.TempDir(), "c.zst")), DefaultRetryConfig())
+
+	found, ok := FindPool(client)
+	require.True(t, ok)
+	assert.Same(t, pool, found)
+
+	_, ok = FindPool(&fakeClient{})
+	assert.False(t, ok)
+}
@@ -2,8 +2,10 @@ package rpc
 
 import (
 	"context"
+	"fmt"
 	"log/slog"
 	"math/big"
+	"net/http"
 
 	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/rpc"
@@ -13,12 +15,49 @@ import (
 // ClientInterface defines the interface for RPC client operations
 type ClientInterface interface {
 	GetLatestBlockNumber(ctx context.Context) (*big.Int, error)
+	GetBlockNumberByTag(ctx context.Context, tag BlockTag) (*big.Int, error)
 	GetCode(ctx context.Context, address string, blockNumber *big.Int) (string, error)
+	GetCodes(ctx context.Context, accounts map[string]uint64) (map[string]string, error)
 	GetStateDiff(ctx context.Context, blockNumber *big.Int) ([]TransactionResult, error)
+	GetPrestate(ctx context.Context, blockNumber *big.Int) ([]TransactionResult, error)
+	GetStateDiffs(ctx context.Context, blocks []uint64) (map[uint64][]TransactionResult, error)
+	GetPrestates(ctx context.Context, blocks []uint64) (map[uint64][]TransactionResult, error)
+	GetBlockHeaders(ctx context.Context, blocks []uint64) (map[uint64]*Head, error)
+}
+
+// AccessMode identifies which tracer was used to collect the state accesses of a block
+type AccessMode string
+
+const (
+	// AccessModeStateDiff only records accounts and slots that were modified (trace_replayBlockTransactions)
+	AccessModeStateDiff AccessMode = "statediff"
+	// AccessModePrestate records every account and slot that was read or written (prestateTracer)
+	AccessModePrestate AccessMode = "prestate"
+)
+
+// ParseAccessMode converts a configuration value into an AccessMode
+func ParseAccessMode(value string) (AccessMode, error) {
+	switch AccessMode(value) {
+	case AccessModeStateDiff, "":
+		return AccessModeStateDiff, nil
+	case AccessModePrestate:
+		return AccessModePrestate, nil
+	default:
+		return "", fmt.Errorf("unknown access mode %q", value)
+	}
+}
+
+// GetBlockAccesses fetches the state accesses of a block using the tracer selected by mode
+func GetBlockAccesses(ctx context.Context, client ClientInterface, mode AccessMode, blockNumber *big.Int) ([]TransactionResult, error) {
+	if mode == AccessModePrestate {
+		return client.GetPrestate(ctx, blockNumber)
+	}
+	return client.GetStateDiff(ctx, blockNumber)
 }
 
 type Client struct {
 	eth    *rpc.Client
+	batch  BatchConfig
 	logger *slog.Logger
 }
 
@@ -26,19 +65,37 @@ type Client struct {
 var _ ClientInterface = (*Client)(nil)
 
 func NewClient(ctx context.Context, url string) (*Client, error) {
+	return NewClientWithBatchConfig(ctx, url, DefaultBatchConfig())
+}
+
+// NewClientWithBatchConfig creates a client that issues batched calls according to batch
+func NewClientWithBatchConfig(ctx context.Context, url string, batch BatchConfig) (*Client, error) {
 	logger := logger.GetLogger("rpc-client")
-	eth, err := rpc.DialContext(ctx, url)
+	// Surface HTTP 429 responses with their Retry-After header as RateLimitErrors
+	httpClient := &http.Client{Transport: &rateLimitTransport{base: http.DefaultTransport}}
+	eth, err := rpc.DialOptions(ctx, url, rpc.WithHTTPClient(httpClient))
 	if err != nil {
 		return nil, err
 	}
-	return &Client{eth: eth, logger: logger}, nil
+
+	defaults := DefaultBatchConfig()
+	if batch.BatchSize <= 0 {
+		batch.BatchSize = defaults.BatchSize
+	}
+	if batch.Concurrency <= 0 {
+		batch.Concurrency = defaults.Concurrency
+	}
+	if batch.MaxRetries < 0 {
+		batch.MaxRetries = 0
+	}
+	return &Client{eth: eth, batch: batch, logger: logger}, nil
 }
 
 func (c *Client) GetLatestBlockNumber(ctx context.Context) (*big.Int, error) {
 	var result hexutil.Big
 	err := c.eth.CallContext(ctx, &result, "eth_blockNumber")
 	if err != nil {
-		return nil, err
+		return nil, Classify(err)
 	}
 	return (*big.Int)(&result), nil
 }
@@ -53,7 +110,7 @@ func (c *Client) GetCode(ctx context.Context, address string, blockNumber *big.I
 
 	err := c.eth.CallContext(ctx, &result, "eth_getCode", address, blockParam)
 	if err != nil {
-		return "", err
+		return "", Classify(err)
 	}
 	return result, nil
 }
@@ -82,7 +139,47 @@ func (c *Client) GetStateDiff(ctx context.Context, blockNumber *big.Int) ([]Tran
 	var result []TransactionResult
 	err := c.eth.CallContext(ctx, &result, "trace_replayBlockTransactions", hexutil.EncodeBig(blockNumber), []string{"stateDiff"})
 	if err != nil {
-		return nil, err
+		return nil, Classify(err)
 	}
 	return result, nil
 }
+
+// PrestateResult represents the prestateTracer output for a single transaction
+type PrestateResult struct {
+	TxHash string                 `json:"txHash,omitempty"`
+	Result map[string]AccountDiff `json:"result"`
+	Error  string                 `json:"error,omitempty"`
+}
+
+// prestateTracerConfig selects the prestateTracer in non-diff mode for debug_traceBlockByNumber
+var prestateTracerConfig = map[string]any{
+	"tracer":       "prestateTracer",
+	"tracerConfig": map[string]any{"diffMode": false},
+}
+
+// GetPrestate returns every account and storage slot touched by the transactions of a block,
+// including read-only accesses. The prestate of each account is returned in the StateDiff field
+// so that it can be stored and parsed the same way as a regular state diff.
+func (c *Client) GetPrestate(ctx context.Context, blockNumber *big.Int) ([]TransactionResult, error) {
+	var result []PrestateResult
+	err := c.eth.CallContext(ctx, &result, "debug_traceBlockByNumber", hexutil.EncodeBig(blockNumber), prestateTracerConfig)
+	if err != nil {
+		return nil, Classify(err)
+	}
+	return prestateToTransactionResults(blockNumber.String(), result)
+}
+
+// prestateToTransactionResults converts prestateTracer output into TransactionResults
+func prestateToTransactionResults(block string, result []PrestateResult) ([]TransactionResult, error) {
+	txResults := make([]TransactionResult, 0, len(result))
+	for i, tx := range result {
+		if tx.Error != "" {
+			return nil, fmt.Errorf("prestate tracer failed for transaction %d in block %s: %s", i, block, tx.Error)
+		}
+		txResults = append(txResults, TransactionResult{
+			StateDiff: tx.Result,
+			TxHash:    tx.TxHash,
+		})
+	}
+	return txResults, nil
+}
@@ -1,12 +1,15 @@
 package rpc
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"math/big"
 	"net/http"
 	"net/http/httptest"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -68,45 +71,64 @@ func (m *MockRPCServer) handleRPC(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var req rpcRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 
+	// Batch requests are sent as a JSON array
+	if len(bytes.TrimSpace(body)) > 0 && bytes.TrimSpace(body)[0] == '[' {
+		var reqs []rpcRequest
+		if err := json.Unmarshal(body, &reqs); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		resps := make([]rpcResponse, 0, len(reqs))
+		for _, req := range reqs {
+			resps = append(resps, m.respond(req))
+		}
+		json.NewEncoder(w).Encode(resps)
+		return
+	}
+
+	var req rpcRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(m.respond(req))
+}
+
+func (m *MockRPCServer) respond(req rpcRequest) rpcResponse {
 	handler, exists := m.handlers[req.Method]
 	if !exists {
-		resp := rpcResponse{
+		return rpcResponse{
 			ID: req.ID,
 			Error: &rpcError{
 				Code:    -32601,
 				Message: "Method not found",
 			},
 		}
-		json.NewEncoder(w).Encode(resp)
-		return
 	}
 
 	result, err := handler(req.Params)
 	if err != nil {
-		resp := rpcResponse{
+		return rpcResponse{
 			ID: req.ID,
 			Error: &rpcError{
 				Code:    -32000,
 				Message: err.Error(),
 			},
 		}
-		json.NewEncoder(w).Encode(resp)
-		return
 	}
 
-	resp := rpcResponse{
+	return rpcResponse{
 		ID:     req.ID,
 		Result: result,
 	}
-	json.NewEncoder(w).Encode(resp)
 }
 
 func TestNewClient(t *testing.T) {
@@ -412,6 +434,213 @@ func TestClient_GetStateDiff(t *testing.T) {
 	})
 }
 
+func TestClient_GetPrestate(t *testing.T) {
+	mockServer := NewMockRPCServer()
+	defer mockServer.Close()
+
+	ctx := context.Background()
+	client, err := NewClient(ctx, mockServer.URL())
+	require.NoError(t, err)
+
+	t.Run("returns read and written accounts", func(t *testing.T) {
+		mockServer.SetHandler("debug_traceBlockByNumber", func(params []interface{}) (interface{}, error) {
+			assert.Len(t, params, 2)
+			assert.Equal(t, "0x64", params[0])
+			assert.Equal(t, map[string]interface{}{
+				"tracer":       "prestateTracer",
+				"tracerConfig": map[string]interface{}{"diffMode": false},
+			}, params[1])
+
+			return []map[string]interface{}{
+				{
+					"txHash": "0xabc",
+					"result": map[string]interface{}{
+						"0x1234567890abcdef1234567890abcdef12345678": map[string]interface{}{
+							"balance": "0x100",
+							"nonce":   1,
+						},
+						"0xabcdef1234567890abcdef1234567890abcdef12": map[string]interface{}{
+							"balance": "0x0",
+							"code":    "0x6080604052",
+							"storage": map[string]string{
+								"0x0000000000000000000000000000000000000000000000000000000000000001": "0x0000000000000000000000000000000000000000000000000000000000000002",
+							},
+						},
+					},
+				},
+			}, nil
+		})
+
+		results, err := client.GetPrestate(ctx, big.NewInt(100))
+		assert.NoError(t, err)
+		require.Len(t, results, 1)
+		assert.Equal(t, "0xabc", results[0].TxHash)
+		assert.Len(t, results[0].StateDiff, 2)
+
+		contract := results[0].StateDiff["0xabcdef1234567890abcdef1234567890abcdef12"]
+		assert.Equal(t, "0x6080604052", contract.Code)
+		assert.NotNil(t, contract.Storage)
+	})
+
+	t.Run("returns error when a transaction failed to trace", func(t *testing.T) {
+		mockServer.SetHandler("debug_traceBlockByNumber", func(params []interface{}) (interface{}, error) {
+			return []map[string]interface{}{
+				{"txHash": "0xabc", "error": "execution timeout"},
+			}, nil
+		})
+
+		_, err := client.GetPrestate(ctx, big.NewInt(100))
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "execution timeout")
+	})
+}
+
+func TestClient_GetStateDiffs(t *testing.T) {
+	mockServer := NewMockRPCServer()
+	defer mockServer.Close()
+
+	ctx := context.Background()
+	client, err := NewClientWithBatchConfig(ctx, mockServer.URL(), BatchConfig{BatchSize: 3, Concurrency: 2, MaxRetries: 2})
+	require.NoError(t, err)
+
+	t.Run("fetches every block across several batches", func(t *testing.T) {
+		mockServer.SetHandler("trace_replayBlockTransactions", func(params []interface{}) (interface{}, error) {
+			return []map[string]interface{}{
+				{"transactionHash": params[0], "stateDiff": map[string]interface{}{}},
+			}, nil
+		})
+
+		blocks := []uint64{1, 2, 3, 4, 5, 6, 7}
+		results, err := client.GetStateDiffs(ctx, blocks)
+		require.NoError(t, err)
+		require.Len(t, results, len(blocks))
+		for _, block := range blocks {
+			require.Len(t, results[block], 1)
+			assert.Equal(t, fmt.Sprintf("0x%x", block), results[block][0].TxHash)
+		}
+	})
+
+	t.Run("retries only the blocks that failed", func(t *testing.T) {
+		var mu sync.Mutex
+		calls := make(map[string]int)
+		mockServer.SetHandler("trace_replayBlockTransactions", func(params []interface{}) (interface{}, error) {
+			block := params[0].(string)
+			mu.Lock()
+			calls[block]++
+			attempt := calls[block]
+			mu.Unlock()
+
+			if block == "0x2" && attempt == 1 {
+				return nil, fmt.Errorf("header not found")
+			}
+			return []map[string]interface{}{}, nil
+		})
+
+		results, err := client.GetStateDiffs(ctx, []uint64{1, 2, 3})
+		require.NoError(t, err)
+		assert.Len(t, results, 3)
+		assert.Equal(t, 1, calls["0x1"])
+		assert.Equal(t, 2, calls["0x2"])
+		assert.Equal(t, 1, calls["0x3"])
+	})
+
+	t.Run("returns partial results when retries are exhausted", func(t *testing.T) {
+		mockServer.SetHandler("trace_replayBlockTransactions", func(params []interface{}) (interface{}, error) {
+			if params[0] == "0x5" {
+				return nil, fmt.Errorf("header not found")
+			}
+			return []map[string]interface{}{}, nil
+		})
+
+		results, err := client.GetStateDiffs(ctx, []uint64{4, 5, 6})
+		require.Error(t, err)
+
+		var batchErr *BatchError
+		require.ErrorAs(t, err, &batchErr)
+		assert.Equal(t, []uint64{5}, batchErr.Blocks())
+		assert.Contains(t, err.Error(), "header not found")
+		assert.Len(t, results, 2)
+	})
+}
+
+func TestClient_GetBlockHeaders(t *testing.T) {
+	mockServer := NewMockRPCServer()
+	defer mockServer.Close()
+
+	ctx := context.Background()
+	client, err := NewClientWithBatchConfig(ctx, mockServer.URL(), BatchConfig{BatchSize: 2, Concurrency: 2, MaxRetries: 1})
+	require.NoError(t, err)
+
+	mockServer.SetHandler("eth_getBlockByNumber", func(params []interface{}) (interface{}, error) {
+		assert.Equal(t, false, params[1], "transactions should not be requested")
+		if params[0] == "0x4" {
+			return nil, nil // Not mined yet
+		}
+		return map[string]interface{}{
+			"number":     params[0],
+			"hash":       "0xhash" + params[0].(string),
+			"parentHash": "0xparent" + params[0].(string),
+			"miner":      "0x0000000000000000000000000000000000000000",
+		}, nil
+	})
+
+	headers, err := client.GetBlockHeaders(ctx, []uint64{1, 2, 3, 4})
+	require.Error(t, err)
+
+	var batchErr *BatchError
+	require.ErrorAs(t, err, &batchErr)
+	assert.Equal(t, []uint64{4}, batchErr.Blocks())
+	assert.True(t, IsRetryable(batchErr.Failed[4]), "missing blocks should be retried later")
+
+	require.Len(t, headers, 3)
+	assert.Equal(t, uint64(2), uint64(headers[2].Number))
+	assert.Equal(t, "0xhash0x2", headers[2].Hash)
+	assert.Equal(t, "0xparent0x2", headers[2].ParentHash)
+}
+
+func TestClient_GetCodes(t *testing.T) {
+	mockServer := NewMockRPCServer()
+	defer mockServer.Close()
+
+	ctx := context.Background()
+	client, err := NewClientWithBatchConfig(ctx, mockServer.URL(), BatchConfig{BatchSize: 2, Concurrency: 2, MaxRetries: 1})
+	require.NoError(t, err)
+
+	mockServer.SetHandler("eth_getCode", func(params []interface{}) (interface{}, error) {
+		switch params[0] {
+		case "0xc0":
+			assert.Equal(t, "0xa", params[1], "code should be read at the block of the account")
+			return "0x6080", nil
+		case "0xfa":
+			return nil, fmt.Errorf("header not found")
+		default:
+			return "0x", nil
+		}
+	})
+
+	codes, err := client.GetCodes(ctx, map[string]uint64{"0xc0": 10, "0xe0": 11, "0xe1": 12, "0xfa": 13})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "first failed account 0xfa")
+
+	require.Len(t, codes, 3)
+	assert.Equal(t, "0x6080", codes["0xc0"])
+	assert.Equal(t, "0x", codes["0xe0"])
+	assert.Equal(t, "0x", codes["0xe1"])
+}
+
+func TestParseAccessMode(t *testing.T) {
+	mode, err := ParseAccessMode("")
+	assert.NoError(t, err)
+	assert.Equal(t, AccessModeStateDiff, mode)
+
+	mode, err = ParseAccessMode("prestate")
+	assert.NoError(t, err)
+	assert.Equal(t, AccessModePrestate, mode)
+
+	_, err = ParseAccessMode("calltracer")
+	assert.Error(t, err)
+}
+
 func TestClient_JSONRPCCompatibility(t *testing.T) {
 	mockServer := NewMockRPCServer()
 	defer mockServer.Close()
@@ -0,0 +1,240 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// ErrorClass tells callers how an RPC error should be handled
+type ErrorClass string
+
+const (
+	ErrorClassTransient ErrorClass = "transient"  // Timeouts, 5xx, connection resets: retry with backoff
+	ErrorClassPermanent ErrorClass = "permanent"  // Method not found, pruned history: retrying will not help
+	ErrorClassRateLimit ErrorClass = "rate-limit" // 429 or provider limits: wait before retrying
+)
+
+// TransientError is an RPC error that is likely to succeed when retried
+type TransientError struct {
+	Err error
+}
+
+func (e *TransientError) Error() string { return e.Err.Error() }
+func (e *TransientError) Unwrap() error { return e.Err }
+
+// PermanentError is an RPC error that will fail again if retried against the same endpoint
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string { return e.Err.Error() }
+func (e *PermanentError) Unwrap() error { return e.Err }
+
+// RateLimitError is returned when an endpoint throttles requests. RetryAfter is the
+// delay requested by the endpoint, or zero if it did not send one.
+type RateLimitError struct {
+	Err        error
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("%v (retry after %s)", e.Err, e.RetryAfter)
+	}
+	return e.Err.Error()
+}
+func (e *RateLimitError) Unwrap() error { return e.Err }
+
+// JSON-RPC error codes that are handled explicitly
+const (
+	codeInvalidRequest = -32600
+	codeMethodNotFound = -32601
+	codeInvalidParams  = -32602
+	codeLimitExceeded  = -32005
+)
+
+// Substrings of JSON-RPC error messages, matched case-insensitively
+var (
+	rateLimitMessages = []string{"rate limit", "too many requests", "limit exceeded", "exceeded the quota", "capacity exceeded"}
+	permanentMessages = []string{"missing trie node", "pruned", "historical state", "state is not available", "state not available", "method not found", "does not exist/is not available", "not supported"}
+)
+
+// Classify wraps err in a TransientError, PermanentError or RateLimitError.
+// Errors that are already classified, batch errors and cancellations of the
+// caller's context are returned unchanged.
+func Classify(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var (
+		transient *TransientError
+		permanent *PermanentError
+		rateLimit *RateLimitError
+		batchErr  *BatchError
+	)
+	if errors.As(err, &transient) || errors.As(err, &permanent) || errors.As(err, &rateLimit) || errors.As(err, &batchErr) {
+		return err
+	}
+	if errors.Is(err, context.Canceled) {
+		return err
+	}
+
+	switch ClassOf(err) {
+	case ErrorClassPermanent:
+		return &PermanentError{Err: err}
+	case ErrorClassRateLimit:
+		return &RateLimitError{Err: err}
+	default:
+		return &TransientError{Err: err}
+	}
+}
+
+// ClassOf returns the class of err. Unrecognised errors are treated as transient
+// so that they are retried within the call budget.
+func ClassOf(err error) ErrorClass {
+	var (
+		transient *TransientError
+		permanent *PermanentError
+		rateLimit *RateLimitError
+	)
+	switch {
+	case errors.As(err, &rateLimit):
+		return ErrorClassRateLimit
+	case errors.As(err, &permanent):
+		return ErrorClassPermanent
+	case errors.As(err, &transient):
+		return ErrorClassTransient
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, ErrNoHealthyEndpoint) || isConnectionError(err) {
+		return ErrorClassTransient
+	}
+
+	var httpErr rpc.HTTPError
+	if errors.As(err, &httpErr) {
+		switch {
+		case httpErr.StatusCode == http.StatusTooManyRequests:
+			return ErrorClassRateLimit
+		case httpErr.StatusCode >= 500, httpErr.StatusCode == http.StatusRequestTimeout:
+			return ErrorClassTransient
+		case httpErr.StatusCode >= 400:
+			return ErrorClassPermanent
+		}
+	}
+
+	var rpcErr rpc.Error
+	if errors.As(err, &rpcErr) {
+		switch rpcErr.ErrorCode() {
+		case codeLimitExceeded, http.StatusTooManyRequests:
+			return ErrorClassRateLimit
+		case codeMethodNotFound, codeInvalidParams, codeInvalidRequest:
+			return ErrorClassPermanent
+		}
+	}
+
+	message := strings.ToLower(err.Error())
+	for _, m := range rateLimitMessages {
+		if strings.Contains(message, m) {
+			return ErrorClassRateLimit
+		}
+	}
+	for _, m := range permanentMessages {
+		if strings.Contains(message, m) {
+			return ErrorClassPermanent
+		}
+	}
+
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+		return ErrorClassPermanent
+	}
+
+	return ErrorClassTransient
+}
+
+// IsRetryable reports whether the call that produced err may succeed if retried
+func IsRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	return ClassOf(err) != ErrorClassPermanent
+}
+
+// RetryAfter returns the delay requested by a rate limited endpoint, or zero
+func RetryAfter(err error) time.Duration {
+	var rateLimit *RateLimitError
+	if errors.As(err, &rateLimit) {
+		return rateLimit.RetryAfter
+	}
+	return 0
+}
+
+// RetryDelay returns how long a polling loop should wait after a failed cycle:
+// the endpoint's Retry-After for rate limits, otherwise fallback
+func RetryDelay(err error, fallback time.Duration) time.Duration {
+	if delay := RetryAfter(err); delay > 0 {
+		return delay
+	}
+	return fallback
+}
+
+// isConnectionError reports whether err is a network level failure
+func isConnectionError(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// rateLimitTransport turns HTTP 429 responses into RateLimitErrors carrying the
+// Retry-After header, which the go-ethereum client does not expose
+type rateLimitTransport struct {
+	base http.RoundTripper
+}
+
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusTooManyRequests {
+		return resp, err
+	}
+
+	retryAfter := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+
+	return nil, &RateLimitError{
+		Err:        fmt.Errorf("%s returned %s", req.URL.Host, resp.Status),
+		RetryAfter: retryAfter,
+	}
+}
+
+// parseRetryAfter parses a Retry-After header given either in seconds or as an HTTP date
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return 0
+}
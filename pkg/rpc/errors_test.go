@@ -0,0 +1,103 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// jsonRPCError mimics the error returned by go-ethereum for JSON-RPC error responses
+type jsonRPCError struct {
+	code    int
+	message string
+}
+
+func (e *jsonRPCError) Error() string  { return e.message }
+func (e *jsonRPCError) ErrorCode() int { return e.code }
+
+func TestClassOf(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want ErrorClass
+	}{
+		{"deadline exceeded", context.DeadlineExceeded, ErrorClassTransient},
+		{"connection reset", fmt.Errorf("read: %w", syscall.ECONNRESET), ErrorClassTransient},
+		{"no healthy endpoint", ErrNoHealthyEndpoint, ErrorClassTransient},
+		{"http 503", rpc.HTTPError{StatusCode: 503, Status: "503 Service Unavailable"}, ErrorClassTransient},
+		{"http 429", rpc.HTTPError{StatusCode: 429, Status: "429 Too Many Requests"}, ErrorClassRateLimit},
+		{"http 401", rpc.HTTPError{StatusCode: 401, Status: "401 Unauthorized"}, ErrorClassPermanent},
+		{"method not found", &jsonRPCError{code: -32601, message: "the method trace_replayBlockTransactions does not exist/is not available"}, ErrorClassPermanent},
+		{"limit exceeded code", &jsonRPCError{code: -32005, message: "request limit reached"}, ErrorClassRateLimit},
+		{"rate limit message", &jsonRPCError{code: -32000, message: "Your app has exceeded its compute units per second capacity, rate limit"}, ErrorClassRateLimit},
+		{"pruned history", &jsonRPCError{code: -32000, message: "missing trie node 1a2b (path ) state 0x1a2b is not available"}, ErrorClassPermanent},
+		{"unknown server error", &jsonRPCError{code: -32000, message: "execution aborted (timeout = 5s)"}, ErrorClassTransient},
+		{"wrapped classification", fmt.Errorf("download: %w", &PermanentError{Err: errors.New("boom")}), ErrorClassPermanent},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, ClassOf(tt.err))
+		})
+	}
+}
+
+func TestClassify(t *testing.T) {
+	t.Run("wraps errors into their exported type", func(t *testing.T) {
+		err := Classify(rpc.HTTPError{StatusCode: 502, Status: "502 Bad Gateway"})
+		var transient *TransientError
+		assert.ErrorAs(t, err, &transient)
+		assert.True(t, IsRetryable(err))
+
+		err = Classify(&jsonRPCError{code: -32601, message: "method not found"})
+		var permanent *PermanentError
+		assert.ErrorAs(t, err, &permanent)
+		assert.False(t, IsRetryable(err))
+	})
+
+	t.Run("leaves nil, cancellations and classified errors alone", func(t *testing.T) {
+		assert.NoError(t, Classify(nil))
+		assert.Equal(t, context.Canceled, Classify(context.Canceled))
+		assert.False(t, IsRetryable(context.Canceled))
+
+		rateLimit := &RateLimitError{Err: errors.New("slow down"), RetryAfter: time.Second}
+		assert.Same(t, rateLimit, Classify(rateLimit))
+	})
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	assert.Equal(t, 3*time.Second, parseRetryAfter("3", now))
+	assert.Equal(t, 30*time.Second, parseRetryAfter(now.Add(30*time.Second).Format(http.TimeFormat), now))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("", now))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("soon", now))
+}
+
+func TestClient_RateLimitRetryAfter(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "7")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	client, err := NewClient(context.Background(), server.URL)
+	require.NoError(t, err)
+
+	_, err = client.GetLatestBlockNumber(context.Background())
+	require.Error(t, err)
+
+	var rateLimit *RateLimitError
+	require.ErrorAs(t, err, &rateLimit)
+	assert.Equal(t, 7*time.Second, rateLimit.RetryAfter)
+	assert.Equal(t, ErrorClassRateLimit, ClassOf(err))
+	assert.Equal(t, 7*time.Second, RetryDelay(err, time.Minute))
+}
@@ -0,0 +1,150 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	gethrpc "github.com/ethereum/go-ethereum/rpc"
+	"github.com/weiihann/state-expiry-indexer/internal/logger"
+)
+
+// BlockTag names a block relative to the head of the chain
+type BlockTag string
+
+const (
+	BlockTagLatest    BlockTag = "latest"
+	BlockTagSafe      BlockTag = "safe"
+	BlockTagFinalized BlockTag = "finalized"
+)
+
+// ErrBlockTagUnsupported is returned when a node does not know a block tag, such as clients
+// from before the merge or chains without finality. It is wrapped in a PermanentError.
+var ErrBlockTagUnsupported = errors.New("block tag not supported")
+
+// unsupportedTagMessages are substrings of the errors nodes answer unknown block tags with,
+// matched case-insensitively
+var unsupportedTagMessages = []string{"invalid argument", "block tag"}
+
+// GetBlockNumberByTag returns the number of the block a tag points to with eth_getBlockByNumber
+func (c *Client) GetBlockNumberByTag(ctx context.Context, tag BlockTag) (*big.Int, error) {
+	var head *Head
+	err := c.eth.CallContext(ctx, &head, "eth_getBlockByNumber", string(tag), false)
+
+	// A node answering with null or rejecting the tag as a parameter does not know it. Other
+	// errors, such as a header that is not found yet, are classified like any other call.
+	if errors.Is(err, gethrpc.ErrNoResult) || (err == nil && head == nil) {
+		return nil, &PermanentError{Err: fmt.Errorf("%w: %s: no block", ErrBlockTagUnsupported, tag)}
+	}
+	if isUnsupportedTag(err) {
+		return nil, &PermanentError{Err: fmt.Errorf("%w: %s: %w", ErrBlockTagUnsupported, tag, err)}
+	}
+	if err != nil {
+		return nil, Classify(err)
+	}
+	return new(big.Int).SetUint64(uint64(head.Number)), nil
+}
+
+// isUnsupportedTag reports whether err is a node rejecting a block tag as an invalid parameter
+func isUnsupportedTag(err error) bool {
+	var rpcErr gethrpc.Error
+	if !errors.As(err, &rpcErr) {
+		return false
+	}
+	if rpcErr.ErrorCode() == codeInvalidParams {
+		return true
+	}
+	message := strings.ToLower(rpcErr.Error())
+	for _, m := range unsupportedTagMessages {
+		if strings.Contains(message, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// Finality selects the highest block treated as final: the block a tag points to, or a fixed
+// number of blocks below the latest block. Blocks above it may still be reorganized away.
+type Finality struct {
+	// Tag is the block tag followed, BlockTagLatest to stay Offset blocks below the latest block
+	Tag BlockTag
+	// Offset is the number of blocks kept below the latest block, with BlockTagLatest and on
+	// nodes that do not know Tag
+	Offset uint64
+
+	fellBack atomic.Bool
+	log      *slog.Logger
+}
+
+// ParseFinality parses a finality policy: "finalized", "safe", "latest" or "latest-N" to stay N
+// blocks below the latest block. Nodes that do not know the finalized or safe tag fall back to
+// fallbackOffset blocks below the latest block. An empty policy is "finalized".
+func ParseFinality(policy string, fallbackOffset uint64) (*Finality, error) {
+	finality := &Finality{Offset: fallbackOffset, log: logger.GetLogger("rpc-finality")}
+
+	policy = strings.ToLower(strings.TrimSpace(policy))
+	switch BlockTag(policy) {
+	case BlockTagFinalized, "":
+		finality.Tag = BlockTagFinalized
+	case BlockTagSafe:
+		finality.Tag = BlockTagSafe
+	case BlockTagLatest:
+		finality.Tag = BlockTagLatest
+		finality.Offset = 0
+	default:
+		offset, ok := strings.CutPrefix(policy, string(BlockTagLatest)+"-")
+		if !ok {
+			return nil, fmt.Errorf("unknown finality %q, must be finalized, safe, latest or latest-N", policy)
+		}
+		n, err := strconv.ParseUint(offset, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid finality %q: %w", policy, err)
+		}
+		finality.Tag = BlockTagLatest
+		finality.Offset = n
+	}
+	return finality, nil
+}
+
+// String returns the policy in the form ParseFinality reads
+func (f *Finality) String() string {
+	if f.Tag == BlockTagLatest && f.Offset > 0 {
+		return fmt.Sprintf("%s-%d", BlockTagLatest, f.Offset)
+	}
+	return string(f.Tag)
+}
+
+// Head returns the highest final block. When the node does not know the tag, Offset blocks
+// below the latest block are used instead; any other error is returned. A chain shorter than
+// the offset has no final block but genesis.
+func (f *Finality) Head(ctx context.Context, client ClientInterface) (uint64, error) {
+	if f.Tag != BlockTagLatest {
+		head, err := client.GetBlockNumberByTag(ctx, f.Tag)
+		if err == nil {
+			return head.Uint64(), nil
+		}
+		if !errors.Is(err, ErrBlockTagUnsupported) {
+			return 0, err
+		}
+		if !f.fellBack.Swap(true) && f.log != nil {
+			f.log.Warn("Node does not support the block tag, falling back to an offset below the latest block",
+				"tag", f.Tag,
+				"offset", f.Offset,
+				"error", err)
+		}
+	}
+
+	latest, err := client.GetLatestBlockNumber(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if latest.Uint64() < f.Offset {
+		return 0, nil
+	}
+	return latest.Uint64() - f.Offset, nil
+}
@@ -0,0 +1,211 @@
+package rpc
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseFinality(t *testing.T) {
+	tests := []struct {
+		policy string
+		tag    BlockTag
+		offset uint64
+	}{
+		{"", BlockTagFinalized, 64},
+		{"finalized", BlockTagFinalized, 64},
+		{" Safe ", BlockTagSafe, 64},
+		{"latest", BlockTagLatest, 0},
+		{"latest-12", BlockTagLatest, 12},
+	}
+	for _, tt := range tests {
+		finality, err := ParseFinality(tt.policy, 64)
+		require.NoError(t, err, tt.policy)
+		assert.Equal(t, tt.tag, finality.Tag, tt.policy)
+		assert.Equal(t, tt.offset, finality.Offset, tt.policy)
+	}
+
+	finality, err := ParseFinality("latest-12", 64)
+	require.NoError(t, err)
+	assert.Equal(t, "latest-12", finality.String())
+
+	for _, policy := range []string{"pending", "latest-", "latest-x", "latest+1"} {
+		_, err := ParseFinality(policy, 64)
+		assert.Error(t, err, policy)
+	}
+}
+
+// serveChain answers eth_blockNumber with latest and eth_getBlockByNumber with the blocks tags
+// point to. Tags missing from tags are rejected as invalid parameters.
+func serveChain(t *testing.T, latest uint64, tags map[string]uint64) *Client {
+	server := NewMockRPCServer()
+	t.Cleanup(server.Close)
+	server.SetHandler("eth_blockNumber", func(params []interface{}) (interface{}, error) {
+		return fmt.Sprintf("0x%x", latest), nil
+	})
+	server.SetHandler("eth_getBlockByNumber", func(params []interface{}) (interface{}, error) {
+		block, ok := tags[params[0].(string)]
+		if !ok {
+			return nil, fmt.Errorf("invalid argument 0: unknown block tag %s", params[0])
+		}
+		return map[string]string{"number": fmt.Sprintf("0x%x", block)}, nil
+	})
+
+	client, err := NewClient(t.Context(), server.URL())
+	require.NoError(t, err)
+	return client
+}
+
+func TestClient_GetBlockNumberByTag(t *testing.T) {
+	client := serveChain(t, 1000, map[string]uint64{"finalized": 936, "safe": 968})
+
+	block, err := client.GetBlockNumberByTag(t.Context(), BlockTagFinalized)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(936), block.Uint64())
+	block, err = client.GetBlockNumberByTag(t.Context(), BlockTagSafe)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(968), block.Uint64())
+
+	t.Run("unknown tags are permanent errors", func(t *testing.T) {
+		client := serveChain(t, 1000, nil)
+		_, err := client.GetBlockNumberByTag(t.Context(), BlockTagFinalized)
+		assert.ErrorIs(t, err, ErrBlockTagUnsupported)
+		assert.Equal(t, ErrorClassPermanent, ClassOf(err))
+	})
+
+	t.Run("null blocks are unsupported", func(t *testing.T) {
+		server := NewMockRPCServer()
+		defer server.Close()
+		server.SetHandler("eth_getBlockByNumber", func(params []interface{}) (interface{}, error) {
+			return nil, nil
+		})
+		client, err := NewClient(t.Context(), server.URL())
+		require.NoError(t, err)
+
+		_, err = client.GetBlockNumberByTag(t.Context(), BlockTagSafe)
+		assert.ErrorIs(t, err, ErrBlockTagUnsupported)
+	})
+
+	t.Run("rate limits are not mistaken for unsupported tags", func(t *testing.T) {
+		server := NewMockRPCServer()
+		defer server.Close()
+		server.SetHandler("eth_getBlockByNumber", func(params []interface{}) (interface{}, error) {
+			return nil, errors.New("rate limit exceeded")
+		})
+		client, err := NewClient(t.Context(), server.URL())
+		require.NoError(t, err)
+
+		_, err = client.GetBlockNumberByTag(t.Context(), BlockTagFinalized)
+		assert.NotErrorIs(t, err, ErrBlockTagUnsupported)
+		assert.Equal(t, ErrorClassRateLimit, ClassOf(err))
+	})
+
+	t.Run("server errors are not mistaken for unsupported tags", func(t *testing.T) {
+		server := NewMockRPCServer()
+		defer server.Close()
+		server.SetHandler("eth_getBlockByNumber", func(params []interface{}) (interface{}, error) {
+			return nil, errors.New("header not found")
+		})
+		client, err := NewClient(t.Context(), server.URL())
+		require.NoError(t, err)
+
+		_, err = client.GetBlockNumberByTag(t.Context(), BlockTagFinalized)
+		assert.NotErrorIs(t, err, ErrBlockTagUnsupported)
+		assert.Equal(t, ErrorClassTransient, ClassOf(err))
+	})
+}
+
+func TestFinality_Head(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy string
+		latest uint64
+		tags   map[string]uint64
+		head   uint64
+	}{
+		{"finalized tag", "finalized", 1000, map[string]uint64{"finalized": 936, "safe": 968}, 936},
+		{"safe tag", "safe", 1000, map[string]uint64{"finalized": 936, "safe": 968}, 968},
+		{"fallback without tags", "finalized", 1000, nil, 1000 - 64},
+		{"fallback on a chain shorter than the offset", "safe", 10, nil, 0},
+		{"latest minus N", "latest-10", 1000, nil, 990},
+		{"latest minus N on a short chain", "latest-10", 5, nil, 0},
+		{"latest", "latest", 1000, nil, 1000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			finality, err := ParseFinality(tt.policy, 64)
+			require.NoError(t, err)
+
+			head, err := finality.Head(t.Context(), serveChain(t, tt.latest, tt.tags))
+			require.NoError(t, err)
+			assert.Equal(t, tt.head, head)
+		})
+	}
+
+	t.Run("transient errors are returned", func(t *testing.T) {
+		finality, err := ParseFinality("finalized", 64)
+		require.NoError(t, err)
+
+		_, err = finality.Head(t.Context(), &fakeClient{fail: true})
+		assert.Error(t, err)
+	})
+
+	t.Run("server errors do not fall back to the offset", func(t *testing.T) {
+		server := NewMockRPCServer()
+		defer server.Close()
+		server.SetHandler("eth_blockNumber", func(params []interface{}) (interface{}, error) {
+			return "0x3e8", nil
+		})
+		server.SetHandler("eth_getBlockByNumber", func(params []interface{}) (interface{}, error) {
+			return nil, errors.New("header not found")
+		})
+		client, err := NewClient(t.Context(), server.URL())
+		require.NoError(t, err)
+		finality, err := ParseFinality("finalized", 64)
+		require.NoError(t, err)
+
+		_, err = finality.Head(t.Context(), client)
+		assert.Error(t, err)
+	})
+
+	t.Run("permanent errors other than an unsupported tag do not fall back", func(t *testing.T) {
+		server := NewMockRPCServer()
+		defer server.Close()
+		server.SetHandler("eth_blockNumber", func(params []interface{}) (interface{}, error) {
+			return "0x3e8", nil
+		})
+		server.SetHandler("eth_getBlockByNumber", func(params []interface{}) (interface{}, error) {
+			return nil, errors.New("missing trie node 1a2b (path ) state 0x1a2b is not available")
+		})
+		client, err := NewClient(t.Context(), server.URL())
+		require.NoError(t, err)
+		finality, err := ParseFinality("finalized", 64)
+		require.NoError(t, err)
+
+		_, err = finality.Head(t.Context(), client)
+		assert.Equal(t, ErrorClassPermanent, ClassOf(err))
+		assert.NotErrorIs(t, err, ErrBlockTagUnsupported)
+	})
+
+	t.Run("unsupported tags replayed from a cassette fall back", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "finality.cassette.zst")
+		recorder := NewRecordingClient(serveChain(t, 1000, nil), path)
+		finality, err := ParseFinality("finalized", 64)
+		require.NoError(t, err)
+		head, err := finality.Head(t.Context(), recorder)
+		require.NoError(t, err)
+		require.NoError(t, recorder.Close())
+
+		replay, err := NewReplayClient(path)
+		require.NoError(t, err)
+		_, err = replay.GetBlockNumberByTag(t.Context(), BlockTagFinalized)
+		assert.ErrorIs(t, err, ErrBlockTagUnsupported)
+		replayed, err := finality.Head(t.Context(), replay)
+		require.NoError(t, err)
+		assert.Equal(t, head, replayed)
+	})
+}
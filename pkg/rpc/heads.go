@@ -0,0 +1,223 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/weiihann/state-expiry-indexer/internal/logger"
+)
+
+// ErrSubscriptionsUnsupported is returned when no endpoint supports eth_subscribe, e.g. plain HTTP endpoints
+var ErrSubscriptionsUnsupported = errors.New("RPC endpoint does not support subscriptions")
+
+const (
+	// headBufferSize is the number of heads buffered between the subscription and the watcher
+	headBufferSize = 16
+	// initialResubscribeDelay is the first backoff after a subscription is lost
+	initialResubscribeDelay = time.Second
+	// maxResubscribeDelay caps the backoff between resubscription attempts
+	maxResubscribeDelay = time.Minute
+)
+
+// Head identifies a block by its hash and parent hash. It is delivered by eth_subscribe("newHeads")
+// subscriptions and returned by GetBlockHeaders to check that blocks belong to the same chain.
+// The remaining fields describe the accounts the block touches outside of its transactions,
+// withdrawals are only returned by GetBlockHeaders.
+type Head struct {
+	Number                hexutil.Uint64 `json:"number"`
+	Hash                  string         `json:"hash"`
+	ParentHash            string         `json:"parentHash"`
+	Miner                 string         `json:"miner,omitempty"`
+	Timestamp             hexutil.Uint64 `json:"timestamp,omitempty"`
+	Withdrawals           []Withdrawal   `json:"withdrawals,omitempty"`
+	ParentBeaconBlockRoot string         `json:"parentBeaconBlockRoot,omitempty"`
+	RequestsHash          string         `json:"requestsHash,omitempty"`
+}
+
+// Subscription is an active server push subscription
+type Subscription interface {
+	Err() <-chan error
+	Unsubscribe()
+}
+
+// HeadSubscriber is implemented by clients that can push new chain heads.
+// Implementations return ErrSubscriptionsUnsupported when the transport cannot push.
+type HeadSubscriber interface {
+	SubscribeNewHeads(ctx context.Context, heads chan<- *Head) (Subscription, error)
+}
+
+// SubscribeNewHeads subscribes to new chain heads. Only WebSocket and IPC endpoints support subscriptions.
+func (c *Client) SubscribeNewHeads(ctx context.Context, heads chan<- *Head) (Subscription, error) {
+	if !c.eth.SupportsSubscriptions() {
+		return nil, ErrSubscriptionsUnsupported
+	}
+	sub, err := c.eth.EthSubscribe(ctx, heads, "newHeads")
+	if err != nil {
+		return nil, Classify(err)
+	}
+	return sub, nil
+}
+
+// SubscribeNewHeads subscribes through the first available endpoint that supports subscriptions
+func (p *Pool) SubscribeNewHeads(ctx context.Context, heads chan<- *Head) (Subscription, error) {
+	lastErr := ErrSubscriptionsUnsupported
+	for _, ep := range p.endpoints {
+		subscriber, ok := ep.client.(HeadSubscriber)
+		if !ok {
+			continue
+		}
+
+		p.mu.Lock()
+		available := p.available(ep, time.Now())
+		p.mu.Unlock()
+		if !available {
+			continue
+		}
+
+		sub, err := subscriber.SubscribeNewHeads(ctx, heads)
+		if err == nil {
+			p.log.Debug("Subscribed to new heads", "endpoint", ep.url)
+			return sub, nil
+		}
+		if !errors.Is(err, ErrSubscriptionsUnsupported) {
+			lastErr = err
+		}
+	}
+	return nil, lastErr
+}
+
+// SubscribeNewHeads subscribes through the wrapped client if it supports subscriptions
+func (r *RetryClient) SubscribeNewHeads(ctx context.Context, heads chan<- *Head) (Subscription, error) {
+	subscriber, ok := r.inner.(HeadSubscriber)
+	if !ok {
+		return nil, ErrSubscriptionsUnsupported
+	}
+	return subscriber.SubscribeNewHeads(ctx, heads)
+}
+
+// HeadWatcher wakes polling loops up as soon as a new head is pushed by the node.
+// It keeps the newHeads subscription alive, resubscribing after disconnects, and
+// falls back to plain polling when subscriptions are unavailable.
+type HeadWatcher struct {
+	subscriber       HeadSubscriber
+	notify           chan struct{}
+	latest           atomic.Uint64
+	subscribed       atomic.Bool
+	resubscribeDelay time.Duration
+	log              *slog.Logger
+}
+
+// NewHeadWatcher returns a watcher for client. Clients that do not implement
+// HeadSubscriber are only polled.
+func NewHeadWatcher(client ClientInterface) *HeadWatcher {
+	subscriber, _ := client.(HeadSubscriber)
+	return &HeadWatcher{
+		subscriber:       subscriber,
+		notify:           make(chan struct{}, 1),
+		resubscribeDelay: initialResubscribeDelay,
+		log:              logger.GetLogger("rpc-heads"),
+	}
+}
+
+// Start maintains the subscription in the background until ctx is cancelled
+func (w *HeadWatcher) Start(ctx context.Context) {
+	if w.subscriber == nil {
+		w.log.Info("RPC client does not support subscriptions, polling for new blocks")
+		return
+	}
+	go w.run(ctx)
+}
+
+// Subscribed reports whether new heads are currently being pushed
+func (w *HeadWatcher) Subscribed() bool {
+	return w.subscribed.Load()
+}
+
+// Latest returns the number of the most recent pushed head, or zero if none was received
+func (w *HeadWatcher) Latest() uint64 {
+	return w.latest.Load()
+}
+
+// Wait blocks until a new head is pushed, pollInterval elapses or ctx is cancelled.
+// The poll interval still applies while subscribed so a silently stalled subscription
+// cannot stop the caller.
+func (w *HeadWatcher) Wait(ctx context.Context, pollInterval time.Duration) {
+	timer := time.NewTimer(pollInterval)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+	case <-w.notify:
+	case <-timer.C:
+	}
+}
+
+func (w *HeadWatcher) run(ctx context.Context) {
+	delay := w.resubscribeDelay
+	for {
+		subscribed, err := w.subscribe(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if subscribed {
+			delay = w.resubscribeDelay
+		}
+		if errors.Is(err, ErrSubscriptionsUnsupported) {
+			w.log.Info("RPC endpoints do not support subscriptions, polling for new blocks")
+			return
+		}
+
+		w.log.Warn("New heads subscription lost, falling back to polling until resubscribed",
+			"error", err,
+			"retry_in", delay)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		if !subscribed {
+			delay = min(delay*2, maxResubscribeDelay)
+		}
+	}
+}
+
+// subscribe runs a single subscription until it fails or ctx is cancelled.
+// It reports whether the subscription was established.
+func (w *HeadWatcher) subscribe(ctx context.Context) (bool, error) {
+	heads := make(chan *Head, headBufferSize)
+	sub, err := w.subscriber.SubscribeNewHeads(ctx, heads)
+	if err != nil {
+		return false, err
+	}
+	defer sub.Unsubscribe()
+
+	w.subscribed.Store(true)
+	defer w.subscribed.Store(false)
+	w.log.Info("Subscribed to new heads")
+
+	for {
+		select {
+		case <-ctx.Done():
+			return true, ctx.Err()
+		case err := <-sub.Err():
+			if err == nil {
+				err = errors.New("subscription closed")
+			}
+			return true, err
+		case head := <-heads:
+			w.latest.Store(uint64(head.Number))
+			w.log.Debug("New head", "number", uint64(head.Number), "hash", head.Hash)
+
+			// Coalesce notifications, waiters only need to know that something changed
+			select {
+			case w.notify <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
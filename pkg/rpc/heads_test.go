@@ -0,0 +1,130 @@
+package rpc
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSubscription is a Subscription whose failure is triggered by the test
+type fakeSubscription struct {
+	errCh chan error
+	once  sync.Once
+}
+
+func (s *fakeSubscription) Err() <-chan error { return s.errCh }
+func (s *fakeSubscription) Unsubscribe()      { s.once.Do(func() { close(s.errCh) }) }
+
+// subscribingClient hands out subscriptions that the test can push heads into
+type subscribingClient struct {
+	fakeClient
+	mu            sync.Mutex
+	unsupported   bool
+	subscriptions int
+	heads         chan<- *Head
+	sub           *fakeSubscription
+}
+
+func (c *subscribingClient) SubscribeNewHeads(ctx context.Context, heads chan<- *Head) (Subscription, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.unsupported {
+		return nil, ErrSubscriptionsUnsupported
+	}
+	c.subscriptions++
+	c.heads = heads
+	c.sub = &fakeSubscription{errCh: make(chan error, 1)}
+	return c.sub, nil
+}
+
+func (c *subscribingClient) push(number uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.heads <- &Head{Number: hexutil.Uint64(number)}
+}
+
+func (c *subscribingClient) drop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sub.errCh <- assert.AnError
+}
+
+func (c *subscribingClient) subscriptionCount() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.subscriptions
+}
+
+func TestHeadWatcher_WakesOnNewHead(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client := &subscribingClient{}
+	watcher := NewHeadWatcher(client)
+	watcher.Start(ctx)
+	require.Eventually(t, watcher.Subscribed, time.Second, time.Millisecond)
+
+	done := make(chan struct{})
+	go func() {
+		watcher.Wait(ctx, time.Minute)
+		close(done)
+	}()
+
+	client.push(100)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Wait did not return after a new head was pushed")
+	}
+	assert.Equal(t, uint64(100), watcher.Latest())
+}
+
+func TestHeadWatcher_Resubscribes(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client := &subscribingClient{}
+	watcher := NewHeadWatcher(client)
+	watcher.resubscribeDelay = time.Millisecond
+	watcher.Start(ctx)
+	require.Eventually(t, watcher.Subscribed, time.Second, time.Millisecond)
+
+	client.drop()
+	require.Eventually(t, func() bool { return client.subscriptionCount() == 2 }, time.Second, time.Millisecond)
+	require.Eventually(t, watcher.Subscribed, time.Second, time.Millisecond)
+
+	client.push(7)
+	require.Eventually(t, func() bool { return watcher.Latest() == 7 }, time.Second, time.Millisecond)
+}
+
+func TestHeadWatcher_FallsBackToPolling(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	t.Run("client without subscription support", func(t *testing.T) {
+		watcher := NewHeadWatcher(&fakeClient{})
+		watcher.Start(ctx)
+
+		start := time.Now()
+		watcher.Wait(ctx, 20*time.Millisecond)
+		assert.GreaterOrEqual(t, time.Since(start), 20*time.Millisecond)
+		assert.False(t, watcher.Subscribed())
+	})
+
+	t.Run("transport without subscription support", func(t *testing.T) {
+		client := &subscribingClient{unsupported: true}
+		pool := NewPoolWithClients([]string{"http"}, []ClientInterface{client}, DefaultPoolConfig())
+		watcher := NewHeadWatcher(NewRetryClient(pool, DefaultRetryConfig()))
+		watcher.Start(ctx)
+
+		start := time.Now()
+		watcher.Wait(ctx, 20*time.Millisecond)
+		assert.GreaterOrEqual(t, time.Since(start), 20*time.Millisecond)
+		assert.False(t, watcher.Subscribed())
+	})
+}
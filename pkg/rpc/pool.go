@@ -0,0 +1,453 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/weiihann/state-expiry-indexer/internal/logger"
+)
+
+// ErrNoHealthyEndpoint is returned when every endpoint in the pool has an open circuit
+var ErrNoHealthyEndpoint = errors.New("no healthy RPC endpoint available")
+
+// latencyDecay is the weight given to the newest sample in the latency moving average
+const latencyDecay = 0.2
+
+// CircuitState is the circuit breaker state of a pool endpoint
+type CircuitState string
+
+const (
+	CircuitClosed   CircuitState = "closed"    // Endpoint is healthy and in rotation
+	CircuitOpen     CircuitState = "open"      // Endpoint is failing and out of rotation
+	CircuitHalfOpen CircuitState = "half-open" // Cooldown elapsed, a single probe request is allowed
+)
+
+// PoolConfig configures health tracking for a Pool
+type PoolConfig struct {
+	// FailureThreshold is the number of consecutive failures that opens an endpoint's circuit
+	FailureThreshold int
+	// Cooldown is how long an open circuit stays open before a probe request is allowed
+	Cooldown time.Duration
+	// MaxInFlight caps the calls in flight on a single endpoint across all callers of the pool.
+	// Callers wait for a free slot when every endpoint is at the cap. Zero means no cap.
+	MaxInFlight int
+	// Batch configures batched calls on the clients dialed by NewPool
+	Batch BatchConfig
+}
+
+// DefaultPoolConfig returns the default pool configuration
+func DefaultPoolConfig() PoolConfig {
+	return PoolConfig{
+		FailureThreshold: 5,
+		Cooldown:         30 * time.Second,
+		Batch:            DefaultBatchConfig(),
+	}
+}
+
+// EndpointStats is a snapshot of the health of a single pool endpoint
+type EndpointStats struct {
+	URL                 string        `json:"url"`
+	State               CircuitState  `json:"state"`
+	Requests            uint64        `json:"requests"`
+	Failures            uint64        `json:"failures"`
+	ConsecutiveFailures int           `json:"consecutive_failures"`
+	ErrorRate           float64       `json:"error_rate"`
+	AvgLatency          time.Duration `json:"avg_latency_ns"`
+	InFlight            int           `json:"in_flight"`
+	LastError           string        `json:"last_error,omitempty"`
+}
+
+type endpoint struct {
+	url    string
+	client ClientInterface
+
+	state               CircuitState
+	openedAt            time.Time
+	probing             bool
+	requests            uint64
+	failures            uint64
+	consecutiveFailures int
+	avgLatency          time.Duration
+	inFlight            int
+	lastError           string
+}
+
+// Pool spreads RPC calls across several endpoints, tracking per-endpoint latency and
+// error rates and taking failing endpoints out of rotation with a circuit breaker.
+type Pool struct {
+	mu        sync.Mutex
+	endpoints []*endpoint
+	config    PoolConfig
+	next      int
+	log       *slog.Logger
+
+	// released is closed and replaced whenever a call finishes, waking callers waiting for a slot
+	released chan struct{}
+}
+
+// Ensure Pool implements ClientInterface
+var _ ClientInterface = (*Pool)(nil)
+
+// NewPool dials every URL and returns a pool over the resulting clients
+func NewPool(ctx context.Context, urls []string, config PoolConfig) (*Pool, error) {
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("at least one RPC URL is required")
+	}
+
+	clients := make([]ClientInterface, 0, len(urls))
+	for _, url := range urls {
+		client, err := NewClientWithBatchConfig(ctx, url, config.Batch)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create RPC client for %s: %w", url, err)
+		}
+		clients = append(clients, client)
+	}
+
+	return NewPoolWithClients(urls, clients, config), nil
+}
+
+// NewPoolWithClients returns a pool over already constructed clients. names[i] identifies clients[i] in stats and logs.
+func NewPoolWithClients(names []string, clients []ClientInterface, config PoolConfig) *Pool {
+	if config.FailureThreshold <= 0 {
+		config.FailureThreshold = DefaultPoolConfig().FailureThreshold
+	}
+	if config.Cooldown <= 0 {
+		config.Cooldown = DefaultPoolConfig().Cooldown
+	}
+
+	endpoints := make([]*endpoint, len(clients))
+	for i, client := range clients {
+		name := fmt.Sprintf("endpoint-%d", i)
+		if i < len(names) {
+			name = names[i]
+		}
+		endpoints[i] = &endpoint{url: name, client: client, state: CircuitClosed}
+	}
+
+	return &Pool{
+		endpoints: endpoints,
+		config:    config,
+		log:       logger.GetLogger("rpc-pool"),
+		released:  make(chan struct{}),
+	}
+}
+
+// FindPool returns the Pool behind client, looking through decorators such as RetryClient
+func FindPool(client ClientInterface) (*Pool, bool) {
+	for client != nil {
+		if pool, ok := client.(*Pool); ok {
+			return pool, true
+		}
+		wrapper, ok := client.(interface{ Unwrap() ClientInterface })
+		if !ok {
+			return nil, false
+		}
+		client = wrapper.Unwrap()
+	}
+	return nil, false
+}
+
+// Size returns the number of endpoints in the pool
+func (p *Pool) Size() int {
+	return len(p.endpoints)
+}
+
+// Stats returns a snapshot of every endpoint's health
+func (p *Pool) Stats() []EndpointStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stats := make([]EndpointStats, 0, len(p.endpoints))
+	for _, ep := range p.endpoints {
+		var errorRate float64
+		if ep.requests > 0 {
+			errorRate = float64(ep.failures) / float64(ep.requests) * 100
+		}
+		stats = append(stats, EndpointStats{
+			URL:                 ep.url,
+			State:               p.currentState(ep, time.Now()),
+			Requests:            ep.requests,
+			Failures:            ep.failures,
+			ConsecutiveFailures: ep.consecutiveFailures,
+			ErrorRate:           errorRate,
+			AvgLatency:          ep.avgLatency,
+			InFlight:            ep.inFlight,
+			LastError:           ep.lastError,
+		})
+	}
+	return stats
+}
+
+func (p *Pool) GetLatestBlockNumber(ctx context.Context) (*big.Int, error) {
+	return poolCall(ctx, p, func(c ClientInterface) (*big.Int, error) {
+		return c.GetLatestBlockNumber(ctx)
+	})
+}
+
+func (p *Pool) GetBlockNumberByTag(ctx context.Context, tag BlockTag) (*big.Int, error) {
+	return poolCall(ctx, p, func(c ClientInterface) (*big.Int, error) {
+		return c.GetBlockNumberByTag(ctx, tag)
+	})
+}
+
+func (p *Pool) GetCode(ctx context.Context, address string, blockNumber *big.Int) (string, error) {
+	return poolCall(ctx, p, func(c ClientInterface) (string, error) {
+		return c.GetCode(ctx, address, blockNumber)
+	})
+}
+
+func (p *Pool) GetCodes(ctx context.Context, accounts map[string]uint64) (map[string]string, error) {
+	return poolCall(ctx, p, func(c ClientInterface) (map[string]string, error) {
+		return c.GetCodes(ctx, accounts)
+	})
+}
+
+func (p *Pool) GetStateDiff(ctx context.Context, blockNumber *big.Int) ([]TransactionResult, error) {
+	return poolCall(ctx, p, func(c ClientInterface) ([]TransactionResult, error) {
+		return c.GetStateDiff(ctx, blockNumber)
+	})
+}
+
+func (p *Pool) GetPrestate(ctx context.Context, blockNumber *big.Int) ([]TransactionResult, error) {
+	return poolCall(ctx, p, func(c ClientInterface) ([]TransactionResult, error) {
+		return c.GetPrestate(ctx, blockNumber)
+	})
+}
+
+func (p *Pool) GetStateDiffs(ctx context.Context, blocks []uint64) (map[uint64][]TransactionResult, error) {
+	return poolBatchCall(ctx, p, blocks, func(c ClientInterface, blocks []uint64) (map[uint64][]TransactionResult, error) {
+		return c.GetStateDiffs(ctx, blocks)
+	})
+}
+
+func (p *Pool) GetPrestates(ctx context.Context, blocks []uint64) (map[uint64][]TransactionResult, error) {
+	return poolBatchCall(ctx, p, blocks, func(c ClientInterface, blocks []uint64) (map[uint64][]TransactionResult, error) {
+		return c.GetPrestates(ctx, blocks)
+	})
+}
+
+func (p *Pool) GetBlockHeaders(ctx context.Context, blocks []uint64) (map[uint64]*Head, error) {
+	return poolBatchCall(ctx, p, blocks, func(c ClientInterface, blocks []uint64) (map[uint64]*Head, error) {
+		return c.GetBlockHeaders(ctx, blocks)
+	})
+}
+
+// poolBatchCall runs a batched call against the healthiest endpoint. Blocks that an endpoint
+// could not fetch are requested from the next endpoint, and results are merged.
+func poolBatchCall[R any](ctx context.Context, p *Pool, blocks []uint64, fn func(ClientInterface, []uint64) (map[uint64]R, error)) (map[uint64]R, error) {
+	results := make(map[uint64]R, len(blocks))
+	pending := blocks
+	var lastErr error
+	tried := make(map[*endpoint]bool, len(p.endpoints))
+
+	for len(tried) < len(p.endpoints) {
+		ep, err := p.acquire(ctx, tried)
+		if err != nil {
+			return results, err
+		}
+		if ep == nil {
+			break
+		}
+		tried[ep] = true
+
+		start := time.Now()
+		partial, err := fn(ep.client, pending)
+		p.release(ep, time.Since(start), err, ctx.Err() != nil)
+
+		for block, result := range partial {
+			results[block] = result
+		}
+		if err == nil {
+			return results, nil
+		}
+		if ctx.Err() != nil {
+			return results, err
+		}
+
+		lastErr = err
+		var batchErr *BatchError
+		if errors.As(err, &batchErr) {
+			pending = batchErr.Blocks()
+		}
+		p.log.Debug("Batched RPC call failed, trying next endpoint", "endpoint", ep.url, "pending_blocks", len(pending), "error", err)
+	}
+
+	if lastErr == nil {
+		return results, ErrNoHealthyEndpoint
+	}
+	return results, lastErr
+}
+
+// poolCall runs fn against the healthiest endpoint, failing over to the next one on error
+func poolCall[T any](ctx context.Context, p *Pool, fn func(ClientInterface) (T, error)) (T, error) {
+	var zero T
+	var lastErr error
+	tried := make(map[*endpoint]bool, len(p.endpoints))
+
+	for len(tried) < len(p.endpoints) {
+		ep, err := p.acquire(ctx, tried)
+		if err != nil {
+			return zero, err
+		}
+		if ep == nil {
+			break
+		}
+		tried[ep] = true
+
+		start := time.Now()
+		result, err := fn(ep.client)
+		p.release(ep, time.Since(start), err, ctx.Err() != nil)
+
+		if err == nil {
+			return result, nil
+		}
+		if ctx.Err() != nil {
+			return zero, err
+		}
+
+		lastErr = err
+		p.log.Debug("RPC call failed, trying next endpoint", "endpoint", ep.url, "error", err)
+	}
+
+	if lastErr == nil {
+		return zero, ErrNoHealthyEndpoint
+	}
+	return zero, lastErr
+}
+
+// acquire picks the best available endpoint that has not been tried yet and marks it in flight.
+// When every such endpoint is at MaxInFlight it waits for a call to finish. It returns nil if
+// no endpoint is available.
+func (p *Pool) acquire(ctx context.Context, tried map[*endpoint]bool) (*endpoint, error) {
+	for {
+		ep, released := p.tryAcquire(tried)
+		if ep != nil || released == nil {
+			return ep, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-released:
+		}
+	}
+}
+
+// tryAcquire picks the best available endpoint that has not been tried yet and marks it in
+// flight. If the only candidates are at MaxInFlight it returns the channel closed when the
+// next call finishes.
+func (p *Pool) tryAcquire(tried map[*endpoint]bool) (*endpoint, <-chan struct{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	var best *endpoint
+	var bestScore float64
+	saturated := false
+
+	// Start scanning at a rotating offset so equally scored endpoints share the load
+	n := len(p.endpoints)
+	for i := 0; i < n; i++ {
+		ep := p.endpoints[(p.next+i)%n]
+		if tried[ep] || !p.available(ep, now) {
+			continue
+		}
+		if p.config.MaxInFlight > 0 && ep.inFlight >= p.config.MaxInFlight {
+			saturated = true
+			continue
+		}
+
+		score := float64(ep.avgLatency) * float64(ep.inFlight+1)
+		if best == nil || score < bestScore {
+			best = ep
+			bestScore = score
+		}
+	}
+
+	if best == nil {
+		if saturated {
+			return nil, p.released
+		}
+		return nil, nil
+	}
+
+	p.next = (p.next + 1) % n
+	if p.currentState(best, now) == CircuitHalfOpen {
+		best.probing = true
+	}
+	best.inFlight++
+	return best, nil
+}
+
+// release records the outcome of a call. Calls aborted by the caller's context are not held against the endpoint.
+func (p *Pool) release(ep *endpoint, latency time.Duration, err error, canceled bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ep.inFlight--
+	close(p.released)
+	p.released = make(chan struct{})
+	wasProbing := ep.probing
+	ep.probing = false
+
+	if err != nil && canceled {
+		return
+	}
+
+	ep.requests++
+	if ep.avgLatency == 0 {
+		ep.avgLatency = latency
+	} else {
+		ep.avgLatency = time.Duration(latencyDecay*float64(latency) + (1-latencyDecay)*float64(ep.avgLatency))
+	}
+
+	if err == nil {
+		if ep.state != CircuitClosed {
+			p.log.Info("RPC endpoint recovered", "endpoint", ep.url)
+		}
+		ep.state = CircuitClosed
+		ep.consecutiveFailures = 0
+		return
+	}
+
+	ep.failures++
+	ep.consecutiveFailures++
+	ep.lastError = err.Error()
+
+	if wasProbing || ep.consecutiveFailures >= p.config.FailureThreshold {
+		if ep.state != CircuitOpen || wasProbing {
+			p.log.Warn("RPC endpoint taken out of rotation",
+				"endpoint", ep.url,
+				"consecutive_failures", ep.consecutiveFailures,
+				"cooldown", p.config.Cooldown,
+				"error", err)
+		}
+		ep.state = CircuitOpen
+		ep.openedAt = time.Now()
+	}
+}
+
+// currentState resolves an open circuit into half-open once its cooldown has elapsed
+func (p *Pool) currentState(ep *endpoint, now time.Time) CircuitState {
+	if ep.state == CircuitOpen && now.Sub(ep.openedAt) >= p.config.Cooldown {
+		return CircuitHalfOpen
+	}
+	return ep.state
+}
+
+// available reports whether an endpoint may receive a request
+func (p *Pool) available(ep *endpoint, now time.Time) bool {
+	switch p.currentState(ep, now) {
+	case CircuitClosed:
+		return true
+	case CircuitHalfOpen:
+		return !ep.probing
+	default:
+		return false
+	}
+}
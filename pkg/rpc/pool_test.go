@@ -0,0 +1,296 @@
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClient is an in-memory ClientInterface used to exercise the pool
+type fakeClient struct {
+	mu    sync.Mutex
+	fail  bool
+	calls int
+	block int64
+	delay time.Duration
+}
+
+func (f *fakeClient) do() error {
+	time.Sleep(f.delay)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+	if f.fail {
+		return fmt.Errorf("connection refused")
+	}
+	return nil
+}
+
+func (f *fakeClient) setFail(fail bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.fail = fail
+}
+
+func (f *fakeClient) callCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls
+}
+
+func (f *fakeClient) GetLatestBlockNumber(ctx context.Context) (*big.Int, error) {
+	if err := f.do(); err != nil {
+		return nil, err
+	}
+	return big.NewInt(f.block), nil
+}
+
+func (f *fakeClient) GetBlockNumberByTag(ctx context.Context, tag BlockTag) (*big.Int, error) {
+	return f.GetLatestBlockNumber(ctx)
+}
+
+func (f *fakeClient) GetCode(ctx context.Context, address string, blockNumber *big.Int) (string, error) {
+	if err := f.do(); err != nil {
+		return "", err
+	}
+	return "0x", nil
+}
+
+func (f *fakeClient) GetCodes(ctx context.Context, accounts map[string]uint64) (map[string]string, error) {
+	return FetchCodes(ctx, accounts, f.GetCode)
+}
+
+func (f *fakeClient) GetStateDiff(ctx context.Context, blockNumber *big.Int) ([]TransactionResult, error) {
+	if err := f.do(); err != nil {
+		return nil, err
+	}
+	return []TransactionResult{{TxHash: blockNumber.String()}}, nil
+}
+
+func (f *fakeClient) GetPrestate(ctx context.Context, blockNumber *big.Int) ([]TransactionResult, error) {
+	return f.GetStateDiff(ctx, blockNumber)
+}
+
+func (f *fakeClient) GetStateDiffs(ctx context.Context, blocks []uint64) (map[uint64][]TransactionResult, error) {
+	return FetchEach(ctx, blocks, f.GetStateDiff)
+}
+
+func (f *fakeClient) GetPrestates(ctx context.Context, blocks []uint64) (map[uint64][]TransactionResult, error) {
+	return FetchEach(ctx, blocks, f.GetPrestate)
+}
+
+func (f *fakeClient) GetBlockHeaders(ctx context.Context, blocks []uint64) (map[uint64]*Head, error) {
+	return FetchEach(ctx, blocks, func(ctx context.Context, blockNumber *big.Int) (*Head, error) {
+		if err := f.do(); err != nil {
+			return nil, err
+		}
+		return testHead(blockNumber.Uint64()), nil
+	})
+}
+
+// testHead returns a header linked to the header of the previous block
+func testHead(block uint64) *Head {
+	return &Head{
+		Number:     hexutil.Uint64(block),
+		Hash:       fmt.Sprintf("0x%064x", block),
+		ParentHash: fmt.Sprintf("0x%064x", block-1),
+	}
+}
+
+func TestPool_Failover(t *testing.T) {
+	bad := &fakeClient{fail: true}
+	good := &fakeClient{block: 42}
+	pool := NewPoolWithClients([]string{"bad", "good"}, []ClientInterface{bad, good}, DefaultPoolConfig())
+
+	for i := 0; i < 3; i++ {
+		block, err := pool.GetLatestBlockNumber(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, int64(42), block.Int64())
+	}
+
+	stats := pool.Stats()
+	require.Len(t, stats, 2)
+	assert.Equal(t, "bad", stats[0].URL)
+	assert.Greater(t, stats[0].Failures, uint64(0))
+	assert.Equal(t, uint64(3), stats[1].Requests)
+	assert.Equal(t, uint64(0), stats[1].Failures)
+}
+
+func TestPool_CircuitBreaker(t *testing.T) {
+	bad := &fakeClient{fail: true}
+	// The healthy endpoint is slower so latency scoring keeps routing to the failing one until its circuit opens
+	good := &fakeClient{block: 1, delay: time.Millisecond}
+	config := PoolConfig{FailureThreshold: 2, Cooldown: 50 * time.Millisecond}
+	pool := NewPoolWithClients([]string{"bad", "good"}, []ClientInterface{bad, good}, config)
+
+	ctx := context.Background()
+	for i := 0; i < 10; i++ {
+		_, err := pool.GetStateDiff(ctx, big.NewInt(int64(i)))
+		require.NoError(t, err)
+	}
+
+	// The failing endpoint is only called until its circuit opens
+	assert.Equal(t, 2, bad.callCount())
+	assert.Equal(t, CircuitOpen, pool.Stats()[0].State)
+
+	// After the cooldown a single probe is allowed and a success closes the circuit
+	bad.setFail(false)
+	time.Sleep(60 * time.Millisecond)
+	assert.Equal(t, CircuitHalfOpen, pool.Stats()[0].State)
+
+	for i := 0; i < 4; i++ {
+		_, err := pool.GetStateDiff(ctx, big.NewInt(int64(i)))
+		require.NoError(t, err)
+	}
+	assert.Equal(t, CircuitClosed, pool.Stats()[0].State)
+	assert.Greater(t, bad.callCount(), 2)
+}
+
+func TestPool_AllEndpointsFailing(t *testing.T) {
+	first := &fakeClient{fail: true}
+	second := &fakeClient{fail: true}
+	config := PoolConfig{FailureThreshold: 1, Cooldown: time.Minute}
+	pool := NewPoolWithClients([]string{"first", "second"}, []ClientInterface{first, second}, config)
+
+	_, err := pool.GetCode(context.Background(), "0x0", nil)
+	assert.ErrorContains(t, err, "connection refused")
+
+	// Both circuits are now open
+	_, err = pool.GetCode(context.Background(), "0x0", nil)
+	assert.ErrorIs(t, err, ErrNoHealthyEndpoint)
+	assert.Equal(t, 1, first.callCount())
+	assert.Equal(t, 1, second.callCount())
+}
+
+func TestPool_SpreadsConcurrentLoad(t *testing.T) {
+	clients := []*fakeClient{{}, {}, {}}
+	pool := NewPoolWithClients(nil, []ClientInterface{clients[0], clients[1], clients[2]}, DefaultPoolConfig())
+
+	var wg sync.WaitGroup
+	for i := 0; i < 300; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := pool.GetLatestBlockNumber(context.Background())
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	total := 0
+	for _, client := range clients {
+		assert.Greater(t, client.callCount(), 0)
+		total += client.callCount()
+	}
+	assert.Equal(t, 300, total)
+}
+
+// gatedClient counts concurrent calls and holds every call until the gate is closed
+type gatedClient struct {
+	fakeClient
+	gate      chan struct{}
+	active    int
+	maxActive int
+}
+
+func (g *gatedClient) GetLatestBlockNumber(ctx context.Context) (*big.Int, error) {
+	g.mu.Lock()
+	g.active++
+	g.maxActive = max(g.maxActive, g.active)
+	g.mu.Unlock()
+
+	<-g.gate
+
+	g.mu.Lock()
+	g.active--
+	g.mu.Unlock()
+	return big.NewInt(1), nil
+}
+
+func TestPool_MaxInFlight(t *testing.T) {
+	config := DefaultPoolConfig()
+	config.MaxInFlight = 2
+
+	t.Run("callers wait for a free slot", func(t *testing.T) {
+		client := &gatedClient{gate: make(chan struct{})}
+		pool := NewPoolWithClients(nil, []ClientInterface{client}, config)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := pool.GetLatestBlockNumber(context.Background())
+				assert.NoError(t, err)
+			}()
+		}
+
+		require.Eventually(t, func() bool { return pool.Stats()[0].InFlight == 2 }, time.Second, time.Millisecond)
+		close(client.gate)
+		wg.Wait()
+
+		assert.Equal(t, 2, client.maxActive)
+		assert.Equal(t, uint64(20), pool.Stats()[0].Requests)
+	})
+
+	t.Run("waiting stops with the context", func(t *testing.T) {
+		client := &gatedClient{gate: make(chan struct{})}
+		defer close(client.gate)
+		pool := NewPoolWithClients(nil, []ClientInterface{client}, config)
+
+		for i := 0; i < 2; i++ {
+			go pool.GetLatestBlockNumber(context.Background())
+		}
+		require.Eventually(t, func() bool { return pool.Stats()[0].InFlight == 2 }, time.Second, time.Millisecond)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		_, err := pool.GetLatestBlockNumber(ctx)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+}
+
+// partialClient fails a fixed set of blocks in batched calls
+type partialClient struct {
+	fakeClient
+	failBlocks map[uint64]bool
+	requested  [][]uint64
+}
+
+func (p *partialClient) GetStateDiffs(ctx context.Context, blocks []uint64) (map[uint64][]TransactionResult, error) {
+	p.requested = append(p.requested, blocks)
+	return FetchEach(ctx, blocks, func(ctx context.Context, block *big.Int) ([]TransactionResult, error) {
+		if p.failBlocks[block.Uint64()] {
+			return nil, fmt.Errorf("header not found")
+		}
+		return []TransactionResult{{TxHash: block.String()}}, nil
+	})
+}
+
+func TestPool_BatchFailoverRequestsOnlyFailedBlocks(t *testing.T) {
+	first := &partialClient{failBlocks: map[uint64]bool{2: true, 4: true}}
+	second := &partialClient{}
+	pool := NewPoolWithClients([]string{"first", "second"}, []ClientInterface{first, second}, DefaultPoolConfig())
+
+	// Make sure the first endpoint is picked first
+	pool.next = 0
+
+	results, err := pool.GetStateDiffs(context.Background(), []uint64{1, 2, 3, 4})
+	require.NoError(t, err)
+	assert.Len(t, results, 4)
+	for block, txs := range results {
+		require.Len(t, txs, 1)
+		assert.Equal(t, fmt.Sprint(block), txs[0].TxHash)
+	}
+
+	require.Len(t, second.requested, 1)
+	assert.Equal(t, []uint64{2, 4}, second.requested[0])
+}
@@ -0,0 +1,137 @@
+package rpc
+
+import (
+	"fmt"
+	"strings"
+)
+
+// AccessSource tags what touched an account. Sources are bit flags so an account touched in
+// several ways in the same block carries all of them.
+type AccessSource uint8
+
+const (
+	// AccessSourceTransaction is an access made while executing a transaction
+	AccessSourceTransaction AccessSource = 1 << iota
+	// AccessSourceWithdrawal is a beacon chain withdrawal credited to its recipient (EIP-4895)
+	AccessSourceWithdrawal
+	// AccessSourceCoinbase is the block reward and priority fees credited to the fee recipient
+	AccessSourceCoinbase
+	// AccessSourceSystem is a system contract call made outside any transaction
+	AccessSourceSystem
+)
+
+var accessSourceNames = map[AccessSource]string{
+	AccessSourceTransaction: "transaction",
+	AccessSourceWithdrawal:  "withdrawal",
+	AccessSourceCoinbase:    "coinbase",
+	AccessSourceSystem:      "system",
+}
+
+func (s AccessSource) String() string {
+	var names []string
+	for source := AccessSourceTransaction; source <= AccessSourceSystem; source <<= 1 {
+		if s&source != 0 {
+			names = append(names, accessSourceNames[source])
+		}
+	}
+	return strings.Join(names, "|")
+}
+
+// MarshalText encodes a single source by name, so range files stay readable
+func (s AccessSource) MarshalText() ([]byte, error) {
+	name, ok := accessSourceNames[s]
+	if !ok {
+		return nil, fmt.Errorf("cannot encode access source %d", s)
+	}
+	return []byte(name), nil
+}
+
+func (s *AccessSource) UnmarshalText(text []byte) error {
+	for source, name := range accessSourceNames {
+		if name == string(text) {
+			*s = source
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown access source %q", text)
+}
+
+// System contracts called by the protocol at the start or end of every block
+const (
+	// BeaconRootsAddress stores parent beacon block roots (EIP-4788, Cancun)
+	BeaconRootsAddress = "0x000f3df6d732807ef1319fb7b8bb8522d0beac02"
+	// HistoryStorageAddress stores parent block hashes (EIP-2935, Prague)
+	HistoryStorageAddress = "0x0000f90827f1c53a10cb7a02335b175320002935"
+	// WithdrawalRequestsAddress dequeues execution layer withdrawal requests (EIP-7002, Prague)
+	WithdrawalRequestsAddress = "0x00000961ef480eb55e80d19ad83579a64c007002"
+	// ConsolidationRequestsAddress dequeues consolidation requests (EIP-7251, Prague)
+	ConsolidationRequestsAddress = "0x0000bbddc7ce488642fb579f8b00f3a590007251"
+
+	// beaconRootsBufferLength is the ring buffer size of the beacon roots contract
+	beaconRootsBufferLength = 8191
+	// historyServeWindow is the ring buffer size of the history storage contract
+	historyServeWindow = 8191
+)
+
+// Withdrawal is a beacon chain withdrawal included in a block
+type Withdrawal struct {
+	Address string `json:"address"`
+}
+
+// ProtocolAccess is an account touched by the protocol outside of transactions
+type ProtocolAccess struct {
+	Address string       `json:"address"`
+	Source  AccessSource `json:"source"`
+	// Storage lists the slots written, when they are known from the block header
+	Storage []string `json:"storage,omitempty"`
+}
+
+// ProtocolAccesses returns the accounts a block touches outside of its transactions: the fee
+// recipient, withdrawal recipients and the system contracts active at the block's fork.
+// Rewards paid to uncle miners before the merge are not included.
+func (h *Head) ProtocolAccesses() []ProtocolAccess {
+	var accesses []ProtocolAccess
+	if h.Miner != "" {
+		accesses = append(accesses, ProtocolAccess{Address: strings.ToLower(h.Miner), Source: AccessSourceCoinbase})
+	}
+
+	seen := make(map[string]bool, len(h.Withdrawals))
+	for _, withdrawal := range h.Withdrawals {
+		address := strings.ToLower(withdrawal.Address)
+		if seen[address] {
+			continue
+		}
+		seen[address] = true
+		accesses = append(accesses, ProtocolAccess{Address: address, Source: AccessSourceWithdrawal})
+	}
+
+	// Cancun headers carry the parent beacon block root, stored keyed by timestamp
+	if h.ParentBeaconBlockRoot != "" {
+		timestampSlot := uint64(h.Timestamp) % beaconRootsBufferLength
+		accesses = append(accesses, ProtocolAccess{
+			Address: BeaconRootsAddress,
+			Source:  AccessSourceSystem,
+			Storage: []string{storageSlot(timestampSlot), storageSlot(timestampSlot + beaconRootsBufferLength)},
+		})
+	}
+
+	// Prague headers carry the requests hash
+	if h.RequestsHash != "" {
+		var parentSlot []string
+		if h.Number > 0 {
+			parentSlot = []string{storageSlot((uint64(h.Number) - 1) % historyServeWindow)}
+		}
+		accesses = append(accesses,
+			ProtocolAccess{Address: HistoryStorageAddress, Source: AccessSourceSystem, Storage: parentSlot},
+			ProtocolAccess{Address: WithdrawalRequestsAddress, Source: AccessSourceSystem},
+			ProtocolAccess{Address: ConsolidationRequestsAddress, Source: AccessSourceSystem},
+		)
+	}
+
+	return accesses
+}
+
+// storageSlot encodes a slot number as a 32-byte storage key
+func storageSlot(slot uint64) string {
+	return fmt.Sprintf("0x%064x", slot)
+}
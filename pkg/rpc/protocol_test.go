@@ -0,0 +1,67 @@
+package rpc
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHead_ProtocolAccesses(t *testing.T) {
+	t.Run("pre-merge block only credits the miner", func(t *testing.T) {
+		head := &Head{Number: 1000, Miner: "0xEA674fdDe714fd979de3EdF0F56AA9716B898ec8"}
+		assert.Equal(t, []ProtocolAccess{
+			{Address: "0xea674fdde714fd979de3edf0f56aa9716b898ec8", Source: AccessSourceCoinbase},
+		}, head.ProtocolAccesses())
+	})
+
+	t.Run("withdrawal recipients are recorded once per block", func(t *testing.T) {
+		head := &Head{
+			Number: 17034870,
+			Withdrawals: []Withdrawal{
+				{Address: "0x00000000000000000000000000000000000000aa"},
+				{Address: "0x00000000000000000000000000000000000000AA"},
+				{Address: "0x00000000000000000000000000000000000000bb"},
+			},
+		}
+		assert.Equal(t, []ProtocolAccess{
+			{Address: "0x00000000000000000000000000000000000000aa", Source: AccessSourceWithdrawal},
+			{Address: "0x00000000000000000000000000000000000000bb", Source: AccessSourceWithdrawal},
+		}, head.ProtocolAccesses())
+	})
+
+	t.Run("cancun writes the beacon root keyed by timestamp", func(t *testing.T) {
+		head := &Head{Number: 19426587, Timestamp: 8191*3 + 5, ParentBeaconBlockRoot: "0x01"}
+		accesses := head.ProtocolAccesses()
+		require.Len(t, accesses, 1)
+		assert.Equal(t, BeaconRootsAddress, accesses[0].Address)
+		assert.Equal(t, AccessSourceSystem, accesses[0].Source)
+		assert.Equal(t, []string{fmt.Sprintf("0x%064x", 5), fmt.Sprintf("0x%064x", 5+8191)}, accesses[0].Storage)
+	})
+
+	t.Run("prague stores the parent hash and dequeues requests", func(t *testing.T) {
+		head := &Head{Number: 8192 + 10, ParentBeaconBlockRoot: "0x01", RequestsHash: "0x02"}
+		accesses := head.ProtocolAccesses()
+		require.Len(t, accesses, 4)
+		assert.Equal(t, HistoryStorageAddress, accesses[1].Address)
+		assert.Equal(t, []string{fmt.Sprintf("0x%064x", 10)}, accesses[1].Storage)
+		assert.Equal(t, WithdrawalRequestsAddress, accesses[2].Address)
+		assert.Equal(t, ConsolidationRequestsAddress, accesses[3].Address)
+	})
+}
+
+func TestAccessSource(t *testing.T) {
+	assert.Equal(t, "transaction|withdrawal", (AccessSourceTransaction | AccessSourceWithdrawal).String())
+
+	data, err := json.Marshal(ProtocolAccess{Address: "0xaa", Source: AccessSourceCoinbase})
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"address":"0xaa","source":"coinbase"}`, string(data))
+
+	var access ProtocolAccess
+	require.NoError(t, json.Unmarshal(data, &access))
+	assert.Equal(t, AccessSourceCoinbase, access.Source)
+
+	assert.Error(t, json.Unmarshal([]byte(`{"source":"uncle"}`), &access))
+}
@@ -0,0 +1,253 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math/big"
+	"math/rand/v2"
+	"time"
+
+	"github.com/weiihann/state-expiry-indexer/internal/logger"
+)
+
+// RetryConfig controls how failed RPC calls are retried
+type RetryConfig struct {
+	// MaxAttempts is the maximum number of attempts per call, including the first one
+	MaxAttempts int
+	// InitialBackoff is the upper bound of the first backoff, doubled after each attempt
+	InitialBackoff time.Duration
+	// MaxBackoff caps a single backoff
+	MaxBackoff time.Duration
+	// Budget is the total time a call may spend retrying before the last error is returned
+	Budget time.Duration
+}
+
+// DefaultRetryConfig returns the default retry configuration
+func DefaultRetryConfig() RetryConfig {
+	return RetryConfig{
+		MaxAttempts:    5,
+		InitialBackoff: 500 * time.Millisecond,
+		MaxBackoff:     30 * time.Second,
+		Budget:         2 * time.Minute,
+	}
+}
+
+// backoff returns a full-jitter exponential backoff for the given retry, starting at 1
+func (c RetryConfig) backoff(retry int) time.Duration {
+	ceiling := c.InitialBackoff << (retry - 1)
+	if ceiling <= 0 || ceiling > c.MaxBackoff {
+		ceiling = c.MaxBackoff
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+	return rand.N(ceiling) + 1
+}
+
+// wait returns the delay before the given retry after err, honouring Retry-After
+func (c RetryConfig) wait(retry int, err error) time.Duration {
+	delay := c.backoff(retry)
+	if after := RetryAfter(err); after > delay {
+		delay = after
+	}
+	return delay
+}
+
+// Retry calls fn until it succeeds, returns a permanent error, or the attempt
+// limit or time budget is exhausted. The returned error is classified.
+func Retry[T any](ctx context.Context, config RetryConfig, fn func(context.Context) (T, error)) (T, error) {
+	start := time.Now()
+	var result T
+	var err error
+
+	for attempt := 1; ; attempt++ {
+		result, err = fn(ctx)
+		if err == nil {
+			return result, nil
+		}
+		err = Classify(err)
+		if !IsRetryable(err) || ctx.Err() != nil || attempt >= config.MaxAttempts {
+			return result, err
+		}
+
+		delay := config.wait(attempt, err)
+		if config.Budget > 0 && time.Since(start)+delay > config.Budget {
+			return result, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return result, err
+		case <-time.After(delay):
+		}
+	}
+}
+
+// RetryClient wraps a ClientInterface and retries transient and rate limited failures
+// with jittered exponential backoff. Batched calls only retry the blocks that failed.
+type RetryClient struct {
+	inner  ClientInterface
+	config RetryConfig
+	log    *slog.Logger
+}
+
+// Ensure RetryClient implements ClientInterface
+var _ ClientInterface = (*RetryClient)(nil)
+
+func NewRetryClient(inner ClientInterface, config RetryConfig) *RetryClient {
+	defaults := DefaultRetryConfig()
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = defaults.MaxAttempts
+	}
+	if config.InitialBackoff <= 0 {
+		config.InitialBackoff = defaults.InitialBackoff
+	}
+	if config.MaxBackoff <= 0 {
+		config.MaxBackoff = defaults.MaxBackoff
+	}
+	return &RetryClient{
+		inner:  inner,
+		config: config,
+		log:    logger.GetLogger("rpc-retry"),
+	}
+}
+
+// Unwrap returns the wrapped client
+func (r *RetryClient) Unwrap() ClientInterface {
+	return r.inner
+}
+
+func (r *RetryClient) GetLatestBlockNumber(ctx context.Context) (*big.Int, error) {
+	return Retry(ctx, r.config, func(ctx context.Context) (*big.Int, error) {
+		return r.inner.GetLatestBlockNumber(ctx)
+	})
+}
+
+func (r *RetryClient) GetBlockNumberByTag(ctx context.Context, tag BlockTag) (*big.Int, error) {
+	return Retry(ctx, r.config, func(ctx context.Context) (*big.Int, error) {
+		return r.inner.GetBlockNumberByTag(ctx, tag)
+	})
+}
+
+func (r *RetryClient) GetCode(ctx context.Context, address string, blockNumber *big.Int) (string, error) {
+	return Retry(ctx, r.config, func(ctx context.Context) (string, error) {
+		return r.inner.GetCode(ctx, address, blockNumber)
+	})
+}
+
+// GetCodes retries the whole call, failed accounts are cheap to fetch again
+func (r *RetryClient) GetCodes(ctx context.Context, accounts map[string]uint64) (map[string]string, error) {
+	return Retry(ctx, r.config, func(ctx context.Context) (map[string]string, error) {
+		return r.inner.GetCodes(ctx, accounts)
+	})
+}
+
+func (r *RetryClient) GetStateDiff(ctx context.Context, blockNumber *big.Int) ([]TransactionResult, error) {
+	return Retry(ctx, r.config, func(ctx context.Context) ([]TransactionResult, error) {
+		return r.inner.GetStateDiff(ctx, blockNumber)
+	})
+}
+
+func (r *RetryClient) GetPrestate(ctx context.Context, blockNumber *big.Int) ([]TransactionResult, error) {
+	return Retry(ctx, r.config, func(ctx context.Context) ([]TransactionResult, error) {
+		return r.inner.GetPrestate(ctx, blockNumber)
+	})
+}
+
+func (r *RetryClient) GetStateDiffs(ctx context.Context, blocks []uint64) (map[uint64][]TransactionResult, error) {
+	return retryBatch(ctx, r, blocks, r.inner.GetStateDiffs)
+}
+
+func (r *RetryClient) GetPrestates(ctx context.Context, blocks []uint64) (map[uint64][]TransactionResult, error) {
+	return retryBatch(ctx, r, blocks, r.inner.GetPrestates)
+}
+
+func (r *RetryClient) GetBlockHeaders(ctx context.Context, blocks []uint64) (map[uint64]*Head, error) {
+	return retryBatch(ctx, r, blocks, r.inner.GetBlockHeaders)
+}
+
+// retryBatch retries the retryable failed blocks of a batched call until every block
+// succeeded or the attempt limit or time budget is exhausted
+func retryBatch[R any](ctx context.Context, r *RetryClient, blocks []uint64, fn func(context.Context, []uint64) (map[uint64]R, error)) (map[uint64]R, error) {
+	start := time.Now()
+	results := make(map[uint64]R, len(blocks))
+	permanent := make(map[uint64]error)
+	pending := blocks
+
+	for attempt := 1; ; attempt++ {
+		partial, err := fn(ctx, pending)
+		for block, result := range partial {
+			results[block] = result
+		}
+		if err == nil {
+			if len(permanent) > 0 {
+				return results, &BatchError{Failed: permanent}
+			}
+			return results, nil
+		}
+
+		var batchErr *BatchError
+		if !errors.As(err, &batchErr) {
+			// The whole call failed, every pending block failed with the same error
+			err = Classify(err)
+			batchErr = &BatchError{Failed: make(map[uint64]error, len(pending))}
+			for _, block := range pending {
+				if _, ok := results[block]; !ok {
+					batchErr.Failed[block] = err
+				}
+			}
+		}
+
+		// Keep permanent failures aside and retry the rest
+		var retryErr error
+		retryable := make(map[uint64]error)
+		pending = pending[:0:0]
+		for _, block := range batchErr.Blocks() {
+			blockErr := Classify(batchErr.Failed[block])
+			if !IsRetryable(blockErr) {
+				permanent[block] = blockErr
+				continue
+			}
+			pending = append(pending, block)
+			retryable[block] = blockErr
+			if retryErr == nil || RetryAfter(blockErr) > RetryAfter(retryErr) {
+				retryErr = blockErr
+			}
+		}
+
+		if len(pending) == 0 || ctx.Err() != nil || attempt >= r.config.MaxAttempts {
+			return results, mergeFailures(ctx, retryable, permanent)
+		}
+
+		delay := r.config.wait(attempt, retryErr)
+		if r.config.Budget > 0 && time.Since(start)+delay > r.config.Budget {
+			return results, mergeFailures(ctx, retryable, permanent)
+		}
+
+		r.log.Debug("Retrying failed blocks", "blocks", len(pending), "attempt", attempt, "delay", delay, "error", retryErr)
+		select {
+		case <-ctx.Done():
+			return results, ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// mergeFailures combines the blocks that were still being retried with the permanently failed ones
+func mergeFailures(ctx context.Context, retryable, permanent map[uint64]error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	failed := make(map[uint64]error, len(retryable)+len(permanent))
+	for block, err := range permanent {
+		failed[block] = err
+	}
+	for block, err := range retryable {
+		failed[block] = err
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	return &BatchError{Failed: failed}
+}
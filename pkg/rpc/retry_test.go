@@ -0,0 +1,129 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fastRetryConfig keeps backoffs short so tests run quickly
+func fastRetryConfig() RetryConfig {
+	return RetryConfig{
+		MaxAttempts:    4,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     5 * time.Millisecond,
+		Budget:         time.Second,
+	}
+}
+
+// scriptedClient returns the queued errors for a block before succeeding
+type scriptedClient struct {
+	fakeClient
+	mu     sync.Mutex
+	errs   map[uint64][]error
+	served map[uint64]int
+}
+
+func newScriptedClient(errs map[uint64][]error) *scriptedClient {
+	return &scriptedClient{errs: errs, served: make(map[uint64]int)}
+}
+
+func (s *scriptedClient) GetStateDiff(ctx context.Context, blockNumber *big.Int) ([]TransactionResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	block := blockNumber.Uint64()
+	s.served[block]++
+	if queued := s.errs[block]; len(queued) > 0 {
+		s.errs[block] = queued[1:]
+		return nil, queued[0]
+	}
+	return []TransactionResult{{TxHash: blockNumber.String()}}, nil
+}
+
+func (s *scriptedClient) GetStateDiffs(ctx context.Context, blocks []uint64) (map[uint64][]TransactionResult, error) {
+	return FetchEach(ctx, blocks, s.GetStateDiff)
+}
+
+func TestRetry(t *testing.T) {
+	t.Run("retries transient errors until success", func(t *testing.T) {
+		calls := 0
+		result, err := Retry(context.Background(), fastRetryConfig(), func(ctx context.Context) (int, error) {
+			calls++
+			if calls < 3 {
+				return 0, errors.New("connection reset by peer")
+			}
+			return 42, nil
+		})
+		require.NoError(t, err)
+		assert.Equal(t, 42, result)
+		assert.Equal(t, 3, calls)
+	})
+
+	t.Run("does not retry permanent errors", func(t *testing.T) {
+		calls := 0
+		_, err := Retry(context.Background(), fastRetryConfig(), func(ctx context.Context) (int, error) {
+			calls++
+			return 0, &jsonRPCError{code: -32601, message: "method not found"}
+		})
+		var permanent *PermanentError
+		assert.ErrorAs(t, err, &permanent)
+		assert.Equal(t, 1, calls)
+	})
+
+	t.Run("stops after max attempts", func(t *testing.T) {
+		calls := 0
+		_, err := Retry(context.Background(), fastRetryConfig(), func(ctx context.Context) (int, error) {
+			calls++
+			return 0, errors.New("upstream timeout")
+		})
+		var transient *TransientError
+		assert.ErrorAs(t, err, &transient)
+		assert.Equal(t, 4, calls)
+	})
+
+	t.Run("does not wait beyond the budget", func(t *testing.T) {
+		config := fastRetryConfig()
+		config.Budget = 50 * time.Millisecond
+
+		calls := 0
+		start := time.Now()
+		_, err := Retry(context.Background(), config, func(ctx context.Context) (int, error) {
+			calls++
+			return 0, &RateLimitError{Err: errors.New("429"), RetryAfter: time.Minute}
+		})
+		assert.ErrorContains(t, err, "429")
+		assert.Equal(t, 1, calls)
+		assert.Less(t, time.Since(start), time.Second)
+	})
+}
+
+func TestRetryClient_GetStateDiffs(t *testing.T) {
+	transient := errors.New("502 Bad Gateway")
+	permanent := &PermanentError{Err: errors.New("missing trie node")}
+	inner := newScriptedClient(map[uint64][]error{
+		2: {transient, transient},
+		3: {permanent},
+	})
+	client := NewRetryClient(inner, fastRetryConfig())
+
+	results, err := client.GetStateDiffs(context.Background(), []uint64{1, 2, 3, 4})
+	require.Error(t, err)
+
+	var batchErr *BatchError
+	require.ErrorAs(t, err, &batchErr)
+	assert.Equal(t, []uint64{3}, batchErr.Blocks())
+	assert.ErrorAs(t, err, &permanent)
+
+	assert.Len(t, results, 3)
+	assert.Equal(t, 1, inner.served[1])
+	assert.Equal(t, 3, inner.served[2])
+	assert.Equal(t, 1, inner.served[3])
+	assert.Equal(t, 1, inner.served[4])
+}
@@ -0,0 +1,217 @@
+// Package rpctest provides a local JSON-RPC server that stands in for an Ethereum
+// node, answering the calls made by the indexer from previously downloaded data.
+package rpctest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	gethrpc "github.com/ethereum/go-ethereum/rpc"
+	"github.com/weiihann/state-expiry-indexer/internal/logger"
+	"github.com/weiihann/state-expiry-indexer/pkg/rpc"
+)
+
+// ErrInjected is the error returned for requests failed by error injection
+var ErrInjected = errors.New("injected failure")
+
+// Options configures latency and failure injection
+type Options struct {
+	// Latency is added before every response
+	Latency time.Duration
+	// ErrorRate is the fraction of calls, between 0 and 1, answered with a JSON-RPC server error
+	ErrorRate float64
+	// RateLimitRate is the fraction of HTTP requests, between 0 and 1, answered with 429 Too Many Requests
+	RateLimitRate float64
+	// RetryAfter is the Retry-After header sent with rate limited responses
+	RetryAfter time.Duration
+	// FailBlocks are blocks whose traces always fail with a pruned history error
+	FailBlocks map[uint64]bool
+}
+
+// Server answers eth_blockNumber, eth_getCode, eth_getBlockByNumber,
+// trace_replayBlockTransactions and debug_traceBlockByNumber from a Source
+type Server struct {
+	source  Source
+	options Options
+	rpc     *gethrpc.Server
+	log     *slog.Logger
+}
+
+// Ensure Server can be mounted as an HTTP handler
+var _ http.Handler = (*Server)(nil)
+
+// NewServer returns a server answering from source
+func NewServer(source Source, options Options) (*Server, error) {
+	s := &Server{
+		source:  source,
+		options: options,
+		rpc:     gethrpc.NewServer(),
+		log:     logger.GetLogger("rpctest"),
+	}
+
+	if err := s.rpc.RegisterName("eth", &ethAPI{server: s}); err != nil {
+		return nil, fmt.Errorf("failed to register eth API: %w", err)
+	}
+	if err := s.rpc.RegisterName("trace", &traceAPI{server: s}); err != nil {
+		return nil, fmt.Errorf("failed to register trace API: %w", err)
+	}
+	if err := s.rpc.RegisterName("debug", &debugAPI{server: s}); err != nil {
+		return nil, fmt.Errorf("failed to register debug API: %w", err)
+	}
+	return s, nil
+}
+
+// ServeHTTP answers JSON-RPC requests, injecting rate limits before they reach the RPC server
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.options.RateLimitRate > 0 && rand.Float64() < s.options.RateLimitRate {
+		if s.options.RetryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(s.options.RetryAfter.Seconds())))
+		}
+		http.Error(w, "too many requests", http.StatusTooManyRequests)
+		return
+	}
+	s.rpc.ServeHTTP(w, r)
+}
+
+// ListenAndServe serves JSON-RPC over HTTP on addr until ctx is cancelled
+func (s *Server) ListenAndServe(ctx context.Context, addr string) error {
+	httpServer := &http.Server{Addr: addr, Handler: s}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- httpServer.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return httpServer.Shutdown(shutdownCtx)
+	}
+}
+
+// Stop stops the RPC server
+func (s *Server) Stop() {
+	s.rpc.Stop()
+}
+
+// before applies latency and error injection to a call
+func (s *Server) before(ctx context.Context) error {
+	if s.options.Latency > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(s.options.Latency):
+		}
+	}
+	if s.options.ErrorRate > 0 && rand.Float64() < s.options.ErrorRate {
+		return ErrInjected
+	}
+	return nil
+}
+
+// resolveBlock turns a block parameter ("latest", "finalized", hex number) into a block number
+func (s *Server) resolveBlock(param string) (uint64, error) {
+	switch strings.ToLower(param) {
+	case "", "latest", "pending", "safe", "finalized":
+		return s.source.LatestBlock()
+	case "earliest":
+		return 0, nil
+	}
+	block, err := hexutil.DecodeUint64(param)
+	if err != nil {
+		return 0, fmt.Errorf("invalid block number %q: %w", param, err)
+	}
+	return block, nil
+}
+
+// blockAccesses returns the transaction results of a block, failing blocks configured in FailBlocks
+func (s *Server) blockAccesses(ctx context.Context, param string) ([]rpc.TransactionResult, error) {
+	if err := s.before(ctx); err != nil {
+		return nil, err
+	}
+	block, err := s.resolveBlock(param)
+	if err != nil {
+		return nil, err
+	}
+	if s.options.FailBlocks[block] {
+		return nil, fmt.Errorf("missing trie node for block %d, historical state is not available", block)
+	}
+	return s.source.BlockAccesses(block)
+}
+
+type ethAPI struct {
+	server *Server
+}
+
+// BlockNumber answers eth_blockNumber
+func (api *ethAPI) BlockNumber(ctx context.Context) (hexutil.Uint64, error) {
+	if err := api.server.before(ctx); err != nil {
+		return 0, err
+	}
+	latest, err := api.server.source.LatestBlock()
+	return hexutil.Uint64(latest), err
+}
+
+// GetCode answers eth_getCode with code seen in the served state diffs
+func (api *ethAPI) GetCode(ctx context.Context, address string, block string) (string, error) {
+	if err := api.server.before(ctx); err != nil {
+		return "", err
+	}
+	return api.server.source.Code(address), nil
+}
+
+// GetBlockByNumber answers eth_getBlockByNumber with the block number, hash and parent hash.
+// Blocks the source has no data for are answered with null like a node that has not seen them.
+func (api *ethAPI) GetBlockByNumber(ctx context.Context, block string, fullTx bool) (*rpc.Head, error) {
+	if err := api.server.before(ctx); err != nil {
+		return nil, err
+	}
+	number, err := api.server.resolveBlock(block)
+	if err != nil {
+		return nil, err
+	}
+	head, err := api.server.source.Header(number)
+	if errors.Is(err, ErrBlockNotFound) {
+		return nil, nil
+	}
+	return head, err
+}
+
+type traceAPI struct {
+	server *Server
+}
+
+// ReplayBlockTransactions answers trace_replayBlockTransactions
+func (api *traceAPI) ReplayBlockTransactions(ctx context.Context, block string, traceTypes []string) ([]rpc.TransactionResult, error) {
+	return api.server.blockAccesses(ctx, block)
+}
+
+type debugAPI struct {
+	server *Server
+}
+
+// TraceBlockByNumber answers debug_traceBlockByNumber with the prestateTracer output
+// shape. It is only meaningful for data recorded in prestate access mode.
+func (api *debugAPI) TraceBlockByNumber(ctx context.Context, block string, config map[string]any) ([]rpc.PrestateResult, error) {
+	results, err := api.server.blockAccesses(ctx, block)
+	if err != nil {
+		return nil, err
+	}
+
+	prestates := make([]rpc.PrestateResult, 0, len(results))
+	for _, tx := range results {
+		prestates = append(prestates, rpc.PrestateResult{TxHash: tx.TxHash, Result: tx.StateDiff})
+	}
+	return prestates, nil
+}
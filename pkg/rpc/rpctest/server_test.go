@@ -0,0 +1,116 @@
+package rpctest
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/weiihann/state-expiry-indexer/pkg/rpc"
+)
+
+func newTestServer(t *testing.T, options Options) *rpc.Client {
+	t.Helper()
+
+	source, err := NewFileSource("../../../testdata/example.json")
+	require.NoError(t, err)
+
+	server, err := NewServer(source, options)
+	require.NoError(t, err)
+
+	httpServer := httptest.NewServer(server)
+	t.Cleanup(func() {
+		httpServer.Close()
+		server.Stop()
+	})
+
+	client, err := rpc.NewClient(context.Background(), httpServer.URL)
+	require.NoError(t, err)
+	return client
+}
+
+func TestServer(t *testing.T) {
+	ctx := context.Background()
+	client := newTestServer(t, Options{})
+
+	t.Run("eth_blockNumber", func(t *testing.T) {
+		latest, err := client.GetLatestBlockNumber(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, int64(5000002), latest.Int64())
+	})
+
+	t.Run("trace_replayBlockTransactions", func(t *testing.T) {
+		results, err := client.GetStateDiff(ctx, big.NewInt(5000001))
+		require.NoError(t, err)
+		assert.NotEmpty(t, results)
+	})
+
+	t.Run("batched traces", func(t *testing.T) {
+		results, err := client.GetStateDiffs(ctx, []uint64{5000001, 5000002})
+		require.NoError(t, err)
+		assert.Len(t, results, 2)
+	})
+
+	t.Run("eth_getCode", func(t *testing.T) {
+		code, err := client.GetCode(ctx, "0x0baa3a6fa67de805ad5760d2a1e82b87b14e9365", big.NewInt(5000002))
+		require.NoError(t, err)
+		assert.Equal(t, "0x", code)
+	})
+
+	t.Run("eth_getBlockByNumber", func(t *testing.T) {
+		headers, err := client.GetBlockHeaders(ctx, []uint64{5000001, 5000002})
+		require.NoError(t, err)
+		require.Len(t, headers, 2)
+		assert.Equal(t, headers[5000001].Hash, headers[5000002].ParentHash)
+	})
+
+	t.Run("unknown block", func(t *testing.T) {
+		_, err := client.GetStateDiff(ctx, big.NewInt(1))
+		assert.Error(t, err)
+	})
+}
+
+func TestServer_FailureInjection(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("failed blocks are permanent", func(t *testing.T) {
+		client := newTestServer(t, Options{FailBlocks: map[uint64]bool{5000002: true}})
+
+		_, err := client.GetStateDiff(ctx, big.NewInt(5000002))
+		var permanent *rpc.PermanentError
+		assert.True(t, errors.As(err, &permanent), "expected permanent error, got %v", err)
+
+		_, err = client.GetStateDiff(ctx, big.NewInt(5000001))
+		assert.NoError(t, err)
+	})
+
+	t.Run("injected errors are transient", func(t *testing.T) {
+		client := newTestServer(t, Options{ErrorRate: 1})
+
+		_, err := client.GetLatestBlockNumber(ctx)
+		require.Error(t, err)
+		assert.Equal(t, rpc.ErrorClassTransient, rpc.ClassOf(err))
+	})
+
+	t.Run("rate limiting", func(t *testing.T) {
+		client := newTestServer(t, Options{RateLimitRate: 1, RetryAfter: 3 * time.Second})
+
+		_, err := client.GetLatestBlockNumber(ctx)
+		require.Error(t, err)
+		assert.Equal(t, rpc.ErrorClassRateLimit, rpc.ClassOf(err))
+		assert.Equal(t, 3*time.Second, rpc.RetryAfter(err))
+	})
+
+	t.Run("latency", func(t *testing.T) {
+		client := newTestServer(t, Options{Latency: 50 * time.Millisecond})
+
+		start := time.Now()
+		_, err := client.GetLatestBlockNumber(ctx)
+		require.NoError(t, err)
+		assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+	})
+}
@@ -0,0 +1,447 @@
+package rpctest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/weiihann/state-expiry-indexer/pkg/rpc"
+	"github.com/weiihann/state-expiry-indexer/pkg/storage"
+	"github.com/weiihann/state-expiry-indexer/pkg/utils"
+)
+
+// ErrBlockNotFound is returned by a Source for blocks it has no data for
+var ErrBlockNotFound = errors.New("block not found")
+
+// Source provides the chain data answered by a Server
+type Source interface {
+	// LatestBlock returns the highest block the source has data for
+	LatestBlock() (uint64, error)
+	// BlockAccesses returns the recorded transaction results of a block
+	BlockAccesses(block uint64) ([]rpc.TransactionResult, error)
+	// Code returns the code of an account as seen in the blocks loaded so far, or "0x"
+	Code(address string) string
+	// Header returns the hash and parent hash of a block
+	Header(block uint64) (*rpc.Head, error)
+}
+
+// syntheticHead derives a stable header for blocks recorded without their hash
+func syntheticHead(block uint64) *rpc.Head {
+	head := &rpc.Head{
+		Number: hexutil.Uint64(block),
+		Hash:   fmt.Sprintf("0x%064x", block),
+	}
+	if block > 0 {
+		head.ParentHash = fmt.Sprintf("0x%064x", block-1)
+	}
+	return head
+}
+
+// storedHead returns the header recorded in a range file, if the range file has one
+func storedHead(block storage.RangeDiffs) *rpc.Head {
+	if block.Hash == "" {
+		return nil
+	}
+	return &rpc.Head{
+		Number:     hexutil.Uint64(block.BlockNum),
+		Hash:       block.Hash,
+		ParentHash: block.ParentHash,
+	}
+}
+
+// placeholderCode is served for contracts loaded from binary range files, which only record
+// that an account is a contract
+const placeholderCode = "0xfe"
+
+// binaryRangeDiffs rebuilds transaction results from a binary range file. Binary ranges only keep
+// the accessed accounts and slots, so balances and nonces are served unchanged and slot values as zero.
+func binaryRangeDiffs(data []byte) ([]storage.RangeDiffs, error) {
+	blocks, err := storage.DecodeRange(data)
+	if err != nil {
+		return nil, err
+	}
+
+	zero := fmt.Sprintf("0x%064x", 0)
+	rangeDiffs := make([]storage.RangeDiffs, 0, len(blocks))
+	for _, block := range blocks {
+		results := make([]rpc.TransactionResult, 0, len(block.Diffs))
+		for _, diffs := range block.Diffs {
+			stateDiff := make(map[string]rpc.AccountDiff, len(diffs.StateDiff))
+			for addr, diff := range diffs.StateDiff {
+				storageDiff := make(map[string]any, len(diff.Storage))
+				for _, slot := range diff.Storage {
+					storageDiff[slot] = map[string]any{"*": map[string]any{"from": zero, "to": zero}}
+				}
+				var code any = "="
+				if diff.IsContract {
+					code = map[string]any{"*": map[string]any{"from": "0x", "to": placeholderCode}}
+				}
+				stateDiff[addr] = rpc.AccountDiff{Balance: "=", Code: code, Nonce: "=", Storage: storageDiff}
+			}
+			results = append(results, rpc.TransactionResult{StateDiff: stateDiff})
+		}
+
+		rangeDiffs = append(rangeDiffs, storage.RangeDiffs{
+			BlockNum:   block.BlockNum,
+			Hash:       block.Hash,
+			ParentHash: block.ParentHash,
+			AccessMode: block.AccessMode,
+			Diffs:      results,
+			Protocol:   block.Protocol,
+		})
+	}
+	return rangeDiffs, nil
+}
+
+// codeIndex remembers contract code found in state diffs so eth_getCode can be answered
+type codeIndex struct {
+	mu    sync.RWMutex
+	codes map[string]string
+}
+
+func newCodeIndex() *codeIndex {
+	return &codeIndex{codes: make(map[string]string)}
+}
+
+func (c *codeIndex) add(results []rpc.TransactionResult) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, tx := range results {
+		for address, diff := range tx.StateDiff {
+			if code := codeOf(diff.Code); code != "" {
+				c.codes[strings.ToLower(address)] = code
+			}
+		}
+	}
+}
+
+func (c *codeIndex) get(address string) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if code, ok := c.codes[strings.ToLower(address)]; ok {
+		return code
+	}
+	return "0x"
+}
+
+// codeOf extracts deployed code from a state diff ({"+": code} or {"*": {"to": code}})
+// or a prestate (code string) code field
+func codeOf(field any) string {
+	switch v := field.(type) {
+	case string:
+		if strings.HasPrefix(v, "0x") && len(v) > 2 {
+			return v
+		}
+	case map[string]any:
+		if born, ok := v["+"].(string); ok && len(born) > 2 {
+			return born
+		}
+		if changed, ok := v["*"].(map[string]any); ok {
+			if to, ok := changed["to"].(string); ok && len(to) > 2 {
+				return to
+			}
+		}
+	}
+	return ""
+}
+
+// MemorySource serves blocks held in memory
+type MemorySource struct {
+	blocks  map[uint64][]rpc.TransactionResult
+	headers map[uint64]*rpc.Head
+	latest  uint64
+	codes   *codeIndex
+}
+
+// Ensure MemorySource implements Source
+var _ Source = (*MemorySource)(nil)
+
+// NewMemorySource serves the given blocks
+func NewMemorySource(blocks map[uint64][]rpc.TransactionResult) *MemorySource {
+	source := &MemorySource{
+		blocks:  blocks,
+		headers: make(map[uint64]*rpc.Head),
+		codes:   newCodeIndex(),
+	}
+	for block, results := range blocks {
+		source.latest = max(source.latest, block)
+		source.codes.add(results)
+	}
+	return source
+}
+
+// NewFileSource loads a JSON file in the range file layout, such as testdata/example.json.
+// Files ending in .zst are decompressed first.
+func NewFileSource(path string) (*MemorySource, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	if strings.HasSuffix(path, ".zst") {
+		decoder, err := utils.NewZstdDecoder()
+		if err != nil {
+			return nil, err
+		}
+		defer decoder.Close()
+
+		data, err = decoder.Decompress(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress %s: %w", path, err)
+		}
+	}
+
+	var rangeDiffs []storage.RangeDiffs
+	if err := json.Unmarshal(data, &rangeDiffs); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	blocks := make(map[uint64][]rpc.TransactionResult, len(rangeDiffs))
+	for _, block := range rangeDiffs {
+		blocks[block.BlockNum] = block.Diffs
+	}
+
+	source := NewMemorySource(blocks)
+	for _, block := range rangeDiffs {
+		if head := storedHead(block); head != nil {
+			source.headers[block.BlockNum] = head
+		}
+	}
+	return source, nil
+}
+
+func (m *MemorySource) LatestBlock() (uint64, error) {
+	return m.latest, nil
+}
+
+func (m *MemorySource) BlockAccesses(block uint64) ([]rpc.TransactionResult, error) {
+	results, ok := m.blocks[block]
+	if !ok {
+		return nil, fmt.Errorf("%w: %d", ErrBlockNotFound, block)
+	}
+	return results, nil
+}
+
+func (m *MemorySource) Code(address string) string {
+	return m.codes.get(address)
+}
+
+func (m *MemorySource) Header(block uint64) (*rpc.Head, error) {
+	if head, ok := m.headers[block]; ok {
+		return head, nil
+	}
+	if _, ok := m.blocks[block]; !ok {
+		return nil, fmt.Errorf("%w: %d", ErrBlockNotFound, block)
+	}
+	return syntheticHead(block), nil
+}
+
+var (
+	rangeFilePattern = regexp.MustCompile(`^(\d+)_(\d+)\.json\.zst$`)
+	blockFilePattern = regexp.MustCompile(`^(\d+)\.json(\.zst)?$`)
+)
+
+// DataDirSource serves blocks from a data directory holding {start}_{end}.json.zst
+// range files and {block}.json or {block}.json.zst per-block files, stored in the flat
+// layout unless SetLayout selects another. Range files are loaded lazily and the most
+// recently used one is kept in memory. Binary range files only record accessed accounts
+// and slots, their values are served as placeholders.
+type DataDirSource struct {
+	dataDir   string
+	backend   storage.Backend
+	rangeSize uint64
+	latest    uint64
+	decoder   *utils.ZstdDecoder
+	codes     *codeIndex
+
+	mu            sync.Mutex
+	cachedStart   uint64
+	cached        map[uint64][]rpc.TransactionResult
+	cachedHeaders map[uint64]*rpc.Head
+}
+
+// Ensure DataDirSource implements Source
+var _ Source = (*DataDirSource)(nil)
+
+// NewDataDirSource scans dataDir to find the latest available block
+func NewDataDirSource(dataDir string, rangeSize int) (*DataDirSource, error) {
+	if rangeSize <= 0 {
+		return nil, fmt.Errorf("range size must be greater than 0")
+	}
+
+	if _, err := os.Stat(dataDir); err != nil {
+		return nil, fmt.Errorf("failed to read data directory %s: %w", dataDir, err)
+	}
+	backend := storage.NewLocalBackend(dataDir)
+	files, err := backend.List("")
+	if err != nil {
+		return nil, err
+	}
+
+	// Files are found in any layout
+	var latest uint64
+	for _, file := range files {
+		name := path.Base(file.Name)
+		if match := rangeFilePattern.FindStringSubmatch(name); match != nil {
+			end, _ := strconv.ParseUint(match[2], 10, 64)
+			latest = max(latest, end)
+		} else if match := blockFilePattern.FindStringSubmatch(name); match != nil {
+			block, _ := strconv.ParseUint(match[1], 10, 64)
+			latest = max(latest, block)
+		}
+	}
+
+	// Per-block files may be compressed with a trained dictionary
+	dictionaries, err := storage.LoadDictionaries(backend)
+	if err != nil {
+		return nil, err
+	}
+	decoder, err := utils.NewZstdDecoderWithOptions(utils.ZstdOptions{Dictionaries: dictionaries})
+	if err != nil {
+		return nil, err
+	}
+
+	return &DataDirSource{
+		dataDir:   dataDir,
+		backend:   backend,
+		rangeSize: uint64(rangeSize),
+		latest:    latest,
+		decoder:   decoder,
+		codes:     newCodeIndex(),
+	}, nil
+}
+
+// SetLayout sets the layout per-block and range files are read from
+func (d *DataDirSource) SetLayout(layout storage.Layout) {
+	d.backend = storage.WithLayout(storage.NewLocalBackend(d.dataDir), layout)
+}
+
+// Close releases the decoder
+func (d *DataDirSource) Close() {
+	d.decoder.Close()
+}
+
+func (d *DataDirSource) LatestBlock() (uint64, error) {
+	return d.latest, nil
+}
+
+func (d *DataDirSource) BlockAccesses(block uint64) ([]rpc.TransactionResult, error) {
+	if block == 0 || block > d.latest {
+		return nil, fmt.Errorf("%w: %d", ErrBlockNotFound, block)
+	}
+
+	results, err := d.fromRange(block)
+	if err == nil {
+		return results, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	return d.fromBlockFile(block)
+}
+
+func (d *DataDirSource) Code(address string) string {
+	return d.codes.get(address)
+}
+
+func (d *DataDirSource) Header(block uint64) (*rpc.Head, error) {
+	if _, err := d.BlockAccesses(block); err != nil {
+		return nil, err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if head, ok := d.cachedHeaders[block]; ok {
+		return head, nil
+	}
+	return syntheticHead(block), nil
+}
+
+// fromRange returns a block from its range file, loading the file if it is not cached
+func (d *DataDirSource) fromRange(block uint64) ([]rpc.TransactionResult, error) {
+	start := (block-1)/d.rangeSize*d.rangeSize + 1
+	end := start + d.rangeSize - 1
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.cached == nil || d.cachedStart != start {
+		name := fmt.Sprintf("%d_%d.json.zst", start, end)
+		path := d.backend.Location(name)
+		compressed, err := storage.ReadFile(d.backend, name)
+		if err != nil {
+			return nil, err
+		}
+		data, err := d.decoder.Decompress(compressed)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress range file %s: %w", path, err)
+		}
+
+		var rangeDiffs []storage.RangeDiffs
+		if storage.IsBinaryRange(data) {
+			rangeDiffs, err = binaryRangeDiffs(data)
+		} else {
+			err = json.Unmarshal(data, &rangeDiffs)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse range file %s: %w", path, err)
+		}
+
+		d.cached = make(map[uint64][]rpc.TransactionResult, len(rangeDiffs))
+		d.cachedHeaders = make(map[uint64]*rpc.Head, len(rangeDiffs))
+		for _, rangeBlock := range rangeDiffs {
+			d.cached[rangeBlock.BlockNum] = rangeBlock.Diffs
+			if head := storedHead(rangeBlock); head != nil {
+				d.cachedHeaders[rangeBlock.BlockNum] = head
+			}
+			d.codes.add(rangeBlock.Diffs)
+		}
+		d.cachedStart = start
+	}
+
+	results, ok := d.cached[block]
+	if !ok {
+		return nil, fmt.Errorf("%w: %d", ErrBlockNotFound, block)
+	}
+	return results, nil
+}
+
+// fromBlockFile returns a block from a per-block file written by the caller
+func (d *DataDirSource) fromBlockFile(block uint64) ([]rpc.TransactionResult, error) {
+	name := fmt.Sprintf("%d.json", block)
+	path := d.backend.Location(name)
+
+	data, err := storage.ReadFile(d.backend, name+".zst")
+	if err == nil {
+		data, err = d.decoder.Decompress(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress block file %s.zst: %w", path, err)
+		}
+	} else if os.IsNotExist(err) {
+		data, err = storage.ReadFile(d.backend, name)
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%w: %d", ErrBlockNotFound, block)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read block file %s: %w", path, err)
+		}
+	} else {
+		return nil, fmt.Errorf("failed to read block file %s.zst: %w", path, err)
+	}
+
+	var results []rpc.TransactionResult
+	if err := json.Unmarshal(data, &results); err != nil {
+		return nil, fmt.Errorf("failed to parse block file %s: %w", path, err)
+	}
+	d.codes.add(results)
+	return results, nil
+}
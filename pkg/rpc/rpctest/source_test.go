@@ -0,0 +1,234 @@
+package rpctest
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/weiihann/state-expiry-indexer/pkg/rpc"
+	"github.com/weiihann/state-expiry-indexer/pkg/storage"
+	"github.com/weiihann/state-expiry-indexer/pkg/utils"
+)
+
+func testResults(address string) []rpc.TransactionResult {
+	return []rpc.TransactionResult{
+		{
+			TxHash: "0xabc",
+			StateDiff: map[string]rpc.AccountDiff{
+				address: {Balance: "=", Code: map[string]any{"+": "0x6080"}, Nonce: "=", Storage: map[string]any{}},
+			},
+		},
+	}
+}
+
+// storedHash differs from the synthetic hashes so tests can tell which one was served
+func storedHash(block uint64) string {
+	return fmt.Sprintf("0x%062x01", block)
+}
+
+func writeRangeFile(t *testing.T, dir string, start, end uint64) {
+	t.Helper()
+
+	var rangeDiffs []storage.RangeDiffs
+	for block := start; block <= end; block++ {
+		rangeDiffs = append(rangeDiffs, storage.RangeDiffs{
+			BlockNum:   block,
+			Hash:       storedHash(block),
+			ParentHash: storedHash(block - 1),
+			Diffs:      testResults(fmt.Sprintf("0x%040x", block)),
+		})
+	}
+	data, err := json.Marshal(rangeDiffs)
+	require.NoError(t, err)
+
+	encoder, err := utils.NewZstdEncoder()
+	require.NoError(t, err)
+	defer encoder.Close()
+	compressed, err := encoder.Compress(data)
+	require.NoError(t, err)
+
+	path := filepath.Join(dir, fmt.Sprintf("%d_%d.json.zst", start, end))
+	require.NoError(t, os.WriteFile(path, compressed, 0o644))
+}
+
+func TestFileSource_ExampleData(t *testing.T) {
+	source, err := NewFileSource("../../../testdata/example.json")
+	require.NoError(t, err)
+
+	latest, err := source.LatestBlock()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(5000002), latest)
+
+	results, err := source.BlockAccesses(5000001)
+	require.NoError(t, err)
+	assert.NotEmpty(t, results)
+
+	_, err = source.BlockAccesses(1)
+	assert.ErrorIs(t, err, ErrBlockNotFound)
+}
+
+func TestMemorySource_Code(t *testing.T) {
+	source := NewMemorySource(map[uint64][]rpc.TransactionResult{
+		7: testResults("0xAbC0000000000000000000000000000000000001"),
+	})
+
+	assert.Equal(t, "0x6080", source.Code("0xabc0000000000000000000000000000000000001"))
+	assert.Equal(t, "0x", source.Code("0x0000000000000000000000000000000000000002"))
+}
+
+func TestDataDirSource(t *testing.T) {
+	dir := t.TempDir()
+	writeRangeFile(t, dir, 1, 10)
+	writeRangeFile(t, dir, 11, 20)
+
+	// A per-block file past the last range, as written by the caller before merging
+	blockData, err := json.Marshal(testResults("0x00000000000000000000000000000000000000ff"))
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "21.json"), blockData, 0o644))
+
+	source, err := NewDataDirSource(dir, 10)
+	require.NoError(t, err)
+	defer source.Close()
+
+	latest, err := source.LatestBlock()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(21), latest)
+
+	t.Run("range file", func(t *testing.T) {
+		for _, block := range []uint64{1, 10, 11, 20} {
+			results, err := source.BlockAccesses(block)
+			require.NoError(t, err)
+			require.Len(t, results, 1)
+			assert.Contains(t, results[0].StateDiff, fmt.Sprintf("0x%040x", block))
+		}
+	})
+
+	t.Run("per-block file", func(t *testing.T) {
+		results, err := source.BlockAccesses(21)
+		require.NoError(t, err)
+		assert.Contains(t, results[0].StateDiff, "0x00000000000000000000000000000000000000ff")
+	})
+
+	t.Run("missing block", func(t *testing.T) {
+		_, err := source.BlockAccesses(22)
+		assert.ErrorIs(t, err, ErrBlockNotFound)
+		_, err = source.BlockAccesses(0)
+		assert.ErrorIs(t, err, ErrBlockNotFound)
+	})
+
+	t.Run("code from loaded blocks", func(t *testing.T) {
+		assert.Equal(t, "0x6080", source.Code(fmt.Sprintf("0x%040x", 11)))
+	})
+
+	t.Run("binary range file", func(t *testing.T) {
+		rp, err := storage.NewRangeProcessor(dir, nil, 10)
+		require.NoError(t, err)
+		defer rp.Close()
+		converted, err := rp.ConvertRange(2)
+		require.NoError(t, err)
+		require.True(t, converted)
+
+		binarySource, err := NewDataDirSource(dir, 10)
+		require.NoError(t, err)
+		defer binarySource.Close()
+
+		results, err := binarySource.BlockAccesses(12)
+		require.NoError(t, err)
+		require.Len(t, results, 1)
+		assert.Contains(t, results[0].StateDiff, fmt.Sprintf("0x%040x", 12))
+
+		head, err := binarySource.Header(12)
+		require.NoError(t, err)
+		assert.Equal(t, storedHash(12), head.Hash)
+	})
+
+	t.Run("headers", func(t *testing.T) {
+		head, err := source.Header(11)
+		require.NoError(t, err)
+		assert.Equal(t, storedHash(11), head.Hash)
+		assert.Equal(t, storedHash(10), head.ParentHash)
+
+		// Per-block files have no hash, a synthetic one is served
+		head, err = source.Header(21)
+		require.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("0x%064x", 21), head.Hash)
+
+		_, err = source.Header(22)
+		assert.ErrorIs(t, err, ErrBlockNotFound)
+	})
+}
+
+func TestDataDirSourceShardedLayout(t *testing.T) {
+	dir := t.TempDir()
+	writeRangeFile(t, dir, 1, 10)
+	blockData, err := json.Marshal(testResults("0x00000000000000000000000000000000000000ff"))
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "11.json"), blockData, 0o644))
+	_, err = storage.Relayout(storage.NewLocalBackend(dir), storage.LayoutSharded, false, nil)
+	require.NoError(t, err)
+
+	source, err := NewDataDirSource(dir, 10)
+	require.NoError(t, err)
+	defer source.Close()
+	source.SetLayout(storage.LayoutSharded)
+
+	latest, err := source.LatestBlock()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(11), latest)
+	results, err := source.BlockAccesses(5)
+	require.NoError(t, err)
+	assert.Contains(t, results[0].StateDiff, fmt.Sprintf("0x%040x", 5))
+	results, err = source.BlockAccesses(11)
+	require.NoError(t, err)
+	assert.Contains(t, results[0].StateDiff, "0x00000000000000000000000000000000000000ff")
+}
+func TestBinaryRangeDiffs(t *testing.T) {
+	dir := t.TempDir()
+	rangeDiffs := []storage.RangeDiffs{{
+		BlockNum: 1,
+		Diffs: []rpc.TransactionResult{{StateDiff: map[string]rpc.AccountDiff{
+			"0x00000000000000000000000000000000000000aa": {
+				Code:    map[string]any{"*": map[string]any{"from": "0x", "to": "0x6080"}},
+				Storage: map[string]any{"0x01": map[string]any{"+": "0x02"}},
+			},
+			"0x00000000000000000000000000000000000000bb": {Balance: map[string]any{"+": "0x1"}},
+		}}},
+	}}
+	data, err := json.Marshal(rangeDiffs)
+	require.NoError(t, err)
+	encoder, err := utils.NewZstdEncoder()
+	require.NoError(t, err)
+	defer encoder.Close()
+	compressed, err := encoder.Compress(data)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "1_10.json.zst"), compressed, 0o644))
+
+	rp, err := storage.NewRangeProcessor(dir, nil, 10)
+	require.NoError(t, err)
+	defer rp.Close()
+	_, err = rp.ConvertRange(1)
+	require.NoError(t, err)
+
+	source, err := NewDataDirSource(dir, 10)
+	require.NoError(t, err)
+	defer source.Close()
+
+	results, err := source.BlockAccesses(1)
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+
+	// Served results parse back to the same accesses
+	served, err := json.Marshal(results[0].StateDiff)
+	require.NoError(t, err)
+	var diffs map[string]storage.Diff
+	require.NoError(t, json.Unmarshal(served, &diffs))
+	assert.Equal(t, map[string]storage.Diff{
+		"0x00000000000000000000000000000000000000aa": {Storage: []string{"0x01"}, IsContract: true},
+		"0x00000000000000000000000000000000000000bb": {},
+	}, diffs)
+	assert.Equal(t, placeholderCode, source.Code("0x00000000000000000000000000000000000000aa"))
+}
@@ -0,0 +1,235 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/weiihann/state-expiry-indexer/pkg/utils"
+)
+
+// Backend stores the files of a data directory. Names are slash separated and relative to the
+// root of the backend.
+type Backend interface {
+	// Save writes a file. Readers see either the old or the new content, never a partial write.
+	Save(name string, data []byte) error
+	// Open opens a file for reading. Missing files return an error wrapping fs.ErrNotExist.
+	Open(name string) (File, error)
+	// Stat describes a file. Missing files return an error wrapping fs.ErrNotExist.
+	Stat(name string) (FileInfo, error)
+	// List describes the files whose names start with prefix, in ascending name order
+	List(prefix string) ([]FileInfo, error)
+	// Rename moves a file, replacing newName if it exists
+	Rename(oldName, newName string) error
+	// Delete removes a file. Deleting a missing file is not an error.
+	Delete(name string) error
+	// Location describes where a file is stored, for logs and error messages
+	Location(name string) string
+}
+
+// File is a file opened for reading from a Backend
+type File interface {
+	io.ReadCloser
+	io.ReaderAt
+	// Size returns the size of the file in bytes
+	Size() int64
+}
+
+// FileInfo describes a file stored in a Backend
+type FileInfo struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// NewBackend returns the backend selected by the scheme of dataDir: s3://bucket/prefix selects
+// an S3 compatible object store configured by s3Config, file:///path or a plain path the local
+// file system.
+func NewBackend(dataDir string, s3Config S3Config) (Backend, error) {
+	scheme, rest, found := strings.Cut(dataDir, "://")
+	if !found {
+		return NewLocalBackend(dataDir), nil
+	}
+
+	switch scheme {
+	case "file":
+		return NewLocalBackend(rest), nil
+	case "s3":
+		u, err := url.Parse(dataDir)
+		if err != nil {
+			return nil, fmt.Errorf("invalid data directory %q: %w", dataDir, err)
+		}
+		return NewS3Backend(u.Host, strings.Trim(u.Path, "/"), s3Config)
+	default:
+		return nil, fmt.Errorf("unsupported data directory scheme %q in %q, expected a path, file:// or s3://", scheme, dataDir)
+	}
+}
+
+// ReadFile reads a whole file from a backend
+func ReadFile(backend Backend, name string) ([]byte, error) {
+	file, err := backend.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
+
+// LocalRoot returns the directory a backend stores files in, unless it stores them remotely
+func LocalRoot(backend Backend) (string, bool) {
+	if layout, ok := backend.(*LayoutBackend); ok {
+		backend = layout.Unwrap()
+	}
+	local, ok := backend.(*LocalBackend)
+	if !ok {
+		return "", false
+	}
+	return local.Root(), true
+}
+
+// LocalBackend stores files in a directory of the local file system. Files are written to a
+// synced temp file and renamed into place, directories are created as needed.
+type LocalBackend struct {
+	root string
+}
+
+// Ensure LocalBackend implements Backend
+var _ Backend = (*LocalBackend)(nil)
+
+// NewLocalBackend returns a backend storing files below root
+func NewLocalBackend(root string) *LocalBackend {
+	return &LocalBackend{root: root}
+}
+
+// Root returns the directory files are stored in
+func (b *LocalBackend) Root() string {
+	return b.root
+}
+
+func (b *LocalBackend) path(name string) string {
+	return filepath.Join(b.root, filepath.FromSlash(name))
+}
+
+func (b *LocalBackend) Save(name string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(b.path(name)), os.ModePerm); err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(b.path(name), data, 0o644)
+}
+
+func (b *LocalBackend) Open(name string) (File, error) {
+	file, err := os.Open(b.path(name))
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &localFile{File: file, size: info.Size()}, nil
+}
+
+func (b *LocalBackend) Stat(name string) (FileInfo, error) {
+	info, err := os.Stat(b.path(name))
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return FileInfo{Name: name, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+// List walks the directory the prefix names and the subdirectories that may hold names with
+// the prefix. Temp files of writes in progress are skipped.
+func (b *LocalBackend) List(prefix string) ([]FileInfo, error) {
+	dir := b.root
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		dir = b.path(prefix[:i])
+	}
+
+	var files []FileInfo
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) && path == dir {
+				return fs.SkipAll
+			}
+			return err
+		}
+
+		rel, err := filepath.Rel(b.root, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+
+		if entry.IsDir() {
+			// Only descend into directories whose files can start with the prefix
+			if path != dir && !strings.HasPrefix(name+"/", prefix) && !strings.HasPrefix(prefix, name+"/") {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if strings.HasSuffix(entry.Name(), utils.TempFileSuffix) || !strings.HasPrefix(name, prefix) {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil // Deleted while listing
+		}
+		if err != nil {
+			return err
+		}
+		files = append(files, FileInfo{Name: name, Size: info.Size(), ModTime: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %w", dir, err)
+	}
+
+	slices.SortFunc(files, func(a, b FileInfo) int { return strings.Compare(a.Name, b.Name) })
+	return files, nil
+}
+
+// Rename removes the directories it leaves empty below root
+func (b *LocalBackend) Rename(oldName, newName string) error {
+	if err := os.MkdirAll(filepath.Dir(b.path(newName)), os.ModePerm); err != nil {
+		return err
+	}
+	if err := os.Rename(b.path(oldName), b.path(newName)); err != nil {
+		return err
+	}
+	for dir := path.Dir(oldName); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		if os.Remove(b.path(dir)) != nil {
+			break // Not empty
+		}
+	}
+	return nil
+}
+
+func (b *LocalBackend) Delete(name string) error {
+	if err := os.Remove(b.path(name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (b *LocalBackend) Location(name string) string {
+	return b.path(name)
+}
+
+type localFile struct {
+	*os.File
+	size int64
+}
+
+func (f *localFile) Size() int64 {
+	return f.size
+}
@@ -0,0 +1,281 @@
+package storage
+
+import (
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/weiihann/state-expiry-indexer/pkg/rpc"
+	"github.com/weiihann/state-expiry-indexer/pkg/storage/s3test"
+)
+
+const (
+	testS3AccessKey = "minioadmin"
+	testS3SecretKey = "minioadmin-secret"
+)
+
+// newTestS3Backend serves a bucket from the in-memory S3 stand-in. Lists return at most two
+// keys per page, so pagination is exercised.
+func newTestS3Backend(t *testing.T, prefix string) (*S3Backend, *s3test.Server) {
+	server := s3test.NewServer(s3test.Options{
+		AccessKeyID:     testS3AccessKey,
+		SecretAccessKey: testS3SecretKey,
+		MaxKeys:         2,
+	}, "ranges")
+	httpServer := httptest.NewServer(server)
+	t.Cleanup(httpServer.Close)
+
+	backend, err := NewS3Backend("ranges", prefix, S3Config{
+		Endpoint:        httpServer.URL,
+		AccessKeyID:     testS3AccessKey,
+		SecretAccessKey: testS3SecretKey,
+	})
+	require.NoError(t, err)
+	return backend, server
+}
+
+func TestBackends(t *testing.T) {
+	backends := map[string]func(t *testing.T) Backend{
+		"local": func(t *testing.T) Backend {
+			return NewLocalBackend(t.TempDir())
+		},
+		"s3": func(t *testing.T) Backend {
+			backend, _ := newTestS3Backend(t, "mainnet")
+			return backend
+		},
+		"sharded local": func(t *testing.T) Backend {
+			return WithLayout(NewLocalBackend(t.TempDir()), LayoutSharded)
+		},
+		"sharded s3": func(t *testing.T) Backend {
+			backend, _ := newTestS3Backend(t, "mainnet")
+			return WithLayout(backend, LayoutSharded)
+		},
+	}
+
+	for name, newBackend := range backends {
+		t.Run(name, func(t *testing.T) {
+			t.Run("save and read", func(t *testing.T) {
+				backend := newBackend(t)
+				require.NoError(t, backend.Save("1_1000.json.zst", []byte("first")))
+				require.NoError(t, backend.Save("1_1000.json.zst", []byte("replaced")))
+
+				data, err := ReadFile(backend, "1_1000.json.zst")
+				require.NoError(t, err)
+				assert.Equal(t, "replaced", string(data))
+
+				info, err := backend.Stat("1_1000.json.zst")
+				require.NoError(t, err)
+				assert.Equal(t, "1_1000.json.zst", info.Name)
+				assert.Equal(t, int64(8), info.Size)
+				assert.False(t, info.ModTime.IsZero())
+			})
+
+			t.Run("read at", func(t *testing.T) {
+				backend := newBackend(t)
+				require.NoError(t, backend.Save("blob", []byte("0123456789")))
+
+				file, err := backend.Open("blob")
+				require.NoError(t, err)
+				defer file.Close()
+				assert.Equal(t, int64(10), file.Size())
+
+				buf := make([]byte, 4)
+				n, err := file.ReadAt(buf, 3)
+				require.NoError(t, err)
+				assert.Equal(t, "3456", string(buf[:n]))
+
+				n, err = file.ReadAt(buf, 8)
+				assert.Equal(t, io.EOF, err)
+				assert.Equal(t, "89", string(buf[:n]))
+
+				_, err = file.ReadAt(buf, 10)
+				assert.Equal(t, io.EOF, err)
+
+				// Read streams from the start independently of ReadAt
+				data, err := io.ReadAll(file)
+				require.NoError(t, err)
+				assert.Equal(t, "0123456789", string(data))
+			})
+
+			t.Run("missing files", func(t *testing.T) {
+				backend := newBackend(t)
+
+				_, err := backend.Open("missing")
+				assert.ErrorIs(t, err, fs.ErrNotExist)
+				_, err = backend.Stat("missing")
+				assert.ErrorIs(t, err, fs.ErrNotExist)
+				_, err = ReadFile(backend, "missing")
+				assert.ErrorIs(t, err, fs.ErrNotExist)
+				assert.NoError(t, backend.Delete("missing"))
+
+				files, err := backend.List("")
+				require.NoError(t, err)
+				assert.Empty(t, files)
+			})
+
+			t.Run("list and delete", func(t *testing.T) {
+				backend := newBackend(t)
+				for _, name := range []string{"2001_3000.json.zst", "1_1000.json.zst", "1001_2000.json.zst", "5.json", "rollback.json"} {
+					require.NoError(t, backend.Save(name, []byte(name)))
+				}
+
+				files, err := backend.List("")
+				require.NoError(t, err)
+				var names []string
+				for _, file := range files {
+					names = append(names, file.Name)
+					assert.Equal(t, int64(len(file.Name)), file.Size)
+				}
+				assert.Equal(t, []string{"1001_2000.json.zst", "1_1000.json.zst", "2001_3000.json.zst", "5.json", "rollback.json"}, names)
+
+				files, err = backend.List("1")
+				require.NoError(t, err)
+				assert.Len(t, files, 2)
+
+				require.NoError(t, backend.Delete("1_1000.json.zst"))
+				_, err = backend.Stat("1_1000.json.zst")
+				assert.ErrorIs(t, err, fs.ErrNotExist)
+
+				files, err = backend.List("")
+				require.NoError(t, err)
+				assert.Len(t, files, 4)
+			})
+
+			t.Run("rename", func(t *testing.T) {
+				backend := newBackend(t)
+				require.NoError(t, backend.Save("5.json", []byte("five")))
+				require.NoError(t, backend.Save("6.json", []byte("six")))
+
+				require.NoError(t, backend.Rename("5.json", "6.json"))
+				data, err := ReadFile(backend, "6.json")
+				require.NoError(t, err)
+				assert.Equal(t, "five", string(data))
+				_, err = backend.Stat("5.json")
+				assert.ErrorIs(t, err, fs.ErrNotExist)
+
+				require.NoError(t, backend.Rename("6.json", "1_1000.json.zst"))
+				files, err := backend.List("")
+				require.NoError(t, err)
+				require.Len(t, files, 1)
+				assert.Equal(t, "1_1000.json.zst", files[0].Name)
+
+				assert.ErrorIs(t, backend.Rename("missing", "7.json"), fs.ErrNotExist)
+			})
+		})
+	}
+}
+
+func TestLocalBackendList(t *testing.T) {
+	backend := NewLocalBackend(t.TempDir())
+	for _, name := range []string{"dictionary_1.zstd", "20/123/20123456.json", "20/124/20124000.json", "21/000/21000001.json"} {
+		require.NoError(t, backend.Save(name, []byte(name)))
+	}
+
+	names := func(prefix string) []string {
+		files, err := backend.List(prefix)
+		require.NoError(t, err)
+		var names []string
+		for _, file := range files {
+			names = append(names, file.Name)
+		}
+		return names
+	}
+
+	assert.Equal(t, []string{"dictionary_1.zstd"}, names("dict"))
+	assert.Equal(t, []string{"20/123/20123456.json", "20/124/20124000.json"}, names("20/"))
+	assert.Equal(t, []string{"20/123/20123456.json", "20/124/20124000.json", "21/000/21000001.json"}, names("2"))
+	assert.Equal(t, []string{"20/123/20123456.json"}, names("20/123/"))
+	assert.Equal(t, []string{"20/124/20124000.json"}, names("20/124/2012"))
+	assert.Empty(t, names("22/"))
+	assert.Len(t, names(""), 4)
+}
+
+func TestS3Backend(t *testing.T) {
+	t.Run("objects are stored below the prefix", func(t *testing.T) {
+		backend, server := newTestS3Backend(t, "/mainnet/statediff/")
+		require.NoError(t, backend.Save("1_1000.json.zst", []byte("range")))
+
+		assert.Equal(t, []string{"mainnet/statediff/1_1000.json.zst"}, server.Keys("ranges"))
+		assert.Equal(t, "s3://ranges/mainnet/statediff/1_1000.json.zst", backend.Location("1_1000.json.zst"))
+	})
+
+	t.Run("wrong credentials are rejected", func(t *testing.T) {
+		backend, _ := newTestS3Backend(t, "")
+		backend.config.SecretAccessKey = "wrong"
+
+		err := backend.Save("1_1000.json.zst", []byte("range"))
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "SignatureDoesNotMatch")
+		assert.NotErrorIs(t, err, fs.ErrNotExist)
+	})
+
+	t.Run("missing bucket", func(t *testing.T) {
+		backend, _ := newTestS3Backend(t, "")
+		backend.bucket = "other"
+
+		_, err := backend.List("")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "NoSuchBucket")
+	})
+
+	t.Run("range processor", func(t *testing.T) {
+		backend, server := newTestS3Backend(t, "mainnet")
+		rp, err := NewRangeProcessorWithBackend(backend, NewMockRPCClient(), 100, rpc.AccessModeStateDiff)
+		require.NoError(t, err)
+		defer rp.Close()
+
+		for rangeNumber := uint64(1); rangeNumber <= 3; rangeNumber++ {
+			require.NoError(t, rp.DownloadRange(t.Context(), rangeNumber))
+		}
+		assert.Equal(t, "s3://ranges/mainnet/1_100.json.zst", rp.GetRangeFilePath(1))
+
+		ranges, err := rp.ListRanges()
+		require.NoError(t, err)
+		assert.Equal(t, []uint64{1, 2, 3}, ranges)
+
+		// The manifest is read with ranged requests, not by downloading the whole file
+		gets := server.Requests(http.MethodGet)
+		assert.True(t, rp.RangeExists(2))
+		manifest, err := rp.ReadManifest(2)
+		require.NoError(t, err)
+		assert.Equal(t, uint64(101), manifest.FirstBlock)
+		assert.Less(t, server.Requests(http.MethodGet)-gets, 5)
+
+		_, err = rp.VerifyRange(2)
+		require.NoError(t, err)
+		rangeDiffs, err := rp.ReadRange(3)
+		require.NoError(t, err)
+		assert.Len(t, rangeDiffs, 100)
+
+		deleted, err := rp.DeleteRangesFrom(150)
+		require.NoError(t, err)
+		assert.Equal(t, 2, deleted)
+		assert.Equal(t, []string{"mainnet/1_100.json.zst"}, server.Keys("ranges"))
+	})
+}
+
+func TestNewBackend(t *testing.T) {
+	backend, err := NewBackend("data/mainnet", S3Config{})
+	require.NoError(t, err)
+	assert.Equal(t, "data/mainnet", backend.(*LocalBackend).Root())
+
+	backend, err = NewBackend("file:///var/lib/indexer", S3Config{})
+	require.NoError(t, err)
+	assert.Equal(t, "/var/lib/indexer", backend.(*LocalBackend).Root())
+
+	backend, err = NewBackend("s3://ranges/mainnet/statediff", S3Config{Endpoint: "http://localhost:9000"})
+	require.NoError(t, err)
+	s3Backend := backend.(*S3Backend)
+	assert.Equal(t, "ranges", s3Backend.bucket)
+	assert.Equal(t, "mainnet/statediff", s3Backend.prefix)
+	assert.Equal(t, "us-east-1", s3Backend.config.Region)
+
+	_, err = NewBackend("s3:///mainnet", S3Config{})
+	assert.Error(t, err)
+	_, err = NewBackend("gs://ranges", S3Config{})
+	assert.Error(t, err)
+}
@@ -0,0 +1,465 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+
+	"github.com/weiihann/state-expiry-indexer/pkg/rpc"
+)
+
+// Binary range files keep only what the indexer reads from a range. Addresses and slot keys
+// are stored once per range in dictionaries and referenced by index from the block records:
+//
+//	file      magic "SEIR" | version byte | dictionary (addresses) | dictionary (slots) | uvarint block count | blocks
+//	dictionary  uvarint count | values
+//	block     uvarint number | value hash | value parent hash | value access mode |
+//	          uvarint transactions | transactions × (uvarint accounts | accounts) |
+//	          uvarint protocol accesses | protocol accesses
+//	account   uvarint address index | flags byte | uvarint slots | uvarint slot indexes
+//	protocol  uvarint address index | source byte | uvarint slots | uvarint slot indexes
+//	value     uvarint (length << 1 | hex flag) | bytes
+//
+// Values holding lowercase 0x-prefixed hex of even length are stored decoded and flagged, other
+// values are stored verbatim. The whole file is zstd compressed like JSON range files.
+const (
+	binaryRangeMagic = "SEIR"
+	// BinaryRangeVersion is the version of the binary range format written by this package
+	BinaryRangeVersion = 1
+)
+
+// maxBinaryValueLength bounds the length of a single value, longer lengths mean the file is corrupt
+const maxBinaryValueLength = 1 << 16
+
+// accountFlagContract marks an account known to be a contract from its diff
+const accountFlagContract = 1
+
+// RangeFormat identifies how a range file is encoded
+type RangeFormat string
+
+const (
+	// RangeFormatJSON is the JSON array of RangeDiffs written before the binary format existed
+	RangeFormatJSON RangeFormat = "json"
+	// RangeFormatBinary is the dictionary encoded binary format
+	RangeFormatBinary RangeFormat = "binary"
+)
+
+// IsBinaryRange reports whether decompressed range data is in the binary format
+func IsBinaryRange(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(binaryRangeMagic))
+}
+
+// DecodeRange decodes decompressed range data in either format
+func DecodeRange(data []byte) ([]ReadRangeDiffs, error) {
+	reader := bufio.NewReader(bytes.NewReader(data))
+	decoder, _, err := newBlockDecoder(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	blocks := []ReadRangeDiffs{}
+	for {
+		block, err := decoder.next()
+		if err == io.EOF {
+			return blocks, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, block)
+	}
+}
+
+// blockDecoder yields the blocks of a range file in order, it returns io.EOF after the last block
+type blockDecoder interface {
+	next() (ReadRangeDiffs, error)
+}
+
+// newBlockDecoder detects the format of a range from its first bytes
+func newBlockDecoder(r *bufio.Reader) (blockDecoder, RangeFormat, error) {
+	magic, err := r.Peek(len(binaryRangeMagic))
+	if err != nil && err != io.EOF {
+		return nil, "", err
+	}
+	if string(magic) != binaryRangeMagic {
+		return newRangeDecoder(r, r.Size()), RangeFormatJSON, nil
+	}
+
+	decoder, err := newBinaryDecoder(r)
+	if err != nil {
+		return nil, "", err
+	}
+	return decoder, RangeFormatBinary, nil
+}
+
+// toReadDiffs extracts the parts of downloaded transaction results the indexer reads, with the
+// same rules used when decoding JSON range files
+func toReadDiffs(results []rpc.TransactionResult) ([]ReadDiffs, error) {
+	diffs := make([]ReadDiffs, 0, len(results))
+	for _, result := range results {
+		stateDiff := make(map[string]Diff, len(result.StateDiff))
+		for addr, account := range result.StateDiff {
+			data, err := json.Marshal(account)
+			if err != nil {
+				return nil, fmt.Errorf("failed to marshal diff of %s: %w", addr, err)
+			}
+			var diff Diff
+			if err := diff.UnmarshalJSON(data); err != nil {
+				return nil, fmt.Errorf("failed to parse diff of %s: %w", addr, err)
+			}
+			stateDiff[addr] = diff
+		}
+		diffs = append(diffs, ReadDiffs{StateDiff: stateDiff})
+	}
+	return diffs, nil
+}
+
+// encodeBinaryRange writes blocks in the binary range format. Accounts are written in address
+// order so the same range always encodes to the same bytes.
+func encodeBinaryRange(w io.Writer, blocks []ReadRangeDiffs) error {
+	addresses := newDictionary()
+	slots := newDictionary()
+	for _, block := range blocks {
+		for _, diffs := range block.Diffs {
+			for _, addr := range slices.Sorted(maps.Keys(diffs.StateDiff)) {
+				addresses.add(addr)
+				for _, slot := range diffs.StateDiff[addr].Storage {
+					slots.add(slot)
+				}
+			}
+		}
+		for _, access := range block.Protocol {
+			addresses.add(access.Address)
+			for _, slot := range access.Storage {
+				slots.add(slot)
+			}
+		}
+	}
+
+	e := &binaryEncoder{w: bufio.NewWriter(w)}
+	e.writeBytes([]byte(binaryRangeMagic))
+	e.writeByte(BinaryRangeVersion)
+	addresses.write(e)
+	slots.write(e)
+
+	e.writeUvarint(uint64(len(blocks)))
+	for _, block := range blocks {
+		e.writeUvarint(block.BlockNum)
+		e.writeValue(block.Hash)
+		e.writeValue(block.ParentHash)
+		e.writeValue(string(block.AccessMode))
+
+		e.writeUvarint(uint64(len(block.Diffs)))
+		for _, diffs := range block.Diffs {
+			e.writeUvarint(uint64(len(diffs.StateDiff)))
+			for _, addr := range slices.Sorted(maps.Keys(diffs.StateDiff)) {
+				diff := diffs.StateDiff[addr]
+				var flags byte
+				if diff.IsContract {
+					flags |= accountFlagContract
+				}
+				e.writeUvarint(addresses.index[addr])
+				e.writeByte(flags)
+				e.writeSlots(slots, diff.Storage)
+			}
+		}
+
+		e.writeUvarint(uint64(len(block.Protocol)))
+		for _, access := range block.Protocol {
+			e.writeUvarint(addresses.index[access.Address])
+			e.writeByte(byte(access.Source))
+			e.writeSlots(slots, access.Storage)
+		}
+	}
+
+	if e.err != nil {
+		return e.err
+	}
+	return e.w.Flush()
+}
+
+// dictionary assigns indexes to values in order of first use
+type dictionary struct {
+	values []string
+	index  map[string]uint64
+}
+
+func newDictionary() *dictionary {
+	return &dictionary{index: make(map[string]uint64)}
+}
+
+func (d *dictionary) add(value string) {
+	if _, ok := d.index[value]; ok {
+		return
+	}
+	d.index[value] = uint64(len(d.values))
+	d.values = append(d.values, value)
+}
+
+func (d *dictionary) write(e *binaryEncoder) {
+	e.writeUvarint(uint64(len(d.values)))
+	for _, value := range d.values {
+		e.writeValue(value)
+	}
+}
+
+// binaryEncoder remembers the first write error so encoding does not check every write
+type binaryEncoder struct {
+	w   *bufio.Writer
+	buf [binary.MaxVarintLen64]byte
+	err error
+}
+
+func (e *binaryEncoder) writeBytes(b []byte) {
+	if e.err == nil {
+		_, e.err = e.w.Write(b)
+	}
+}
+
+func (e *binaryEncoder) writeByte(b byte) {
+	if e.err == nil {
+		e.err = e.w.WriteByte(b)
+	}
+}
+
+func (e *binaryEncoder) writeUvarint(v uint64) {
+	n := binary.PutUvarint(e.buf[:], v)
+	e.writeBytes(e.buf[:n])
+}
+
+func (e *binaryEncoder) writeValue(value string) {
+	if raw, ok := decodeHexValue(value); ok {
+		e.writeUvarint(uint64(len(raw))<<1 | 1)
+		e.writeBytes(raw)
+		return
+	}
+	e.writeUvarint(uint64(len(value)) << 1)
+	e.writeBytes([]byte(value))
+}
+
+func (e *binaryEncoder) writeSlots(slots *dictionary, storage []string) {
+	e.writeUvarint(uint64(len(storage)))
+	for _, slot := range storage {
+		e.writeUvarint(slots.index[slot])
+	}
+}
+
+// decodeHexValue decodes values that re-encode to exactly the same string
+func decodeHexValue(value string) ([]byte, bool) {
+	if len(value) < 2 || value[:2] != "0x" || len(value)%2 != 0 {
+		return nil, false
+	}
+	for _, c := range value[2:] {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return nil, false
+		}
+	}
+	raw, err := hex.DecodeString(value[2:])
+	if err != nil {
+		return nil, false
+	}
+	return raw, true
+}
+
+// binaryDecoder reads the blocks of a binary range file one at a time. The dictionaries are
+// read up front, every block references their strings instead of allocating its own.
+type binaryDecoder struct {
+	r         *bufio.Reader
+	addresses []string
+	slots     []string
+	remaining uint64
+	buf       []byte
+}
+
+func newBinaryDecoder(r *bufio.Reader) (*binaryDecoder, error) {
+	d := &binaryDecoder{r: r}
+
+	header := make([]byte, len(binaryRangeMagic)+1)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, d.eofError(err)
+	}
+	if version := header[len(binaryRangeMagic)]; version != BinaryRangeVersion {
+		return nil, fmt.Errorf("unsupported binary range format version %d, expected %d", version, BinaryRangeVersion)
+	}
+
+	var err error
+	if d.addresses, err = d.readDictionary(); err != nil {
+		return nil, fmt.Errorf("failed to read address dictionary: %w", err)
+	}
+	if d.slots, err = d.readDictionary(); err != nil {
+		return nil, fmt.Errorf("failed to read slot dictionary: %w", err)
+	}
+	if d.remaining, err = d.readUvarint(); err != nil {
+		return nil, fmt.Errorf("failed to read block count: %w", err)
+	}
+	return d, nil
+}
+
+func (d *binaryDecoder) next() (ReadRangeDiffs, error) {
+	if d.remaining == 0 {
+		return ReadRangeDiffs{}, io.EOF
+	}
+	d.remaining--
+
+	block, err := d.readBlock()
+	if err != nil {
+		return ReadRangeDiffs{}, fmt.Errorf("failed to read block record: %w", err)
+	}
+	return block, nil
+}
+
+func (d *binaryDecoder) readBlock() (ReadRangeDiffs, error) {
+	var block ReadRangeDiffs
+	var err error
+	if block.BlockNum, err = d.readUvarint(); err != nil {
+		return block, err
+	}
+	if block.Hash, err = d.readValue(); err != nil {
+		return block, err
+	}
+	if block.ParentHash, err = d.readValue(); err != nil {
+		return block, err
+	}
+	accessMode, err := d.readValue()
+	if err != nil {
+		return block, err
+	}
+	block.AccessMode = rpc.AccessMode(accessMode)
+
+	txs, err := d.readUvarint()
+	if err != nil {
+		return block, err
+	}
+	block.Diffs = make([]ReadDiffs, 0, min(txs, 1<<16))
+	for range txs {
+		accounts, err := d.readUvarint()
+		if err != nil {
+			return block, err
+		}
+		stateDiff := make(map[string]Diff, min(accounts, 1<<16))
+		for range accounts {
+			addr, err := d.readIndex(d.addresses)
+			if err != nil {
+				return block, err
+			}
+			flags, err := d.r.ReadByte()
+			if err != nil {
+				return block, d.eofError(err)
+			}
+			storage, err := d.readSlots()
+			if err != nil {
+				return block, err
+			}
+			stateDiff[addr] = Diff{Storage: storage, IsContract: flags&accountFlagContract != 0}
+		}
+		block.Diffs = append(block.Diffs, ReadDiffs{StateDiff: stateDiff})
+	}
+
+	accesses, err := d.readUvarint()
+	if err != nil {
+		return block, err
+	}
+	for range accesses {
+		addr, err := d.readIndex(d.addresses)
+		if err != nil {
+			return block, err
+		}
+		source, err := d.r.ReadByte()
+		if err != nil {
+			return block, d.eofError(err)
+		}
+		storage, err := d.readSlots()
+		if err != nil {
+			return block, err
+		}
+		block.Protocol = append(block.Protocol, rpc.ProtocolAccess{Address: addr, Source: rpc.AccessSource(source), Storage: storage})
+	}
+
+	return block, nil
+}
+
+func (d *binaryDecoder) readDictionary() ([]string, error) {
+	count, err := d.readUvarint()
+	if err != nil {
+		return nil, err
+	}
+	values := make([]string, 0, min(count, 1<<20))
+	for range count {
+		value, err := d.readValue()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+func (d *binaryDecoder) readSlots() ([]string, error) {
+	count, err := d.readUvarint()
+	if err != nil || count == 0 {
+		return nil, err
+	}
+	storage := make([]string, 0, min(count, 1<<16))
+	for range count {
+		slot, err := d.readIndex(d.slots)
+		if err != nil {
+			return nil, err
+		}
+		storage = append(storage, slot)
+	}
+	return storage, nil
+}
+
+func (d *binaryDecoder) readIndex(values []string) (string, error) {
+	index, err := d.readUvarint()
+	if err != nil {
+		return "", err
+	}
+	if index >= uint64(len(values)) {
+		return "", fmt.Errorf("dictionary index %d out of range, dictionary has %d entries", index, len(values))
+	}
+	return values[index], nil
+}
+
+func (d *binaryDecoder) readValue() (string, error) {
+	header, err := d.readUvarint()
+	if err != nil {
+		return "", err
+	}
+	length := header >> 1
+	if length > maxBinaryValueLength {
+		return "", fmt.Errorf("value of %d bytes is too long", length)
+	}
+
+	d.buf = slices.Grow(d.buf[:0], int(length))[:length]
+	if _, err := io.ReadFull(d.r, d.buf); err != nil {
+		return "", d.eofError(err)
+	}
+	if header&1 == 1 {
+		return "0x" + hex.EncodeToString(d.buf), nil
+	}
+	return string(d.buf), nil
+}
+
+func (d *binaryDecoder) readUvarint() (uint64, error) {
+	v, err := binary.ReadUvarint(d.r)
+	if err != nil {
+		return 0, d.eofError(err)
+	}
+	return v, nil
+}
+
+// eofError turns the end of the stream into an error, a binary range never ends mid-record
+func (d *binaryDecoder) eofError(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,148 @@
+package storage
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/weiihann/state-expiry-indexer/pkg/rpc"
+)
+
+func TestBinaryRangeRoundTrip(t *testing.T) {
+	blocks := []ReadRangeDiffs{
+		{
+			BlockNum:   1,
+			Hash:       "0x" + string(bytes.Repeat([]byte("ab"), 32)),
+			ParentHash: "0x" + string(bytes.Repeat([]byte("cd"), 32)),
+			AccessMode: rpc.AccessModePrestate,
+			Diffs: []ReadDiffs{
+				{StateDiff: map[string]Diff{
+					"0x00000000000000000000000000000000000000aa": {Storage: []string{"0x02", "0x01"}, IsContract: true},
+					"0x00000000000000000000000000000000000000bb": {},
+				}},
+				{StateDiff: map[string]Diff{
+					"0x00000000000000000000000000000000000000aa": {Storage: []string{"0x01"}, IsContract: true},
+				}},
+			},
+			Protocol: []rpc.ProtocolAccess{
+				{Address: "0x00000000000000000000000000000000000000bb", Source: rpc.AccessSourceCoinbase},
+				{Address: rpc.BeaconRootsAddress, Source: rpc.AccessSourceSystem, Storage: []string{"0x01"}},
+			},
+		},
+		{
+			// Legacy blocks without hashes, non-canonical hex is kept verbatim
+			BlockNum: 2,
+			Diffs: []ReadDiffs{
+				{StateDiff: map[string]Diff{
+					"0xABC": {Storage: []string{"0x1", "slot"}, IsContract: true},
+				}},
+			},
+		},
+		{BlockNum: 3, Diffs: []ReadDiffs{}},
+	}
+
+	var encoded bytes.Buffer
+	require.NoError(t, encodeBinaryRange(&encoded, blocks))
+	assert.True(t, IsBinaryRange(encoded.Bytes()))
+
+	decoded, err := DecodeRange(encoded.Bytes())
+	require.NoError(t, err)
+	assert.Equal(t, blocks, decoded)
+
+	// The encoding does not depend on map iteration order
+	var again bytes.Buffer
+	require.NoError(t, encodeBinaryRange(&again, blocks))
+	assert.Equal(t, encoded.Bytes(), again.Bytes())
+}
+
+func TestBinaryRangeCorruption(t *testing.T) {
+	blocks := []ReadRangeDiffs{{
+		BlockNum: 1,
+		Diffs:    []ReadDiffs{{StateDiff: map[string]Diff{"0xaa": {Storage: []string{"0x01"}}}}},
+	}}
+	var encoded bytes.Buffer
+	require.NoError(t, encodeBinaryRange(&encoded, blocks))
+	data := encoded.Bytes()
+
+	t.Run("truncated", func(t *testing.T) {
+		for i := len(binaryRangeMagic); i < len(data); i++ {
+			_, err := DecodeRange(data[:i])
+			assert.Error(t, err, "decoding %d of %d bytes should fail", i, len(data))
+		}
+	})
+
+	t.Run("unknown version", func(t *testing.T) {
+		future := bytes.Clone(data)
+		future[len(binaryRangeMagic)] = BinaryRangeVersion + 1
+		_, err := DecodeRange(future)
+		assert.ErrorContains(t, err, "unsupported binary range format version")
+	})
+}
+
+func TestRangeProcessorConvertRange(t *testing.T) {
+	rp, _, _, cleanup := setupRangeProcessorTest(t)
+	defer cleanup()
+
+	data := benchmarkRangeJSON(100, 20)
+	writeRangeFile(t, rp, 1, data)
+	jsonInfo, err := os.Stat(rp.GetRangeFilePath(1))
+	require.NoError(t, err)
+
+	format, err := rp.RangeFormat(1)
+	require.NoError(t, err)
+	assert.Equal(t, RangeFormatJSON, format)
+
+	want, err := rp.ReadRange(1)
+	require.NoError(t, err)
+
+	converted, err := rp.ConvertRange(1)
+	require.NoError(t, err)
+	assert.True(t, converted)
+
+	format, err = rp.RangeFormat(1)
+	require.NoError(t, err)
+	assert.Equal(t, RangeFormatBinary, format)
+
+	binaryInfo, err := os.Stat(rp.GetRangeFilePath(1))
+	require.NoError(t, err)
+	assert.Less(t, binaryInfo.Size(), jsonInfo.Size())
+
+	got, err := rp.ReadRange(1)
+	require.NoError(t, err)
+	assert.Equal(t, want, got)
+
+	converted, err = rp.ConvertRange(1)
+	require.NoError(t, err)
+	assert.False(t, converted, "Binary ranges are left alone")
+}
+
+func TestRangeProcessorDownloadRangeWritesBinary(t *testing.T) {
+	rp, _, _, cleanup := setupRangeProcessorTest(t)
+	defer cleanup()
+
+	require.NoError(t, rp.DownloadRange(t.Context(), 1))
+
+	format, err := rp.RangeFormat(1)
+	require.NoError(t, err)
+	assert.Equal(t, RangeFormatBinary, format)
+
+	_, err = os.Stat(rp.GetRangeFilePath(1) + ".tmp")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestRangeProcessorListRanges(t *testing.T) {
+	rp, _, dir, cleanup := setupRangeProcessorTest(t)
+	defer cleanup()
+
+	for _, name := range []string{"201_300.json.zst", "1_100.json.zst", "1_1000.json.zst", "5.json.zst", "101_200.json.zst.tmp"} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte("x"), 0o644))
+	}
+
+	ranges, err := rp.ListRanges()
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{1, 3}, ranges)
+}
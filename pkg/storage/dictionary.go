@@ -0,0 +1,110 @@
+package storage
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+
+	"github.com/weiihann/state-expiry-indexer/pkg/utils"
+)
+
+// Dictionaries trained on per-block state diff files are stored next to them as
+// zstd-{id}.dict. Files are compressed with the dictionary of the highest ID, and every stored
+// dictionary stays loaded for decompression, so files compressed with an older dictionary
+// remain readable after training a new one. Range files are compressed without a dictionary, so
+// they can be read by indexers that bootstrap from a mirror.
+var dictionaryFilePattern = regexp.MustCompile(`^zstd-(\d+)\.dict$`)
+
+const dictionaryFilePrefix = "zstd-"
+
+func dictionaryFileName(id uint32) string {
+	return fmt.Sprintf("%s%d.dict", dictionaryFilePrefix, id)
+}
+
+// dictionaryIDs returns the IDs of the dictionaries stored in backend in ascending order
+func dictionaryIDs(backend Backend) ([]uint32, error) {
+	files, err := backend.List(dictionaryFilePrefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list dictionaries: %w", err)
+	}
+
+	var ids []uint32
+	for _, file := range files {
+		match := dictionaryFilePattern.FindStringSubmatch(file.Name)
+		if match == nil {
+			continue
+		}
+		id, err := strconv.ParseUint(match[1], 10, 32)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, uint32(id))
+	}
+	slices.Sort(ids)
+	return ids, nil
+}
+
+// NextDictionaryID returns the ID for a new dictionary, one above the highest stored ID
+func NextDictionaryID(backend Backend) (uint32, error) {
+	ids, err := dictionaryIDs(backend)
+	if err != nil {
+		return 0, err
+	}
+	if len(ids) == 0 {
+		return utils.MinZstdDictionaryID, nil
+	}
+	return max(ids[len(ids)-1]+1, utils.MinZstdDictionaryID), nil
+}
+
+// SaveDictionary stores a trained dictionary under its ID and returns its location. Files
+// compressed from then on use it.
+func SaveDictionary(backend Backend, dictionary []byte) (string, error) {
+	id, err := utils.ZstdDictionaryID(dictionary)
+	if err != nil {
+		return "", err
+	}
+	name := dictionaryFileName(id)
+	if err := backend.Save(name, dictionary); err != nil {
+		return "", fmt.Errorf("failed to write dictionary %s: %w", backend.Location(name), err)
+	}
+	return backend.Location(name), nil
+}
+
+// LoadDictionaries returns the dictionaries stored in backend, ordered by ID
+func LoadDictionaries(backend Backend) ([][]byte, error) {
+	ids, err := dictionaryIDs(backend)
+	if err != nil {
+		return nil, err
+	}
+
+	dictionaries := make([][]byte, 0, len(ids))
+	for _, id := range ids {
+		name := dictionaryFileName(id)
+		dictionary, err := ReadFile(backend, name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read dictionary %s: %w", backend.Location(name), err)
+		}
+		if storedID, err := utils.ZstdDictionaryID(dictionary); err != nil || storedID != id {
+			return nil, fmt.Errorf("dictionary %s is corrupt", backend.Location(name))
+		}
+		dictionaries = append(dictionaries, dictionary)
+	}
+	return dictionaries, nil
+}
+
+// LoadZstdOptions returns the options per-block state diff files in backend are compressed
+// with: level and, if useDictionary is set, the newest stored dictionary. Every stored
+// dictionary is used for decompression.
+func LoadZstdOptions(backend Backend, level int, useDictionary bool) (utils.ZstdOptions, error) {
+	dictionaries, err := LoadDictionaries(backend)
+	if err != nil {
+		return utils.ZstdOptions{}, err
+	}
+
+	options := utils.ZstdOptions{Level: level, Dictionaries: dictionaries}
+	if useDictionary && len(dictionaries) > 0 {
+		options.Dictionary = dictionaries[len(dictionaries)-1]
+	}
+	return options, nil
+}
@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/weiihann/state-expiry-indexer/pkg/utils"
+)
+
+// trainDictionary trains a dictionary with id on the state diffs of the mock RPC client
+func trainDictionary(t *testing.T, id uint32) []byte {
+	node := NewMockRPCClient()
+	var samples [][]byte
+	for block := uint64(1); block <= 200; block++ {
+		results, err := node.GetStateDiff(t.Context(), new(big.Int).SetUint64(block))
+		require.NoError(t, err)
+		data, err := json.MarshalIndent(results, "", "  ")
+		require.NoError(t, err)
+		samples = append(samples, data)
+	}
+	dictionary, err := utils.TrainZstdDictionary(samples, id, 4*1024, 0)
+	require.NoError(t, err)
+	return dictionary
+}
+
+func TestDictionaries(t *testing.T) {
+	backend := NewLocalBackend(t.TempDir())
+
+	id, err := NextDictionaryID(backend)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(utils.MinZstdDictionaryID), id)
+	options, err := LoadZstdOptions(backend, 3, true)
+	require.NoError(t, err)
+	assert.Equal(t, utils.ZstdOptions{Level: 3, Dictionaries: [][]byte{}}, options)
+
+	first := trainDictionary(t, id)
+	location, err := SaveDictionary(backend, first)
+	require.NoError(t, err)
+	assert.Equal(t, backend.Location("zstd-32768.dict"), location)
+
+	id, err = NextDictionaryID(backend)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(utils.MinZstdDictionaryID+1), id)
+	second := trainDictionary(t, id)
+	_, err = SaveDictionary(backend, second)
+	require.NoError(t, err)
+
+	// Files are compressed with the newest dictionary and read with any
+	options, err = LoadZstdOptions(backend, 0, true)
+	require.NoError(t, err)
+	assert.Equal(t, second, options.Dictionary)
+	assert.Equal(t, [][]byte{first, second}, options.Dictionaries)
+
+	options, err = LoadZstdOptions(backend, 0, false)
+	require.NoError(t, err)
+	assert.Nil(t, options.Dictionary)
+	assert.Len(t, options.Dictionaries, 2)
+
+	require.NoError(t, backend.Save("zstd-32770.dict", []byte("not a dictionary")))
+	_, err = LoadDictionaries(backend)
+	assert.ErrorContains(t, err, "is corrupt")
+}
+
+func TestBlockFileSourceDictionaries(t *testing.T) {
+	rp, _ := newSourceProcessor(t, nil)
+	dictionary := trainDictionary(t, utils.MinZstdDictionaryID)
+	_, err := SaveDictionary(rp.Backend(), dictionary)
+	require.NoError(t, err)
+	options, err := LoadZstdOptions(rp.Backend(), 0, true)
+	require.NoError(t, err)
+
+	// Per-block files saved by the file store are compressed with the dictionary
+	fileStore, err := NewFileStoreWithOptions(rp.Backend(), true, options)
+	require.NoError(t, err)
+	defer fileStore.Close()
+	node := NewMockRPCClient()
+	for block := uint64(1); block <= 100; block++ {
+		results, err := node.GetStateDiff(t.Context(), new(big.Int).SetUint64(block))
+		require.NoError(t, err)
+		data, err := json.Marshal(results)
+		require.NoError(t, err)
+		require.NoError(t, fileStore.SaveCompressed(fmt.Sprintf("%d.json", block), data))
+	}
+	compressed, err := ReadFile(rp.Backend(), "1.json.zst")
+	require.NoError(t, err)
+	id, err := utils.ZstdFrameDictionaryID(compressed)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(utils.MinZstdDictionaryID), id)
+
+	source := NewBlockFileSource(rp.Backend(), nil, rp.AccessMode())
+	_, err = source.FetchRange(t.Context(), 1, 1, 100)
+	assert.Error(t, err, "files cannot be read without the dictionary")
+
+	source.SetDictionaries(options.Dictionaries)
+	rangeDiffs, err := source.FetchRange(t.Context(), 1, 1, 100)
+	require.NoError(t, err)
+	assert.Len(t, rangeDiffs, 100)
+}
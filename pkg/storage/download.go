@@ -0,0 +1,113 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"sync"
+	"time"
+
+	"github.com/weiihann/state-expiry-indexer/pkg/rpc"
+)
+
+// downloadChunkSize is the number of blocks a download worker fetches at once
+const downloadChunkSize = 100
+
+// DownloadProgress reports how far the download of a range has come
+type DownloadProgress struct {
+	RangeNumber uint64
+	// Blocks is the number of blocks downloaded so far
+	Blocks int
+	// TotalBlocks is the number of blocks in the range
+	TotalBlocks int
+	// Elapsed is the time since the download of the range started
+	Elapsed time.Duration
+}
+
+// SetDownloadWorkers sets how many chunks of a range DownloadRange fetches in parallel.
+// How many calls reach a single endpoint is capped by the RPC pool.
+func (rp *RangeProcessor) SetDownloadWorkers(workers int) {
+	rp.downloadWorkers = max(workers, 1)
+}
+
+// SetProgressFunc sets a function called by DownloadRange whenever a chunk of blocks has been
+// downloaded. Calls for one range are not concurrent and report increasing block counts.
+func (rp *RangeProcessor) SetProgressFunc(fn func(DownloadProgress)) {
+	rp.progress = fn
+}
+
+// fetchRange downloads the state accesses and headers of the blocks of a range. The blocks are
+// split in chunks fetched by a bounded pool of workers, and the first failure cancels the
+// chunks still in flight. The headers of all chunks are checked to form a single chain.
+func (rp *RangeProcessor) fetchRange(ctx context.Context, rangeNumber uint64, blocks []uint64) (map[uint64][]rpc.TransactionResult, map[uint64]*rpc.Head, error) {
+	var chunks [][]uint64
+	for start := 0; start < len(blocks); start += downloadChunkSize {
+		chunks = append(chunks, blocks[start:min(start+downloadChunkSize, len(blocks))])
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(map[uint64][]rpc.TransactionResult, len(blocks))
+	headers := make(map[uint64]*rpc.Head, len(blocks))
+	errs := make([]error, len(chunks))
+	started := time.Now()
+	done := 0
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, max(rp.downloadWorkers, 1))
+	for i, chunk := range chunks {
+		select {
+		case <-ctx.Done():
+		case sem <- struct{}{}:
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		wg.Add(1)
+		go func(i int, chunk []uint64) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			chunkResults, chunkHeaders, err := rp.downloadBlocks(ctx, chunk)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs[i] = err
+				cancel()
+				return
+			}
+			maps.Copy(results, chunkResults)
+			maps.Copy(headers, chunkHeaders)
+
+			done += len(chunk)
+			if rp.progress != nil {
+				rp.progress(DownloadProgress{
+					RangeNumber: rangeNumber,
+					Blocks:      done,
+					TotalBlocks: len(blocks),
+					Elapsed:     time.Since(started),
+				})
+			}
+		}(i, chunk)
+	}
+	wg.Wait()
+
+	// Report the failure of the lowest chunk, not the cancellation it caused in later chunks
+	for _, err := range errs {
+		if err != nil && !errors.Is(err, context.Canceled) {
+			return nil, nil, err
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	if err := checkChain(blocks, headers); err != nil {
+		return nil, nil, err
+	}
+	return results, headers, nil
+}
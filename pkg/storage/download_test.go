@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRangeProcessorConcurrentDownload(t *testing.T) {
+	newProcessor := func(t *testing.T, workers int) (*RangeProcessor, *MockRPCClient) {
+		mockClient := NewMockRPCClient()
+		rp, err := NewRangeProcessor(t.TempDir(), mockClient, 400)
+		require.NoError(t, err)
+		t.Cleanup(rp.Close)
+		rp.SetDownloadWorkers(workers)
+		return rp, mockClient
+	}
+
+	t.Run("blocks are stored in order", func(t *testing.T) {
+		rp, mockClient := newProcessor(t, 4)
+		mockClient.SetGetStateDiffDelay(2 * time.Millisecond)
+
+		start := time.Now()
+		require.NoError(t, rp.DownloadRange(t.Context(), 1))
+		// Four chunks of 100 blocks fetched side by side, one after another would take 800ms
+		assert.Less(t, time.Since(start), 600*time.Millisecond)
+		assert.Equal(t, 400, mockClient.GetCallCount("GetStateDiff"))
+
+		rangeDiffs, err := rp.ReadRange(1)
+		require.NoError(t, err)
+		require.Len(t, rangeDiffs, 400)
+		for i, block := range rangeDiffs {
+			assert.Equal(t, uint64(i+1), block.BlockNum)
+		}
+		_, err = rp.VerifyRange(1)
+		assert.NoError(t, err)
+	})
+
+	t.Run("progress is reported per chunk", func(t *testing.T) {
+		rp, _ := newProcessor(t, 3)
+
+		var progress []DownloadProgress
+		rp.SetProgressFunc(func(p DownloadProgress) {
+			progress = append(progress, p)
+		})
+		require.NoError(t, rp.DownloadRange(t.Context(), 2))
+
+		require.Len(t, progress, 4)
+		for i, p := range progress {
+			assert.Equal(t, uint64(2), p.RangeNumber)
+			assert.Equal(t, (i+1)*downloadChunkSize, p.Blocks)
+			assert.Equal(t, 400, p.TotalBlocks)
+		}
+	})
+
+	t.Run("failed chunk fails the range", func(t *testing.T) {
+		rp, mockClient := newProcessor(t, 4)
+		mockClient.SetErrorResponse(big.NewInt(250), fmt.Errorf("block not found"))
+
+		err := rp.DownloadRange(t.Context(), 1)
+		assert.ErrorContains(t, err, "failed to download block 250")
+		assert.False(t, rp.RangeExists(1))
+	})
+
+	t.Run("canceled context", func(t *testing.T) {
+		rp, mockClient := newProcessor(t, 4)
+		mockClient.SetGetStateDiffDelay(time.Millisecond)
+
+		ctx, cancel := context.WithTimeout(t.Context(), 20*time.Millisecond)
+		defer cancel()
+		err := rp.DownloadRange(ctx, 1)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.False(t, rp.RangeExists(1))
+	})
+}
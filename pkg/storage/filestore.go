@@ -3,13 +3,13 @@ package storage
 import (
 	"fmt"
 	"os"
-	"path/filepath"
 
 	"github.com/weiihann/state-expiry-indexer/pkg/utils"
 )
 
 type FileStore struct {
 	Path    string
+	backend Backend
 	encoder *utils.ZstdEncoder
 }
 
@@ -17,21 +17,32 @@ func NewFileStore(path string) (*FileStore, error) {
 	if err := os.MkdirAll(path, os.ModePerm); err != nil {
 		return nil, err
 	}
-	return &FileStore{Path: path}, nil
+	return &FileStore{Path: path, backend: NewLocalBackend(path)}, nil
 }
 
 func NewFileStoreWithCompression(path string, compressionEnabled bool) (*FileStore, error) {
 	if err := os.MkdirAll(path, os.ModePerm); err != nil {
 		return nil, err
 	}
+	return NewFileStoreWithBackend(NewLocalBackend(path), compressionEnabled)
+}
+
+// NewFileStoreWithBackend creates a file store that saves files in backend
+func NewFileStoreWithBackend(backend Backend, compressionEnabled bool) (*FileStore, error) {
+	return NewFileStoreWithOptions(backend, compressionEnabled, utils.ZstdOptions{})
+}
 
+// NewFileStoreWithOptions creates a file store that saves files in backend, compressed with
+// the level and dictionary of options
+func NewFileStoreWithOptions(backend Backend, compressionEnabled bool, options utils.ZstdOptions) (*FileStore, error) {
 	fs := &FileStore{
-		Path: path,
+		Path:    backend.Location(""),
+		backend: backend,
 	}
 
 	// Initialize encoder if compression is enabled
 	if compressionEnabled {
-		encoder, err := utils.NewZstdEncoder()
+		encoder, err := utils.NewZstdEncoderWithOptions(options)
 		if err != nil {
 			return nil, fmt.Errorf("failed to create zstd encoder: %w", err)
 		}
@@ -41,8 +52,13 @@ func NewFileStoreWithCompression(path string, compressionEnabled bool) (*FileSto
 	return fs, nil
 }
 
+// Backend returns the backend files are stored in
+func (fs *FileStore) Backend() Backend {
+	return fs.backend
+}
+
 func (fs *FileStore) Save(filename string, data []byte) error {
-	return os.WriteFile(filepath.Join(fs.Path, filename), data, 0o644)
+	return fs.backend.Save(filename, data)
 }
 
 func (fs *FileStore) SaveCompressed(filename string, data []byte) error {
@@ -64,7 +80,18 @@ func (fs *FileStore) SaveCompressed(filename string, data []byte) error {
 	compressedFilename := filename + ".zst"
 
 	// Write compressed data to file
-	return os.WriteFile(filepath.Join(fs.Path, compressedFilename), compressed, 0o644)
+	return fs.backend.Save(compressedFilename, compressed)
+}
+
+// Exists reports whether filename was saved, compressed or not. Empty files do not count.
+func (fs *FileStore) Exists(filename string) bool {
+	for _, name := range []string{filename, filename + ".zst"} {
+		info, err := fs.backend.Stat(name)
+		if err == nil && info.Size > 0 {
+			return true
+		}
+	}
+	return false
 }
 
 func (fs *FileStore) Close() error {
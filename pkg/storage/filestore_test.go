@@ -194,3 +194,28 @@ func TestFileStoreClose(t *testing.T) {
 		t.Fatalf("Failed to close FileStore: %v", err)
 	}
 }
+
+func TestFileStoreExists(t *testing.T) {
+	tempDir := t.TempDir()
+	fs, err := NewFileStoreWithCompression(tempDir, true)
+	if err != nil {
+		t.Fatalf("Failed to create FileStore: %v", err)
+	}
+	defer fs.Close()
+
+	if err := fs.Save("1.json", []byte(`[]`)); err != nil {
+		t.Fatalf("Failed to save file: %v", err)
+	}
+	if err := fs.SaveCompressed("2.json", []byte(`[]`)); err != nil {
+		t.Fatalf("Failed to save compressed file: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(tempDir, "3.json.zst"), nil, 0o644); err != nil {
+		t.Fatalf("Failed to write empty file: %v", err)
+	}
+
+	for filename, want := range map[string]bool{"1.json": true, "2.json": true, "3.json": false, "4.json": false} {
+		if got := fs.Exists(filename); got != want {
+			t.Errorf("Exists(%q) = %v, want %v", filename, got, want)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// blockFilePattern matches per-block state diff files, compressed or not
+var blockFilePattern = regexp.MustCompile(`^(\d+)\.json(\.zst)?$`)
+
+// GapKind describes why a block is not available
+type GapKind string
+
+const (
+	// GapMissing is a block without a per-block file or range file
+	GapMissing GapKind = "missing"
+	// GapEmpty is a block whose only file is empty
+	GapEmpty GapKind = "empty"
+	// GapUnparsable is a block whose only file cannot be decompressed or decoded
+	GapUnparsable GapKind = "unparsable"
+)
+
+// Gap is a block that no intact per-block or range file holds
+type Gap struct {
+	Block uint64  `json:"block"`
+	Kind  GapKind `json:"kind"`
+	// File is the damaged file the block was read from, empty for missing blocks
+	File  string `json:"file,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// GapReport lists the gaps in the data directory between two blocks
+type GapReport struct {
+	FromBlock uint64 `json:"from_block"`
+	ToBlock   uint64 `json:"to_block"`
+	Gaps      []Gap  `json:"gaps"`
+	// DamagedRanges lists the range files that are empty or unparsable, even if per-block
+	// files hold all of their blocks
+	DamagedRanges []uint64 `json:"damaged_ranges"`
+}
+
+// Blocks returns the blocks of the gaps in ascending order
+func (r *GapReport) Blocks() []uint64 {
+	blocks := make([]uint64, len(r.Gaps))
+	for i, gap := range r.Gaps {
+		blocks[i] = gap.Block
+	}
+	return blocks
+}
+
+// damagedFile is a range file that failed its check
+type damagedFile struct {
+	kind GapKind
+	file string
+	err  error
+}
+
+// ScanGaps finds the blocks from from to to that neither an intact range file nor a readable
+// per-block file of blocks holds. A to of 0 scans up to the highest block stored. Range files
+// are checked against their manifest, or decoded completely with deep. Per-block files of
+// blocks outside of intact range files are always decoded.
+func (rp *RangeProcessor) ScanGaps(ctx context.Context, blocks *BlockFileSource, from, to uint64, deep bool) (*GapReport, error) {
+	from = max(from, 1) // Genesis is handled separately
+
+	files, err := ListBlockFiles(blocks.backend, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read data directory: %w", err)
+	}
+	// Names are listed in ascending order, the uncompressed file of a block comes first and is
+	// the one read when both exist
+	blockFiles := make(map[uint64]FileInfo)
+	for _, file := range files {
+		match := blockFilePattern.FindStringSubmatch(file.Name)
+		block, err := strconv.ParseUint(match[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		if _, ok := blockFiles[block]; ok && match[2] != "" {
+			continue
+		}
+		blockFiles[block] = file
+	}
+
+	ranges, err := rp.ListRanges()
+	if err != nil {
+		return nil, err
+	}
+	if to == 0 {
+		for block := range blockFiles {
+			to = max(to, block)
+		}
+		if len(ranges) > 0 {
+			_, end := rp.GetRangeBlockNumbers(ranges[len(ranges)-1])
+			to = max(to, end)
+		}
+	}
+
+	report := &GapReport{FromBlock: from, ToBlock: to, Gaps: []Gap{}, DamagedRanges: []uint64{}}
+	if to < from {
+		return report, nil
+	}
+
+	// Check the range files overlapping the scanned blocks
+	intact := make(map[uint64]bool)
+	damaged := make(map[uint64]damagedFile)
+	for _, rangeNumber := range ranges {
+		start, end := rp.GetRangeBlockNumbers(rangeNumber)
+		if end < from || start > to {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		damage, err := rp.checkRangeFile(rangeNumber, deep)
+		if err != nil {
+			return nil, err
+		}
+		if damage == nil {
+			intact[rangeNumber] = true
+			continue
+		}
+		damaged[rangeNumber] = *damage
+		report.DamagedRanges = append(report.DamagedRanges, rangeNumber)
+	}
+
+	for block := from; block <= to; block++ {
+		rangeNumber := rp.rangeOf(block)
+		if intact[rangeNumber] {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		file, ok := blockFiles[block]
+		switch {
+		case ok && file.Size == 0:
+			report.Gaps = append(report.Gaps, Gap{Block: block, Kind: GapEmpty, File: blocks.backend.Location(file.Name)})
+		case ok:
+			if _, err := blocks.readBlock(block); err != nil {
+				report.Gaps = append(report.Gaps, Gap{Block: block, Kind: GapUnparsable, File: blocks.backend.Location(file.Name), Error: err.Error()})
+			}
+		default:
+			gap := Gap{Block: block, Kind: GapMissing}
+			if damage, ok := damaged[rangeNumber]; ok {
+				gap.Kind = damage.kind
+				gap.File = damage.file
+				if damage.err != nil {
+					gap.Error = damage.err.Error()
+				}
+			}
+			report.Gaps = append(report.Gaps, gap)
+		}
+	}
+
+	return report, nil
+}
+
+// checkRangeFile checks a stored range file, the way VerifyRange does with deep. It returns the
+// damage found, or nil if the file is intact. Errors other than damage, such as failing
+// reads, are returned.
+func (rp *RangeProcessor) checkRangeFile(rangeNumber uint64, deep bool) (*damagedFile, error) {
+	info, err := rp.StatRange(rangeNumber)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat range file %s: %w", rp.GetRangeFilePath(rangeNumber), err)
+	}
+	if info.Size == 0 {
+		return &damagedFile{kind: GapEmpty, file: rp.GetRangeFilePath(rangeNumber)}, nil
+	}
+
+	if deep {
+		_, err = rp.VerifyRange(rangeNumber)
+	} else {
+		err = rp.CheckRange(rangeNumber)
+	}
+	if errors.Is(err, ErrCorruptRange) {
+		return &damagedFile{kind: GapUnparsable, file: rp.GetRangeFilePath(rangeNumber), err: err}, nil
+	}
+	return nil, err
+}
@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScanGaps(t *testing.T) {
+	node := NewMockRPCClient()
+	rp, err := NewRangeProcessor(t.TempDir(), node, 100)
+	require.NoError(t, err)
+	defer rp.Close()
+	backend := rp.Backend()
+	blocks := NewBlockFileSource(backend, node, rp.AccessMode())
+
+	// Range 1 is intact
+	require.NoError(t, rp.DownloadRange(t.Context(), 1))
+
+	// Range 2 is truncated, per-block files only hold its first half
+	require.NoError(t, rp.DownloadRange(t.Context(), 2))
+	data, err := ReadFile(backend, "101_200.json.zst")
+	require.NoError(t, err)
+	require.NoError(t, backend.Save("101_200.json.zst", data[:len(data)/2]))
+	writeBlockFiles(t, backend, 101, 150)
+
+	// Range 3 only has per-block files, one missing, one empty and one unparsable
+	writeBlockFiles(t, backend, 201, 250)
+	require.NoError(t, backend.Delete("230.json.zst"))
+	require.NoError(t, backend.Save("240.json.zst", nil))
+	require.NoError(t, backend.Save("245.json", []byte("not json")))
+
+	// Range 4 is empty
+	require.NoError(t, backend.Save("301_400.json.zst", nil))
+
+	kinds := func(gaps []Gap) map[uint64]GapKind {
+		result := make(map[uint64]GapKind)
+		for _, gap := range gaps {
+			result[gap.Block] = gap.Kind
+		}
+		return result
+	}
+
+	t.Run("every stored block is scanned by default", func(t *testing.T) {
+		report, err := rp.ScanGaps(t.Context(), blocks, 1, 0, false)
+		require.NoError(t, err)
+		assert.Equal(t, uint64(1), report.FromBlock)
+		assert.Equal(t, uint64(400), report.ToBlock)
+		assert.Equal(t, []uint64{2, 4}, report.DamagedRanges)
+
+		expected := make(map[uint64]GapKind)
+		for block := uint64(151); block <= 200; block++ {
+			expected[block] = GapUnparsable
+		}
+		expected[230] = GapMissing
+		expected[240] = GapEmpty
+		expected[245] = GapUnparsable
+		for block := uint64(251); block <= 300; block++ {
+			expected[block] = GapMissing
+		}
+		for block := uint64(301); block <= 400; block++ {
+			expected[block] = GapEmpty
+		}
+		assert.Equal(t, expected, kinds(report.Gaps))
+		assert.Len(t, report.Blocks(), len(expected))
+
+		for _, gap := range report.Gaps {
+			switch gap.Block {
+			case 151, 200:
+				assert.Equal(t, rp.GetRangeFilePath(2), gap.File)
+				assert.NotEmpty(t, gap.Error)
+			case 230:
+				assert.Empty(t, gap.File)
+			case 245:
+				assert.Equal(t, backend.Location("245.json"), gap.File)
+				assert.NotEmpty(t, gap.Error)
+			}
+		}
+	})
+
+	t.Run("a block span is scanned", func(t *testing.T) {
+		report, err := rp.ScanGaps(t.Context(), blocks, 200, 245, false)
+		require.NoError(t, err)
+		assert.Equal(t, []uint64{2}, report.DamagedRanges)
+		assert.Equal(t, []uint64{200, 230, 240, 245}, report.Blocks())
+	})
+
+	t.Run("filled gaps are not reported", func(t *testing.T) {
+		require.NoError(t, backend.Delete("240.json.zst"))
+		require.NoError(t, backend.Delete("245.json"))
+		writeBlockFiles(t, backend, 151, 300)
+
+		report, err := rp.ScanGaps(t.Context(), blocks, 1, 300, false)
+		require.NoError(t, err)
+		assert.Empty(t, report.Gaps)
+		assert.Equal(t, []uint64{2}, report.DamagedRanges, "the range file is damaged until it is rebuilt")
+
+		require.NoError(t, rp.DeleteRange(2))
+		rp.SetSources(blocks)
+		require.NoError(t, rp.EnsureRangeExists(t.Context(), 2))
+		report, err = rp.ScanGaps(t.Context(), blocks, 1, 300, true)
+		require.NoError(t, err)
+		assert.Empty(t, report.Gaps)
+		assert.Empty(t, report.DamagedRanges)
+	})
+}
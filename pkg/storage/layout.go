@@ -0,0 +1,254 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Layout places the per-block and range files of a data directory. Files are always
+// addressed by their flat name, such as 20123456.json.zst or 20123001_20124000.json.zst,
+// and Path resolves where that name is stored.
+type Layout string
+
+const (
+	// LayoutFlat stores every file in the root of the data directory
+	LayoutFlat Layout = "flat"
+	// LayoutSharded stores per-block files in directories by the million and the thousand of
+	// their block, such as 20/123/20123456.json.zst, and range files the same way by their first
+	// block below ranges/, such as ranges/20/123/20123001_20124000.json.zst. Other files, such as
+	// dictionaries and the rollback marker, stay in the root.
+	LayoutSharded Layout = "sharded"
+)
+
+// rangeShard is the directory the sharded layout stores range files in, apart from per-block files
+const rangeShard = "ranges/"
+
+// Layouts lists the supported layouts
+var Layouts = []Layout{LayoutFlat, LayoutSharded}
+
+// shardedFilePattern matches the per-block ({block}.json(.zst)) and range
+// ({start}_{end}.json.zst) files that are sharded by their first block
+var shardedFilePattern = regexp.MustCompile(`^(\d+)(_\d+)?\.json(\.zst)?$`)
+
+// ParseLayout returns the layout with the given name, the flat layout if name is empty
+func ParseLayout(name string) (Layout, error) {
+	layout := Layout(strings.ToLower(strings.TrimSpace(name)))
+	if layout == "" {
+		return LayoutFlat, nil
+	}
+	if !slices.Contains(Layouts, layout) {
+		return "", fmt.Errorf("unknown data directory layout %q, must be one of: %s, %s", name, LayoutFlat, LayoutSharded)
+	}
+	return layout, nil
+}
+
+// Path returns where the file with the flat name is stored in the layout, slash separated
+func (l Layout) Path(name string) string {
+	if l != LayoutSharded {
+		return name
+	}
+	match := shardedFilePattern.FindStringSubmatch(name)
+	if match == nil {
+		return name
+	}
+	block, err := strconv.ParseUint(match[1], 10, 64)
+	if err != nil {
+		return name
+	}
+	if match[2] != "" {
+		return rangeShard + blockShard(block) + name
+	}
+	return blockShard(block) + name
+}
+
+// blockShard returns the directory of the sharded layout holding the files of a block
+func blockShard(block uint64) string {
+	return fmt.Sprintf("%d/%03d/", block/1_000_000, block/1_000%1_000)
+}
+
+// LayoutBackend stores the files of another backend in a layout. Names passed to it are flat,
+// List returns flat names too and skips files that are not where the layout places them.
+type LayoutBackend struct {
+	backend Backend
+	layout  Layout
+}
+
+// Ensure LayoutBackend implements Backend
+var _ Backend = (*LayoutBackend)(nil)
+
+// WithLayout returns backend storing its files in layout. The flat layout is the layout of
+// every backend, so backend is returned as is.
+func WithLayout(backend Backend, layout Layout) Backend {
+	if layout == LayoutFlat {
+		return backend
+	}
+	return &LayoutBackend{backend: backend, layout: layout}
+}
+
+// Unwrap returns the backend files are stored in
+func (b *LayoutBackend) Unwrap() Backend {
+	return b.backend
+}
+
+func (b *LayoutBackend) Save(name string, data []byte) error {
+	return b.backend.Save(b.layout.Path(name), data)
+}
+
+func (b *LayoutBackend) Open(name string) (File, error) {
+	return b.backend.Open(b.layout.Path(name))
+}
+
+func (b *LayoutBackend) Stat(name string) (FileInfo, error) {
+	info, err := b.backend.Stat(b.layout.Path(name))
+	info.Name = name
+	return info, err
+}
+
+// List lists the whole backend for prefixes of sharded names, which are spread over
+// directories. Other prefixes only match files in the root. Use ListRangeFiles and
+// ListBlockFiles to only list the directories of range or per-block files.
+func (b *LayoutBackend) List(prefix string) ([]FileInfo, error) {
+	listPrefix := prefix
+	if prefix == "" || prefix[0] >= '0' && prefix[0] <= '9' {
+		listPrefix = ""
+	}
+	return b.list(listPrefix, prefix)
+}
+
+// list lists the files below the stored prefix listPrefix whose flat names start with prefix
+func (b *LayoutBackend) list(listPrefix, prefix string) ([]FileInfo, error) {
+	files, err := b.backend.List(listPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	listed := files[:0]
+	for _, file := range files {
+		name := path.Base(file.Name)
+		if b.layout.Path(name) != file.Name || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		file.Name = name
+		listed = append(listed, file)
+	}
+	slices.SortFunc(listed, func(a, b FileInfo) int { return strings.Compare(a.Name, b.Name) })
+	return listed, nil
+}
+
+// ListRangeFiles lists the range files of backend in ascending name order. The sharded layout
+// stores range files in a directory of their own, only that directory is listed.
+func ListRangeFiles(backend Backend) ([]FileInfo, error) {
+	var files []FileInfo
+	var err error
+	if layout, ok := backend.(*LayoutBackend); ok && layout.layout == LayoutSharded {
+		files, err = layout.list(rangeShard, "")
+	} else {
+		files, err = backend.List("")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return slices.DeleteFunc(files, func(file FileInfo) bool {
+		return !rangeFilePattern.MatchString(file.Name)
+	}), nil
+}
+
+// ListBlockFiles lists the per-block files of the blocks from from to to of backend in ascending
+// name order, up to the highest block stored if to is 0. The sharded layout only lists the
+// directories of those blocks.
+func ListBlockFiles(backend Backend, from, to uint64) ([]FileInfo, error) {
+	var files []FileInfo
+	if layout, ok := backend.(*LayoutBackend); ok && layout.layout == LayoutSharded && to > 0 {
+		for million := from / 1_000_000; million <= to/1_000_000; million++ {
+			listed, err := layout.list(fmt.Sprintf("%d/", million), "")
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, listed...)
+		}
+		slices.SortFunc(files, func(a, b FileInfo) int { return strings.Compare(a.Name, b.Name) })
+	} else {
+		var err error
+		if files, err = backend.List(""); err != nil {
+			return nil, err
+		}
+	}
+
+	return slices.DeleteFunc(files, func(file FileInfo) bool {
+		match := blockFilePattern.FindStringSubmatch(file.Name)
+		if match == nil {
+			return true
+		}
+		block, err := strconv.ParseUint(match[1], 10, 64)
+		return err != nil || block < from || to > 0 && block > to
+	}), nil
+}
+
+func (b *LayoutBackend) Rename(oldName, newName string) error {
+	return b.backend.Rename(b.layout.Path(oldName), b.layout.Path(newName))
+}
+
+func (b *LayoutBackend) Delete(name string) error {
+	return b.backend.Delete(b.layout.Path(name))
+}
+
+func (b *LayoutBackend) Location(name string) string {
+	return b.backend.Location(b.layout.Path(name))
+}
+
+// RelayoutResult counts the files moved by Relayout
+type RelayoutResult struct {
+	// Moved counts the files moved to where layout places them
+	Moved int
+	// InPlace counts the per-block and range files that were already in place
+	InPlace int
+	// Conflicts lists the files that were left in place because a file with the same name
+	// already is where layout places it
+	Conflicts []string
+}
+
+// Relayout moves the per-block and range files of backend, stored in any layout, to where
+// layout places them. backend must not be wrapped in a layout. moved is called for every file
+// moved; with dryRun files are only reported. Relayout can be run again after an interruption.
+func Relayout(backend Backend, layout Layout, dryRun bool, moved func(from, to string)) (RelayoutResult, error) {
+	var result RelayoutResult
+	files, err := backend.List("")
+	if err != nil {
+		return result, err
+	}
+
+	for _, file := range files {
+		name := path.Base(file.Name)
+		if !shardedFilePattern.MatchString(name) {
+			continue
+		}
+		target := layout.Path(name)
+		if target == file.Name {
+			result.InPlace++
+			continue
+		}
+		if _, err := backend.Stat(target); err == nil {
+			result.Conflicts = append(result.Conflicts, file.Name)
+			continue
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return result, fmt.Errorf("failed to check %s: %w", backend.Location(target), err)
+		}
+
+		if !dryRun {
+			if err := backend.Rename(file.Name, target); err != nil {
+				return result, fmt.Errorf("failed to move %s to %s: %w", backend.Location(file.Name), backend.Location(target), err)
+			}
+		}
+		result.Moved++
+		if moved != nil {
+			moved(file.Name, target)
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,213 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/weiihann/state-expiry-indexer/pkg/rpc"
+)
+
+func TestLayoutPath(t *testing.T) {
+	tests := []struct {
+		name    string
+		flat    string
+		sharded string
+	}{
+		{"block file", "20123456.json", "20/123/20123456.json"},
+		{"compressed block file", "20123456.json.zst", "20/123/20123456.json.zst"},
+		{"range file", "20123001_20124000.json.zst", "ranges/20/123/20123001_20124000.json.zst"},
+		{"early block", "5.json.zst", "0/000/5.json.zst"},
+		{"early range", "1001_2000.json.zst", "ranges/0/001/1001_2000.json.zst"},
+		{"dictionary", "zstd-32768.dict", "zstd-32768.dict"},
+		{"rollback marker", "rollback.json", "rollback.json"},
+		{"unrelated numbered file", "5.txt", "5.txt"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.flat, LayoutFlat.Path(tt.flat))
+			assert.Equal(t, tt.sharded, LayoutSharded.Path(tt.flat))
+		})
+	}
+
+	layout, err := ParseLayout(" Sharded ")
+	require.NoError(t, err)
+	assert.Equal(t, LayoutSharded, layout)
+	layout, err = ParseLayout("")
+	require.NoError(t, err)
+	assert.Equal(t, LayoutFlat, layout)
+	_, err = ParseLayout("nested")
+	assert.ErrorContains(t, err, "unknown data directory layout")
+}
+
+func TestLayoutBackend(t *testing.T) {
+	root := t.TempDir()
+	local := NewLocalBackend(root)
+	backend := WithLayout(local, LayoutSharded)
+	assert.Same(t, local, WithLayout(local, LayoutFlat))
+
+	require.NoError(t, backend.Save("1234567.json", []byte("block")))
+	require.NoError(t, backend.Save("zstd-32768.dict", []byte("dictionary")))
+	assert.FileExists(t, filepath.Join(root, "1", "234", "1234567.json"))
+	assert.FileExists(t, filepath.Join(root, "zstd-32768.dict"))
+	assert.Equal(t, filepath.Join(root, "1", "234", "1234567.json"), backend.Location("1234567.json"))
+
+	info, err := backend.Stat("1234567.json")
+	require.NoError(t, err)
+	assert.Equal(t, "1234567.json", info.Name)
+	gotRoot, ok := LocalRoot(backend)
+	assert.True(t, ok)
+	assert.Equal(t, root, gotRoot)
+
+	// Files that are not where the layout places them are not listed
+	require.NoError(t, local.Save("7.json", []byte("flat")))
+	files, err := backend.List("")
+	require.NoError(t, err)
+	var names []string
+	for _, file := range files {
+		names = append(names, file.Name)
+	}
+	assert.Equal(t, []string{"1234567.json", "zstd-32768.dict"}, names)
+
+	files, err = backend.List("zstd-")
+	require.NoError(t, err)
+	assert.Len(t, files, 1)
+	files, err = backend.List("12")
+	require.NoError(t, err)
+	assert.Len(t, files, 1)
+}
+
+func TestListRangeAndBlockFiles(t *testing.T) {
+	for _, layout := range Layouts {
+		t.Run(string(layout), func(t *testing.T) {
+			backend := WithLayout(NewLocalBackend(t.TempDir()), layout)
+			for _, name := range []string{"1_1000.json.zst", "1001_2000.json.zst", "5.json", "999.json.zst", "1001.json", "2000001.json", "rollback.json"} {
+				require.NoError(t, backend.Save(name, []byte(name)))
+			}
+
+			names := func(files []FileInfo, err error) []string {
+				require.NoError(t, err)
+				var names []string
+				for _, file := range files {
+					names = append(names, file.Name)
+				}
+				return names
+			}
+
+			assert.Equal(t, []string{"1001_2000.json.zst", "1_1000.json.zst"}, names(ListRangeFiles(backend)))
+			assert.Equal(t, []string{"1001.json", "2000001.json", "5.json", "999.json.zst"}, names(ListBlockFiles(backend, 0, 0)))
+			assert.Equal(t, []string{"1001.json", "999.json.zst"}, names(ListBlockFiles(backend, 6, 1001)))
+			assert.Equal(t, []string{"2000001.json"}, names(ListBlockFiles(backend, 1002, 3000000)))
+		})
+	}
+
+	t.Run("only the range directory is listed for ranges", func(t *testing.T) {
+		root := t.TempDir()
+		backend := WithLayout(NewLocalBackend(root), LayoutSharded)
+		require.NoError(t, backend.Save("1_1000.json.zst", []byte("range")))
+		require.NoError(t, backend.Save("5.json", []byte("block")))
+		// A directory of per-block files that cannot be read fails any listing that walks it
+		require.NoError(t, os.WriteFile(filepath.Join(root, "7"), []byte("not a directory"), 0o644))
+		require.NoError(t, os.Symlink(filepath.Join(root, "missing"), filepath.Join(root, "0", "001")))
+
+		files, err := ListRangeFiles(backend)
+		require.NoError(t, err)
+		require.Len(t, files, 1)
+		assert.Equal(t, "1_1000.json.zst", files[0].Name)
+	})
+}
+
+func TestRelayout(t *testing.T) {
+	root := t.TempDir()
+	local := NewLocalBackend(root)
+	writeBlockFiles(t, local, 999, 1002)
+	for _, name := range []string{"1_1000.json.zst", "rollback.json", "zstd-32768.dict"} {
+		require.NoError(t, local.Save(name, []byte(name)))
+	}
+
+	var moves [][2]string
+	result, err := Relayout(local, LayoutSharded, true, func(from, to string) {
+		moves = append(moves, [2]string{from, to})
+	})
+	require.NoError(t, err)
+	assert.Equal(t, RelayoutResult{Moved: 5}, result)
+	assert.Contains(t, moves, [2]string{"1000.json.zst", "0/001/1000.json.zst"})
+	assert.FileExists(t, filepath.Join(root, "1000.json.zst"), "dry runs move nothing")
+
+	result, err = Relayout(local, LayoutSharded, false, nil)
+	require.NoError(t, err)
+	assert.Equal(t, RelayoutResult{Moved: 5}, result)
+	for _, path := range []string{"0/000/999.json", "0/001/1000.json.zst", "0/001/1001.json", "0/001/1002.json.zst", "ranges/0/000/1_1000.json.zst", "rollback.json", "zstd-32768.dict"} {
+		assert.FileExists(t, filepath.Join(root, filepath.FromSlash(path)))
+	}
+
+	// Running again moves nothing, files left behind are reported when they conflict
+	require.NoError(t, local.Save("999.json", []byte("stale")))
+	result, err = Relayout(local, LayoutSharded, false, nil)
+	require.NoError(t, err)
+	assert.Equal(t, RelayoutResult{InPlace: 5, Conflicts: []string{"999.json"}}, result)
+
+	// Moving back to the flat layout removes the emptied directories
+	require.NoError(t, local.Delete("999.json"))
+	result, err = Relayout(local, LayoutFlat, false, nil)
+	require.NoError(t, err)
+	assert.Equal(t, RelayoutResult{Moved: 5}, result)
+	entries, err := os.ReadDir(root)
+	require.NoError(t, err)
+	for _, entry := range entries {
+		assert.False(t, entry.IsDir(), "directory %s is left", entry.Name())
+	}
+}
+
+func TestRelayoutShardedRangeFiles(t *testing.T) {
+	// Sharded data directories used to store range files next to the per-block files
+	root := t.TempDir()
+	local := NewLocalBackend(root)
+	for _, name := range []string{"0/000/1_1000.json.zst", "0/001/1001_2000.json.zst", "0/000/5.json"} {
+		require.NoError(t, local.Save(name, []byte(name)))
+	}
+	backend := WithLayout(local, LayoutSharded)
+	files, err := ListRangeFiles(backend)
+	require.NoError(t, err)
+	assert.Empty(t, files, "range files are only listed where the layout places them")
+
+	result, err := Relayout(local, LayoutSharded, false, nil)
+	require.NoError(t, err)
+	assert.Equal(t, RelayoutResult{Moved: 2, InPlace: 1}, result)
+	for _, path := range []string{"ranges/0/000/1_1000.json.zst", "ranges/0/001/1001_2000.json.zst", "0/000/5.json"} {
+		assert.FileExists(t, filepath.Join(root, filepath.FromSlash(path)))
+	}
+
+	files, err = ListRangeFiles(backend)
+	require.NoError(t, err)
+	require.Len(t, files, 2)
+	assert.Equal(t, "1001_2000.json.zst", files[0].Name)
+	assert.Equal(t, "1_1000.json.zst", files[1].Name)
+	files, err = ListBlockFiles(backend, 1, 1000)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	assert.Equal(t, "5.json", files[0].Name)
+}
+
+func TestRangeProcessorShardedLayout(t *testing.T) {
+	node := NewMockRPCClient()
+	backend := WithLayout(NewLocalBackend(t.TempDir()), LayoutSharded)
+	rp, err := NewRangeProcessorWithBackend(backend, node, 100, rpc.AccessModeStateDiff)
+	require.NoError(t, err)
+	defer rp.Close()
+	writeBlockFiles(t, backend, 101, 200)
+	rp.SetSources(NewBlockFileSource(backend, node, rp.AccessMode()), rp.RPCSource())
+
+	require.NoError(t, rp.EnsureRangeExists(t.Context(), 1))
+	require.NoError(t, rp.EnsureRangeExists(t.Context(), 2))
+	assert.Equal(t, 100, node.GetCallCount("GetStateDiff"), "only the first range is traced")
+	assert.Contains(t, rp.GetRangeFilePath(2), filepath.Join("ranges", "0", "000", "101_200.json.zst"))
+
+	ranges, err := rp.ListRanges()
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{1, 2}, ranges)
+	_, err = rp.VerifyRange(2)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,289 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+
+	"github.com/weiihann/state-expiry-indexer/pkg/utils"
+)
+
+// Every range file written by RangeProcessor ends with a zstd skippable frame holding the
+// manifest of the range. zstd decoders skip the frame, so range files stay plain zstd files,
+// and the manifest is written in the same file write as the data it describes:
+//
+//	frame     uint32 skippable frame magic | uint32 payload size | payload
+//	payload   magic "SEIM" | version byte | uint64 first block | uint64 last block |
+//	          uint64 block count | uint64 uncompressed size | uint64 compressed size | sha256
+//
+// Integers are little endian. The compressed size excludes the manifest frame and the hash
+// covers the uncompressed content.
+const (
+	manifestFrameMagic  = 0x184D2A5E
+	manifestMagic       = "SEIM"
+	manifestVersion     = 1
+	manifestPayloadSize = 4 + 1 + 5*8 + sha256.Size // magic, version, five integers and the hash
+	manifestFrameSize   = 8 + manifestPayloadSize
+)
+
+var (
+	// ErrNoManifest is returned for range files written before manifests existed
+	ErrNoManifest = errors.New("range file has no manifest")
+	// ErrCorruptRange is returned when a range file does not match its manifest or cannot be decoded
+	ErrCorruptRange = errors.New("range file is corrupt")
+)
+
+// RangeManifest describes the content of a range file
+type RangeManifest struct {
+	FirstBlock uint64 `json:"firstBlock"`
+	LastBlock  uint64 `json:"lastBlock"`
+	BlockCount uint64 `json:"blockCount"`
+	// UncompressedSize is the size of the decompressed range data
+	UncompressedSize uint64 `json:"uncompressedSize"`
+	// CompressedSize is the size of the file without the manifest frame
+	CompressedSize uint64 `json:"compressedSize"`
+	// SHA256 is the hex encoded hash of the decompressed range data
+	SHA256 string `json:"sha256"`
+}
+
+// newRangeManifest describes uncompressed range data holding blocks
+func newRangeManifest(blocks []ReadRangeDiffs, uncompressed []byte, compressedSize int) RangeManifest {
+	manifest := RangeManifest{
+		BlockCount:       uint64(len(blocks)),
+		UncompressedSize: uint64(len(uncompressed)),
+		CompressedSize:   uint64(compressedSize),
+	}
+	if len(blocks) > 0 {
+		manifest.FirstBlock = blocks[0].BlockNum
+		manifest.LastBlock = blocks[len(blocks)-1].BlockNum
+	}
+	sum := sha256.Sum256(uncompressed)
+	manifest.SHA256 = hex.EncodeToString(sum[:])
+	return manifest
+}
+
+// encodeManifestFrame encodes a manifest as a zstd skippable frame
+func encodeManifestFrame(manifest RangeManifest) ([]byte, error) {
+	sum, err := hex.DecodeString(manifest.SHA256)
+	if err != nil || len(sum) != sha256.Size {
+		return nil, fmt.Errorf("invalid manifest hash %q", manifest.SHA256)
+	}
+
+	frame := make([]byte, 0, manifestFrameSize)
+	frame = binary.LittleEndian.AppendUint32(frame, manifestFrameMagic)
+	frame = binary.LittleEndian.AppendUint32(frame, uint32(manifestPayloadSize))
+	frame = append(frame, manifestMagic...)
+	frame = append(frame, manifestVersion)
+	for _, v := range []uint64{manifest.FirstBlock, manifest.LastBlock, manifest.BlockCount, manifest.UncompressedSize, manifest.CompressedSize} {
+		frame = binary.LittleEndian.AppendUint64(frame, v)
+	}
+	return append(frame, sum...), nil
+}
+
+// decodeManifestFrame decodes the manifest frame at the end of a range file
+func decodeManifestFrame(frame []byte) (*RangeManifest, error) {
+	if len(frame) != manifestFrameSize ||
+		binary.LittleEndian.Uint32(frame) != manifestFrameMagic ||
+		binary.LittleEndian.Uint32(frame[4:]) != uint32(manifestPayloadSize) ||
+		string(frame[8:8+len(manifestMagic)]) != manifestMagic {
+		return nil, ErrNoManifest
+	}
+
+	payload := frame[8+len(manifestMagic):]
+	if version := payload[0]; version != manifestVersion {
+		return nil, fmt.Errorf("unsupported range manifest version %d, expected %d", version, manifestVersion)
+	}
+	payload = payload[1:]
+
+	fields := make([]uint64, 5)
+	for i := range fields {
+		fields[i] = binary.LittleEndian.Uint64(payload[i*8:])
+	}
+	return &RangeManifest{
+		FirstBlock:       fields[0],
+		LastBlock:        fields[1],
+		BlockCount:       fields[2],
+		UncompressedSize: fields[3],
+		CompressedSize:   fields[4],
+		SHA256:           hex.EncodeToString(payload[5*8:]),
+	}, nil
+}
+
+// ReadManifest returns the manifest of a range file, or ErrNoManifest if the file was written
+// before manifests existed or lost its end
+func (rp *RangeProcessor) ReadManifest(rangeNumber uint64) (*RangeManifest, error) {
+	rangeFilePath := rp.GetRangeFilePath(rangeNumber)
+	file, err := rp.backend.Open(rp.rangeFileName(rangeNumber))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read range file %s: %w", rangeFilePath, err)
+	}
+	defer file.Close()
+
+	size := file.Size()
+	if size < manifestFrameSize {
+		return nil, ErrNoManifest
+	}
+
+	frame := make([]byte, manifestFrameSize)
+	if _, err := file.ReadAt(frame, size-manifestFrameSize); err != nil {
+		return nil, fmt.Errorf("failed to read manifest of range file %s: %w", rangeFilePath, err)
+	}
+	manifest, err := decodeManifestFrame(frame)
+	if err != nil {
+		return nil, err
+	}
+	if manifest.CompressedSize+manifestFrameSize != uint64(size) {
+		return nil, fmt.Errorf("%w: %s is %d bytes, manifest expects %d", ErrCorruptRange, rangeFilePath, size, manifest.CompressedSize+manifestFrameSize)
+	}
+	return manifest, nil
+}
+
+// CheckRange is the cheap check made by RangeExists: a range file with a manifest must have
+// the size the manifest records, one without must be a JSON range file from before manifests
+// existed. A binary range without a manifest lost its end.
+func (rp *RangeProcessor) CheckRange(rangeNumber uint64) error {
+	_, err := rp.ReadManifest(rangeNumber)
+	if !errors.Is(err, ErrNoManifest) {
+		return err
+	}
+
+	format, err := rp.RangeFormat(rangeNumber)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrCorruptRange, err)
+	}
+	if format == RangeFormatBinary {
+		return fmt.Errorf("%w: binary range file %s has no manifest", ErrCorruptRange, rp.GetRangeFilePath(rangeNumber))
+	}
+	return nil
+}
+
+// VerifyRange decompresses and decodes a whole range file. It checks that the file holds every
+// block of the range in order, that each block builds on the one before it and that the content
+// matches the manifest. It returns the manifest computed from the content, which has no
+// CompressedSize for files without a manifest. Integrity failures wrap ErrCorruptRange.
+func (rp *RangeProcessor) VerifyRange(rangeNumber uint64) (*RangeManifest, error) {
+	if rangeNumber == 0 {
+		return nil, fmt.Errorf("cannot verify genesis as range")
+	}
+	rangeFilePath := rp.GetRangeFilePath(rangeNumber)
+	corrupt := func(format string, args ...any) error {
+		return fmt.Errorf("%w: %s: %s", ErrCorruptRange, rangeFilePath, fmt.Sprintf(format, args...))
+	}
+
+	stored, err := rp.ReadManifest(rangeNumber)
+	if errors.Is(err, ErrCorruptRange) {
+		return nil, err
+	}
+	if err != nil && !errors.Is(err, ErrNoManifest) {
+		return nil, err
+	}
+
+	file, err := rp.backend.Open(rp.rangeFileName(rangeNumber))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read range file %s: %w", rangeFilePath, err)
+	}
+	defer file.Close()
+
+	start, end := rp.GetRangeBlockNumbers(rangeNumber)
+	computed, err := verifyRangeStream(file, start, end, stored, nil)
+	if err != nil {
+		return nil, corrupt("%v", err)
+	}
+	return computed, nil
+}
+
+// verifyRangeStream decodes compressed range data holding blocks start to end and checks it the
+// way VerifyRange does, comparing the content with stored unless it is nil. fn, if not nil, is
+// called with each block in order.
+func verifyRangeStream(r io.Reader, start, end uint64, stored *RangeManifest, fn func(ReadRangeDiffs)) (*RangeManifest, error) {
+	zstdReader, err := utils.NewZstdStreamReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer zstdReader.Close()
+
+	// Hash everything the decoder reads, buffered read-ahead included
+	content := &hashingReader{r: zstdReader, hash: sha256.New()}
+	reader := bufio.NewReaderSize(content, streamBufferSize)
+	decoder, _, err := newBlockDecoder(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	expected := start
+	var previousHash string
+	for {
+		block, err := decoder.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if block.BlockNum != expected {
+			return nil, fmt.Errorf("expected block %d, found block %d", expected, block.BlockNum)
+		}
+		if previousHash != "" && block.ParentHash != "" && block.ParentHash != previousHash {
+			return nil, fmt.Errorf("block %d does not build on block %d", block.BlockNum, block.BlockNum-1)
+		}
+		previousHash = block.Hash
+		expected++
+		if fn != nil {
+			fn(block)
+		}
+	}
+	if expected != end+1 {
+		return nil, fmt.Errorf("range ends at block %d, expected block %d", expected-1, end)
+	}
+
+	// Trailing whitespace after a JSON range is content too
+	if _, err := io.Copy(io.Discard, reader); err != nil {
+		return nil, err
+	}
+
+	computed := &RangeManifest{
+		FirstBlock:       start,
+		LastBlock:        end,
+		BlockCount:       end - start + 1,
+		UncompressedSize: content.size,
+		SHA256:           hex.EncodeToString(content.hash.Sum(nil)),
+	}
+	if stored == nil {
+		return computed, nil
+	}
+
+	computed.CompressedSize = stored.CompressedSize
+	if *computed != *stored {
+		return nil, fmt.Errorf("content does not match manifest: found %+v, manifest %+v", *computed, *stored)
+	}
+	return computed, nil
+}
+
+// hashingReader hashes and counts the bytes read through it
+type hashingReader struct {
+	r    io.Reader
+	hash hash.Hash
+	size uint64
+}
+
+func (h *hashingReader) Read(p []byte) (int, error) {
+	n, err := h.r.Read(p)
+	h.hash.Write(p[:n])
+	h.size += uint64(n)
+	return n, err
+}
+
+// appendManifest returns compressed range data followed by the manifest frame of the range
+func appendManifest(compressed []byte, blocks []ReadRangeDiffs, uncompressed []byte) ([]byte, error) {
+	frame, err := encodeManifestFrame(newRangeManifest(blocks, uncompressed, len(compressed)))
+	if err != nil {
+		return nil, err
+	}
+	return bytes.Join([][]byte{compressed, frame}, nil), nil
+}
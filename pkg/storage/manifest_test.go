@@ -0,0 +1,208 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// jsonRange builds a JSON range file holding the given blocks
+func jsonRange(blocks ...uint64) []byte {
+	entries := make([]string, 0, len(blocks))
+	for _, block := range blocks {
+		entries = append(entries, fmt.Sprintf(`{"blockNum": %d, "hash": "0x%02x", "parentHash": "0x%02x", "diffs": []}`, block, block, block-1))
+	}
+	return []byte("[" + strings.Join(entries, ",") + "]\n")
+}
+
+func blockSequence(start, end uint64) []uint64 {
+	var blocks []uint64
+	for block := start; block <= end; block++ {
+		blocks = append(blocks, block)
+	}
+	return blocks
+}
+
+func TestRangeManifest(t *testing.T) {
+	t.Run("written with every range", func(t *testing.T) {
+		rp, _, _, cleanup := setupRangeProcessorTest(t)
+		defer cleanup()
+		require.NoError(t, rp.DownloadRange(t.Context(), 2))
+
+		manifest, err := rp.ReadManifest(2)
+		require.NoError(t, err)
+		assert.Equal(t, uint64(101), manifest.FirstBlock)
+		assert.Equal(t, uint64(200), manifest.LastBlock)
+		assert.Equal(t, uint64(100), manifest.BlockCount)
+		assert.Len(t, manifest.SHA256, 64)
+
+		info, err := os.Stat(rp.GetRangeFilePath(2))
+		require.NoError(t, err)
+		assert.Equal(t, uint64(info.Size()), manifest.CompressedSize+manifestFrameSize)
+
+		verified, err := rp.VerifyRange(2)
+		require.NoError(t, err)
+		assert.Equal(t, manifest, verified)
+	})
+
+	t.Run("frame round trip", func(t *testing.T) {
+		manifest := RangeManifest{FirstBlock: 1, LastBlock: 2, BlockCount: 2, UncompressedSize: 3, CompressedSize: 4, SHA256: strings.Repeat("ab", 32)}
+		frame, err := encodeManifestFrame(manifest)
+		require.NoError(t, err)
+		require.Len(t, frame, manifestFrameSize)
+
+		decoded, err := decodeManifestFrame(frame)
+		require.NoError(t, err)
+		assert.Equal(t, manifest, *decoded)
+
+		_, err = decodeManifestFrame(frame[1:])
+		assert.ErrorIs(t, err, ErrNoManifest)
+	})
+}
+
+func TestRangeProcessorCorruptRanges(t *testing.T) {
+	t.Run("truncated binary range", func(t *testing.T) {
+		rp, _, _, cleanup := setupRangeProcessorTest(t)
+		defer cleanup()
+		require.NoError(t, rp.DownloadRange(t.Context(), 1))
+
+		path := rp.GetRangeFilePath(1)
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+		require.NoError(t, os.Truncate(path, info.Size()/2))
+
+		assert.False(t, rp.RangeExists(1), "Truncated ranges are downloaded again")
+		_, err = rp.VerifyRange(1)
+		assert.ErrorIs(t, err, ErrCorruptRange)
+	})
+
+	t.Run("flipped byte", func(t *testing.T) {
+		rp, _, _, cleanup := setupRangeProcessorTest(t)
+		defer cleanup()
+		require.NoError(t, rp.DownloadRange(t.Context(), 1))
+
+		path := rp.GetRangeFilePath(1)
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		data[len(data)/2] ^= 0xff
+		require.NoError(t, os.WriteFile(path, data, 0o644))
+
+		// The size still matches, only decoding finds the damage
+		assert.True(t, rp.RangeExists(1))
+		_, err = rp.VerifyRange(1)
+		assert.ErrorIs(t, err, ErrCorruptRange)
+	})
+
+	t.Run("garbage", func(t *testing.T) {
+		rp, _, _, cleanup := setupRangeProcessorTest(t)
+		defer cleanup()
+		require.NoError(t, os.WriteFile(rp.GetRangeFilePath(1), []byte("corrupted data"), 0o644))
+
+		assert.False(t, rp.RangeExists(1))
+		_, err := rp.VerifyRange(1)
+		assert.ErrorIs(t, err, ErrCorruptRange)
+	})
+}
+
+func TestRangeProcessorVerifyLegacyRange(t *testing.T) {
+	tests := []struct {
+		name    string
+		blocks  []uint64
+		wantErr string
+	}{
+		{name: "complete", blocks: blockSequence(1, 100)},
+		{name: "missing tail", blocks: blockSequence(1, 99), wantErr: "range ends at block 99"},
+		{name: "gap", blocks: append(blockSequence(1, 49), blockSequence(51, 100)...), wantErr: "expected block 50, found block 51"},
+		{name: "foreign block", blocks: append(blockSequence(1, 100), 101), wantErr: "range ends at block 101"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rp, _, _, cleanup := setupRangeProcessorTest(t)
+			defer cleanup()
+			data := jsonRange(tt.blocks...)
+			writeRangeFile(t, rp, 1, data)
+
+			_, err := rp.ReadManifest(1)
+			assert.ErrorIs(t, err, ErrNoManifest)
+			assert.True(t, rp.RangeExists(1), "JSON ranges without a manifest are accepted")
+
+			manifest, err := rp.VerifyRange(1)
+			if tt.wantErr != "" {
+				assert.ErrorIs(t, err, ErrCorruptRange)
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, uint64(len(data)), manifest.UncompressedSize)
+			assert.Equal(t, uint64(100), manifest.BlockCount)
+			assert.Zero(t, manifest.CompressedSize)
+		})
+	}
+
+	t.Run("broken chain", func(t *testing.T) {
+		rp, _, _, cleanup := setupRangeProcessorTest(t)
+		defer cleanup()
+		data := strings.Replace(string(jsonRange(blockSequence(1, 100)...)), `"parentHash": "0x09"`, `"parentHash": "0xff"`, 1)
+		writeRangeFile(t, rp, 1, []byte(data))
+
+		_, err := rp.VerifyRange(1)
+		assert.ErrorContains(t, err, "block 10 does not build on block 9")
+	})
+}
+
+func TestRangeProcessorRecompressRange(t *testing.T) {
+	t.Run("manifest hash is kept", func(t *testing.T) {
+		rp, _, _, cleanup := setupRangeProcessorTest(t)
+		defer cleanup()
+		require.NoError(t, rp.DownloadRange(t.Context(), 1))
+		before, err := rp.ReadManifest(1)
+		require.NoError(t, err)
+		want, err := rp.ReadRange(1)
+		require.NoError(t, err)
+
+		require.NoError(t, rp.SetCompressionLevel(1))
+		require.NoError(t, rp.RecompressRange(1))
+		after, err := rp.ReadManifest(1)
+		require.NoError(t, err)
+		assert.Equal(t, before.SHA256, after.SHA256)
+		assert.NotEqual(t, before.CompressedSize, after.CompressedSize)
+		info, err := rp.StatRange(1)
+		require.NoError(t, err)
+		assert.Equal(t, int64(after.CompressedSize+manifestFrameSize), info.Size)
+
+		got, err := rp.ReadRange(1)
+		require.NoError(t, err)
+		assert.Equal(t, want, got)
+		_, err = rp.VerifyRange(1)
+		assert.NoError(t, err)
+	})
+
+	t.Run("legacy ranges get a manifest", func(t *testing.T) {
+		rp, _, _, cleanup := setupRangeProcessorTest(t)
+		defer cleanup()
+		writeRangeFile(t, rp, 1, jsonRange(blockSequence(1, 100)...))
+
+		require.NoError(t, rp.RecompressRange(1))
+		manifest, err := rp.ReadManifest(1)
+		require.NoError(t, err)
+		assert.Equal(t, uint64(100), manifest.BlockCount)
+		format, err := rp.RangeFormat(1)
+		require.NoError(t, err)
+		assert.Equal(t, RangeFormatJSON, format)
+	})
+
+	t.Run("corrupt ranges are not rewritten", func(t *testing.T) {
+		rp, _, _, cleanup := setupRangeProcessorTest(t)
+		defer cleanup()
+		writeRangeFile(t, rp, 1, jsonRange(blockSequence(1, 99)...))
+
+		assert.ErrorIs(t, rp.RecompressRange(1), ErrCorruptRange)
+		_, err := rp.ReadManifest(1)
+		assert.ErrorIs(t, err, ErrNoManifest)
+	})
+}
@@ -0,0 +1,385 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/weiihann/state-expiry-indexer/pkg/rpc"
+)
+
+const (
+	// mirrorTimeout bounds a single request to a mirror
+	mirrorTimeout = 5 * time.Minute
+	// mirrorResumes is how many times an interrupted range file download is resumed with a
+	// range request before it fails
+	mirrorResumes = 3
+)
+
+// RangeSHA256Header is the response header carrying the manifest hash of the uncompressed
+// content of a range file served by a mirror
+const RangeSHA256Header = "X-Range-Sha256"
+
+// MirrorIndex lists the range files served by a mirror
+type MirrorIndex struct {
+	RangeSize int           `json:"rangeSize"`
+	Ranges    []MirrorRange `json:"ranges"`
+}
+
+// MirrorRange describes a range file served by a mirror
+type MirrorRange struct {
+	Start uint64 `json:"start"`
+	End   uint64 `json:"end"`
+	// Size is the size of the range file in bytes
+	Size int64 `json:"size"`
+	// Manifest is the manifest of the range file, nil for files written before manifests existed
+	Manifest *RangeManifest `json:"manifest,omitempty"`
+}
+
+// MirrorHandler serves the range files of the range processor to other indexers:
+//
+//	GET /ranges                 the MirrorIndex of every intact range file, as JSON
+//	GET /ranges/{start}_{end}   the range file of blocks start to end
+//
+// Range files are served as stored, with their manifest hash in the X-Range-Sha256 header, and
+// support range requests so interrupted downloads can be resumed. Corrupt files are not served.
+func (rp *RangeProcessor) MirrorHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /ranges", rp.serveMirrorIndex)
+	mux.HandleFunc("GET /ranges/{name}", rp.serveMirrorRange)
+	return mux
+}
+
+func (rp *RangeProcessor) serveMirrorIndex(w http.ResponseWriter, r *http.Request) {
+	ranges, err := rp.ListRanges()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	index := MirrorIndex{RangeSize: rp.rangeSize, Ranges: make([]MirrorRange, 0, len(ranges))}
+	for _, rangeNumber := range ranges {
+		entry, err := rp.mirrorRange(rangeNumber)
+		if err != nil {
+			continue // Corrupt or deleted since listing
+		}
+		index.Ranges = append(index.Ranges, entry)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(index)
+}
+
+func (rp *RangeProcessor) serveMirrorRange(w http.ResponseWriter, r *http.Request) {
+	rangeNumber, ok := rp.parseMirrorRange(r.PathValue("name"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	entry, err := rp.mirrorRange(rangeNumber)
+	if errors.Is(err, fs.ErrNotExist) || errors.Is(err, ErrCorruptRange) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	file, err := rp.backend.Open(rp.rangeFileName(rangeNumber))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+	info, err := rp.StatRange(rangeNumber)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zstd")
+	if entry.Manifest != nil {
+		w.Header().Set(RangeSHA256Header, entry.Manifest.SHA256)
+		// The content hash alone does not identify the bytes, the file may be recompressed
+		w.Header().Set("ETag", fmt.Sprintf(`"%s-%d"`, entry.Manifest.SHA256, entry.Manifest.CompressedSize))
+	}
+	// ServeContent answers range and conditional requests
+	http.ServeContent(w, r, "", info.ModTime, io.NewSectionReader(file, 0, file.Size()))
+}
+
+// parseMirrorRange returns the range served at /ranges/{start}_{end}
+func (rp *RangeProcessor) parseMirrorRange(name string) (uint64, bool) {
+	startText, _, found := strings.Cut(name, "_")
+	start, err := strconv.ParseUint(startText, 10, 64)
+	if !found || err != nil || start == 0 {
+		return 0, false
+	}
+	rangeNumber := rp.rangeOf(start)
+	return rangeNumber, rp.rangeFileName(rangeNumber) == name+".json.zst"
+}
+
+// mirrorRange describes a range file that passes CheckRange
+func (rp *RangeProcessor) mirrorRange(rangeNumber uint64) (MirrorRange, error) {
+	info, err := rp.StatRange(rangeNumber)
+	if err != nil {
+		return MirrorRange{}, err
+	}
+	manifest, err := rp.ReadManifest(rangeNumber)
+	if errors.Is(err, ErrNoManifest) {
+		manifest, err = nil, rp.CheckRange(rangeNumber)
+	}
+	if err != nil {
+		return MirrorRange{}, err
+	}
+
+	start, end := rp.GetRangeBlockNumbers(rangeNumber)
+	return MirrorRange{Start: start, End: end, Size: info.Size, Manifest: manifest}, nil
+}
+
+// MirrorSource downloads range files from another indexer serving MirrorHandler. Downloaded
+// files are checked against their manifest before they are used.
+type MirrorSource struct {
+	base   string
+	client *http.Client
+}
+
+// Ensure MirrorSource implements RangeSource
+var _ RangeSource = (*MirrorSource)(nil)
+
+// NewMirrorSource returns a source downloading range files from the mirror at baseURL
+func NewMirrorSource(baseURL string) (*MirrorSource, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid mirror URL %q", baseURL)
+	}
+	return &MirrorSource{
+		base:   strings.TrimSuffix(baseURL, "/"),
+		client: &http.Client{Timeout: mirrorTimeout},
+	}, nil
+}
+
+func (s *MirrorSource) Name() string {
+	return SourceMirror
+}
+
+// Index lists the range files of the mirror
+func (s *MirrorSource) Index(ctx context.Context) (*MirrorIndex, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.base+"/ranges", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list mirror ranges: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to list mirror ranges: %s returned %s", req.URL, resp.Status)
+	}
+
+	var index MirrorIndex
+	if err := json.NewDecoder(resp.Body).Decode(&index); err != nil {
+		return nil, fmt.Errorf("failed to decode mirror range index: %w", err)
+	}
+	return &index, nil
+}
+
+func (s *MirrorSource) FetchRange(ctx context.Context, rangeNumber, start, end uint64) ([]ReadRangeDiffs, error) {
+	data, err := s.download(ctx, start, end)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download range %d from mirror: %w", rangeNumber, err)
+	}
+
+	var rangeDiffs []ReadRangeDiffs
+	if _, err := verifyRangeData(data, start, end, func(block ReadRangeDiffs) {
+		rangeDiffs = append(rangeDiffs, block)
+	}); err != nil {
+		return nil, fmt.Errorf("mirror range %d: %w", rangeNumber, err)
+	}
+	return rangeDiffs, nil
+}
+
+// download fetches the range file of blocks start to end. A download interrupted mid-file is
+// resumed from where it stopped, as long as the file did not change on the mirror. The hash
+// announced by the mirror must match the manifest of the file.
+func (s *MirrorSource) download(ctx context.Context, start, end uint64) ([]byte, error) {
+	rangeURL := fmt.Sprintf("%s/ranges/%d_%d", s.base, start, end)
+
+	var data []byte
+	var etag, announced string
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, rangeURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		if len(data) > 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", len(data)))
+			req.Header.Set("If-Range", etag)
+		}
+
+		resp, err := s.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		switch resp.StatusCode {
+		case http.StatusOK:
+			// A fresh download, or the file changed since the interrupted one
+			data = data[:0]
+			etag = resp.Header.Get("ETag")
+			announced = resp.Header.Get(RangeSHA256Header)
+		case http.StatusPartialContent:
+		case http.StatusNotFound:
+			resp.Body.Close()
+			return nil, fmt.Errorf("mirror does not have blocks %d-%d: %w", start, end, ErrRangeUnavailable)
+		default:
+			resp.Body.Close()
+			return nil, fmt.Errorf("%s returned %s", rangeURL, resp.Status)
+		}
+
+		var buf bytes.Buffer
+		buf.Write(data)
+		_, err = buf.ReadFrom(resp.Body)
+		resp.Body.Close()
+		data = buf.Bytes()
+		if err == nil {
+			break
+		}
+		// Only downloads the mirror can resume are retried
+		if ctx.Err() != nil || etag == "" || attempt >= mirrorResumes {
+			return nil, err
+		}
+	}
+
+	if announced != "" {
+		manifest, err := decodeManifestFrame(data[max(len(data)-manifestFrameSize, 0):])
+		if err != nil || manifest.SHA256 != announced {
+			return nil, fmt.Errorf("%w: %s does not match the announced hash %s", ErrCorruptRange, rangeURL, announced)
+		}
+	}
+	return data, nil
+}
+
+// verifyRangeData checks a whole range file held in memory the way VerifyRange checks a stored
+// one and calls fn with each block. Integrity failures wrap ErrCorruptRange.
+func verifyRangeData(data []byte, start, end uint64, fn func(ReadRangeDiffs)) (*RangeManifest, error) {
+	stored, err := decodeManifestFrame(data[max(len(data)-manifestFrameSize, 0):])
+	if errors.Is(err, ErrNoManifest) {
+		stored = nil
+	} else if err != nil {
+		return nil, err
+	} else if stored.CompressedSize+manifestFrameSize != uint64(len(data)) {
+		return nil, fmt.Errorf("%w: %d bytes, manifest expects %d", ErrCorruptRange, len(data), stored.CompressedSize+manifestFrameSize)
+	}
+
+	manifest, err := verifyRangeStream(bytes.NewReader(data), start, end, stored, func(block ReadRangeDiffs) {
+		// Range files written before access modes existed only contain state diffs
+		if block.AccessMode == "" {
+			block.AccessMode = rpc.AccessModeStateDiff
+		}
+		fn(block)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrCorruptRange, err)
+	}
+	return manifest, nil
+}
+
+// BootstrapProgress reports a range file handled by Bootstrap
+type BootstrapProgress struct {
+	RangeNumber uint64
+	// Downloaded is false for ranges that were already stored
+	Downloaded bool
+	Bytes      int64
+}
+
+// Bootstrap downloads every range file the mirror has and the range processor does not, in
+// ascending order. Each file is checked against its manifest and must extend the stored chain
+// before it is stored as it was served. Ranges the mirror does not have are left to the range
+// sources of EnsureRangeExists. It returns the number of downloaded range files.
+func (rp *RangeProcessor) Bootstrap(ctx context.Context, mirror *MirrorSource, progress func(BootstrapProgress)) (int, error) {
+	index, err := mirror.Index(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if index.RangeSize != rp.rangeSize {
+		return 0, fmt.Errorf("mirror stores ranges of %d blocks, expected %d", index.RangeSize, rp.rangeSize)
+	}
+
+	downloaded := 0
+	for _, entry := range index.Ranges {
+		if entry.Start == 0 {
+			continue
+		}
+		rangeNumber := rp.rangeOf(entry.Start)
+		if start, end := rp.GetRangeBlockNumbers(rangeNumber); start != entry.Start || end != entry.End {
+			return downloaded, fmt.Errorf("mirror lists blocks %d-%d, which is not a range", entry.Start, entry.End)
+		}
+
+		if rp.RangeExists(rangeNumber) {
+			if progress != nil {
+				progress(BootstrapProgress{RangeNumber: rangeNumber})
+			}
+			continue
+		}
+
+		size, err := rp.bootstrapRange(ctx, mirror, rangeNumber)
+		if err != nil {
+			return downloaded, fmt.Errorf("failed to bootstrap range %d: %w", rangeNumber, err)
+		}
+		downloaded++
+		if progress != nil {
+			progress(BootstrapProgress{RangeNumber: rangeNumber, Downloaded: true, Bytes: size})
+		}
+	}
+	return downloaded, nil
+}
+
+// bootstrapRange downloads, checks and stores a single range file from a mirror
+func (rp *RangeProcessor) bootstrapRange(ctx context.Context, mirror *MirrorSource, rangeNumber uint64) (int64, error) {
+	start, end := rp.GetRangeBlockNumbers(rangeNumber)
+	data, err := mirror.download(ctx, start, end)
+	if err != nil {
+		return 0, err
+	}
+
+	var first, last ReadRangeDiffs
+	var accessMode rpc.AccessMode
+	_, err = verifyRangeData(data, start, end, func(block ReadRangeDiffs) {
+		if block.BlockNum == start {
+			first = block
+			accessMode = block.AccessMode
+		}
+		if block.AccessMode != accessMode {
+			accessMode = ""
+		}
+		last = block
+	})
+	if err != nil {
+		return 0, err
+	}
+	if accessMode != rp.AccessMode() {
+		return 0, fmt.Errorf("mirror range was not collected in %s mode", rp.AccessMode())
+	}
+	if err := rp.checkContinuity(rangeNumber, first); err != nil {
+		return 0, err
+	}
+
+	if err := rp.backend.Save(rp.rangeFileName(rangeNumber), data); err != nil {
+		return 0, fmt.Errorf("failed to write range file %s: %w", rp.GetRangeFilePath(rangeNumber), err)
+	}
+	if last.Hash != "" {
+		rp.setTail(rangeNumber, last.Hash)
+	}
+	return int64(len(data)), nil
+}
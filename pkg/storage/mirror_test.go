@@ -0,0 +1,205 @@
+package storage
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newMirrorUpstream returns a range processor holding ranges 1 to count downloaded through RPC
+func newMirrorUpstream(t *testing.T, count uint64) *RangeProcessor {
+	rp, err := NewRangeProcessor(t.TempDir(), NewMockRPCClient(), 100)
+	require.NoError(t, err)
+	t.Cleanup(rp.Close)
+	for rangeNumber := uint64(1); rangeNumber <= count; rangeNumber++ {
+		require.NoError(t, rp.DownloadRange(t.Context(), rangeNumber))
+	}
+	return rp
+}
+
+func TestMirrorHandler(t *testing.T) {
+	upstream := newMirrorUpstream(t, 3)
+	// Range 3 loses its end and must not be served
+	data, err := ReadFile(upstream.Backend(), "201_300.json.zst")
+	require.NoError(t, err)
+	require.NoError(t, upstream.Backend().Save("201_300.json.zst", data[:len(data)/2]))
+	server := serveMirror(t, upstream)
+
+	t.Run("index", func(t *testing.T) {
+		resp, err := http.Get(server.URL + "/ranges")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var index MirrorIndex
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&index))
+		assert.Equal(t, 100, index.RangeSize)
+		require.Len(t, index.Ranges, 2)
+
+		manifest, err := upstream.ReadManifest(2)
+		require.NoError(t, err)
+		info, err := upstream.StatRange(2)
+		require.NoError(t, err)
+		assert.Equal(t, MirrorRange{Start: 101, End: 200, Size: info.Size, Manifest: manifest}, index.Ranges[1])
+	})
+
+	t.Run("range file", func(t *testing.T) {
+		want, err := ReadFile(upstream.Backend(), "1_100.json.zst")
+		require.NoError(t, err)
+		manifest, err := upstream.ReadManifest(1)
+		require.NoError(t, err)
+
+		resp, err := http.Get(server.URL + "/ranges/1_100")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, manifest.SHA256, resp.Header.Get(RangeSHA256Header))
+		assert.Equal(t, "bytes", resp.Header.Get("Accept-Ranges"))
+		got, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, want, got)
+
+		req, err := http.NewRequest(http.MethodGet, server.URL+"/ranges/1_100", nil)
+		require.NoError(t, err)
+		req.Header.Set("Range", "bytes=10-19")
+		resp, err = http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+		got, err = io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, want[10:20], got)
+	})
+
+	t.Run("unknown ranges", func(t *testing.T) {
+		for _, path := range []string{"/ranges/201_300", "/ranges/401_500", "/ranges/1_99", "/ranges/0_99", "/ranges/abc", "/ranges/1_100.json.zst"} {
+			resp, err := http.Get(server.URL + path)
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusNotFound, resp.StatusCode, path)
+		}
+	})
+}
+
+func TestRangeProcessorBootstrap(t *testing.T) {
+	t.Run("missing ranges are downloaded", func(t *testing.T) {
+		upstream := newMirrorUpstream(t, 3)
+		mirror, err := NewMirrorSource(serveMirror(t, upstream).URL)
+		require.NoError(t, err)
+
+		node := NewMockRPCClient()
+		rp, err := NewRangeProcessor(t.TempDir(), node, 100)
+		require.NoError(t, err)
+		defer rp.Close()
+		require.NoError(t, rp.DownloadRange(t.Context(), 1))
+
+		var progress []BootstrapProgress
+		downloaded, err := rp.Bootstrap(t.Context(), mirror, func(p BootstrapProgress) {
+			progress = append(progress, p)
+		})
+		require.NoError(t, err)
+		assert.Equal(t, 2, downloaded)
+		require.Len(t, progress, 3)
+		assert.False(t, progress[0].Downloaded)
+		assert.True(t, progress[2].Downloaded)
+
+		// Files are stored as served and pass the deep check
+		for _, name := range []string{"101_200.json.zst", "201_300.json.zst"} {
+			want, err := ReadFile(upstream.Backend(), name)
+			require.NoError(t, err)
+			got, err := ReadFile(rp.Backend(), name)
+			require.NoError(t, err)
+			assert.Equal(t, want, got)
+		}
+		_, err = rp.VerifyRange(3)
+		assert.NoError(t, err)
+
+		// Ranges the mirror does not have come from RPC
+		calls := node.GetCallCount("GetStateDiff")
+		rp.SetSources(mirror, rp.RPCSource())
+		require.NoError(t, rp.EnsureRangeExists(t.Context(), 4))
+		assert.Equal(t, calls+100, node.GetCallCount("GetStateDiff"))
+	})
+
+	t.Run("interrupted downloads are resumed", func(t *testing.T) {
+		upstream := newMirrorUpstream(t, 1)
+		handler := upstream.MirrorHandler()
+
+		var cut, ranged atomic.Int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Range") != "" {
+				ranged.Add(1)
+			}
+			if r.URL.Path == "/ranges/1_100" && cut.Add(1) == 1 {
+				// Send the headers and half of the file, then drop the connection
+				recorder := httptest.NewRecorder()
+				handler.ServeHTTP(recorder, r)
+				for name, values := range recorder.Header() {
+					w.Header()[name] = values
+				}
+				w.WriteHeader(recorder.Code)
+				w.Write(recorder.Body.Bytes()[:recorder.Body.Len()/2])
+				w.(http.Flusher).Flush()
+				panic(http.ErrAbortHandler)
+			}
+			handler.ServeHTTP(w, r)
+		}))
+		defer server.Close()
+		mirror, err := NewMirrorSource(server.URL)
+		require.NoError(t, err)
+
+		rp, err := NewRangeProcessor(t.TempDir(), nil, 100)
+		require.NoError(t, err)
+		defer rp.Close()
+
+		downloaded, err := rp.Bootstrap(t.Context(), mirror, nil)
+		require.NoError(t, err)
+		assert.Equal(t, 1, downloaded)
+		assert.Equal(t, int32(1), ranged.Load())
+		_, err = rp.VerifyRange(1)
+		assert.NoError(t, err)
+	})
+
+	t.Run("tampered files are rejected", func(t *testing.T) {
+		upstream := newMirrorUpstream(t, 1)
+		handler := upstream.MirrorHandler()
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, r)
+			body := recorder.Body.Bytes()
+			if r.URL.Path == "/ranges/1_100" {
+				body[len(body)/3] ^= 0xff
+			}
+			w.Write(body)
+		}))
+		defer server.Close()
+		mirror, err := NewMirrorSource(server.URL)
+		require.NoError(t, err)
+
+		rp, err := NewRangeProcessor(t.TempDir(), nil, 100)
+		require.NoError(t, err)
+		defer rp.Close()
+
+		_, err = rp.Bootstrap(t.Context(), mirror, nil)
+		assert.ErrorIs(t, err, ErrCorruptRange)
+		assert.False(t, rp.RangeExists(1))
+	})
+
+	t.Run("range size mismatch", func(t *testing.T) {
+		mirror, err := NewMirrorSource(serveMirror(t, newMirrorUpstream(t, 1)).URL)
+		require.NoError(t, err)
+
+		rp, err := NewRangeProcessor(t.TempDir(), nil, 1000)
+		require.NoError(t, err)
+		defer rp.Close()
+
+		_, err = rp.Bootstrap(t.Context(), mirror, nil)
+		assert.ErrorContains(t, err, "mirror stores ranges of 100 blocks, expected 1000")
+	})
+}
@@ -1,34 +1,65 @@
 package storage
 
 import (
+	"bytes"
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"math/big"
-	"os"
-	"path/filepath"
+	"io"
+	"slices"
+	"strconv"
+	"sync"
 
 	"github.com/weiihann/state-expiry-indexer/pkg/rpc"
 	"github.com/weiihann/state-expiry-indexer/pkg/utils"
 )
 
-// RangeDiffs represents a block range with its state diffs
+// RangeDiffs represents a block range with its state diffs, as stored in JSON range files
 type RangeDiffs struct {
-	BlockNum uint64                  `json:"blockNum"`
-	Diffs    []rpc.TransactionResult `json:"diffs"`
+	BlockNum   uint64                  `json:"blockNum"`
+	Hash       string                  `json:"hash,omitempty"`
+	ParentHash string                  `json:"parentHash,omitempty"`
+	AccessMode rpc.AccessMode          `json:"accessMode,omitempty"`
+	Diffs      []rpc.TransactionResult `json:"diffs"`
+	// Protocol lists the accounts touched outside of transactions, such as withdrawal recipients
+	Protocol []rpc.ProtocolAccess `json:"protocol,omitempty"`
 }
 
 // RangeProcessor handles downloading and processing of block ranges
 type RangeProcessor struct {
-	dataDir   string
-	rpcClient rpc.ClientInterface
-	rangeSize int
-	encoder   *utils.ZstdEncoder
-	decoder   *utils.ZstdDecoder
+	backend    Backend
+	rpcClient  rpc.ClientInterface
+	rangeSize  int
+	accessMode rpc.AccessMode
+	encoder    *utils.ZstdEncoder
+	decoder    *utils.ZstdDecoder
+
+	// downloadWorkers is the number of chunks of a range downloaded in parallel
+	downloadWorkers int
+	progress        func(DownloadProgress)
+
+	// sources are tried in order for ranges that are not stored yet
+	sources    []RangeSource
+	sourceFunc func(rangeNumber uint64, source string, err error)
+
+	// tail remembers the hash of the last block of the most recently written or read range,
+	// so checking that the next range builds on it does not require reading the file again
+	mu   sync.Mutex
+	tail rangeTail
 }
 
-// NewRangeProcessor creates a new range processor
+// NewRangeProcessor creates a new range processor that downloads state diffs
 func NewRangeProcessor(dataDir string, rpcClient rpc.ClientInterface, rangeSize int) (*RangeProcessor, error) {
+	return NewRangeProcessorWithAccessMode(dataDir, rpcClient, rangeSize, rpc.AccessModeStateDiff)
+}
+
+// NewRangeProcessorWithAccessMode creates a new range processor that downloads ranges with the given access mode
+func NewRangeProcessorWithAccessMode(dataDir string, rpcClient rpc.ClientInterface, rangeSize int, accessMode rpc.AccessMode) (*RangeProcessor, error) {
+	return NewRangeProcessorWithBackend(NewLocalBackend(dataDir), rpcClient, rangeSize, accessMode)
+}
+
+// NewRangeProcessorWithBackend creates a new range processor that stores range files in backend
+func NewRangeProcessorWithBackend(backend Backend, rpcClient rpc.ClientInterface, rangeSize int, accessMode rpc.AccessMode) (*RangeProcessor, error) {
 	encoder, err := utils.NewZstdEncoder()
 	if err != nil {
 		return nil, fmt.Errorf("failed to create zstd encoder: %w", err)
@@ -40,13 +71,38 @@ func NewRangeProcessor(dataDir string, rpcClient rpc.ClientInterface, rangeSize
 		return nil, fmt.Errorf("failed to create zstd decoder: %w", err)
 	}
 
-	return &RangeProcessor{
-		dataDir:   dataDir,
-		rpcClient: rpcClient,
-		rangeSize: rangeSize,
-		encoder:   encoder,
-		decoder:   decoder,
-	}, nil
+	rp := &RangeProcessor{
+		backend:         backend,
+		rpcClient:       rpcClient,
+		rangeSize:       rangeSize,
+		accessMode:      accessMode,
+		encoder:         encoder,
+		decoder:         decoder,
+		downloadWorkers: 1,
+	}
+	rp.sources = []RangeSource{rp.RPCSource()}
+	return rp, nil
+}
+
+// AccessMode returns the access mode new ranges are downloaded with
+func (rp *RangeProcessor) AccessMode() rpc.AccessMode {
+	if rp.accessMode == "" {
+		return rpc.AccessModeStateDiff
+	}
+	return rp.accessMode
+}
+
+// SetCompressionLevel sets the zstd level range files are written with, 0 for the default level
+func (rp *RangeProcessor) SetCompressionLevel(level int) error {
+	encoder, err := utils.NewZstdEncoderWithOptions(utils.ZstdOptions{Level: level})
+	if err != nil {
+		return err
+	}
+	if rp.encoder != nil {
+		rp.encoder.Close()
+	}
+	rp.encoder = encoder
+	return nil
 }
 
 // Close properly closes the range processor resources
@@ -67,6 +123,11 @@ func (rp *RangeProcessor) GetRangeNumber(blockNumber uint64) uint64 {
 	return (blockNumber - 1) / uint64(rp.rangeSize)
 }
 
+// rangeOf returns the number of the range file holding a block other than genesis
+func (rp *RangeProcessor) rangeOf(block uint64) uint64 {
+	return (block-1)/uint64(rp.rangeSize) + 1
+}
+
 // GetRangeBlockNumbers returns the start and end block numbers for a range
 func (rp *RangeProcessor) GetRangeBlockNumbers(rangeNumber uint64) (uint64, uint64) {
 	if rangeNumber == 0 {
@@ -77,130 +138,336 @@ func (rp *RangeProcessor) GetRangeBlockNumbers(rangeNumber uint64) (uint64, uint
 	return start, end
 }
 
-// GetRangeFilePath returns the file path for a range
+// Backend returns the backend range files are stored in
+func (rp *RangeProcessor) Backend() Backend {
+	return rp.backend
+}
+
+// rangeFileName returns the name of a range file in the backend
+func (rp *RangeProcessor) rangeFileName(rangeNumber uint64) string {
+	start, end := rp.GetRangeBlockNumbers(rangeNumber)
+	return fmt.Sprintf("%d_%d.json.zst", start, end)
+}
+
+// GetRangeFilePath returns the location of the file of a range, a file path for local data directories
 func (rp *RangeProcessor) GetRangeFilePath(rangeNumber uint64) string {
 	if rangeNumber == 0 {
 		return "" // Genesis doesn't have a range file
 	}
-	start, end := rp.GetRangeBlockNumbers(rangeNumber)
-	filename := fmt.Sprintf("%d_%d.json.zst", start, end)
-	return filepath.Join(rp.dataDir, filename)
+	return rp.backend.Location(rp.rangeFileName(rangeNumber))
+}
+
+// StatRange describes the file of a range
+func (rp *RangeProcessor) StatRange(rangeNumber uint64) (FileInfo, error) {
+	return rp.backend.Stat(rp.rangeFileName(rangeNumber))
+}
+
+// DeleteRange deletes the file of a range, so it is downloaded again
+func (rp *RangeProcessor) DeleteRange(rangeNumber uint64) error {
+	rp.setTail(0, "")
+	return rp.backend.Delete(rp.rangeFileName(rangeNumber))
+}
+
+// ListRanges returns the numbers of the range files in the data directory in ascending order.
+// Files written with a different range size are ignored.
+func (rp *RangeProcessor) ListRanges() ([]uint64, error) {
+	files, err := ListRangeFiles(rp.backend)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read data directory: %w", err)
+	}
+
+	var ranges []uint64
+	for _, file := range files {
+		match := rangeFilePattern.FindStringSubmatch(file.Name)
+		if match == nil {
+			continue
+		}
+		start, err := strconv.ParseUint(match[1], 10, 64)
+		if err != nil || start == 0 {
+			continue
+		}
+		rangeNumber := rp.rangeOf(start)
+		if rp.rangeFileName(rangeNumber) == file.Name {
+			ranges = append(ranges, rangeNumber)
+		}
+	}
+
+	slices.Sort(ranges)
+	return ranges, nil
 }
 
-// RangeExists checks if a range file exists and is not empty
+// RangeExists checks if a range file exists and is intact. Files that are empty, do not have
+// the size recorded in their manifest or cannot be decompressed are treated as unavailable, so
+// they are downloaded again. Use VerifyRange to check the content of a range.
 func (rp *RangeProcessor) RangeExists(rangeNumber uint64) bool {
 	if rangeNumber == 0 {
 		return true // Genesis is always considered to exist
 	}
-	filePath := rp.GetRangeFilePath(rangeNumber)
-	fileInfo, err := os.Stat(filePath)
+	fileInfo, err := rp.backend.Stat(rp.rangeFileName(rangeNumber))
 	if err != nil {
 		return false // File doesn't exist
 	}
 	// Check if file is empty - treat empty files as unavailable
-	return fileInfo.Size() > 0
+	if fileInfo.Size == 0 {
+		return false
+	}
+	return rp.CheckRange(rangeNumber) == nil
 }
 
-// DownloadRange downloads all blocks in a range and saves as a compressed range file
+// DownloadRange downloads all blocks in a range through RPC and saves them as a compressed
+// range file. Use EnsureRangeExists to try the configured range sources first.
 func (rp *RangeProcessor) DownloadRange(ctx context.Context, rangeNumber uint64) error {
 	if rangeNumber == 0 {
 		return fmt.Errorf("cannot download genesis range, use genesis processing instead")
 	}
 
-	start, end := rp.GetRangeBlockNumbers(rangeNumber)
-	rangeFilePath := rp.GetRangeFilePath(rangeNumber)
-
 	// Check if file already exists
 	if rp.RangeExists(rangeNumber) {
 		return nil
 	}
 
-	var rangeDiffs []RangeDiffs
-
-	// Download each block in the range
-	for blockNum := start; blockNum <= end; blockNum++ {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		default:
-		}
+	return rp.fillRange(ctx, rangeNumber, rp.RPCSource())
+}
 
-		// Download state diff for this block
-		blockBigInt := big.NewInt(int64(blockNum))
-		stateDiff, err := rp.rpcClient.GetStateDiff(ctx, blockBigInt)
-		if err != nil {
-			return fmt.Errorf("failed to download block %d: %w", blockNum, err)
-		}
+// fillRange fetches a range from a source, checks that it holds every block of the range and
+// extends the stored chain, and saves it as a range file
+func (rp *RangeProcessor) fillRange(ctx context.Context, rangeNumber uint64, source RangeSource) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
 
-		// Convert to the expected format
-		var transactionResults []rpc.TransactionResult
-		transactionResults = append(transactionResults, stateDiff...)
+	start, end := rp.GetRangeBlockNumbers(rangeNumber)
+	rangeDiffs, err := source.FetchRange(ctx, rangeNumber, start, end)
+	if err != nil {
+		return err
+	}
+	if err := checkRangeBlocks(start, end, rp.AccessMode(), rangeDiffs); err != nil {
+		return fmt.Errorf("%s source returned an invalid range %d: %w", source.Name(), rangeNumber, err)
+	}
 
-		// Add to range data
-		rangeDiffs = append(rangeDiffs, RangeDiffs{
-			BlockNum: blockNum,
-			Diffs:    transactionResults,
-		})
+	// The range must extend the chain stored in the previous range file
+	if err := rp.checkContinuity(rangeNumber, rangeDiffs[0]); err != nil {
+		return err
 	}
 
-	// Marshal range data to JSON
-	rangeData, err := json.MarshalIndent(rangeDiffs, "", "  ")
-	if err != nil {
-		return fmt.Errorf("failed to marshal range data: %w", err)
+	return rp.writeRange(rangeNumber, rangeDiffs)
+}
+
+// writeRange saves blocks as a compressed binary range file
+func (rp *RangeProcessor) writeRange(rangeNumber uint64, rangeDiffs []ReadRangeDiffs) error {
+	rangeFilePath := rp.GetRangeFilePath(rangeNumber)
+
+	var rangeData bytes.Buffer
+	if err := encodeBinaryRange(&rangeData, rangeDiffs); err != nil {
+		return fmt.Errorf("failed to encode range data: %w", err)
 	}
 
 	// Compress the range data
-	compressedData, err := rp.encoder.Compress(rangeData)
+	compressedData, err := rp.encoder.Compress(rangeData.Bytes())
 	if err != nil {
 		return fmt.Errorf("failed to compress range data: %w", err)
 	}
+	compressedData, err = appendManifest(compressedData, rangeDiffs, rangeData.Bytes())
+	if err != nil {
+		return fmt.Errorf("failed to write range manifest: %w", err)
+	}
 
-	// Save compressed range file
-	if err := os.WriteFile(rangeFilePath, compressedData, 0o644); err != nil {
+	// A rewritten range is never left half written
+	if err := rp.backend.Save(rp.rangeFileName(rangeNumber), compressedData); err != nil {
 		return fmt.Errorf("failed to write range file %s: %w", rangeFilePath, err)
 	}
 
+	if len(rangeDiffs) > 0 {
+		rp.setTail(rangeNumber, rangeDiffs[len(rangeDiffs)-1].Hash)
+	}
 	return nil
 }
 
-// ReadRange reads and decompresses a range file
-func (rp *RangeProcessor) ReadRange(rangeNumber uint64) ([]ReadRangeDiffs, error) {
-	if rangeNumber == 0 {
-		return nil, fmt.Errorf("cannot read genesis as range, use genesis processing instead")
+// Recover removes the temp files left in a local data directory by writes that were interrupted
+// by a crash. Temp files of writes other processes have in progress are kept. Object stores
+// replace objects atomically and need no recovery.
+func (rp *RangeProcessor) Recover() ([]string, error) {
+	root, ok := LocalRoot(rp.backend)
+	if !ok {
+		return nil, nil
 	}
+	return utils.RemoveTempFiles(root, utils.StaleTempFileAge)
+}
 
+// RangeFormat returns the format a range file is stored in
+func (rp *RangeProcessor) RangeFormat(rangeNumber uint64) (RangeFormat, error) {
 	rangeFilePath := rp.GetRangeFilePath(rangeNumber)
+	file, err := rp.backend.Open(rp.rangeFileName(rangeNumber))
+	if err != nil {
+		return "", fmt.Errorf("failed to read range file %s: %w", rangeFilePath, err)
+	}
+	defer file.Close()
 
-	// Read compressed file from disk
-	compressedData, err := os.ReadFile(rangeFilePath)
+	zstdReader, err := utils.NewZstdStreamReader(file)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read range file %s: %w", rangeFilePath, err)
+		return "", fmt.Errorf("failed to decompress range file %s: %w", rangeFilePath, err)
+	}
+	defer zstdReader.Close()
+
+	// io.ReadFull would report a truncated zstd stream as a short file
+	magic := make([]byte, len(binaryRangeMagic))
+	n := 0
+	for n < len(magic) {
+		read, err := zstdReader.Read(magic[n:])
+		n += read
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to decompress range file %s: %w", rangeFilePath, err)
+		}
+	}
+	if IsBinaryRange(magic[:n]) {
+		return RangeFormatBinary, nil
 	}
+	return RangeFormatJSON, nil
+}
 
-	// Decompress the data
-	decompressedData, err := rp.decoder.Decompress(compressedData)
+// ConvertRange rewrites a JSON range file in the binary format. It returns false if the range
+// was already binary. Transaction hashes and balance, nonce and value payloads are dropped.
+func (rp *RangeProcessor) ConvertRange(rangeNumber uint64) (bool, error) {
+	format, err := rp.RangeFormat(rangeNumber)
 	if err != nil {
-		return nil, fmt.Errorf("failed to decompress range file %s: %w", rangeFilePath, err)
+		return false, err
+	}
+	if format == RangeFormatBinary {
+		return false, nil
 	}
 
-	// Unmarshal JSON data with better error handling
-	var rangeDiffs []ReadRangeDiffs
-	if err := json.Unmarshal(decompressedData, &rangeDiffs); err != nil {
-		return nil, err
+	rangeDiffs, err := rp.ReadRange(rangeNumber)
+	if err != nil {
+		return false, err
+	}
+	if err := rp.writeRange(rangeNumber, rangeDiffs); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// RecompressRange compresses a range file again at the compression level of the range
+// processor. The file is verified first. Its content and the manifest hash do not change, range
+// files written before manifests existed get one.
+func (rp *RangeProcessor) RecompressRange(rangeNumber uint64) error {
+	manifest, err := rp.VerifyRange(rangeNumber)
+	if err != nil {
+		return err
+	}
+
+	rangeFilePath := rp.GetRangeFilePath(rangeNumber)
+	data, err := ReadFile(rp.backend, rp.rangeFileName(rangeNumber))
+	if err != nil {
+		return fmt.Errorf("failed to read range file %s: %w", rangeFilePath, err)
+	}
+	if stored, err := rp.ReadManifest(rangeNumber); err == nil {
+		data = data[:stored.CompressedSize]
+	}
+
+	rangeData, err := rp.decoder.Decompress(data)
+	if err != nil {
+		return fmt.Errorf("failed to decompress range file %s: %w", rangeFilePath, err)
+	}
+	compressedData, err := rp.encoder.Compress(rangeData)
+	if err != nil {
+		return fmt.Errorf("failed to compress range data: %w", err)
 	}
+	manifest.CompressedSize = uint64(len(compressedData))
+	frame, err := encodeManifestFrame(*manifest)
+	if err != nil {
+		return fmt.Errorf("failed to write range manifest: %w", err)
+	}
+
+	if err := rp.backend.Save(rp.rangeFileName(rangeNumber), bytes.Join([][]byte{compressedData, frame}, nil)); err != nil {
+		return fmt.Errorf("failed to write range file %s: %w", rangeFilePath, err)
+	}
+	return nil
+}
 
+// ReadRange reads and decompresses a whole range file. Use StreamRange to process a range
+// without holding all of its blocks in memory.
+func (rp *RangeProcessor) ReadRange(rangeNumber uint64) ([]ReadRangeDiffs, error) {
+	rangeDiffs := []ReadRangeDiffs{}
+	err := rp.StreamRange(rangeNumber, func(block ReadRangeDiffs) error {
+		rangeDiffs = append(rangeDiffs, block)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
 	return rangeDiffs, nil
 }
 
-// EnsureRangeExists ensures a range file exists, downloading it if necessary
+// EnsureRangeExists ensures a range file exists. A missing range is taken from the first
+// range source that has it, in the order set by SetSources.
 func (rp *RangeProcessor) EnsureRangeExists(ctx context.Context, rangeNumber uint64) error {
 	if rangeNumber == 0 {
 		return nil // Genesis is handled separately
 	}
 
-	if !rp.RangeExists(rangeNumber) {
-		return rp.DownloadRange(ctx, rangeNumber)
+	if rp.RangeExists(rangeNumber) {
+		return nil
 	}
 
-	return nil
+	// A source that fails is skipped like one that does not have the range, but its error is
+	// reported if no later source has the range either
+	var lastErr error
+	for _, source := range rp.sources {
+		err := rp.fillRange(ctx, rangeNumber, source)
+		if rp.sourceFunc != nil {
+			rp.sourceFunc(rangeNumber, source.Name(), err)
+		}
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !errors.Is(err, ErrRangeUnavailable) {
+			lastErr = err
+		}
+	}
+
+	if lastErr != nil {
+		return lastErr
+	}
+	return fmt.Errorf("range %d: %w in any range source", rangeNumber, ErrRangeUnavailable)
+}
+
+// FetchBlocks returns blocks start to end of a range that is not complete yet from the first
+// range source that has them, without writing a range file. Sources that only serve whole range
+// files, such as a mirror, do not have them. Blocks starting a range must build on the previous
+// range file, a *ReorgError is returned otherwise.
+func (rp *RangeProcessor) FetchBlocks(ctx context.Context, rangeNumber, start, end uint64) ([]ReadRangeDiffs, error) {
+	var lastErr error
+	for _, source := range rp.sources {
+		blocks, err := source.FetchRange(ctx, rangeNumber, start, end)
+		if err == nil {
+			if err := checkRangeBlocks(start, end, rp.AccessMode(), blocks); err != nil {
+				return nil, fmt.Errorf("%s source returned invalid blocks %d-%d: %w", source.Name(), start, end, err)
+			}
+			if first, _ := rp.GetRangeBlockNumbers(rangeNumber); start == first {
+				if err := rp.checkContinuity(rangeNumber, blocks[0]); err != nil {
+					return nil, err
+				}
+			}
+			return blocks, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if !errors.Is(err, ErrRangeUnavailable) {
+			lastErr = err
+		}
+	}
+
+	if lastErr != nil {
+		return nil, lastErr
+	}
+	return nil, fmt.Errorf("blocks %d-%d: %w in any range source", start, end, ErrRangeUnavailable)
 }
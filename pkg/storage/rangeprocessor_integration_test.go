@@ -10,6 +10,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
@@ -27,6 +28,8 @@ type MockRPCClient struct {
 	simulateTimeout      bool
 	simulateNetworkError bool
 	getStateDiffDelay    time.Duration
+	forkBlock            uint64
+	fork                 int
 }
 
 func NewMockRPCClient() *MockRPCClient {
@@ -52,6 +55,16 @@ func (m *MockRPCClient) GetLatestBlockNumber(ctx context.Context) (*big.Int, err
 	return new(big.Int).Set(m.latestBlockNumber), nil
 }
 
+func (m *MockRPCClient) GetBlockNumberByTag(ctx context.Context, tag rpc.BlockTag) (*big.Int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.simulateNetworkError {
+		return nil, fmt.Errorf("network error: connection refused")
+	}
+	return new(big.Int).Set(m.latestBlockNumber), nil
+}
+
 func (m *MockRPCClient) GetCode(ctx context.Context, address string, blockNumber *big.Int) (string, error) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
@@ -66,6 +79,10 @@ func (m *MockRPCClient) GetCode(ctx context.Context, address string, blockNumber
 	return "0x", nil // Return empty code for simplicity
 }
 
+func (m *MockRPCClient) GetCodes(ctx context.Context, accounts map[string]uint64) (map[string]string, error) {
+	return rpc.FetchCodes(ctx, accounts, m.GetCode)
+}
+
 func (m *MockRPCClient) GetStateDiff(ctx context.Context, blockNumber *big.Int) ([]rpc.TransactionResult, error) {
 	// Read configuration values under lock
 	m.mu.RLock()
@@ -136,7 +153,89 @@ func (m *MockRPCClient) GetStateDiff(ctx context.Context, blockNumber *big.Int)
 	}, nil
 }
 
+func (m *MockRPCClient) GetPrestate(ctx context.Context, blockNumber *big.Int) ([]rpc.TransactionResult, error) {
+	m.mu.RLock()
+	response, hasResponse := m.mockResponses[blockNumber.String()]
+	m.mu.RUnlock()
+
+	m.mu.Lock()
+	m.callCount["GetPrestate"]++
+	m.mu.Unlock()
+
+	if hasResponse {
+		return response, nil
+	}
+
+	// Default prestate response: one contract read without modification
+	return []rpc.TransactionResult{
+		{
+			TxHash: fmt.Sprintf("0x%064d", blockNumber.Uint64()),
+			StateDiff: map[string]rpc.AccountDiff{
+				fmt.Sprintf("0x%040d", blockNumber.Uint64()): {
+					Balance: "0x0",
+					Code:    "0x6080604052",
+					Storage: map[string]any{
+						fmt.Sprintf("0x%064d", 1): fmt.Sprintf("0x%064d", blockNumber.Uint64()),
+					},
+				},
+			},
+		},
+	}, nil
+}
+
+func (m *MockRPCClient) GetStateDiffs(ctx context.Context, blocks []uint64) (map[uint64][]rpc.TransactionResult, error) {
+	return rpc.FetchEach(ctx, blocks, m.GetStateDiff)
+}
+
+func (m *MockRPCClient) GetPrestates(ctx context.Context, blocks []uint64) (map[uint64][]rpc.TransactionResult, error) {
+	return rpc.FetchEach(ctx, blocks, m.GetPrestate)
+}
+
+// GetBlockHeaders returns headers linked by parent hash. Blocks from the fork block set by
+// SetFork on have different hashes.
+func (m *MockRPCClient) GetBlockHeaders(ctx context.Context, blocks []uint64) (map[uint64]*rpc.Head, error) {
+	return rpc.FetchEach(ctx, blocks, func(ctx context.Context, blockNumber *big.Int) (*rpc.Head, error) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.callCount["GetBlockHeader"]++
+
+		block := blockNumber.Uint64()
+		head := &rpc.Head{
+			Number:     hexutil.Uint64(block),
+			Hash:       m.blockHash(block),
+			ParentHash: m.blockHash(block - 1),
+			Miner:      mockCoinbase,
+		}
+		if block%2 == 0 {
+			head.Withdrawals = []rpc.Withdrawal{{Address: mockWithdrawalRecipient}}
+		}
+		return head, nil
+	})
+}
+
+const (
+	mockCoinbase            = "0x00000000000000000000000000000000000000c0"
+	mockWithdrawalRecipient = "0x00000000000000000000000000000000000000d0"
+)
+
+func (m *MockRPCClient) blockHash(block uint64) string {
+	fork := 0
+	if m.forkBlock > 0 && block >= m.forkBlock {
+		fork = m.fork
+	}
+	return fmt.Sprintf("0x%062x%02x", block, fork)
+}
+
 // Helper methods for configuring mock behavior
+
+// SetFork switches the chain to a new fork starting at block
+func (m *MockRPCClient) SetFork(block uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.forkBlock = block
+	m.fork++
+}
+
 func (m *MockRPCClient) SetMockResponse(blockNumber *big.Int, response []rpc.TransactionResult) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -435,6 +534,66 @@ func TestRangeProcessorReadRange(t *testing.T) {
 	})
 }
 
+func TestRangeProcessorAccessMode(t *testing.T) {
+	t.Run("defaults to state diff access mode", func(t *testing.T) {
+		rp, mockClient, _, cleanup := setupRangeProcessorTest(t)
+		defer cleanup()
+
+		require.NoError(t, rp.DownloadRange(context.Background(), 1))
+
+		rangeDiffs, err := rp.ReadRange(1)
+		require.NoError(t, err)
+		for _, diff := range rangeDiffs {
+			assert.Equal(t, rpc.AccessModeStateDiff, diff.AccessMode)
+		}
+		assert.Equal(t, 100, mockClient.GetCallCount("GetStateDiff"))
+		assert.Equal(t, 0, mockClient.GetCallCount("GetPrestate"))
+	})
+
+	t.Run("prestate mode records read-only accesses", func(t *testing.T) {
+		tempDir := t.TempDir()
+		mockClient := NewMockRPCClient()
+		rp, err := NewRangeProcessorWithAccessMode(tempDir, mockClient, 100, rpc.AccessModePrestate)
+		require.NoError(t, err)
+		defer rp.Close()
+
+		require.NoError(t, rp.DownloadRange(context.Background(), 1))
+		assert.Equal(t, 100, mockClient.GetCallCount("GetPrestate"))
+		assert.Equal(t, 0, mockClient.GetCallCount("GetStateDiff"))
+
+		rangeDiffs, err := rp.ReadRange(1)
+		require.NoError(t, err)
+		require.Len(t, rangeDiffs, 100)
+
+		first := rangeDiffs[0]
+		assert.Equal(t, rpc.AccessModePrestate, first.AccessMode)
+		require.Len(t, first.Diffs, 1)
+		diff := first.Diffs[0].StateDiff[fmt.Sprintf("0x%040d", 1)]
+		assert.True(t, diff.IsContract)
+		assert.Equal(t, []string{fmt.Sprintf("0x%064d", 1)}, diff.Storage)
+	})
+}
+
+func TestRangeProcessorProtocolAccesses(t *testing.T) {
+	rp, _, _, cleanup := setupRangeProcessorTest(t)
+	defer cleanup()
+
+	require.NoError(t, rp.DownloadRange(context.Background(), 1))
+
+	rangeDiffs, err := rp.ReadRange(1)
+	require.NoError(t, err)
+	require.Len(t, rangeDiffs, 100)
+
+	// Odd blocks only credit the fee recipient, even blocks also pay a withdrawal
+	assert.Equal(t, []rpc.ProtocolAccess{
+		{Address: mockCoinbase, Source: rpc.AccessSourceCoinbase},
+	}, rangeDiffs[0].Protocol)
+	assert.Equal(t, []rpc.ProtocolAccess{
+		{Address: mockCoinbase, Source: rpc.AccessSourceCoinbase},
+		{Address: mockWithdrawalRecipient, Source: rpc.AccessSourceWithdrawal},
+	}, rangeDiffs[1].Protocol)
+}
+
 func TestRangeProcessorEnsureRangeExists(t *testing.T) {
 	t.Run("ensure non-existent range", func(t *testing.T) {
 		rp, _, _, cleanup := setupRangeProcessorTest(t)
@@ -1,7 +1,9 @@
 package storage
 
 import (
+	"os"
 	"testing"
+	"time"
 )
 
 func TestRangeProcessor_GetRangeNumber(t *testing.T) {
@@ -58,7 +60,7 @@ func TestRangeProcessor_GetRangeBlockNumbers(t *testing.T) {
 func TestRangeProcessor_GetRangeFilePath(t *testing.T) {
 	// Create a range processor with range size 1000
 	rp := &RangeProcessor{
-		dataDir:   "/test/data",
+		backend:   NewLocalBackend("/test/data"),
 		rangeSize: 1000,
 	}
 
@@ -116,3 +118,41 @@ func TestRangeProcessor_DifferentRangeSize(t *testing.T) {
 		t.Errorf("GetRangeBlockNumbers(2) with range size 500 = (%d, %d), expected (501, 1000)", start, end)
 	}
 }
+
+func TestRangeProcessorRecover(t *testing.T) {
+	dir := t.TempDir()
+	rp, err := NewRangeProcessor(dir, nil, 100)
+	if err != nil {
+		t.Fatalf("Failed to create range processor: %v", err)
+	}
+	defer rp.Close()
+
+	rangeFile := rp.GetRangeFilePath(1)
+	tempFile := rangeFile + ".123.tmp"
+	inProgress := rp.GetRangeFilePath(2) + ".456.tmp"
+	stale := time.Now().Add(-time.Hour)
+	for _, path := range []string{rangeFile, tempFile, inProgress} {
+		if err := os.WriteFile(path, []byte("data"), 0o644); err != nil {
+			t.Fatalf("Failed to write %s: %v", path, err)
+		}
+		if path != inProgress {
+			if err := os.Chtimes(path, stale, stale); err != nil {
+				t.Fatalf("Failed to age %s: %v", path, err)
+			}
+		}
+	}
+
+	removed, err := rp.Recover()
+	if err != nil {
+		t.Fatalf("Recover failed: %v", err)
+	}
+	if len(removed) != 1 || removed[0] != tempFile {
+		t.Errorf("Expected to remove %s, removed %v", tempFile, removed)
+	}
+	if _, err := os.Stat(rangeFile); err != nil {
+		t.Errorf("Range file should be kept: %v", err)
+	}
+	if _, err := os.Stat(inProgress); err != nil {
+		t.Errorf("Temp file of a write in progress should be kept: %v", err)
+	}
+}
@@ -0,0 +1,162 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+)
+
+// RechunkResult summarizes the range files written by Rechunk
+type RechunkResult struct {
+	// Written is the number of range files written, Existing the number already stored
+	Written  int
+	Existing int
+	// Incomplete lists the ranges whose blocks are not all stored in the source files. They
+	// are not written.
+	Incomplete []uint64
+}
+
+// Rechunk streams the range files of from, which stores ranges of another size in the same
+// or another backend, into range files of the range size of rp. Only the blocks of one range
+// of the new size are held in memory. The blocks of every source file must be contiguous and
+// every range written must extend the stored chain. Ranges that are already stored are
+// skipped, so an interrupted run can be started again. written is called after every range
+// file written and may be nil.
+func (rp *RangeProcessor) Rechunk(ctx context.Context, from *RangeProcessor, written func(rangeNumber uint64)) (RechunkResult, error) {
+	if from.rangeSize == rp.rangeSize {
+		return RechunkResult{}, fmt.Errorf("range files are already stored in ranges of %d blocks", rp.rangeSize)
+	}
+
+	sources, err := from.ListRanges()
+	if err != nil {
+		return RechunkResult{}, err
+	}
+
+	r := &rechunker{rp: rp, written: written}
+	for _, sourceRange := range sources {
+		if err := ctx.Err(); err != nil {
+			return r.result, err
+		}
+
+		rangeFilePath := from.GetRangeFilePath(sourceRange)
+		start, end := from.GetRangeBlockNumbers(sourceRange)
+		next := start
+		err := from.StreamRange(sourceRange, func(block ReadRangeDiffs) error {
+			if block.BlockNum != next {
+				return fmt.Errorf("range file %s: expected block %d, found block %d", rangeFilePath, next, block.BlockNum)
+			}
+			next++
+			return r.add(block)
+		})
+		if err != nil {
+			return r.result, err
+		}
+		if next != end+1 {
+			return r.result, fmt.Errorf("range file %s ends at block %d, expected block %d", rangeFilePath, next-1, end)
+		}
+	}
+
+	if err := r.flush(); err != nil {
+		return r.result, err
+	}
+	return r.result, nil
+}
+
+// rechunker collects the blocks of one range of the new size at a time
+type rechunker struct {
+	rp      *RangeProcessor
+	written func(rangeNumber uint64)
+	result  RechunkResult
+
+	// current is the range blocks are collected for, 0 before the first block
+	current  uint64
+	existing bool
+	blocks   []ReadRangeDiffs
+}
+
+// add collects a block, writing the range collected so far once a block of the next range
+// arrives. Source files are read in ascending order, so block numbers only increase.
+func (r *rechunker) add(block ReadRangeDiffs) error {
+	rangeNumber := r.rp.rangeOf(block.BlockNum)
+	if rangeNumber != r.current {
+		if err := r.flush(); err != nil {
+			return err
+		}
+		r.current = rangeNumber
+		r.existing = r.rp.RangeExists(rangeNumber)
+	}
+	if !r.existing {
+		r.blocks = append(r.blocks, block)
+	}
+	return nil
+}
+
+// flush writes the range collected so far if the source files held all of its blocks
+func (r *rechunker) flush() error {
+	rangeNumber, blocks := r.current, r.blocks
+	r.current, r.blocks = 0, r.blocks[:0]
+
+	switch {
+	case rangeNumber == 0:
+		return nil
+	case r.existing:
+		r.result.Existing++
+		return nil
+	case len(blocks) != r.rp.rangeSize:
+		// A gap between source files, or the end of the stored ranges
+		r.result.Incomplete = append(r.result.Incomplete, rangeNumber)
+		return nil
+	}
+
+	rp := r.rp
+	start, end := rp.GetRangeBlockNumbers(rangeNumber)
+	if err := checkRangeBlocks(start, end, rp.AccessMode(), blocks); err != nil {
+		return fmt.Errorf("invalid range %d: %w", rangeNumber, err)
+	}
+	if err := rp.checkContinuity(rangeNumber, blocks[0]); err != nil {
+		return err
+	}
+	if err := rp.writeRange(rangeNumber, blocks); err != nil {
+		return err
+	}
+
+	r.result.Written++
+	if r.written != nil {
+		r.written(rangeNumber)
+	}
+	return nil
+}
+
+// DeleteRechunked deletes the range files of from whose blocks are all stored in intact range
+// files of rp, so the old range files can be removed once Rechunk has written the new ones
+func (rp *RangeProcessor) DeleteRechunked(from *RangeProcessor) (int, error) {
+	if from.rangeSize == rp.rangeSize {
+		return 0, fmt.Errorf("range files are already stored in ranges of %d blocks", rp.rangeSize)
+	}
+
+	sources, err := from.ListRanges()
+	if err != nil {
+		return 0, err
+	}
+
+	exists := make(map[uint64]bool)
+	deleted := 0
+	for _, sourceRange := range sources {
+		start, end := from.GetRangeBlockNumbers(sourceRange)
+		covered := true
+		for rangeNumber := rp.rangeOf(start); rangeNumber <= rp.rangeOf(end) && covered; rangeNumber++ {
+			if _, ok := exists[rangeNumber]; !ok {
+				exists[rangeNumber] = rp.RangeExists(rangeNumber)
+			}
+			covered = exists[rangeNumber]
+		}
+		if !covered {
+			continue
+		}
+
+		if err := from.DeleteRange(sourceRange); err != nil {
+			return deleted, fmt.Errorf("failed to delete range file %s: %w", from.GetRangeFilePath(sourceRange), err)
+		}
+		deleted++
+	}
+	return deleted, nil
+}
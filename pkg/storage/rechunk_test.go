@@ -0,0 +1,132 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/weiihann/state-expiry-indexer/pkg/rpc"
+)
+
+// newRechunkProcessors returns a range processor holding the given ranges of 100 blocks and a
+// range processor of rangeSize blocks over the same backend
+func newRechunkProcessors(t *testing.T, rangeSize int, ranges ...uint64) (*RangeProcessor, *RangeProcessor) {
+	from, err := NewRangeProcessor(t.TempDir(), NewMockRPCClient(), 100)
+	require.NoError(t, err)
+	t.Cleanup(from.Close)
+	for _, rangeNumber := range ranges {
+		require.NoError(t, from.DownloadRange(t.Context(), rangeNumber))
+	}
+
+	to, err := NewRangeProcessorWithBackend(from.Backend(), nil, rangeSize, rpc.AccessModeStateDiff)
+	require.NoError(t, err)
+	t.Cleanup(to.Close)
+	return from, to
+}
+
+// readBlocks reads every block of ranges in order
+func readBlocks(t *testing.T, rp *RangeProcessor, ranges ...uint64) []ReadRangeDiffs {
+	var blocks []ReadRangeDiffs
+	for _, rangeNumber := range ranges {
+		rangeDiffs, err := rp.ReadRange(rangeNumber)
+		require.NoError(t, err)
+		blocks = append(blocks, rangeDiffs...)
+	}
+	return blocks
+}
+
+func TestRangeProcessorRechunk(t *testing.T) {
+	t.Run("larger ranges", func(t *testing.T) {
+		from, to := newRechunkProcessors(t, 250, 1, 2, 3, 4, 5)
+
+		var written []uint64
+		result, err := to.Rechunk(t.Context(), from, func(rangeNumber uint64) {
+			written = append(written, rangeNumber)
+		})
+		require.NoError(t, err)
+		assert.Equal(t, RechunkResult{Written: 2}, result)
+		assert.Equal(t, []uint64{1, 2}, written)
+		assert.Equal(t, "251_500.json.zst", to.rangeFileName(2))
+
+		assert.Equal(t, readBlocks(t, from, 1, 2, 3, 4, 5), readBlocks(t, to, 1, 2))
+		for _, rangeNumber := range written {
+			_, err := to.VerifyRange(rangeNumber)
+			assert.NoError(t, err)
+		}
+
+		// The range files of both sizes are listed separately
+		ranges, err := from.ListRanges()
+		require.NoError(t, err)
+		assert.Len(t, ranges, 5)
+	})
+
+	t.Run("smaller ranges", func(t *testing.T) {
+		from, to := newRechunkProcessors(t, 30, 1, 2, 3)
+
+		result, err := to.Rechunk(t.Context(), from, nil)
+		require.NoError(t, err)
+		assert.Equal(t, 10, result.Written)
+		assert.Empty(t, result.Incomplete)
+		assert.Equal(t, readBlocks(t, from, 1, 2, 3), readBlocks(t, to, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10))
+	})
+
+	t.Run("ranges missing blocks are not written", func(t *testing.T) {
+		// Blocks 501-600 are missing from the third range of 250 blocks, and the fifth ends
+		// after the last stored block
+		from, to := newRechunkProcessors(t, 250, 1, 2, 3, 4, 5, 7, 8, 9, 10, 11)
+
+		result, err := to.Rechunk(t.Context(), from, nil)
+		require.NoError(t, err)
+		assert.Equal(t, RechunkResult{Written: 3, Incomplete: []uint64{3, 5}}, result)
+		assert.True(t, to.RangeExists(2))
+		assert.False(t, to.RangeExists(3))
+		assert.True(t, to.RangeExists(4))
+	})
+
+	t.Run("stored ranges are skipped", func(t *testing.T) {
+		from, to := newRechunkProcessors(t, 250, 1, 2, 3, 4, 5)
+		_, err := to.Rechunk(t.Context(), from, nil)
+		require.NoError(t, err)
+		require.NoError(t, to.DeleteRange(2))
+
+		result, err := to.Rechunk(t.Context(), from, nil)
+		require.NoError(t, err)
+		assert.Equal(t, RechunkResult{Written: 1, Existing: 1}, result)
+		_, err = to.VerifyRange(2)
+		assert.NoError(t, err)
+	})
+
+	t.Run("blocks missing in a range file", func(t *testing.T) {
+		from, to := newRechunkProcessors(t, 250, 1)
+		blocks, err := from.ReadRange(1)
+		require.NoError(t, err)
+		require.NoError(t, from.writeRange(2, blocks))
+
+		_, err = to.Rechunk(t.Context(), from, nil)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "expected block 101, found block 1")
+		assert.False(t, to.RangeExists(1))
+	})
+
+	t.Run("same range size", func(t *testing.T) {
+		from, to := newRechunkProcessors(t, 100, 1)
+		_, err := to.Rechunk(t.Context(), from, nil)
+		assert.ErrorContains(t, err, "already stored in ranges of 100 blocks")
+	})
+}
+
+func TestRangeProcessorDeleteRechunked(t *testing.T) {
+	from, to := newRechunkProcessors(t, 250, 1, 2, 3, 4)
+	result, err := to.Rechunk(t.Context(), from, nil)
+	require.NoError(t, err)
+	require.Equal(t, RechunkResult{Written: 1, Incomplete: []uint64{2}}, result)
+
+	// Range 3 also holds blocks 251-300, which are only stored in the old range files
+	deleted, err := to.DeleteRechunked(from)
+	require.NoError(t, err)
+	assert.Equal(t, 2, deleted)
+	ranges, err := from.ListRanges()
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{3, 4}, ranges)
+	assert.True(t, to.RangeExists(1))
+}
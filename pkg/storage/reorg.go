@@ -0,0 +1,234 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"regexp"
+	"strconv"
+
+	"github.com/weiihann/state-expiry-indexer/pkg/rpc"
+)
+
+const (
+	// maxHeaderRechecks is how many times blocks whose hash changed during a download are fetched again
+	maxHeaderRechecks = 3
+	// MaxReorgDepthRanges is how many range files FindForkPoint walks back before giving up
+	MaxReorgDepthRanges = 16
+)
+
+// rangeFilePattern matches compressed range file names ({start}_{end}.json.zst)
+var rangeFilePattern = regexp.MustCompile(`^(\d+)_(\d+)\.json\.zst$`)
+
+// ReorgError reports that a downloaded block does not build on the chain stored in the range files
+type ReorgError struct {
+	// Block is the first block whose parent hash does not match the stored hash of its parent
+	Block uint64
+	// StoredHash is the hash of the parent block stored in the range files
+	StoredHash string
+	// ParentHash is the parent hash reported by the node
+	ParentHash string
+}
+
+func (e *ReorgError) Error() string {
+	return fmt.Sprintf("chain reorganization detected at block %d: parent hash %s does not match stored hash %s",
+		e.Block, e.ParentHash, e.StoredHash)
+}
+
+// rangeTail is the hash of the last block of a range
+type rangeTail struct {
+	rangeNumber uint64
+	hash        string
+}
+
+func (rp *RangeProcessor) setTail(rangeNumber uint64, hash string) {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	rp.tail = rangeTail{rangeNumber: rangeNumber, hash: hash}
+}
+
+// tailHash returns the stored hash of the last block of a range, or "" if the range
+// file does not exist or was written before block hashes were stored
+func (rp *RangeProcessor) tailHash(rangeNumber uint64) (string, error) {
+	rp.mu.Lock()
+	tail := rp.tail
+	rp.mu.Unlock()
+	if tail.rangeNumber == rangeNumber && tail.hash != "" {
+		return tail.hash, nil
+	}
+
+	if !rp.RangeExists(rangeNumber) {
+		return "", nil
+	}
+	rangeDiffs, err := rp.ReadRange(rangeNumber)
+	if err != nil {
+		return "", err
+	}
+	if len(rangeDiffs) == 0 {
+		return "", nil
+	}
+	return rangeDiffs[len(rangeDiffs)-1].Hash, nil
+}
+
+// checkContinuity verifies that the first block of a range builds on the last block stored
+// in the previous range file
+func (rp *RangeProcessor) checkContinuity(rangeNumber uint64, first ReadRangeDiffs) error {
+	if rangeNumber <= 1 || first.ParentHash == "" {
+		return nil
+	}
+
+	storedHash, err := rp.tailHash(rangeNumber - 1)
+	if err != nil {
+		return fmt.Errorf("failed to read previous range %d: %w", rangeNumber-1, err)
+	}
+	if storedHash == "" || storedHash == first.ParentHash {
+		return nil
+	}
+
+	return &ReorgError{
+		Block:      first.BlockNum,
+		StoredHash: storedHash,
+		ParentHash: first.ParentHash,
+	}
+}
+
+// downloadBlocks fetches the state accesses and headers of consecutive blocks. Headers are
+// fetched before and after the state accesses, blocks whose hash changed in between were
+// reorganized during the download and are fetched again.
+func (rp *RangeProcessor) downloadBlocks(ctx context.Context, blocks []uint64) (map[uint64][]rpc.TransactionResult, map[uint64]*rpc.Head, error) {
+	headers, err := rp.rpcClient.GetBlockHeaders(ctx, blocks)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	results := make(map[uint64][]rpc.TransactionResult, len(blocks))
+	pending := blocks
+	for recheck := 0; len(pending) > 0; recheck++ {
+		if recheck > maxHeaderRechecks {
+			return nil, nil, fmt.Errorf("blocks %d-%d kept changing while downloading", pending[0], pending[len(pending)-1])
+		}
+
+		fetched, err := rpc.GetBlockAccessesBatch(ctx, rp.rpcClient, rp.AccessMode(), pending)
+		if err != nil {
+			return nil, nil, err
+		}
+		maps.Copy(results, fetched)
+
+		current, err := rp.rpcClient.GetBlockHeaders(ctx, blocks)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		pending = nil
+		for _, block := range blocks {
+			if current[block].Hash != headers[block].Hash {
+				pending = append(pending, block)
+			}
+		}
+		headers = current
+	}
+
+	return results, headers, nil
+}
+
+// checkChain verifies that every block builds on the one before it
+func checkChain(blocks []uint64, headers map[uint64]*rpc.Head) error {
+	for i := 1; i < len(blocks); i++ {
+		parent, child := headers[blocks[i-1]], headers[blocks[i]]
+		if child.ParentHash != parent.Hash {
+			return fmt.Errorf("block %d does not build on block %d: parent hash %s, stored hash %s",
+				blocks[i], blocks[i-1], child.ParentHash, parent.Hash)
+		}
+	}
+	return nil
+}
+
+// FindForkPoint walks back from rangeNumber through the stored range files and returns the
+// first block whose stored hash differs from the node's canonical chain. If every stored
+// block is canonical the first block after rangeNumber is returned. Blocks stored without
+// a hash cannot be checked and are assumed to be canonical.
+func (rp *RangeProcessor) FindForkPoint(ctx context.Context, rangeNumber uint64) (uint64, error) {
+	_, end := rp.GetRangeBlockNumbers(rangeNumber)
+	forkBlock := end + 1
+
+	for current := rangeNumber; current >= 1; current-- {
+		if rangeNumber-current >= MaxReorgDepthRanges {
+			return 0, fmt.Errorf("reorg is deeper than %d ranges, last checked block %d", MaxReorgDepthRanges, forkBlock)
+		}
+		if !rp.RangeExists(current) {
+			break
+		}
+
+		stored, err := rp.ReadRange(current)
+		if err != nil {
+			return 0, fmt.Errorf("failed to read range %d: %w", current, err)
+		}
+
+		blocks := make([]uint64, 0, len(stored))
+		for _, block := range stored {
+			if block.Hash != "" {
+				blocks = append(blocks, block.BlockNum)
+			}
+		}
+		if len(blocks) == 0 {
+			break
+		}
+
+		canonical, err := rp.rpcClient.GetBlockHeaders(ctx, blocks)
+		if err != nil {
+			var batchErr *rpc.BatchError
+			if errors.As(err, &batchErr) {
+				return 0, fmt.Errorf("failed to fetch header of block %d: %w", batchErr.FirstFailed(), err)
+			}
+			return 0, fmt.Errorf("failed to fetch headers of range %d: %w", current, err)
+		}
+
+		mismatch := uint64(0)
+		for _, block := range stored {
+			if block.Hash != "" && block.Hash != canonical[block.BlockNum].Hash {
+				mismatch = block.BlockNum
+				break
+			}
+		}
+		if mismatch == 0 {
+			break
+		}
+
+		forkBlock = mismatch
+		if start, _ := rp.GetRangeBlockNumbers(current); mismatch > start {
+			break
+		}
+	}
+
+	return forkBlock, nil
+}
+
+// DeleteRangesFrom deletes every range file that contains blocks at or after block,
+// so they are downloaded again. It returns the number of deleted files.
+func (rp *RangeProcessor) DeleteRangesFrom(block uint64) (int, error) {
+	files, err := ListRangeFiles(rp.backend)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read data directory: %w", err)
+	}
+
+	deleted := 0
+	for _, file := range files {
+		match := rangeFilePattern.FindStringSubmatch(file.Name)
+		if match == nil {
+			continue
+		}
+		end, err := strconv.ParseUint(match[2], 10, 64)
+		if err != nil || end < block {
+			continue
+		}
+
+		if err := rp.backend.Delete(file.Name); err != nil {
+			return deleted, fmt.Errorf("failed to delete range file %s: %w", rp.backend.Location(file.Name), err)
+		}
+		deleted++
+	}
+
+	rp.setTail(0, "")
+	return deleted, nil
+}
@@ -0,0 +1,130 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/weiihann/state-expiry-indexer/pkg/rpc"
+)
+
+// forkingClient switches to a new fork starting at forkBlock during the first batch of state diffs
+type forkingClient struct {
+	*MockRPCClient
+	forkBlock uint64
+	once      sync.Once
+}
+
+func (f *forkingClient) GetStateDiffs(ctx context.Context, blocks []uint64) (map[uint64][]rpc.TransactionResult, error) {
+	results, err := f.MockRPCClient.GetStateDiffs(ctx, blocks)
+	f.once.Do(func() { f.MockRPCClient.SetFork(f.forkBlock) })
+	return results, err
+}
+
+func TestRangeProcessorBlockHashes(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("stores hash and parent hash of every block", func(t *testing.T) {
+		rp, mockClient, _, cleanup := setupRangeProcessorTest(t)
+		defer cleanup()
+
+		require.NoError(t, rp.DownloadRange(ctx, 1))
+
+		rangeDiffs, err := rp.ReadRange(1)
+		require.NoError(t, err)
+		require.Len(t, rangeDiffs, 100)
+		for _, block := range rangeDiffs {
+			assert.Equal(t, mockClient.blockHash(block.BlockNum), block.Hash)
+			assert.Equal(t, mockClient.blockHash(block.BlockNum-1), block.ParentHash)
+		}
+	})
+
+	t.Run("detects a reorg below the previous range", func(t *testing.T) {
+		rp, mockClient, _, cleanup := setupRangeProcessorTest(t)
+		defer cleanup()
+
+		require.NoError(t, rp.DownloadRange(ctx, 1))
+		require.NoError(t, rp.DownloadRange(ctx, 2))
+
+		// Blocks 180 and later are replaced, range 3 no longer builds on the stored range 2
+		mockClient.SetFork(180)
+		err := rp.DownloadRange(ctx, 3)
+
+		var reorgErr *ReorgError
+		require.ErrorAs(t, err, &reorgErr)
+		assert.Equal(t, uint64(201), reorgErr.Block)
+		assert.False(t, rp.RangeExists(3), "a range that does not build on the stored chain must not be written")
+
+		forkBlock, err := rp.FindForkPoint(ctx, 2)
+		require.NoError(t, err)
+		assert.Equal(t, uint64(180), forkBlock)
+	})
+
+	t.Run("finds a fork point across ranges", func(t *testing.T) {
+		rp, mockClient, _, cleanup := setupRangeProcessorTest(t)
+		defer cleanup()
+
+		for rangeNumber := uint64(1); rangeNumber <= 3; rangeNumber++ {
+			require.NoError(t, rp.DownloadRange(ctx, rangeNumber))
+		}
+
+		mockClient.SetFork(101)
+		forkBlock, err := rp.FindForkPoint(ctx, 3)
+		require.NoError(t, err)
+		assert.Equal(t, uint64(101), forkBlock)
+	})
+
+	t.Run("returns the next block when the stored chain is canonical", func(t *testing.T) {
+		rp, _, _, cleanup := setupRangeProcessorTest(t)
+		defer cleanup()
+
+		require.NoError(t, rp.DownloadRange(ctx, 1))
+
+		forkBlock, err := rp.FindForkPoint(ctx, 1)
+		require.NoError(t, err)
+		assert.Equal(t, uint64(101), forkBlock)
+	})
+
+	t.Run("downloads blocks reorganized during the download again", func(t *testing.T) {
+		tempDir := t.TempDir()
+		mockClient := &forkingClient{MockRPCClient: NewMockRPCClient(), forkBlock: 50}
+		rp, err := NewRangeProcessor(tempDir, mockClient, 100)
+		require.NoError(t, err)
+		defer rp.Close()
+
+		require.NoError(t, rp.DownloadRange(ctx, 1))
+
+		// Blocks 50-100 were fetched twice, once on each fork
+		assert.Equal(t, 151, mockClient.GetCallCount("GetStateDiff"))
+
+		rangeDiffs, err := rp.ReadRange(1)
+		require.NoError(t, err)
+		for _, block := range rangeDiffs {
+			assert.Equal(t, mockClient.blockHash(block.BlockNum), block.Hash)
+		}
+	})
+}
+
+func TestRangeProcessorDeleteRangesFrom(t *testing.T) {
+	rp, _, tempDir, cleanup := setupRangeProcessorTest(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	for rangeNumber := uint64(1); rangeNumber <= 3; rangeNumber++ {
+		require.NoError(t, rp.DownloadRange(ctx, rangeNumber))
+	}
+	require.NoError(t, os.WriteFile(tempDir+"/150.json", []byte("[]"), 0o644))
+
+	deleted, err := rp.DeleteRangesFrom(150)
+	require.NoError(t, err)
+	assert.Equal(t, 2, deleted)
+
+	assert.True(t, rp.RangeExists(1))
+	assert.False(t, rp.RangeExists(2))
+	assert.False(t, rp.RangeExists(3))
+	assert.FileExists(t, tempDir+"/150.json", "per-block files are left alone")
+}
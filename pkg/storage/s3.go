@@ -0,0 +1,415 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// emptyPayloadHash is the SHA-256 of an empty request body
+	emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	s3Timeout        = 5 * time.Minute
+)
+
+// S3Config configures the S3 compatible object store used for s3:// data directories
+type S3Config struct {
+	// Endpoint is the URL of the object store, such as http://localhost:9000 for MinIO.
+	// Empty selects AWS S3 in Region.
+	Endpoint string
+	// Region is the region requests are signed for
+	Region string
+	// AccessKeyID and SecretAccessKey sign requests. Without them requests are anonymous,
+	// which is enough to read public buckets.
+	AccessKeyID     string
+	SecretAccessKey string
+}
+
+// S3Backend stores files as objects below a prefix of an S3 compatible bucket. Objects are
+// addressed path style (endpoint/bucket/key), which every S3 compatible store supports, and
+// requests are signed with AWS Signature Version 4. A PUT replaces an object atomically.
+type S3Backend struct {
+	client   *http.Client
+	endpoint *url.URL
+	bucket   string
+	prefix   string
+	config   S3Config
+	now      func() time.Time
+}
+
+// Ensure S3Backend implements Backend
+var _ Backend = (*S3Backend)(nil)
+
+// NewS3Backend returns a backend storing files below prefix in bucket
+func NewS3Backend(bucket, prefix string, config S3Config) (*S3Backend, error) {
+	if bucket == "" {
+		return nil, fmt.Errorf("S3 bucket is required")
+	}
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+	if config.Endpoint == "" {
+		config.Endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", config.Region)
+	}
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid S3 endpoint %q", config.Endpoint)
+	}
+
+	return &S3Backend{
+		client:   &http.Client{Timeout: s3Timeout},
+		endpoint: endpoint,
+		bucket:   bucket,
+		prefix:   strings.Trim(prefix, "/"),
+		config:   config,
+		now:      time.Now,
+	}, nil
+}
+
+// key returns the object key of a file
+func (b *S3Backend) key(name string) string {
+	if b.prefix == "" {
+		return name
+	}
+	return b.prefix + "/" + name
+}
+
+func (b *S3Backend) Save(name string, data []byte) error {
+	resp, err := b.do(http.MethodPut, b.key(name), nil, nil, data)
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", b.Location(name), err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Open checks that the object exists. The content is fetched on the first Read, ReadAt fetches
+// only the requested bytes.
+func (b *S3Backend) Open(name string) (File, error) {
+	info, err := b.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return &s3File{backend: b, name: name, size: info.Size}, nil
+}
+
+func (b *S3Backend) Stat(name string) (FileInfo, error) {
+	resp, err := b.do(http.MethodHead, b.key(name), nil, nil, nil)
+	if err != nil {
+		return FileInfo{}, fmt.Errorf("failed to stat %s: %w", b.Location(name), err)
+	}
+	resp.Body.Close()
+
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return FileInfo{Name: name, Size: resp.ContentLength, ModTime: modTime}, nil
+}
+
+// List pages through ListObjectsV2 results
+func (b *S3Backend) List(prefix string) ([]FileInfo, error) {
+	var files []FileInfo
+	query := url.Values{"list-type": {"2"}, "prefix": {b.key(prefix)}}
+	if prefix == "" && b.prefix != "" {
+		query.Set("prefix", b.prefix+"/")
+	}
+
+	for {
+		resp, err := b.do(http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list %s: %w", b.Location(prefix), err)
+		}
+		var result listBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode listing of %s: %w", b.Location(prefix), err)
+		}
+
+		for _, object := range result.Contents {
+			name := object.Key
+			if b.prefix != "" {
+				name = strings.TrimPrefix(name, b.prefix+"/")
+			}
+			files = append(files, FileInfo{Name: name, Size: object.Size, ModTime: object.LastModified})
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+
+	slices.SortFunc(files, func(a, b FileInfo) int { return strings.Compare(a.Name, b.Name) })
+	return files, nil
+}
+
+// Rename copies the object server side and deletes the original
+func (b *S3Backend) Rename(oldName, newName string) error {
+	header := http.Header{"X-Amz-Copy-Source": {uriEncode(path.Join("/", b.bucket, b.key(oldName)), false)}}
+	resp, err := b.do(http.MethodPut, b.key(newName), nil, header, nil)
+	if err != nil {
+		return fmt.Errorf("failed to copy %s to %s: %w", b.Location(oldName), b.Location(newName), err)
+	}
+	resp.Body.Close()
+	return b.Delete(oldName)
+}
+
+func (b *S3Backend) Delete(name string) error {
+	resp, err := b.do(http.MethodDelete, b.key(name), nil, nil, nil)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to delete %s: %w", b.Location(name), err)
+	}
+	if resp != nil {
+		resp.Body.Close()
+	}
+	return nil
+}
+
+func (b *S3Backend) Location(name string) string {
+	return "s3://" + path.Join(b.bucket, b.key(name))
+}
+
+// listBucketResult is the part of a ListObjectsV2 response the backend reads
+type listBucketResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// s3Error is an error response of the object store
+type s3Error struct {
+	Status  int
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("S3 request failed with status %d", e.Status)
+	}
+	return fmt.Sprintf("S3 request failed with status %d: %s: %s", e.Status, e.Code, e.Message)
+}
+
+// Is matches fs.ErrNotExist for missing objects
+func (e *s3Error) Is(target error) bool {
+	return target == fs.ErrNotExist && e.Status == http.StatusNotFound
+}
+
+// do sends a signed request for an object key, or for the bucket if key is empty. Responses
+// other than 2xx are returned as errors and their body is closed.
+func (b *S3Backend) do(method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	u := *b.endpoint
+	u.Path = path.Join("/", b.endpoint.Path, b.bucket, key)
+	if key == "" {
+		u.Path += "/"
+	}
+	u.RawPath = ""
+	u.RawQuery = canonicalQuery(query)
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	b.sign(req, body)
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+
+	defer resp.Body.Close()
+	s3Err := &s3Error{Status: resp.StatusCode}
+	if method != http.MethodHead {
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		xml.Unmarshal(data, s3Err)
+	}
+	return nil, s3Err
+}
+
+// sign adds AWS Signature Version 4 headers to a request. Anonymous backends send requests unsigned.
+func (b *S3Backend) sign(req *http.Request, body []byte) {
+	payloadHash := emptyPayloadHash
+	if len(body) > 0 {
+		sum := sha256.Sum256(body)
+		payloadHash = hex.EncodeToString(sum[:])
+	}
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	if b.config.AccessKeyID == "" {
+		return
+	}
+
+	now := b.now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	req.Header.Set("x-amz-date", amzDate)
+
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", now.Format("20060102"), b.config.Region)
+	signedHeaders, canonicalRequest := canonicalRequest(req, payloadHash)
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, sha256Hex([]byte(canonicalRequest))}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+b.config.SecretAccessKey), now.Format("20060102"))
+	key = hmacSHA256(key, b.config.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		b.config.AccessKeyID, scope, signedHeaders, signature))
+}
+
+// canonicalRequest returns the signed header list and the canonical form of a request.
+// The host and every x-amz-* header are signed.
+func canonicalRequest(req *http.Request, payloadHash string) (string, string) {
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	return signedHeaders, strings.Join([]string{
+		req.Method,
+		uriEncode(req.URL.Path, false),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+}
+
+// canonicalQuery encodes query parameters sorted by name, as Signature Version 4 requires
+func canonicalQuery(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	var parts []string
+	for _, name := range names {
+		values := slices.Clone(query[name])
+		slices.Sort(values)
+		for _, value := range values {
+			parts = append(parts, uriEncode(name, true)+"="+uriEncode(value, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// uriEncode percent-encodes everything but unreserved characters. Slashes are kept in paths.
+func uriEncode(s string, encodeSlash bool) string {
+	var out strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			out.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			out.WriteByte(c)
+		default:
+			fmt.Fprintf(&out, "%%%02X", c)
+		}
+	}
+	return out.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// s3File reads an object. Read streams the object from the first byte, ReadAt issues a
+// ranged GET for every call.
+type s3File struct {
+	backend *S3Backend
+	name    string
+	size    int64
+	body    io.ReadCloser
+}
+
+func (f *s3File) Read(p []byte) (int, error) {
+	if f.body == nil {
+		resp, err := f.backend.do(http.MethodGet, f.backend.key(f.name), nil, nil, nil)
+		if err != nil {
+			return 0, fmt.Errorf("failed to read %s: %w", f.backend.Location(f.name), err)
+		}
+		f.body = resp.Body
+	}
+	return f.body.Read(p)
+}
+
+func (f *s3File) ReadAt(p []byte, off int64) (int, error) {
+	if off >= f.size {
+		return 0, io.EOF
+	}
+	end := min(off+int64(len(p)), f.size) - 1
+	header := http.Header{"Range": {"bytes=" + strconv.FormatInt(off, 10) + "-" + strconv.FormatInt(end, 10)}}
+
+	resp, err := f.backend.do(http.MethodGet, f.backend.key(f.name), nil, header, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read %s: %w", f.backend.Location(f.name), err)
+	}
+	defer resp.Body.Close()
+
+	n, err := io.ReadFull(resp.Body, p[:end-off+1])
+	if err != nil {
+		return n, err
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *s3File) Size() int64 {
+	return f.size
+}
+
+func (f *s3File) Close() error {
+	if f.body == nil {
+		return nil
+	}
+	return f.body.Close()
+}
@@ -0,0 +1,288 @@
+// Package s3test provides an in-memory server that stands in for an S3 compatible object store
+// such as MinIO, answering the requests made by the S3 storage backend.
+package s3test
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Options configures the server
+type Options struct {
+	// AccessKeyID and SecretAccessKey, when set, are the only credentials accepted. Requests
+	// must carry a valid AWS Signature Version 4.
+	AccessKeyID     string
+	SecretAccessKey string
+	// MaxKeys caps the objects returned by one list request, 1000 if zero
+	MaxKeys int
+}
+
+type object struct {
+	data    []byte
+	modTime time.Time
+}
+
+// Server implements PUT (with copies), GET (with byte ranges), HEAD and DELETE of objects and
+// ListObjectsV2 with path style addressing
+type Server struct {
+	options Options
+
+	mu       sync.Mutex
+	buckets  map[string]map[string]object
+	requests map[string]int
+}
+
+// Ensure Server can be mounted as an HTTP handler
+var _ http.Handler = (*Server)(nil)
+
+// NewServer returns a server holding the given buckets, all empty
+func NewServer(options Options, buckets ...string) *Server {
+	s := &Server{
+		options:  options,
+		buckets:  make(map[string]map[string]object),
+		requests: make(map[string]int),
+	}
+	for _, bucket := range buckets {
+		s.buckets[bucket] = make(map[string]object)
+	}
+	return s
+}
+
+// Object returns the content of an object
+func (s *Server) Object(bucket, key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	obj, ok := s.buckets[bucket][key]
+	return obj.data, ok
+}
+
+// Keys returns the keys of a bucket in ascending order
+func (s *Server) Keys(bucket string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := make([]string, 0, len(s.buckets[bucket]))
+	for key := range s.buckets[bucket] {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// Requests returns how many requests with the given method were served
+func (s *Server) Requests(method string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[method]
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+		return
+	}
+	if err := s.authenticate(r, body); err != nil {
+		writeError(w, http.StatusForbidden, "SignatureDoesNotMatch", err.Error())
+		return
+	}
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests[r.Method]++
+
+	objects, ok := s.buckets[bucket]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist")
+		return
+	}
+
+	if key == "" {
+		if r.Method != http.MethodGet || r.URL.Query().Get("list-type") != "2" {
+			writeError(w, http.StatusNotImplemented, "NotImplemented", "Only ListObjectsV2 is supported on buckets")
+			return
+		}
+		s.list(w, r.URL.Query(), objects)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		if source := r.Header.Get("X-Amz-Copy-Source"); source != "" {
+			s.copy(w, objects, key, source)
+			return
+		}
+		objects[key] = object{data: body, modTime: time.Now().UTC().Truncate(time.Second)}
+		w.WriteHeader(http.StatusOK)
+	case http.MethodGet, http.MethodHead:
+		obj, ok := objects[key]
+		if !ok {
+			writeError(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist")
+			return
+		}
+		// ServeContent answers HEAD and Range requests
+		http.ServeContent(w, r, key, obj.modTime, bytes.NewReader(obj.data))
+	case http.MethodDelete:
+		delete(objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", r.Method+" is not supported")
+	}
+}
+
+type listContent struct {
+	Key          string    `xml:"Key"`
+	Size         int       `xml:"Size"`
+	LastModified time.Time `xml:"LastModified"`
+}
+
+type listResult struct {
+	XMLName               xml.Name      `xml:"ListBucketResult"`
+	Prefix                string        `xml:"Prefix"`
+	KeyCount              int           `xml:"KeyCount"`
+	IsTruncated           bool          `xml:"IsTruncated"`
+	NextContinuationToken string        `xml:"NextContinuationToken,omitempty"`
+	Contents              []listContent `xml:"Contents"`
+}
+
+// list answers ListObjectsV2. The continuation token is the last key of the previous page.
+func (s *Server) list(w http.ResponseWriter, query url.Values, objects map[string]object) {
+	prefix := query.Get("prefix")
+	after := query.Get("continuation-token")
+	maxKeys := s.options.MaxKeys
+	if maxKeys <= 0 {
+		maxKeys = 1000
+	}
+	if n, err := strconv.Atoi(query.Get("max-keys")); err == nil && n > 0 && n < maxKeys {
+		maxKeys = n
+	}
+
+	var keys []string
+	for key := range objects {
+		if strings.HasPrefix(key, prefix) && key > after {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+
+	result := listResult{Prefix: prefix}
+	if len(keys) > maxKeys {
+		keys = keys[:maxKeys]
+		result.IsTruncated = true
+		result.NextContinuationToken = keys[len(keys)-1]
+	}
+	for _, key := range keys {
+		obj := objects[key]
+		result.Contents = append(result.Contents, listContent{Key: key, Size: len(obj.data), LastModified: obj.modTime})
+	}
+	result.KeyCount = len(result.Contents)
+
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(result)
+}
+
+// copy answers CopyObject requests into objects, source is /bucket/key
+func (s *Server) copy(w http.ResponseWriter, objects map[string]object, key, source string) {
+	source, err := url.PathUnescape(source)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "InvalidArgument", err.Error())
+		return
+	}
+	sourceBucket, sourceKey, _ := strings.Cut(strings.TrimPrefix(source, "/"), "/")
+	obj, ok := s.buckets[sourceBucket][sourceKey]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist")
+		return
+	}
+
+	obj.modTime = time.Now().UTC().Truncate(time.Second)
+	objects[key] = obj
+	w.Header().Set("Content-Type", "application/xml")
+	fmt.Fprintf(w, "<CopyObjectResult><LastModified>%s</LastModified></CopyObjectResult>", obj.modTime.Format(time.RFC3339))
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "%s<Error><Code>%s</Code><Message>%s</Message></Error>", xml.Header, code, message)
+}
+
+// authenticate checks the Signature Version 4 of a request when credentials are configured
+func (s *Server) authenticate(r *http.Request, body []byte) error {
+	if s.options.AccessKeyID == "" {
+		return nil
+	}
+
+	auth := r.Header.Get("Authorization")
+	fields := map[string]string{}
+	algorithm, params, _ := strings.Cut(auth, " ")
+	if algorithm != "AWS4-HMAC-SHA256" {
+		return fmt.Errorf("unsupported authorization %q", algorithm)
+	}
+	for _, param := range strings.Split(params, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+		fields[name] = value
+	}
+
+	credential := strings.Split(fields["Credential"], "/")
+	if len(credential) != 5 || credential[0] != s.options.AccessKeyID {
+		return fmt.Errorf("unknown credential %q", fields["Credential"])
+	}
+	date, region := credential[1], credential[2]
+
+	sum := sha256.Sum256(body)
+	if hash := r.Header.Get("x-amz-content-sha256"); hash != hex.EncodeToString(sum[:]) {
+		return fmt.Errorf("payload hash %q does not match the body", hash)
+	}
+
+	var canonicalHeaders strings.Builder
+	signedHeaders := strings.Split(fields["SignedHeaders"], ";")
+	for _, name := range signedHeaders {
+		value := r.Header.Get(name)
+		if name == "host" {
+			value = r.Host
+		}
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+
+	canonicalRequest := strings.Join([]string{
+		r.Method,
+		r.URL.EscapedPath(),
+		r.URL.RawQuery,
+		canonicalHeaders.String(),
+		fields["SignedHeaders"],
+		r.Header.Get("x-amz-content-sha256"),
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	scope := strings.Join(credential[1:], "/")
+	stringToSign := "AWS4-HMAC-SHA256\n" + r.Header.Get("x-amz-date") + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + s.options.SecretAccessKey)
+	for _, part := range []string{date, region, "s3", "aws4_request"} {
+		key = sign(key, part)
+	}
+	if signature := hex.EncodeToString(sign(key, stringToSign)); !hmac.Equal([]byte(signature), []byte(fields["Signature"])) {
+		return fmt.Errorf("signature does not match")
+	}
+	return nil
+}
+
+func sign(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
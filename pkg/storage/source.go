@@ -0,0 +1,230 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"strconv"
+
+	"github.com/weiihann/state-expiry-indexer/pkg/rpc"
+	"github.com/weiihann/state-expiry-indexer/pkg/utils"
+)
+
+// ErrRangeUnavailable is returned by a RangeSource that does not have a range
+var ErrRangeUnavailable = errors.New("range not available")
+
+// RangeSource supplies the blocks of ranges that are not stored in a range file yet
+type RangeSource interface {
+	// Name identifies the source in logs and configuration
+	Name() string
+	// FetchRange returns every block from start to end of a range in ascending order, start and
+	// end are the bounds of the range or, for FetchBlocks, a part of it. A source that does not
+	// have every block returns an error wrapping ErrRangeUnavailable.
+	FetchRange(ctx context.Context, rangeNumber, start, end uint64) ([]ReadRangeDiffs, error)
+}
+
+// Range source names used in configuration
+const (
+	SourceBlockFiles = "blocks"
+	SourceMirror     = "mirror"
+	SourceRPC        = "rpc"
+)
+
+// SetSources sets the sources EnsureRangeExists takes missing ranges from, in the order they
+// are tried. Ranges stored in a range file are always used first. The default is RPC only.
+func (rp *RangeProcessor) SetSources(sources ...RangeSource) {
+	rp.sources = sources
+}
+
+// SetSourceFunc sets a function called by EnsureRangeExists after every source it tried, with
+// the error of the source or nil if the range was taken from it
+func (rp *RangeProcessor) SetSourceFunc(fn func(rangeNumber uint64, source string, err error)) {
+	rp.sourceFunc = fn
+}
+
+// checkRangeBlocks verifies that blocks holds every block from start to end in order, collected
+// with accessMode, and that each block builds on the one before it where hashes are known
+func checkRangeBlocks(start, end uint64, accessMode rpc.AccessMode, blocks []ReadRangeDiffs) error {
+	if uint64(len(blocks)) != end-start+1 {
+		return fmt.Errorf("expected %d blocks, got %d", end-start+1, len(blocks))
+	}
+	for i, block := range blocks {
+		if block.BlockNum != start+uint64(i) {
+			return fmt.Errorf("expected block %d, found block %d", start+uint64(i), block.BlockNum)
+		}
+		if block.AccessMode != accessMode {
+			return fmt.Errorf("block %d was collected in %s mode, expected %s", block.BlockNum, block.AccessMode, accessMode)
+		}
+		if i > 0 && block.ParentHash != "" && blocks[i-1].Hash != "" && block.ParentHash != blocks[i-1].Hash {
+			return fmt.Errorf("block %d does not build on block %d", block.BlockNum, block.BlockNum-1)
+		}
+	}
+	return nil
+}
+
+// rpcSource downloads ranges through the RPC client of a range processor
+type rpcSource struct {
+	rp *RangeProcessor
+}
+
+// RPCSource returns the source that downloads ranges through RPC, with the download workers
+// and progress function of the range processor
+func (rp *RangeProcessor) RPCSource() RangeSource {
+	return rpcSource{rp: rp}
+}
+
+func (s rpcSource) Name() string {
+	return SourceRPC
+}
+
+func (s rpcSource) FetchRange(ctx context.Context, rangeNumber, start, end uint64) ([]ReadRangeDiffs, error) {
+	rp := s.rp
+	if rp.rpcClient == nil {
+		return nil, fmt.Errorf("no RPC client: %w", ErrRangeUnavailable)
+	}
+
+	blocks := make([]uint64, 0, end-start+1)
+	for blockNum := start; blockNum <= end; blockNum++ {
+		blocks = append(blocks, blockNum)
+	}
+
+	// Download state accesses and headers for every block in the range with batched calls
+	results, headers, err := rp.fetchRange(ctx, rangeNumber, blocks)
+	if err != nil {
+		var batchErr *rpc.BatchError
+		if errors.As(err, &batchErr) {
+			blockNum := batchErr.FirstFailed()
+			return nil, fmt.Errorf("failed to download block %d: %w", blockNum, batchErr.Failed[blockNum])
+		}
+		return nil, fmt.Errorf("failed to download range %d: %w", rangeNumber, err)
+	}
+
+	rangeDiffs := make([]ReadRangeDiffs, 0, len(blocks))
+	for _, blockNum := range blocks {
+		diffs, err := toReadDiffs(results[blockNum])
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal range data of block %d: %w", blockNum, err)
+		}
+		rangeDiffs = append(rangeDiffs, ReadRangeDiffs{
+			BlockNum:   blockNum,
+			Hash:       headers[blockNum].Hash,
+			ParentHash: headers[blockNum].ParentHash,
+			AccessMode: rp.AccessMode(),
+			Diffs:      diffs,
+			Protocol:   headers[blockNum].ProtocolAccesses(),
+		})
+	}
+	return rangeDiffs, nil
+}
+
+// BlockFileSource assembles ranges from the per-block {block}.json and {block}.json.zst state
+// diff files written by the RPC caller. The files hold no headers: with a header client, block
+// hashes and the accounts touched outside of transactions are taken from block headers, which
+// are much cheaper than tracing the blocks again. Without one those are left empty.
+type BlockFileSource struct {
+	backend      Backend
+	headers      rpc.ClientInterface
+	accessMode   rpc.AccessMode
+	dictionaries [][]byte
+}
+
+// Ensure BlockFileSource implements RangeSource
+var _ RangeSource = (*BlockFileSource)(nil)
+
+// NewBlockFileSource returns a source reading per-block files collected with accessMode from
+// backend. headers may be nil.
+func NewBlockFileSource(backend Backend, headers rpc.ClientInterface, accessMode rpc.AccessMode) *BlockFileSource {
+	return &BlockFileSource{backend: backend, headers: headers, accessMode: accessMode}
+}
+
+// SetDictionaries sets the zstd dictionaries compressed block files may be compressed with
+func (s *BlockFileSource) SetDictionaries(dictionaries [][]byte) {
+	s.dictionaries = dictionaries
+}
+
+func (s *BlockFileSource) Name() string {
+	return SourceBlockFiles
+}
+
+func (s *BlockFileSource) FetchRange(ctx context.Context, rangeNumber, start, end uint64) ([]ReadRangeDiffs, error) {
+	blocks := make([]uint64, 0, end-start+1)
+	rangeDiffs := make([]ReadRangeDiffs, 0, end-start+1)
+	for blockNum := start; blockNum <= end; blockNum++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		results, err := s.readBlock(blockNum)
+		if err != nil {
+			return nil, err
+		}
+		diffs, err := toReadDiffs(results)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal range data of block %d: %w", blockNum, err)
+		}
+		blocks = append(blocks, blockNum)
+		rangeDiffs = append(rangeDiffs, ReadRangeDiffs{
+			BlockNum:   blockNum,
+			AccessMode: s.accessMode,
+			Diffs:      diffs,
+		})
+	}
+
+	if s.headers == nil {
+		return rangeDiffs, nil
+	}
+	headers, err := s.headers.GetBlockHeaders(ctx, blocks)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download headers of range %d: %w", rangeNumber, err)
+	}
+	if err := checkChain(blocks, headers); err != nil {
+		return nil, err
+	}
+	for i := range rangeDiffs {
+		header := headers[rangeDiffs[i].BlockNum]
+		rangeDiffs[i].Hash = header.Hash
+		rangeDiffs[i].ParentHash = header.ParentHash
+		rangeDiffs[i].Protocol = header.ProtocolAccesses()
+	}
+	return rangeDiffs, nil
+}
+
+// readBlock reads the state diff file of a block, uncompressed or compressed
+func (s *BlockFileSource) readBlock(blockNum uint64) ([]rpc.TransactionResult, error) {
+	name := strconv.FormatUint(blockNum, 10) + ".json"
+
+	data, err := ReadFile(s.backend, name)
+	if errors.Is(err, fs.ErrNotExist) {
+		data, err = s.readCompressed(name + ".zst")
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("no state diff file for block %d: %w", blockNum, ErrRangeUnavailable)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state diff file of block %d: %w", blockNum, err)
+	}
+
+	var results []rpc.TransactionResult
+	if err := json.Unmarshal(data, &results); err != nil {
+		return nil, fmt.Errorf("failed to parse state diff file of block %d: %w", blockNum, err)
+	}
+	return results, nil
+}
+
+func (s *BlockFileSource) readCompressed(name string) ([]byte, error) {
+	file, err := s.backend.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	zstdReader, err := utils.NewZstdStreamReaderWithOptions(file, utils.ZstdOptions{Dictionaries: s.dictionaries})
+	if err != nil {
+		return nil, err
+	}
+	defer zstdReader.Close()
+	return io.ReadAll(zstdReader)
+}
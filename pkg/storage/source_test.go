@@ -0,0 +1,242 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/weiihann/state-expiry-indexer/pkg/rpc"
+	"github.com/weiihann/state-expiry-indexer/pkg/utils"
+)
+
+// writeBlockFiles writes the per-block state diff files the RPC caller would write for blocks
+// start to end, compressing every other block
+func writeBlockFiles(t *testing.T, backend Backend, start, end uint64) {
+	encoder, err := utils.NewZstdEncoder()
+	require.NoError(t, err)
+	defer encoder.Close()
+
+	node := NewMockRPCClient()
+	for block := start; block <= end; block++ {
+		results, err := node.GetStateDiff(t.Context(), new(big.Int).SetUint64(block))
+		require.NoError(t, err)
+		data, err := json.MarshalIndent(results, "", "  ")
+		require.NoError(t, err)
+
+		name := fmt.Sprintf("%d.json", block)
+		if block%2 == 0 {
+			data, err = encoder.Compress(data)
+			require.NoError(t, err)
+			name += ".zst"
+		}
+		require.NoError(t, backend.Save(name, data))
+	}
+}
+
+// serveMirror serves the range files of a range processor
+func serveMirror(t *testing.T, rp *RangeProcessor) *httptest.Server {
+	server := httptest.NewServer(rp.MirrorHandler())
+	t.Cleanup(server.Close)
+	return server
+}
+
+type sourceAttempt struct {
+	source string
+	err    error
+}
+
+func newSourceProcessor(t *testing.T, node rpc.ClientInterface) (*RangeProcessor, *[]sourceAttempt) {
+	rp, err := NewRangeProcessor(t.TempDir(), node, 100)
+	require.NoError(t, err)
+	t.Cleanup(rp.Close)
+
+	var attempts []sourceAttempt
+	rp.SetSourceFunc(func(rangeNumber uint64, source string, err error) {
+		attempts = append(attempts, sourceAttempt{source: source, err: err})
+	})
+	return rp, &attempts
+}
+
+func TestRangeSources(t *testing.T) {
+	t.Run("ranges are assembled from block files", func(t *testing.T) {
+		node := NewMockRPCClient()
+		rp, attempts := newSourceProcessor(t, node)
+		writeBlockFiles(t, rp.Backend(), 1, 200)
+		rp.SetSources(NewBlockFileSource(rp.Backend(), node, rp.AccessMode()), rp.RPCSource())
+
+		require.NoError(t, rp.EnsureRangeExists(t.Context(), 1))
+		require.NoError(t, rp.EnsureRangeExists(t.Context(), 2))
+		assert.Zero(t, node.GetCallCount("GetStateDiff"), "no block is traced again")
+		assert.Equal(t, []sourceAttempt{{SourceBlockFiles, nil}, {SourceBlockFiles, nil}}, *attempts)
+
+		// The assembled range matches the range downloaded through RPC, headers included
+		downloaded, _ := newSourceProcessor(t, NewMockRPCClient())
+		require.NoError(t, downloaded.DownloadRange(t.Context(), 2))
+		want, err := downloaded.ReadRange(2)
+		require.NoError(t, err)
+		got, err := rp.ReadRange(2)
+		require.NoError(t, err)
+		assert.Equal(t, want, got)
+		_, err = rp.VerifyRange(2)
+		assert.NoError(t, err)
+	})
+
+	t.Run("block files without headers", func(t *testing.T) {
+		rp, _ := newSourceProcessor(t, nil)
+		writeBlockFiles(t, rp.Backend(), 1, 100)
+		rp.SetSources(NewBlockFileSource(rp.Backend(), nil, rp.AccessMode()))
+
+		require.NoError(t, rp.EnsureRangeExists(t.Context(), 1))
+		rangeDiffs, err := rp.ReadRange(1)
+		require.NoError(t, err)
+		require.Len(t, rangeDiffs, 100)
+		assert.Empty(t, rangeDiffs[0].Hash)
+		assert.Len(t, rangeDiffs[0].Diffs, 1)
+	})
+
+	t.Run("incomplete block files fall back to RPC", func(t *testing.T) {
+		node := NewMockRPCClient()
+		rp, attempts := newSourceProcessor(t, node)
+		writeBlockFiles(t, rp.Backend(), 1, 99)
+		rp.SetSources(NewBlockFileSource(rp.Backend(), node, rp.AccessMode()), rp.RPCSource())
+
+		require.NoError(t, rp.EnsureRangeExists(t.Context(), 1))
+		assert.Equal(t, 100, node.GetCallCount("GetStateDiff"))
+		require.Len(t, *attempts, 2)
+		assert.ErrorIs(t, (*attempts)[0].err, ErrRangeUnavailable)
+		assert.Contains(t, (*attempts)[0].err.Error(), "block 100")
+		assert.Equal(t, sourceAttempt{SourceRPC, nil}, (*attempts)[1])
+	})
+
+	t.Run("ranges are downloaded from a mirror", func(t *testing.T) {
+		upstream, _ := newSourceProcessor(t, NewMockRPCClient())
+		require.NoError(t, upstream.DownloadRange(t.Context(), 1))
+		mirror, err := NewMirrorSource(serveMirror(t, upstream).URL + "/")
+		require.NoError(t, err)
+
+		node := NewMockRPCClient()
+		rp, attempts := newSourceProcessor(t, node)
+		rp.SetSources(mirror, rp.RPCSource())
+
+		require.NoError(t, rp.EnsureRangeExists(t.Context(), 1))
+		assert.Zero(t, node.GetCallCount("GetStateDiff"))
+		want, err := upstream.ReadRange(1)
+		require.NoError(t, err)
+		got, err := rp.ReadRange(1)
+		require.NoError(t, err)
+		assert.Equal(t, want, got)
+
+		// The mirror does not have range 2 yet
+		require.NoError(t, rp.EnsureRangeExists(t.Context(), 2))
+		assert.Equal(t, 100, node.GetCallCount("GetStateDiff"))
+		require.Len(t, *attempts, 3)
+		assert.ErrorIs(t, (*attempts)[1].err, ErrRangeUnavailable)
+		assert.Equal(t, sourceAttempt{SourceRPC, nil}, (*attempts)[2])
+	})
+
+	t.Run("a failing source is skipped", func(t *testing.T) {
+		broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("not a range file"))
+		}))
+		defer broken.Close()
+		mirror, err := NewMirrorSource(broken.URL)
+		require.NoError(t, err)
+
+		rp, attempts := newSourceProcessor(t, NewMockRPCClient())
+		rp.SetSources(mirror, rp.RPCSource())
+
+		require.NoError(t, rp.EnsureRangeExists(t.Context(), 1))
+		require.Len(t, *attempts, 2)
+		assert.Error(t, (*attempts)[0].err)
+		assert.NotErrorIs(t, (*attempts)[0].err, ErrRangeUnavailable)
+		assert.NoError(t, (*attempts)[1].err)
+	})
+
+	t.Run("invalid ranges are rejected", func(t *testing.T) {
+		upstream, err := NewRangeProcessorWithAccessMode(t.TempDir(), NewMockRPCClient(), 100, rpc.AccessModePrestate)
+		require.NoError(t, err)
+		defer upstream.Close()
+		require.NoError(t, upstream.DownloadRange(t.Context(), 1))
+		mirror, err := NewMirrorSource(serveMirror(t, upstream).URL)
+		require.NoError(t, err)
+
+		rp, _ := newSourceProcessor(t, nil)
+		rp.SetSources(mirror)
+
+		err = rp.EnsureRangeExists(t.Context(), 1)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "collected in prestate mode")
+		assert.False(t, rp.RangeExists(1))
+	})
+
+	t.Run("no source has the range", func(t *testing.T) {
+		rp, attempts := newSourceProcessor(t, nil)
+		writeBlockFiles(t, rp.Backend(), 1, 10)
+		rp.SetSources(NewBlockFileSource(rp.Backend(), nil, rp.AccessMode()), rp.RPCSource())
+
+		err := rp.EnsureRangeExists(t.Context(), 1)
+		assert.ErrorIs(t, err, ErrRangeUnavailable)
+		assert.Len(t, *attempts, 2)
+	})
+
+	t.Run("cancellation stops the chain", func(t *testing.T) {
+		rp, attempts := newSourceProcessor(t, NewMockRPCClient())
+		rp.SetSources(NewBlockFileSource(rp.Backend(), nil, rp.AccessMode()), rp.RPCSource())
+
+		ctx, cancel := context.WithCancel(t.Context())
+		cancel()
+		assert.ErrorIs(t, rp.EnsureRangeExists(ctx, 1), context.Canceled)
+		assert.Len(t, *attempts, 1)
+	})
+}
+
+func TestFetchBlocks(t *testing.T) {
+	upstream, _ := newSourceProcessor(t, NewMockRPCClient())
+	require.NoError(t, upstream.DownloadRange(t.Context(), 2))
+	mirror, err := NewMirrorSource(serveMirror(t, upstream).URL)
+	require.NoError(t, err)
+
+	node := NewMockRPCClient()
+	rp, _ := newSourceProcessor(t, node)
+	require.NoError(t, rp.DownloadRange(t.Context(), 1))
+	writeBlockFiles(t, rp.Backend(), 101, 120)
+	rp.SetSources(mirror, NewBlockFileSource(rp.Backend(), node, rp.AccessMode()), rp.RPCSource())
+
+	t.Run("blocks are taken from block files", func(t *testing.T) {
+		traced := node.GetCallCount("GetStateDiff")
+		blocks, err := rp.FetchBlocks(t.Context(), 2, 101, 110)
+		require.NoError(t, err)
+		require.Len(t, blocks, 10)
+		assert.Equal(t, uint64(101), blocks[0].BlockNum)
+		assert.Equal(t, node.blockHash(110), blocks[9].Hash)
+		assert.Equal(t, traced, node.GetCallCount("GetStateDiff"))
+		assert.False(t, rp.RangeExists(2), "no range file is written")
+	})
+
+	t.Run("blocks without files are downloaded", func(t *testing.T) {
+		traced := node.GetCallCount("GetStateDiff")
+		blocks, err := rp.FetchBlocks(t.Context(), 2, 115, 130)
+		require.NoError(t, err)
+		require.Len(t, blocks, 16)
+		assert.Equal(t, uint64(130), blocks[15].BlockNum)
+		assert.Equal(t, traced+16, node.GetCallCount("GetStateDiff"))
+	})
+
+	t.Run("blocks starting a range must build on the previous range", func(t *testing.T) {
+		node.SetFork(90)
+		_, err := rp.FetchBlocks(t.Context(), 2, 101, 110)
+		var reorgErr *ReorgError
+		require.ErrorAs(t, err, &reorgErr)
+		assert.Equal(t, uint64(101), reorgErr.Block)
+
+		// Later blocks are checked by the caller, which knows the blocks it indexed before
+		_, err = rp.FetchBlocks(t.Context(), 2, 111, 120)
+		assert.NoError(t, err)
+	})
+}
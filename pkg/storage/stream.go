@@ -0,0 +1,541 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/weiihann/state-expiry-indexer/pkg/rpc"
+	"github.com/weiihann/state-expiry-indexer/pkg/utils"
+)
+
+// streamBufferSize is how much decompressed data StreamRange reads ahead
+const streamBufferSize = 64 * 1024
+
+// StreamRange decodes a range file in either format one block at a time and calls fn with each block in order.
+// Only the block passed to fn is held in memory. An error returned by fn stops the stream and is
+// returned as is.
+func (rp *RangeProcessor) StreamRange(rangeNumber uint64, fn func(ReadRangeDiffs) error) error {
+	if rangeNumber == 0 {
+		return fmt.Errorf("cannot read genesis as range, use genesis processing instead")
+	}
+
+	rangeFilePath := rp.GetRangeFilePath(rangeNumber)
+	file, err := rp.backend.Open(rp.rangeFileName(rangeNumber))
+	if err != nil {
+		return fmt.Errorf("failed to read range file %s: %w", rangeFilePath, err)
+	}
+	defer file.Close()
+
+	zstdReader, err := utils.NewZstdStreamReader(file)
+	if err != nil {
+		return fmt.Errorf("failed to decompress range file %s: %w", rangeFilePath, err)
+	}
+	defer zstdReader.Close()
+
+	decoder, _, err := newBlockDecoder(bufio.NewReaderSize(decompressReader{zstdReader}, streamBufferSize))
+	if err != nil {
+		return rangeStreamError(rangeFilePath, err)
+	}
+
+	var lastHash string
+	for {
+		block, err := decoder.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return rangeStreamError(rangeFilePath, err)
+		}
+
+		// Range files written before access modes existed only contain state diffs
+		if block.AccessMode == "" {
+			block.AccessMode = rpc.AccessModeStateDiff
+		}
+		lastHash = block.Hash
+
+		if err := fn(block); err != nil {
+			return err
+		}
+	}
+
+	if lastHash != "" {
+		rp.setTail(rangeNumber, lastHash)
+	}
+
+	return nil
+}
+
+// rangeStreamError reports whether a range file failed to decompress or to decode
+func rangeStreamError(rangeFilePath string, err error) error {
+	var decompressErr *decompressError
+	if errors.As(err, &decompressErr) {
+		return fmt.Errorf("failed to decompress range file %s: %w", rangeFilePath, decompressErr.err)
+	}
+	return fmt.Errorf("failed to decode range file %s: %w", rangeFilePath, err)
+}
+
+// decompressError marks a failure of the compressed stream, as opposed to malformed JSON in it
+type decompressError struct {
+	err error
+}
+
+func (e *decompressError) Error() string { return e.err.Error() }
+func (e *decompressError) Unwrap() error { return e.err }
+
+type decompressReader struct {
+	r io.Reader
+}
+
+func (r decompressReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF {
+		err = &decompressError{err: err}
+	}
+	return n, err
+}
+
+// rangeDecoder reads the JSON array of a range file one block at a time. It understands just
+// enough JSON to pick out the fields the indexer uses: balances, nonces, storage values and
+// trace output are stepped over byte by byte without being allocated.
+type rangeDecoder struct {
+	r      *bufio.Reader
+	offset int64
+
+	// str holds the most recently read string, it is overwritten by the next one
+	str []byte
+	// raw collects the bytes of a value while recording is set
+	raw       []byte
+	recording bool
+
+	started bool
+	done    bool
+}
+
+func newRangeDecoder(r io.Reader, bufferSize int) *rangeDecoder {
+	return &rangeDecoder{r: bufio.NewReaderSize(r, bufferSize)}
+}
+
+// next decodes the next block of the range, it returns io.EOF after the last block
+func (d *rangeDecoder) next() (ReadRangeDiffs, error) {
+	if d.done {
+		return ReadRangeDiffs{}, io.EOF
+	}
+
+	if !d.started {
+		d.started = true
+		if err := d.expect('['); err != nil {
+			return ReadRangeDiffs{}, err
+		}
+		c, err := d.peek()
+		if err != nil {
+			return ReadRangeDiffs{}, err
+		}
+		if c == ']' {
+			d.done = true
+			return ReadRangeDiffs{}, io.EOF
+		}
+	} else {
+		c, err := d.readToken()
+		if err != nil {
+			return ReadRangeDiffs{}, err
+		}
+		if c == ']' {
+			d.done = true
+			return ReadRangeDiffs{}, io.EOF
+		}
+		if c != ',' {
+			return ReadRangeDiffs{}, d.syntaxError(c, "',' or ']' after block")
+		}
+	}
+
+	var block ReadRangeDiffs
+	if err := d.decodeBlock(&block); err != nil {
+		return ReadRangeDiffs{}, err
+	}
+	return block, nil
+}
+
+func (d *rangeDecoder) decodeBlock(block *ReadRangeDiffs) error {
+	return d.object(func(key []byte) error {
+		switch string(key) {
+		case "blockNum":
+			return d.unmarshal(&block.BlockNum)
+		case "hash":
+			return d.unmarshal(&block.Hash)
+		case "parentHash":
+			return d.unmarshal(&block.ParentHash)
+		case "accessMode":
+			return d.unmarshal(&block.AccessMode)
+		case "protocol":
+			return d.unmarshal(&block.Protocol)
+		case "diffs":
+			block.Diffs = []ReadDiffs{}
+			return d.array(func() error {
+				var diffs ReadDiffs
+				err := d.object(func(key []byte) error {
+					if string(key) != "stateDiff" {
+						return d.skipValue()
+					}
+					diffs.StateDiff = make(map[string]Diff)
+					return d.object(func(key []byte) error {
+						addr := string(key)
+						var diff Diff
+						if err := d.decodeDiff(&diff); err != nil {
+							return err
+						}
+						diffs.StateDiff[addr] = diff
+						return nil
+					})
+				})
+				block.Diffs = append(block.Diffs, diffs)
+				return err
+			})
+		default:
+			return d.skipValue()
+		}
+	})
+}
+
+// decodeDiff decodes an account entry with the same rules as Diff.UnmarshalJSON
+func (d *rangeDecoder) decodeDiff(diff *Diff) error {
+	*diff = Diff{}
+	return d.object(func(key []byte) error {
+		switch string(key) {
+		case "code":
+			return d.decodeCode(diff)
+		case "storage":
+			c, err := d.peek()
+			if err != nil {
+				return err
+			}
+			if c != '{' {
+				return d.skipValue()
+			}
+			return d.object(func(slot []byte) error {
+				diff.Storage = append(diff.Storage, string(slot))
+				diff.IsContract = true
+				return d.skipValue()
+			})
+		default:
+			return d.skipValue()
+		}
+	})
+}
+
+// decodeCode marks the account as a contract if its code changed (stateDiff) or is non-empty (prestate)
+func (d *rangeDecoder) decodeCode(diff *Diff) error {
+	c, err := d.peek()
+	if err != nil {
+		return err
+	}
+	switch c {
+	case '{':
+		return d.object(func(key []byte) error {
+			if string(key) == "*" {
+				diff.IsContract = true
+			}
+			return d.skipValue()
+		})
+	case '"':
+		code, err := d.readString()
+		if err != nil {
+			return err
+		}
+		if len(code) > 2 && bytes.HasPrefix(code, []byte("0x")) {
+			diff.IsContract = true
+		}
+		return nil
+	default:
+		return d.skipValue()
+	}
+}
+
+// object calls fn with each key of an object, fn must consume the value. The key is only
+// valid until the next string is read. null is treated as an empty object.
+func (d *rangeDecoder) object(fn func(key []byte) error) error {
+	c, err := d.peek()
+	if err != nil {
+		return err
+	}
+	if c == 'n' {
+		return d.skipValue()
+	}
+	if err := d.expect('{'); err != nil {
+		return err
+	}
+
+	if c, err = d.peek(); err != nil {
+		return err
+	}
+	if c == '}' {
+		_, err := d.readByte()
+		return err
+	}
+
+	for {
+		key, err := d.readString()
+		if err != nil {
+			return err
+		}
+		if err := d.expect(':'); err != nil {
+			return err
+		}
+		if err := fn(key); err != nil {
+			return err
+		}
+
+		c, err := d.readToken()
+		if err != nil {
+			return err
+		}
+		if c == '}' {
+			return nil
+		}
+		if c != ',' {
+			return d.syntaxError(c, "',' or '}' in object")
+		}
+	}
+}
+
+// array calls fn for each element of an array, fn must consume the element.
+// null is treated as an empty array.
+func (d *rangeDecoder) array(fn func() error) error {
+	c, err := d.peek()
+	if err != nil {
+		return err
+	}
+	if c == 'n' {
+		return d.skipValue()
+	}
+	if err := d.expect('['); err != nil {
+		return err
+	}
+
+	if c, err = d.peek(); err != nil {
+		return err
+	}
+	if c == ']' {
+		_, err := d.readByte()
+		return err
+	}
+
+	for {
+		if err := fn(); err != nil {
+			return err
+		}
+
+		c, err := d.readToken()
+		if err != nil {
+			return err
+		}
+		if c == ']' {
+			return nil
+		}
+		if c != ',' {
+			return d.syntaxError(c, "',' or ']' in array")
+		}
+	}
+}
+
+// unmarshal decodes the next value into v with encoding/json, for small fields only
+func (d *rangeDecoder) unmarshal(v any) error {
+	if _, err := d.peek(); err != nil {
+		return err
+	}
+
+	d.raw = d.raw[:0]
+	d.recording = true
+	err := d.skipValue()
+	d.recording = false
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(d.raw, v); err != nil {
+		return fmt.Errorf("invalid value at offset %d: %w", d.offset, err)
+	}
+	return nil
+}
+
+// readString reads a string value. The returned bytes are only valid until the next string is read.
+func (d *rangeDecoder) readString() ([]byte, error) {
+	if err := d.expect('"'); err != nil {
+		return nil, err
+	}
+
+	d.str = d.str[:0]
+	escaped := false
+	for {
+		c, err := d.readByte()
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case c == '\\':
+			escaped = true
+			d.str = append(d.str, c)
+			// The escaped character is kept as is, including an escaped quote
+			c, err = d.readByte()
+			if err != nil {
+				return nil, err
+			}
+			d.str = append(d.str, c)
+		case c == '"':
+			if !escaped {
+				return d.str, nil
+			}
+			// Escapes never appear in the data written by DownloadRange, decode them the slow way
+			var s string
+			if err := json.Unmarshal(append(append([]byte{'"'}, d.str...), '"'), &s); err != nil {
+				return nil, fmt.Errorf("invalid string at offset %d: %w", d.offset, err)
+			}
+			d.str = append(d.str[:0], s...)
+			return d.str, nil
+		default:
+			d.str = append(d.str, c)
+		}
+	}
+}
+
+// skipValue consumes the next value without decoding it
+func (d *rangeDecoder) skipValue() error {
+	c, err := d.readToken()
+	if err != nil {
+		return err
+	}
+
+	switch c {
+	case '"':
+		return d.skipString()
+	case '{', '[':
+		depth := 1
+		for depth > 0 {
+			c, err := d.readByte()
+			if err != nil {
+				return err
+			}
+			switch c {
+			case '"':
+				if err := d.skipString(); err != nil {
+					return err
+				}
+			case '{', '[':
+				depth++
+			case '}', ']':
+				depth--
+			}
+		}
+		return nil
+	case '}', ']', ',', ':':
+		return d.syntaxError(c, "value")
+	default:
+		// Numbers and literals run until the next delimiter
+		for {
+			next, err := d.r.Peek(1)
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			switch next[0] {
+			case ',', '}', ']', ' ', '\t', '\n', '\r':
+				return nil
+			}
+			if _, err := d.readByte(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// skipString consumes the rest of a string whose opening quote was already read
+func (d *rangeDecoder) skipString() error {
+	for {
+		c, err := d.readByte()
+		if err != nil {
+			return err
+		}
+		switch c {
+		case '\\':
+			if _, err := d.readByte(); err != nil {
+				return err
+			}
+		case '"':
+			return nil
+		}
+	}
+}
+
+// expect consumes the next non-whitespace byte, which must be c
+func (d *rangeDecoder) expect(c byte) error {
+	got, err := d.readToken()
+	if err != nil {
+		return err
+	}
+	if got != c {
+		return d.syntaxError(got, fmt.Sprintf("'%c'", c))
+	}
+	return nil
+}
+
+// peek returns the next non-whitespace byte without consuming it
+func (d *rangeDecoder) peek() (byte, error) {
+	for {
+		next, err := d.r.Peek(1)
+		if err != nil {
+			return 0, d.eofError(err)
+		}
+		if !isSpace(next[0]) {
+			return next[0], nil
+		}
+		if _, err := d.readByte(); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// readToken consumes and returns the next non-whitespace byte
+func (d *rangeDecoder) readToken() (byte, error) {
+	for {
+		c, err := d.readByte()
+		if err != nil {
+			return 0, err
+		}
+		if !isSpace(c) {
+			return c, nil
+		}
+	}
+}
+
+func (d *rangeDecoder) readByte() (byte, error) {
+	c, err := d.r.ReadByte()
+	if err != nil {
+		return 0, d.eofError(err)
+	}
+	d.offset++
+	if d.recording {
+		d.raw = append(d.raw, c)
+	}
+	return c, nil
+}
+
+// eofError turns the end of the stream into an error, a range file never ends mid-value
+func (d *rangeDecoder) eofError(err error) error {
+	if err == io.EOF {
+		return fmt.Errorf("unexpected end of range data at offset %d: %w", d.offset, io.ErrUnexpectedEOF)
+	}
+	return err
+}
+
+func (d *rangeDecoder) syntaxError(got byte, want string) error {
+	return fmt.Errorf("invalid character %q at offset %d, expected %s", got, d.offset, want)
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
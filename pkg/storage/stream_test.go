@@ -0,0 +1,255 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/weiihann/state-expiry-indexer/pkg/rpc"
+	"github.com/weiihann/state-expiry-indexer/pkg/utils"
+)
+
+// writeRangeFile compresses raw JSON into the file of a range
+func writeRangeFile(t testing.TB, rp *RangeProcessor, rangeNumber uint64, data []byte) {
+	compressed, err := rp.encoder.Compress(data)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(rp.GetRangeFilePath(rangeNumber), compressed, 0o644))
+}
+
+// decodeAll runs the streaming decoder over raw JSON
+func decodeAll(data string) ([]ReadRangeDiffs, error) {
+	decoder := newRangeDecoder(strings.NewReader(data), 16)
+	var blocks []ReadRangeDiffs
+	for {
+		block, err := decoder.next()
+		if err == io.EOF {
+			return blocks, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, block)
+	}
+}
+
+func TestRangeDecoder(t *testing.T) {
+	t.Run("skips values the indexer does not use", func(t *testing.T) {
+		blocks, err := decodeAll(`[
+			{
+				"blockNum": 7,
+				"hash": "0x07",
+				"parentHash": "0x06",
+				"accessMode": "prestate",
+				"extra": {"nested": [1, 2.5e3, true, null, "x\"]}"]},
+				"diffs": [
+					{
+						"output": "0x",
+						"trace": [],
+						"transactionHash": "0xaa",
+						"vmTrace": null,
+						"stateDiff": {
+							"0x01": {
+								"balance": {"*": {"from": "0x0", "to": "0x100"}},
+								"code": "=",
+								"nonce": {"+": "0x1"},
+								"storage": {
+									"0x02": {"*": {"from": "0x0", "to": "0x1"}},
+									"0x01": {"+": "0x1"}
+								}
+							},
+							"0x03": {"balance": "0x1", "nonce": 12, "code": "0x6080"},
+							"0x04": {"code": {"*": {"from": "0x", "to": "0x60"}}},
+							"0x05": {"code": "0x", "storage": {}}
+						}
+					},
+					{"stateDiff": null}
+				],
+				"protocol": [{"address": "0xc0", "source": "coinbase"}]
+			},
+			{"blockNum": 8, "diffs": null}
+		]`)
+		require.NoError(t, err)
+		require.Len(t, blocks, 2)
+
+		assert.Equal(t, ReadRangeDiffs{
+			BlockNum:   7,
+			Hash:       "0x07",
+			ParentHash: "0x06",
+			AccessMode: rpc.AccessModePrestate,
+			Diffs: []ReadDiffs{
+				{StateDiff: map[string]Diff{
+					"0x01": {Storage: []string{"0x02", "0x01"}, IsContract: true},
+					"0x03": {IsContract: true},
+					"0x04": {IsContract: true},
+					"0x05": {},
+				}},
+				{StateDiff: map[string]Diff{}},
+			},
+			Protocol: []rpc.ProtocolAccess{{Address: "0xc0", Source: rpc.AccessSourceCoinbase}},
+		}, blocks[0])
+		assert.Equal(t, uint64(8), blocks[1].BlockNum)
+		assert.Empty(t, blocks[1].Diffs)
+	})
+
+	t.Run("decodes escaped keys", func(t *testing.T) {
+		blocks, err := decodeAll(`[{"blockNum": 1, "diffs": [{"stateDiff": {"0xa": {"storage": {"\"k\"": "0x1"}}}}]}]`)
+		require.NoError(t, err)
+		assert.Equal(t, []string{`"k"`}, blocks[0].Diffs[0].StateDiff["0xa"].Storage)
+	})
+
+	t.Run("empty range", func(t *testing.T) {
+		blocks, err := decodeAll(" [ ] ")
+		require.NoError(t, err)
+		assert.Empty(t, blocks)
+	})
+
+	t.Run("malformed data", func(t *testing.T) {
+		for _, data := range []string{
+			``,
+			`{}`,
+			`[{"blockNum": 1`,
+			`[{"blockNum": 1}`,
+			`[{"blockNum": 1} {"blockNum": 2}]`,
+			`[{"blockNum": "one"}]`,
+			`[{"diffs": [{"stateDiff": {"0x01": {"storage": {"0x01": }}}}]}]`,
+		} {
+			_, err := decodeAll(data)
+			assert.Error(t, err, "decoding %q should fail", data)
+		}
+	})
+}
+
+func TestRangeProcessorStreamRange(t *testing.T) {
+	t.Run("yields blocks in order", func(t *testing.T) {
+		rp, _, _, cleanup := setupRangeProcessorTest(t)
+		defer cleanup()
+		require.NoError(t, rp.DownloadRange(t.Context(), 2))
+
+		var blockNums []uint64
+		err := rp.StreamRange(2, func(block ReadRangeDiffs) error {
+			blockNums = append(blockNums, block.BlockNum)
+			assert.Equal(t, rpc.AccessModeStateDiff, block.AccessMode)
+			return nil
+		})
+		require.NoError(t, err)
+		require.Len(t, blockNums, 100)
+		assert.Equal(t, uint64(101), blockNums[0])
+		assert.Equal(t, uint64(200), blockNums[99])
+	})
+
+	t.Run("callback error stops the stream", func(t *testing.T) {
+		rp, _, _, cleanup := setupRangeProcessorTest(t)
+		defer cleanup()
+		require.NoError(t, rp.DownloadRange(t.Context(), 1))
+
+		stop := errors.New("stop")
+		calls := 0
+		err := rp.StreamRange(1, func(block ReadRangeDiffs) error {
+			calls++
+			return stop
+		})
+		assert.Same(t, stop, err)
+		assert.Equal(t, 1, calls)
+	})
+
+	t.Run("truncated range file", func(t *testing.T) {
+		rp, _, _, cleanup := setupRangeProcessorTest(t)
+		defer cleanup()
+		writeRangeFile(t, rp, 1, []byte(`[{"blockNum": 1, "diffs": []}, {"blockNum": 2, "di`))
+
+		calls := 0
+		err := rp.StreamRange(1, func(block ReadRangeDiffs) error {
+			calls++
+			return nil
+		})
+		assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+		assert.Contains(t, err.Error(), "failed to decode range file")
+		assert.Equal(t, 1, calls, "Blocks before the damage are still delivered")
+	})
+
+	t.Run("missing range file", func(t *testing.T) {
+		rp, _, _, cleanup := setupRangeProcessorTest(t)
+		defer cleanup()
+
+		err := rp.StreamRange(1, func(block ReadRangeDiffs) error { return nil })
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+}
+
+// benchmarkRangeJSON builds a range of blocks shaped like trace_replayBlockTransactions output
+func benchmarkRangeJSON(blocks, txs int) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("[")
+	for b := range blocks {
+		if b > 0 {
+			buf.WriteString(",")
+		}
+		fmt.Fprintf(&buf, `{"blockNum":%d,"hash":"0x%064x","parentHash":"0x%064x","accessMode":"stateDiff","diffs":[`, b+1, b+1, b)
+		for tx := range txs {
+			if tx > 0 {
+				buf.WriteString(",")
+			}
+			fmt.Fprintf(&buf, `{"output":"0x","stateDiff":{`+
+				`"0x%040x":{"balance":{"*":{"from":"0x693c124a2b710860c0","to":"0x693c19c01bcb0fa0c0"}},"code":"=","nonce":{"*":{"from":"0x1","to":"0x2"}},"storage":{}},`+
+				`"0x%040x":{"balance":"=","code":"=","nonce":"=","storage":{"0x%064x":{"*":{"from":"0x%064x","to":"0x%064x"}}}}`+
+				`},"trace":[],"transactionHash":"0x%064x","vmTrace":null}`, tx, tx+1<<20, tx, b, tx, tx)
+		}
+		buf.WriteString("]}")
+	}
+	buf.WriteString("]")
+	return buf.Bytes()
+}
+
+func BenchmarkReadRange(b *testing.B) {
+	rp, err := NewRangeProcessor(b.TempDir(), NewMockRPCClient(), 100)
+	require.NoError(b, err)
+	defer rp.Close()
+
+	data := benchmarkRangeJSON(100, 150)
+	writeRangeFile(b, rp, 1, data)
+
+	b.Run("encoding/json", func(b *testing.B) {
+		b.SetBytes(int64(len(data)))
+		b.ReportAllocs()
+		for b.Loop() {
+			compressed, err := os.ReadFile(rp.GetRangeFilePath(1))
+			require.NoError(b, err)
+			decompressed, err := utils.NewZstdDecoder()
+			require.NoError(b, err)
+			raw, err := decompressed.Decompress(compressed)
+			require.NoError(b, err)
+			decompressed.Close()
+			var rangeDiffs []ReadRangeDiffs
+			require.NoError(b, json.Unmarshal(raw, &rangeDiffs))
+		}
+	})
+
+	b.Run("StreamRange", func(b *testing.B) {
+		b.SetBytes(int64(len(data)))
+		b.ReportAllocs()
+		for b.Loop() {
+			require.NoError(b, rp.StreamRange(1, func(ReadRangeDiffs) error { return nil }))
+		}
+	})
+
+	// The same range converted, SetBytes stays the JSON size so MB/s compare directly
+	writeRangeFile(b, rp, 2, data)
+	_, err = rp.ConvertRange(2)
+	require.NoError(b, err)
+
+	b.Run("StreamRange binary", func(b *testing.B) {
+		b.SetBytes(int64(len(data)))
+		b.ReportAllocs()
+		for b.Loop() {
+			require.NoError(b, rp.StreamRange(2, func(ReadRangeDiffs) error { return nil }))
+		}
+	})
+}
@@ -1,52 +1,34 @@
 package storage
 
 import (
-	"encoding/json"
+	"bytes"
+
+	"github.com/weiihann/state-expiry-indexer/pkg/rpc"
 )
 
 type ReadRangeDiffs struct {
-	BlockNum uint64
-	Diffs    []ReadDiffs `json:"diffs"`
+	BlockNum   uint64
+	Hash       string               `json:"hash"`
+	ParentHash string               `json:"parentHash"`
+	AccessMode rpc.AccessMode       `json:"accessMode"`
+	Diffs      []ReadDiffs          `json:"diffs"`
+	Protocol   []rpc.ProtocolAccess `json:"protocol"`
 }
 
 type ReadDiffs struct {
 	StateDiff map[string]Diff `json:"stateDiff"`
 }
 
+// Diff holds the parts of an account entry the indexer needs. It accepts both the
+// trace_replayBlockTransactions stateDiff shape and the prestateTracer account shape.
 type Diff struct {
 	Storage    []string
 	IsContract bool
 }
 
+// UnmarshalJSON keeps storage keys in document order and skips balances, nonces and values
+// without decoding them. A code change (stateDiff) or non-empty code (prestate) marks a contract,
+// as does any storage entry.
 func (d *Diff) UnmarshalJSON(data []byte) error {
-	var raw map[string]json.RawMessage
-	if err := json.Unmarshal(data, &raw); err != nil {
-		return err
-	}
-
-	d.Storage = nil
-	d.IsContract = false
-
-	if code, ok := raw["code"]; ok && code != nil {
-		var temp map[string]json.RawMessage
-		if err := json.Unmarshal(code, &temp); err == nil {
-			if _, isObj := temp["*"]; isObj {
-				d.IsContract = true
-			}
-		}
-	}
-
-	if storage, ok := raw["storage"]; ok && storage != nil {
-		var temp map[string]json.RawMessage
-		if err := json.Unmarshal(storage, &temp); err == nil {
-			for k := range temp {
-				d.Storage = append(d.Storage, k)
-			}
-			if len(temp) > 0 {
-				d.IsContract = true
-			}
-		}
-	}
-
-	return nil
+	return newRangeDecoder(bytes.NewReader(data), len(data)).decodeDiff(d)
 }
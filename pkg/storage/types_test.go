@@ -112,6 +112,34 @@ func TestDiff_UnmarshalJSON(t *testing.T) {
 				IsContract: true,
 			},
 		},
+		{
+			name: "prestate contract with read-only storage",
+			jsonData: `{
+				"balance": "0x0",
+				"nonce": 1,
+				"code": "0x6080604052",
+				"storage": {
+					"0x0000000000000000000000000000000000000000000000000000000000000003": "0x0000000000000000000000000000000000000000000000000000000000000001"
+				}
+			}`,
+			want: Diff{
+				Storage: []string{
+					"0x0000000000000000000000000000000000000000000000000000000000000003",
+				},
+				IsContract: true,
+			},
+		},
+		{
+			name: "prestate EOA",
+			jsonData: `{
+				"balance": "0x1bc16d674ec80000",
+				"nonce": 12
+			}`,
+			want: Diff{
+				Storage:    nil,
+				IsContract: false,
+			},
+		},
 	}
 
 	for _, tt := range tests {
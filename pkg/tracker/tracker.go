@@ -1,41 +1,301 @@
 package tracker
 
 import (
-	"os"
-	"path/filepath"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
+
+	"github.com/weiihann/state-expiry-indexer/pkg/storage"
 )
 
 const (
-	LastDownloadedBlockFile = ".last_downloaded_block" // For RPC caller tracking
+	DownloadTrackerFile     = ".download_tracker.json" // For RPC caller tracking
+	LastDownloadedBlockFile = ".last_downloaded_block" // Tracker of older versions, migrated on load
+
+	// ReconcileDepth is how far Reconcile walks back from the last downloaded block
+	ReconcileDepth = 1024
+
+	// DefaultFlushInterval is how often MarkDownloaded writes the tracker file at most
+	DefaultFlushInterval = 5 * time.Second
 )
 
-// DownloadTracker tracks the last successfully downloaded block
+// downloadState is the content of the tracker file
+type downloadState struct {
+	// LastDownloadedBlock is the low-water mark: every block up to it is downloaded
+	LastDownloadedBlock uint64 `json:"last_downloaded_block"`
+	// Completed lists the blocks above the low-water mark that are downloaded, in ascending order
+	Completed []uint64 `json:"completed,omitempty"`
+}
+
+// DownloadTracker tracks the blocks downloaded by the RPC caller. Blocks may be downloaded out of
+// order by parallel workers: the tracker records the last block below which every block is
+// downloaded, the low-water mark, and the blocks completed above it. After a crash exactly the
+// missing blocks are downloaded again. The tracker file is stored in the storage backend of the
+// data directory. Blocks are recorded in memory and written at most once per flush interval,
+// call Flush before exiting. Blocks recorded after the last write are downloaded again after a
+// crash, their files are found and skipped. It is safe for concurrent use.
 type DownloadTracker struct {
-	filePath string
+	backend       storage.Backend
+	flushInterval time.Duration
+
+	mu        sync.Mutex
+	loaded    bool
+	last      uint64
+	completed map[uint64]bool
+	dirty     bool
+	flushed   time.Time
+
+	// writeMu orders the writes of the tracker file, which are made without holding mu
+	writeMu sync.Mutex
 }
 
-func NewDownloadTracker(dir string) *DownloadTracker {
-	return &DownloadTracker{filePath: filepath.Join(dir, LastDownloadedBlockFile)}
+func NewDownloadTracker(backend storage.Backend) *DownloadTracker {
+	return &DownloadTracker{backend: backend, flushInterval: DefaultFlushInterval}
 }
 
-func (t *DownloadTracker) GetLastDownloadedBlock() (uint64, error) {
-	data, err := os.ReadFile(t.filePath)
-	if os.IsNotExist(err) {
-		return 0, nil // If file doesn't exist, start from block 0
+// SetFlushInterval sets how often MarkDownloaded writes the tracker file at most, 0 writes it
+// for every block
+func (t *DownloadTracker) SetFlushInterval(interval time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.flushInterval = interval
+}
+
+// load reads the tracker file once, falling back to the tracker file of older versions. A tracker
+// file of an older version is migrated and removed.
+func (t *DownloadTracker) load() error {
+	if t.loaded {
+		return nil
+	}
+
+	var state downloadState
+	data, err := storage.ReadFile(t.backend, DownloadTrackerFile)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(data, &state); err != nil {
+			return fmt.Errorf("failed to parse download tracker %s: %w", t.backend.Location(DownloadTrackerFile), err)
+		}
+	case errors.Is(err, fs.ErrNotExist):
+		var found bool
+		state.LastDownloadedBlock, found, err = t.loadLegacy()
+		if err != nil {
+			return err
+		}
+		if found {
+			if err := t.migrateLegacy(state); err != nil {
+				return err
+			}
+		}
+	default:
+		return err
+	}
+
+	t.last = state.LastDownloadedBlock
+	t.completed = make(map[uint64]bool, len(state.Completed))
+	for _, block := range state.Completed {
+		if block > t.last {
+			t.completed[block] = true
+		}
+	}
+	t.loaded = true
+	return nil
+}
+
+// loadLegacy reads the last downloaded block from the tracker file of older versions and
+// reports whether the file exists
+func (t *DownloadTracker) loadLegacy() (uint64, bool, error) {
+	data, err := storage.ReadFile(t.backend, LastDownloadedBlockFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, false, nil // If file doesn't exist, start from block 0
 	}
 	if err != nil {
-		return 0, err
+		return 0, false, err
 	}
+
 	lastBlock, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
 	if err != nil {
+		return 0, false, err
+	}
+	return lastBlock, true, nil
+}
+
+// migrateLegacy writes the state read from the tracker file of older versions to the tracker
+// file, then removes the old file
+func (t *DownloadTracker) migrateLegacy(state downloadState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := t.backend.Save(DownloadTrackerFile, data); err != nil {
+		return err
+	}
+	return t.backend.Delete(LastDownloadedBlockFile)
+}
+
+// advance moves the low-water mark over the completed blocks it reaches
+func (t *DownloadTracker) advance() {
+	for t.completed[t.last+1] {
+		delete(t.completed, t.last+1)
+		t.last++
+	}
+}
+
+// Flush writes the blocks recorded since the last write to the tracker file
+func (t *DownloadTracker) Flush() error {
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+	return t.write()
+}
+
+// write writes the tracker file if blocks were recorded since the last write. It is called with
+// writeMu held, so that files are written in the order their state was taken, and without mu,
+// so that blocks are recorded while the file is written.
+func (t *DownloadTracker) write() error {
+	t.mu.Lock()
+	if !t.dirty {
+		t.mu.Unlock()
+		return nil
+	}
+	state := downloadState{LastDownloadedBlock: t.last, Completed: t.completedBlocks()}
+	t.dirty = false
+	t.flushed = time.Now()
+	t.mu.Unlock()
+
+	data, err := json.Marshal(state)
+	if err == nil {
+		err = t.backend.Save(DownloadTrackerFile, data)
+	}
+	if err != nil {
+		// The state is written again by the next write
+		t.mu.Lock()
+		t.dirty = true
+		t.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (t *DownloadTracker) completedBlocks() []uint64 {
+	blocks := make([]uint64, 0, len(t.completed))
+	for block := range t.completed {
+		blocks = append(blocks, block)
+	}
+	slices.Sort(blocks)
+	return blocks
+}
+
+// GetLastDownloadedBlock returns the low-water mark: every block up to it is downloaded
+func (t *DownloadTracker) GetLastDownloadedBlock() (uint64, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.load(); err != nil {
+		return 0, err
+	}
+	return t.last, nil
+}
+
+// GetCompletedBlocks returns the blocks above the low-water mark that are downloaded, in
+// ascending order
+func (t *DownloadTracker) GetCompletedBlocks() ([]uint64, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.load(); err != nil {
+		return nil, err
+	}
+	return t.completedBlocks(), nil
+}
+
+// MarkDownloaded records a downloaded block, in any order, and returns the low-water mark. The
+// tracker file is written once the flush interval has passed since the last write; a worker
+// finding another one writing it carries on.
+func (t *DownloadTracker) MarkDownloaded(blockNumber uint64) (uint64, error) {
+	t.mu.Lock()
+	if err := t.load(); err != nil {
+		t.mu.Unlock()
+		return 0, err
+	}
+	if blockNumber > t.last && !t.completed[blockNumber] {
+		t.completed[blockNumber] = true
+		t.advance()
+		t.dirty = true
+	}
+	last := t.last
+	due := t.dirty && time.Since(t.flushed) >= t.flushInterval
+	t.mu.Unlock()
+
+	if due && t.writeMu.TryLock() {
+		defer t.writeMu.Unlock()
+		if err := t.write(); err != nil {
+			return 0, err
+		}
+	}
+	return last, nil
+}
+
+// Reconcile checks the tracker against the blocks that were actually saved. If the last
+// downloaded block is missing, for example because the tracker was written before a crash
+// lost the block, it walks back to the last saved block and records it. A crash only loses the
+// last few blocks: when none of the ReconcileDepth blocks below the last downloaded block is
+// saved, they were merged into range files or deleted on purpose and the tracker is kept.
+// Completed blocks that are missing are forgotten. exists reports whether a block was saved.
+func (t *DownloadTracker) Reconcile(exists func(blockNumber uint64) bool) (uint64, error) {
+	t.mu.Lock()
+	if err := t.load(); err != nil {
+		t.mu.Unlock()
 		return 0, err
 	}
-	return lastBlock, nil
+
+	block := t.last
+	for block > 0 && !exists(block) {
+		if t.last-block == ReconcileDepth {
+			block = t.last
+			break
+		}
+		block--
+	}
+	changed := block != t.last
+	t.last = block
+	for completed := range t.completed {
+		if completed <= t.last || !exists(completed) {
+			delete(t.completed, completed)
+			changed = true
+		}
+	}
+
+	t.advance()
+	last := t.last
+	t.dirty = t.dirty || changed
+	t.mu.Unlock()
+
+	if err := t.Flush(); err != nil {
+		return 0, err
+	}
+	return last, nil
 }
 
+// SetLastDownloadedBlock sets the low-water mark, forgetting the completed blocks up to it
 func (t *DownloadTracker) SetLastDownloadedBlock(blockNumber uint64) error {
-	data := []byte(strconv.FormatUint(blockNumber, 10))
-	return os.WriteFile(t.filePath, data, 0o644)
+	t.mu.Lock()
+	if err := t.load(); err != nil {
+		t.mu.Unlock()
+		return err
+	}
+
+	t.last = blockNumber
+	for completed := range t.completed {
+		if completed <= blockNumber {
+			delete(t.completed, completed)
+		}
+	}
+	t.advance()
+	t.dirty = true
+	t.mu.Unlock()
+
+	return t.Flush()
 }
@@ -0,0 +1,226 @@
+package tracker
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/weiihann/state-expiry-indexer/pkg/storage"
+	"github.com/weiihann/state-expiry-indexer/pkg/storage/s3test"
+)
+
+func TestDownloadTrackerReconcile(t *testing.T) {
+	saved := func(last uint64) func(uint64) bool {
+		return func(block uint64) bool { return block <= last }
+	}
+
+	t.Run("tracker matches the saved blocks", func(t *testing.T) {
+		tracker := NewDownloadTracker(storage.NewLocalBackend(t.TempDir()))
+		require.NoError(t, tracker.SetLastDownloadedBlock(100))
+
+		block, err := tracker.Reconcile(saved(100))
+		require.NoError(t, err)
+		assert.Equal(t, uint64(100), block)
+	})
+
+	t.Run("tracker points past the saved blocks", func(t *testing.T) {
+		tracker := NewDownloadTracker(storage.NewLocalBackend(t.TempDir()))
+		require.NoError(t, tracker.SetLastDownloadedBlock(100))
+
+		block, err := tracker.Reconcile(saved(97))
+		require.NoError(t, err)
+		assert.Equal(t, uint64(97), block)
+
+		stored, err := tracker.GetLastDownloadedBlock()
+		require.NoError(t, err)
+		assert.Equal(t, uint64(97), stored)
+	})
+
+	t.Run("nothing saved", func(t *testing.T) {
+		tracker := NewDownloadTracker(storage.NewLocalBackend(t.TempDir()))
+		require.NoError(t, tracker.SetLastDownloadedBlock(5))
+
+		block, err := tracker.Reconcile(saved(0))
+		require.NoError(t, err)
+		assert.Zero(t, block)
+	})
+
+	t.Run("blocks deleted long before the last downloaded block", func(t *testing.T) {
+		tracker := NewDownloadTracker(storage.NewLocalBackend(t.TempDir()))
+		require.NoError(t, tracker.SetLastDownloadedBlock(100_000))
+
+		block, err := tracker.Reconcile(saved(0))
+		require.NoError(t, err)
+		assert.Equal(t, uint64(100_000), block, "the tracker must not rewind toward genesis")
+	})
+
+	t.Run("last saved block at the reconcile depth", func(t *testing.T) {
+		tracker := NewDownloadTracker(storage.NewLocalBackend(t.TempDir()))
+		require.NoError(t, tracker.SetLastDownloadedBlock(100_000))
+
+		block, err := tracker.Reconcile(saved(100_000 - ReconcileDepth))
+		require.NoError(t, err)
+		assert.Equal(t, uint64(100_000-ReconcileDepth), block)
+	})
+
+	t.Run("last saved block just past the reconcile depth", func(t *testing.T) {
+		tracker := NewDownloadTracker(storage.NewLocalBackend(t.TempDir()))
+		require.NoError(t, tracker.SetLastDownloadedBlock(100_000))
+
+		block, err := tracker.Reconcile(saved(100_000 - ReconcileDepth - 1))
+		require.NoError(t, err)
+		assert.Equal(t, uint64(100_000), block)
+	})
+}
+
+func TestDownloadTrackerOutOfOrder(t *testing.T) {
+	dir := t.TempDir()
+	tracker := NewDownloadTracker(storage.NewLocalBackend(dir))
+
+	// Blocks completed ahead of a missing block do not move the low-water mark
+	for _, block := range []uint64{3, 2, 5} {
+		last, err := tracker.MarkDownloaded(block)
+		require.NoError(t, err)
+		assert.Zero(t, last)
+	}
+	completed, err := tracker.GetCompletedBlocks()
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{2, 3, 5}, completed)
+
+	last, err := tracker.MarkDownloaded(1)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), last)
+	require.NoError(t, tracker.Flush())
+
+	// A restart resumes with the blocks completed out of order
+	restarted := NewDownloadTracker(storage.NewLocalBackend(dir))
+	last, err = restarted.GetLastDownloadedBlock()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), last)
+	completed, err = restarted.GetCompletedBlocks()
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{5}, completed)
+
+	last, err = restarted.MarkDownloaded(4)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(5), last)
+	last, err = restarted.MarkDownloaded(2)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(5), last, "blocks below the low-water mark are ignored")
+}
+
+func TestDownloadTrackerConcurrent(t *testing.T) {
+	tracker := NewDownloadTracker(storage.NewLocalBackend(t.TempDir()))
+
+	var wg sync.WaitGroup
+	for worker := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Each worker marks every eighth block, from the highest down
+			for block := 100 - worker; block > 0; block -= 8 {
+				_, err := tracker.MarkDownloaded(uint64(block))
+				assert.NoError(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	last, err := tracker.GetLastDownloadedBlock()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(100), last)
+	completed, err := tracker.GetCompletedBlocks()
+	require.NoError(t, err)
+	assert.Empty(t, completed)
+}
+
+func TestDownloadTrackerS3(t *testing.T) {
+	server := s3test.NewServer(s3test.Options{AccessKeyID: "minioadmin", SecretAccessKey: "minioadmin-secret"}, "data")
+	httpServer := httptest.NewServer(server)
+	t.Cleanup(httpServer.Close)
+	backend, err := storage.NewS3Backend("data", "mainnet", storage.S3Config{
+		Endpoint:        httpServer.URL,
+		AccessKeyID:     "minioadmin",
+		SecretAccessKey: "minioadmin-secret",
+	})
+	require.NoError(t, err)
+
+	tracker := NewDownloadTracker(backend)
+	for _, block := range []uint64{1, 2, 4} {
+		_, err := tracker.MarkDownloaded(block)
+		require.NoError(t, err)
+	}
+	require.NoError(t, tracker.Flush())
+
+	_, ok := server.Object("data", "mainnet/"+DownloadTrackerFile)
+	assert.True(t, ok, "the tracker is stored in the bucket")
+	last, err := NewDownloadTracker(backend).GetLastDownloadedBlock()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), last)
+}
+
+func TestDownloadTrackerMigratesLegacyFile(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, LastDownloadedBlockFile), []byte("42\n"), 0o644))
+
+	tracker := NewDownloadTracker(storage.NewLocalBackend(dir))
+	last, err := tracker.GetLastDownloadedBlock()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(42), last)
+	assert.NoFileExists(t, filepath.Join(dir, LastDownloadedBlockFile), "the old file is removed once migrated")
+
+	_, err = tracker.MarkDownloaded(44)
+	require.NoError(t, err)
+	require.NoError(t, tracker.Flush())
+	last, err = NewDownloadTracker(storage.NewLocalBackend(dir)).GetLastDownloadedBlock()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(42), last)
+}
+
+func TestDownloadTrackerFlushInterval(t *testing.T) {
+	dir := t.TempDir()
+	tracker := NewDownloadTracker(storage.NewLocalBackend(dir))
+	stored := func() uint64 {
+		last, err := NewDownloadTracker(storage.NewLocalBackend(dir)).GetLastDownloadedBlock()
+		require.NoError(t, err)
+		return last
+	}
+
+	// The first block is written right away, later ones once the interval has passed
+	_, err := tracker.MarkDownloaded(1)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), stored())
+	last, err := tracker.MarkDownloaded(2)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), last)
+	assert.Equal(t, uint64(1), stored(), "blocks are only written once per flush interval")
+
+	require.NoError(t, tracker.Flush())
+	assert.Equal(t, uint64(2), stored())
+
+	tracker.SetFlushInterval(0)
+	_, err = tracker.MarkDownloaded(3)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), stored())
+}
+
+func TestDownloadTrackerReconcileCompleted(t *testing.T) {
+	tracker := NewDownloadTracker(storage.NewLocalBackend(t.TempDir()))
+	require.NoError(t, tracker.SetLastDownloadedBlock(10))
+	for _, block := range []uint64{12, 13, 15} {
+		_, err := tracker.MarkDownloaded(block)
+		require.NoError(t, err)
+	}
+
+	// Block 13 was recorded but lost
+	last, err := tracker.Reconcile(func(block uint64) bool { return block != 13 })
+	require.NoError(t, err)
+	assert.Equal(t, uint64(10), last)
+	completed, err := tracker.GetCompletedBlocks()
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{12, 15}, completed)
+}
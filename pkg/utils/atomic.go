@@ -0,0 +1,114 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// TempFileSuffix ends the name of every temp file written by WriteFileAtomic
+const TempFileSuffix = ".tmp"
+
+// StaleTempFileAge is how long a temp file goes unmodified before it is treated as left by an
+// interrupted write. A write in progress modifies its temp file well within it.
+const StaleTempFileAge = 10 * time.Minute
+
+// WriteFileAtomic writes data to a temp file next to path, syncs it to disk and renames it over
+// path. After a crash path holds either its old or its new content, never a partial write.
+// Temp files left by a crash are removed by RemoveTempFiles.
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir, name := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+
+	file, err := os.CreateTemp(dir, name+".*"+TempFileSuffix)
+	if err != nil {
+		return fmt.Errorf("failed to create temp file for %s: %w", path, err)
+	}
+	tempPath := file.Name()
+
+	err = writeAndSync(file, data, perm)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tempPath, path)
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+
+	// The rename is only durable once the directory entry is
+	return syncDir(dir)
+}
+
+func writeAndSync(file *os.File, data []byte, perm os.FileMode) error {
+	if _, err := file.Write(data); err != nil {
+		return err
+	}
+	if err := file.Chmod(perm); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// syncDir flushes a directory so renames and removals inside it survive a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open directory %s: %w", dir, err)
+	}
+	defer d.Close()
+
+	// Some platforms and file systems cannot sync directories, there is nothing more to do there
+	if err := d.Sync(); err != nil && !errors.Is(err, os.ErrInvalid) && !errors.Is(err, os.ErrPermission) {
+		return fmt.Errorf("failed to sync directory %s: %w", dir, err)
+	}
+	return nil
+}
+
+// RemoveTempFiles deletes the temp files that WriteFileAtomic left in dir and its subdirectories
+// when a write was interrupted, and returns the paths it removed. Other processes may write to
+// dir meanwhile: temp files modified within minAge may belong to their writes and are kept.
+func RemoveTempFiles(dir string, minAge time.Duration) ([]string, error) {
+	cutoff := time.Now().Add(-minAge)
+	var removed []string
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) && path == dir {
+				return fs.SkipAll
+			}
+			return err
+		}
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), TempFileSuffix) {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil // Renamed into place while scanning
+		}
+		if err != nil {
+			return err
+		}
+		if info.ModTime().After(cutoff) {
+			return nil
+		}
+
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to remove temp file %s: %w", path, err)
+		}
+		removed = append(removed, path)
+		return nil
+	})
+	if err != nil {
+		return removed, fmt.Errorf("failed to scan %s for temp files: %w", dir, err)
+	}
+	return removed, nil
+}
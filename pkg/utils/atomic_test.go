@@ -0,0 +1,115 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "1_1000.json.zst")
+
+	if err := WriteFileAtomic(path, []byte("old"), 0o644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if err := WriteFileAtomic(path, []byte("new"), 0o600); err != nil {
+		t.Fatalf("Failed to overwrite file: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read file: %v", err)
+	}
+	if string(data) != "new" {
+		t.Errorf("Expected new content, got %q", data)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Failed to stat file: %v", err)
+	}
+	if info.Mode().Perm() != 0o600 {
+		t.Errorf("Expected mode 0600, got %v", info.Mode().Perm())
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("Failed to read directory: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("Expected only the written file, found %d entries", len(entries))
+	}
+}
+
+func TestWriteFileAtomicMissingDirectory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "missing", "file")
+	if err := WriteFileAtomic(path, []byte("data"), 0o644); err == nil {
+		t.Error("Expected an error for a missing directory")
+	}
+}
+
+func TestRemoveTempFiles(t *testing.T) {
+	dir := t.TempDir()
+	nested := filepath.Join(dir, "nested")
+	if err := os.Mkdir(nested, 0o755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+
+	files := map[string]bool{
+		filepath.Join(dir, "1_1000.json.zst"):                  false,
+		filepath.Join(dir, "1_1000.json.zst.123456.tmp"):       true,
+		filepath.Join(dir, ".last_downloaded_block.42.tmp"):    true,
+		filepath.Join(nested, "1001_2000.json.zst.987654.tmp"): true,
+		filepath.Join(nested, "tmp"):                           false,
+	}
+	stale := time.Now().Add(-time.Hour)
+	var want []string
+	for path, temp := range files {
+		if err := os.WriteFile(path, []byte("partial"), 0o644); err != nil {
+			t.Fatalf("Failed to write %s: %v", path, err)
+		}
+		if err := os.Chtimes(path, stale, stale); err != nil {
+			t.Fatalf("Failed to age %s: %v", path, err)
+		}
+		if temp {
+			want = append(want, path)
+		}
+	}
+
+	// A write of another process in progress
+	inProgress := filepath.Join(dir, "1001_2000.json.zst.555.tmp")
+	if err := os.WriteFile(inProgress, []byte("partial"), 0o644); err != nil {
+		t.Fatalf("Failed to write %s: %v", inProgress, err)
+	}
+
+	removed, err := RemoveTempFiles(dir, StaleTempFileAge)
+	if err != nil {
+		t.Fatalf("Failed to remove temp files: %v", err)
+	}
+	slices.Sort(removed)
+	slices.Sort(want)
+	if !slices.Equal(removed, want) {
+		t.Errorf("Expected to remove %v, removed %v", want, removed)
+	}
+
+	for path, temp := range files {
+		_, err := os.Stat(path)
+		if temp && !os.IsNotExist(err) {
+			t.Errorf("Temp file %s should be removed", path)
+		}
+		if !temp && err != nil {
+			t.Errorf("File %s should be kept: %v", path, err)
+		}
+	}
+	if _, err := os.Stat(inProgress); err != nil {
+		t.Errorf("Temp file of a write in progress should be kept: %v", err)
+	}
+
+	removed, err = RemoveTempFiles(filepath.Join(dir, "missing"), StaleTempFileAge)
+	if err != nil || len(removed) != 0 {
+		t.Errorf("Expected nothing to do for a missing directory, got %v, %v", removed, err)
+	}
+}
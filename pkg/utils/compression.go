@@ -2,16 +2,75 @@ package utils
 
 import (
 	"fmt"
+	"io"
 
 	"github.com/klauspost/compress/zstd"
 )
 
+// MaxZstdLevel is the highest zstd compression level
+const MaxZstdLevel = 22
+
+// ZstdOptions configures encoders and decoders. The zero value compresses at the default level
+// without a dictionary.
+type ZstdOptions struct {
+	// Level is a zstd compression level from 1 to MaxZstdLevel, mapped to the closest level
+	// the encoder implements. 0 selects the default level.
+	Level int
+	// Dictionary compresses data when set. Its ID is recorded in every frame.
+	Dictionary []byte
+	// Dictionaries decompress frames compressed with one of them, in addition to Dictionary.
+	// Frames compressed without a dictionary are always decompressed.
+	Dictionaries [][]byte
+}
+
+// ValidateZstdLevel checks that level is a zstd compression level or 0 for the default
+func ValidateZstdLevel(level int) error {
+	if level < 0 || level > MaxZstdLevel {
+		return fmt.Errorf("compression level must be between 1 and %d, or 0 for the default level", MaxZstdLevel)
+	}
+	return nil
+}
+
+func (o ZstdOptions) encoderOptions() ([]zstd.EOption, error) {
+	if err := ValidateZstdLevel(o.Level); err != nil {
+		return nil, err
+	}
+	var options []zstd.EOption
+	if o.Level != 0 {
+		options = append(options, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(o.Level)))
+	}
+	if o.Dictionary != nil {
+		options = append(options, zstd.WithEncoderDict(o.Dictionary))
+	}
+	return options, nil
+}
+
+func (o ZstdOptions) decoderOptions() []zstd.DOption {
+	dictionaries := o.Dictionaries
+	if o.Dictionary != nil {
+		dictionaries = append([][]byte{o.Dictionary}, dictionaries...)
+	}
+	if len(dictionaries) == 0 {
+		return nil
+	}
+	return []zstd.DOption{zstd.WithDecoderDicts(dictionaries...)}
+}
+
 type ZstdEncoder struct {
 	encoder *zstd.Encoder
 }
 
 func NewZstdEncoder() (*ZstdEncoder, error) {
-	encoder, err := zstd.NewWriter(nil)
+	return NewZstdEncoderWithOptions(ZstdOptions{})
+}
+
+// NewZstdEncoderWithOptions creates an encoder compressing at the level and with the dictionary of options
+func NewZstdEncoderWithOptions(options ZstdOptions) (*ZstdEncoder, error) {
+	encoderOptions, err := options.encoderOptions()
+	if err != nil {
+		return nil, err
+	}
+	encoder, err := zstd.NewWriter(nil, encoderOptions...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create zstd encoder: %w", err)
 	}
@@ -39,7 +98,13 @@ type ZstdDecoder struct {
 }
 
 func NewZstdDecoder() (*ZstdDecoder, error) {
-	decoder, err := zstd.NewReader(nil)
+	return NewZstdDecoderWithOptions(ZstdOptions{})
+}
+
+// NewZstdDecoderWithOptions creates a decoder that also decompresses frames compressed with the
+// dictionaries of options
+func NewZstdDecoderWithOptions(options ZstdOptions) (*ZstdDecoder, error) {
+	decoder, err := zstd.NewReader(nil, options.decoderOptions()...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create zstd decoder: %w", err)
 	}
@@ -67,6 +132,23 @@ func (c *ZstdDecoder) Decompress(compressedData []byte) ([]byte, error) {
 	return decompressed, nil
 }
 
+// NewZstdStreamReader returns a reader that decompresses r as it is read, so the decompressed
+// data never has to be held in memory at once. Closing it releases the decoder.
+func NewZstdStreamReader(r io.Reader) (io.ReadCloser, error) {
+	return NewZstdStreamReaderWithOptions(r, ZstdOptions{})
+}
+
+// NewZstdStreamReaderWithOptions returns a stream reader that also decompresses frames
+// compressed with the dictionaries of options
+func NewZstdStreamReaderWithOptions(r io.Reader, options ZstdOptions) (io.ReadCloser, error) {
+	decoderOptions := append([]zstd.DOption{zstd.WithDecoderConcurrency(1), zstd.WithDecoderLowmem(true)}, options.decoderOptions()...)
+	decoder, err := zstd.NewReader(r, decoderOptions...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create zstd stream decoder: %w", err)
+	}
+	return decoder.IOReadCloser(), nil
+}
+
 // GetCompressionRatio calculates the compression ratio as a percentage.
 // Returns the space saved: 0% = no compression, 90% = excellent compression.
 func GetCompressionRatio(originalSize, compressedSize int) float64 {
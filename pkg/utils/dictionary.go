@@ -0,0 +1,157 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"slices"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// MinZstdDictionaryID is the lowest dictionary ID outside of the range reserved for
+// dictionaries registered with the zstd project
+const MinZstdDictionaryID = 32768
+
+// DefaultZstdDictionarySize is the dictionary size the zstd command line tool trains by default
+const DefaultZstdDictionarySize = 110 * 1024
+
+const (
+	// dictionarySegmentSize is the length of the segments the dictionary content is made of
+	dictionarySegmentSize = 64
+	// dictionaryDmerSize is the length of the substrings whose frequency scores a segment
+	dictionaryDmerSize = 8
+	// dictionaryHashBits is the size of the substring frequency table, colliding substrings
+	// share a count
+	dictionaryHashBits = 22
+)
+
+// TrainZstdDictionary builds a zstd dictionary of at most size bytes of content from samples of
+// the data it will compress, tuned for level (0 for the default level).
+//
+// The content is selected like the COVER algorithm of the zstd command line tool: the samples
+// are split into one epoch per segment, and from each epoch the segment made of the substrings
+// found in the most samples is taken. Substrings of a chosen segment no longer score, so
+// segments do not repeat each other. The best segments go last, where matches are cheapest.
+func TrainZstdDictionary(samples [][]byte, id uint32, size, level int) ([]byte, error) {
+	if id == 0 {
+		return nil, fmt.Errorf("dictionary ID must not be 0")
+	}
+	if err := ValidateZstdLevel(level); err != nil {
+		return nil, err
+	}
+	data := bytes.Join(samples, nil)
+	if size < dictionarySegmentSize || len(data) < size {
+		return nil, fmt.Errorf("%d bytes of samples are not enough to train a dictionary of %d bytes", len(data), size)
+	}
+
+	// Count the samples each substring occurs in
+	freqs := make([]uint32, 1<<dictionaryHashBits)
+	seen := make([]int32, 1<<dictionaryHashBits)
+	for i, sample := range samples {
+		for p := 0; p+dictionaryDmerSize <= len(sample); p++ {
+			h := dmerHash(sample[p:])
+			if seen[h] != int32(i+1) {
+				seen[h] = int32(i + 1)
+				freqs[h]++
+			}
+		}
+	}
+
+	type segment struct {
+		start int
+		score uint64
+	}
+	epochs := size / dictionarySegmentSize
+	epochSize := max(len(data)/epochs, dictionarySegmentSize)
+	var segments []segment
+	for begin := 0; begin+dictionarySegmentSize <= len(data) && len(segments) < epochs; begin += epochSize {
+		start, score := bestSegment(data[begin:min(begin+epochSize, len(data))], freqs)
+		if score == 0 {
+			continue
+		}
+		start += begin
+		for p := start; p+dictionaryDmerSize <= start+dictionarySegmentSize; p++ {
+			freqs[dmerHash(data[p:])] = 0
+		}
+		segments = append(segments, segment{start: start, score: score})
+	}
+	if len(segments) == 0 {
+		return nil, fmt.Errorf("samples have no content in common")
+	}
+
+	slices.SortStableFunc(segments, func(a, b segment) int {
+		switch {
+		case a.score < b.score:
+			return -1
+		case a.score > b.score:
+			return 1
+		}
+		return 0
+	})
+	history := make([]byte, 0, len(segments)*dictionarySegmentSize)
+	for _, segment := range segments {
+		history = append(history, data[segment.start:segment.start+dictionarySegmentSize]...)
+	}
+
+	options := zstd.BuildDictOptions{
+		ID:       id,
+		Contents: samples,
+		History:  history,
+		Offsets:  [3]int{1, 4, 8},
+	}
+	if level != 0 {
+		options.Level = zstd.EncoderLevelFromZstd(level)
+	}
+	dictionary, err := zstd.BuildDict(options)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build zstd dictionary: %w", err)
+	}
+	return dictionary, nil
+}
+
+// bestSegment returns the start and score of the segment of epoch whose substrings occur in
+// the most samples. An epoch shorter than a segment is not scored.
+func bestSegment(epoch []byte, freqs []uint32) (int, uint64) {
+	if len(epoch) < dictionarySegmentSize {
+		return 0, 0
+	}
+	const dmers = dictionarySegmentSize - dictionaryDmerSize + 1
+
+	var score uint64
+	for p := range dmers {
+		score += uint64(freqs[dmerHash(epoch[p:])])
+	}
+	bestStart, bestScore := 0, score
+	for start := 1; start+dictionarySegmentSize <= len(epoch); start++ {
+		score -= uint64(freqs[dmerHash(epoch[start-1:])])
+		score += uint64(freqs[dmerHash(epoch[start+dmers-1:])])
+		if score > bestScore {
+			bestStart, bestScore = start, score
+		}
+	}
+	return bestStart, bestScore
+}
+
+func dmerHash(b []byte) uint64 {
+	return binary.LittleEndian.Uint64(b) * 0x9E3779B185EBCA87 >> (64 - dictionaryHashBits)
+}
+
+// ZstdDictionaryID returns the ID of a zstd dictionary
+func ZstdDictionaryID(dictionary []byte) (uint32, error) {
+	info, err := zstd.InspectDictionary(dictionary)
+	if err != nil {
+		return 0, fmt.Errorf("invalid zstd dictionary: %w", err)
+	}
+	return info.ID(), nil
+}
+
+// ZstdFrameDictionaryID returns the ID of the dictionary the first frame of compressed data was
+// compressed with, or 0 if it was compressed without one
+func ZstdFrameDictionaryID(compressed []byte) (uint32, error) {
+	var header zstd.Header
+	if err := header.Decode(compressed); err != nil {
+		return 0, fmt.Errorf("invalid zstd frame: %w", err)
+	}
+	return header.DictionaryID, nil
+}
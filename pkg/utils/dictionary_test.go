@@ -0,0 +1,128 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// blockSamples returns per-block state diff files of a few accounts and slots each. Hot
+// contracts are touched by many blocks, the other addresses are random.
+func blockSamples(count int) [][]byte {
+	random := rand.New(rand.NewSource(1))
+	hex := func(n int) string {
+		b := make([]byte, n)
+		random.Read(b)
+		return fmt.Sprintf("0x%x", b)
+	}
+	var hot, slots []string
+	for range 10 {
+		hot = append(hot, hex(20))
+		slots = append(slots, hex(32))
+	}
+
+	samples := make([][]byte, count)
+	for i := range samples {
+		stateDiff := map[string]any{}
+		for range 2 {
+			stateDiff[hex(20)] = map[string]any{"balance": map[string]any{"*": map[string]string{"from": hex(8), "to": hex(8)}}, "nonce": "="}
+		}
+		for j := range 3 {
+			stateDiff[hot[random.Intn(len(hot))]] = map[string]any{"storage": map[string]any{slots[(i+j)%len(slots)]: map[string]any{"*": map[string]string{"from": hex(4), "to": hex(4)}}}}
+		}
+		data, _ := json.MarshalIndent([]map[string]any{{"stateDiff": stateDiff, "transactionHash": hex(32), "output": "0x"}}, "", "  ")
+		samples[i] = data
+	}
+	return samples
+}
+
+func TestTrainZstdDictionary(t *testing.T) {
+	samples := blockSamples(1000)
+	dictionary, err := TrainZstdDictionary(samples[:500], MinZstdDictionaryID, 16*1024, 0)
+	require.NoError(t, err)
+
+	id, err := ZstdDictionaryID(dictionary)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(MinZstdDictionaryID), id)
+
+	plain, err := NewZstdEncoder()
+	require.NoError(t, err)
+	defer plain.Close()
+	withDictionary, err := NewZstdEncoderWithOptions(ZstdOptions{Dictionary: dictionary})
+	require.NoError(t, err)
+	defer withDictionary.Close()
+	decoder, err := NewZstdDecoderWithOptions(ZstdOptions{Dictionaries: [][]byte{dictionary}})
+	require.NoError(t, err)
+	defer decoder.Close()
+	plainDecoder, err := NewZstdDecoder()
+	require.NoError(t, err)
+	defer plainDecoder.Close()
+
+	// Compress blocks the dictionary was not trained on
+	var plainSize, dictionarySize int
+	for _, sample := range samples[500:] {
+		compressed, err := plain.Compress(sample)
+		require.NoError(t, err)
+		plainSize += len(compressed)
+
+		compressed, err = withDictionary.Compress(sample)
+		require.NoError(t, err)
+		dictionarySize += len(compressed)
+
+		frameID, err := ZstdFrameDictionaryID(compressed)
+		require.NoError(t, err)
+		assert.Equal(t, id, frameID)
+		decompressed, err := decoder.Decompress(compressed)
+		require.NoError(t, err)
+		assert.Equal(t, sample, decompressed)
+	}
+	assert.Less(t, float64(dictionarySize), float64(plainSize)*0.6, "dictionary %d bytes, plain %d bytes", dictionarySize, plainSize)
+
+	// Frames need their dictionary, frames without one decompress with any decoder
+	compressed, err := withDictionary.Compress(samples[0])
+	require.NoError(t, err)
+	_, err = plainDecoder.Decompress(compressed)
+	assert.Error(t, err)
+	compressed, err = plain.Compress(samples[0])
+	require.NoError(t, err)
+	frameID, err := ZstdFrameDictionaryID(compressed)
+	require.NoError(t, err)
+	assert.Zero(t, frameID)
+	decompressed, err := decoder.Decompress(compressed)
+	require.NoError(t, err)
+	assert.Equal(t, samples[0], decompressed)
+
+	_, err = TrainZstdDictionary(samples[:2], MinZstdDictionaryID, 16*1024, 0)
+	assert.ErrorContains(t, err, "not enough to train")
+	_, err = TrainZstdDictionary(samples, 0, 16*1024, 0)
+	assert.Error(t, err)
+}
+
+func TestZstdOptionsLevel(t *testing.T) {
+	data := []byte(sampleStateDiffJSON)
+	for _, level := range []int{0, 1, 3, 7, MaxZstdLevel} {
+		encoder, err := NewZstdEncoderWithOptions(ZstdOptions{Level: level})
+		require.NoError(t, err, "level %d", level)
+		compressed, err := encoder.Compress(data)
+		require.NoError(t, err)
+		encoder.Close()
+
+		stream, err := NewZstdStreamReaderWithOptions(bytes.NewReader(compressed), ZstdOptions{})
+		require.NoError(t, err)
+		decompressed, err := io.ReadAll(stream)
+		stream.Close()
+		require.NoError(t, err)
+		assert.Equal(t, data, decompressed, "level %d", level)
+	}
+
+	for _, level := range []int{-1, MaxZstdLevel + 1} {
+		_, err := NewZstdEncoderWithOptions(ZstdOptions{Level: level})
+		assert.Error(t, err, "level %d", level)
+	}
+}